@@ -0,0 +1,10 @@
+// Package exercises ships the web UI within the binary, so the server can
+// be started from any directory.
+package exercises
+
+import "embed"
+
+// The templates in views/ and the stylesheets in css/, see cmd/main.go.
+//
+//go:embed views/*.html css/*.css
+var Assets embed.FS
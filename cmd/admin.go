@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The admin dashboard on /admin shows at a glance how the library is
+// doing: the size of the catalog, the latest changes to the books, the
+// webhooks whose deliveries fail, the background jobs and the slow queries.
+// It refreshes itself every half minute. The details are found in the API,
+// under /api/v1/audit, /api/v1/webhooks and /api/v1/admin/jobs.
+
+const (
+	dashboardAuditEntries = 10
+	// How many of the latest deliveries of a webhook are looked at
+	dashboardDeliveries = 10
+)
+
+type adminDashboard struct {
+	Books           int64
+	AveragePages    float64
+	Audit           []dashboardAuditEntry
+	FailingWebhooks []failingWebhook
+	Jobs            []JobStatus
+	SlowQueries     []SlowQueryCount
+	// The threshold of slow queries
+	SlowQuery string
+}
+
+type dashboardAuditEntry struct {
+	AuditEntry
+	// The name of the book after the change, or before it if it was
+	// deleted
+	Book string
+}
+
+// A webhook whose latest delivery failed, with how many of the latest ones
+// failed in a row.
+type failingWebhook struct {
+	Webhook  Webhook
+	Failures int
+	Last     WebhookDelivery
+}
+
+func (s *server) adminDashboard(ctx context.Context) (*adminDashboard, error) {
+	stats, err := s.catalogStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d := &adminDashboard{
+		Books:        stats.Books,
+		AveragePages: stats.AveragePages,
+		Jobs:         s.jobs.statuses(),
+		SlowQueries:  slowQueries.list(),
+		SlowQuery:    slowQueryThreshold.String(),
+	}
+
+	entries, _, err := s.audit.FindAll(ctx, AuditQuery{Limit: dashboardAuditEntries})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		entry := dashboardAuditEntry{AuditEntry: e}
+		if e.After != nil {
+			entry.Book = e.After.BookName
+		} else if e.Before != nil {
+			entry.Book = e.Before.BookName
+		}
+		d.Audit = append(d.Audit, entry)
+	}
+
+	if d.FailingWebhooks, err = s.failingWebhooks(ctx); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (s *server) failingWebhooks(ctx context.Context) ([]failingWebhook, error) {
+	hooks, err := s.webhooks.FindAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var failing []failingWebhook
+	for _, hook := range hooks {
+		deliveries, err := s.webhooks.FindDeliveries(ctx, hook.ID, dashboardDeliveries)
+		if err != nil {
+			return nil, err
+		}
+		failures := 0
+		for failures < len(deliveries) && deliveries[failures].Error != "" {
+			failures++
+		}
+		if failures > 0 {
+			failing = append(failing, failingWebhook{Webhook: hook, Failures: failures, Last: deliveries[0]})
+		}
+	}
+	return failing, nil
+}
+
+func (s *server) adminPage(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	d, err := s.adminDashboard(ctx)
+	if err != nil {
+		return err
+	}
+	if c.Request().Header.Get("HX-Request") == "true" {
+		return c.Render(http.StatusOK, "admin-dashboard", d)
+	}
+	view := s.indexView(c, nil)
+	view["Admin"] = d
+	return c.Render(http.StatusOK, "index", view)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// A key for clients that cannot log in interactively. Only the SHA-256 hash
+// of the key is stored; the key itself is shown once, when it is created.
+// Prefix holds its first characters, so people can tell their keys apart.
+type APIKey struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name      string             `json:"name" bson:"name"`
+	Prefix    string             `json:"prefix" bson:"prefix"`
+	Hash      string             `json:"-" bson:"hash"`
+	Scopes    []Scope            `json:"scopes" bson:"scopes"`
+	CreatedBy primitive.ObjectID `json:"created_by" bson:"created_by"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	RevokedAt *time.Time         `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+// Stores the API keys, next to the users of the same backend.
+type APIKeyRepository interface {
+	// Returns all keys, revoked ones included, oldest first.
+	FindAll(ctx context.Context) ([]APIKey, error)
+	FindByHash(ctx context.Context, hash string) (APIKey, error)
+	Insert(ctx context.Context, k APIKey) (APIKey, error)
+	// Marks the key as revoked. Revoking a key twice keeps the first date.
+	Revoke(ctx context.Context, id primitive.ObjectID, at time.Time) (APIKey, error)
+}
+
+// Keeps the API keys in memory, for the memory storage.
+type memoryAPIKeyRepository struct {
+	mu   sync.RWMutex
+	keys []APIKey
+}
+
+func newMemoryAPIKeyRepository() *memoryAPIKeyRepository {
+	return &memoryAPIKeyRepository{}
+}
+
+func (r *memoryAPIKeyRepository) FindAll(ctx context.Context) ([]APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]APIKey{}, r.keys...), nil
+}
+
+func (r *memoryAPIKeyRepository) FindByHash(ctx context.Context, hash string) (APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	i := slices.IndexFunc(r.keys, func(k APIKey) bool { return k.Hash == hash })
+	if i < 0 {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return r.keys[i], nil
+}
+
+func (r *memoryAPIKeyRepository) Insert(ctx context.Context, k APIKey) (APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k.ID = primitive.NewObjectID()
+	r.keys = append(r.keys, k)
+	return k, nil
+}
+
+func (r *memoryAPIKeyRepository) Revoke(ctx context.Context, id primitive.ObjectID, at time.Time) (APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.keys, func(k APIKey) bool { return k.ID == id })
+	if i < 0 {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if r.keys[i].RevokedAt == nil {
+		r.keys[i].RevokedAt = &at
+	}
+	return r.keys[i], nil
+}
+
+// Creates the unique index on the hash, which every authenticated request
+// with an API key looks up.
+func prepareAPIKeys(ctx context.Context, coll *mongo.Collection) error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetName("api_keys_hash_unique").SetUnique(true),
+	}
+	return ensureIndexes(ctx, coll, index)
+}
+
+// Stores the API keys in their own MongoDB collection.
+type mongoAPIKeyRepository struct {
+	coll mongoCollection
+}
+
+func newMongoAPIKeyRepository(coll *mongo.Collection) *mongoAPIKeyRepository {
+	return &mongoAPIKeyRepository{coll: withPolicy(coll)}
+}
+
+func (r *mongoAPIKeyRepository) FindAll(ctx context.Context) ([]APIKey, error) {
+	cursor, err := r.coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	keys := []APIKey{}
+	if err = cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (r *mongoAPIKeyRepository) FindByHash(ctx context.Context, hash string) (APIKey, error) {
+	var k APIKey
+	err := r.coll.FindOne(ctx, bson.M{"hash": hash}).Decode(&k)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return k, ErrAPIKeyNotFound
+	}
+	return k, err
+}
+
+func (r *mongoAPIKeyRepository) Insert(ctx context.Context, k APIKey) (APIKey, error) {
+	k.ID = primitive.NewObjectID()
+	_, err := r.coll.InsertOne(ctx, k)
+	return k, err
+}
+
+func (r *mongoAPIKeyRepository) Revoke(ctx context.Context, id primitive.ObjectID, at time.Time) (APIKey, error) {
+	// Only keys that are not yet revoked get the date
+	_, err := r.coll.UpdateOne(ctx,
+		bson.M{"_id": id, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": at}})
+	if err != nil {
+		return APIKey{}, err
+	}
+	var k APIKey
+	err = r.coll.FindOne(ctx, bson.M{"_id": id}).Decode(&k)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return k, ErrAPIKeyNotFound
+	}
+	return k, err
+}
+
+// Stores the API keys in the api_keys table, see sqlMigrations. The scopes
+// are kept as a comma separated list.
+type sqlAPIKeyRepository struct {
+	db *sql.DB
+}
+
+func newSQLAPIKeyRepository(db *sql.DB) *sqlAPIKeyRepository {
+	return &sqlAPIKeyRepository{db: db}
+}
+
+const apiKeyColumns = "id, name, prefix, hash, scopes, created_by, created_at, revoked_at"
+
+func joinScopes(scopes []Scope) string {
+	var parts []string
+	for _, s := range scopes {
+		parts = append(parts, string(s))
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitScopes(s string) []Scope {
+	scopes := []Scope{}
+	for _, part := range strings.Split(s, ",") {
+		if part != "" {
+			scopes = append(scopes, Scope(part))
+		}
+	}
+	return scopes
+}
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var k APIKey
+	var id, scopes, createdBy string
+	var revokedAt sql.NullTime
+	err := row.Scan(&id, &k.Name, &k.Prefix, &k.Hash, &scopes, &createdBy, &k.CreatedAt, &revokedAt)
+	if err != nil {
+		return k, err
+	}
+	if k.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return k, err
+	}
+	if k.CreatedBy, err = primitive.ObjectIDFromHex(createdBy); err != nil {
+		return k, err
+	}
+	k.Scopes = splitScopes(scopes)
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+	return k, nil
+}
+
+func (r *sqlAPIKeyRepository) FindAll(ctx context.Context) ([]APIKey, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (r *sqlAPIKeyRepository) findOne(ctx context.Context, where string, arg interface{}) (APIKey, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE "+where+" = $1", arg)
+	k, err := scanAPIKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return k, ErrAPIKeyNotFound
+	}
+	return k, err
+}
+
+func (r *sqlAPIKeyRepository) FindByHash(ctx context.Context, hash string) (APIKey, error) {
+	return r.findOne(ctx, "hash", hash)
+}
+
+func (r *sqlAPIKeyRepository) Insert(ctx context.Context, k APIKey) (APIKey, error) {
+	k.ID = primitive.NewObjectID()
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO api_keys ("+apiKeyColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, NULL)",
+		k.ID.Hex(), k.Name, k.Prefix, k.Hash, joinScopes(k.Scopes), k.CreatedBy.Hex(), k.CreatedAt)
+	return k, err
+}
+
+func (r *sqlAPIKeyRepository) Revoke(ctx context.Context, id primitive.ObjectID, at time.Time) (APIKey, error) {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL", at, id.Hex())
+	if err != nil {
+		return APIKey{}, err
+	}
+	return r.findOne(ctx, "id", id.Hex())
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The header clients send their API key in.
+const headerAPIKey = "X-API-Key"
+
+// Every key starts with this, which makes leaked keys easy to grep for.
+const apiKeyPrefix = "bks_"
+
+// What an admin sends to create an API key.
+type newAPIKey struct {
+	Name   string  `json:"name"`
+	Scopes []Scope `json:"scopes"`
+}
+
+// Returns a fresh random key.
+func generateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// API keys and session IDs are long and random, so a fast hash is enough,
+// and unlike with bcrypt we can look them up by their hash.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Looks up the key sent in the X-API-Key header. Unknown and revoked keys
+// are treated the same.
+func (s *server) authenticateAPIKey(ctx context.Context, key string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	k, err := s.apiKeys.FindByHash(ctx, hashSecret(key))
+	if errors.Is(err, ErrAPIKeyNotFound) || (err == nil && k.RevokedAt != nil) {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Invalid or revoked API key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// Returns the API key the request was authenticated with, or nil.
+func currentAPIKey(c echo.Context) *APIKey {
+	key, _ := c.Get("apiKey").(*APIKey)
+	return key
+}
+
+func (s *server) listAPIKeys(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	keys, err := s.apiKeys.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+func (s *server) createAPIKey(c echo.Context) error {
+	var req newAPIKey
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid API key data").SetInternal(err)
+	}
+
+	v := &ValidationError{}
+	if strings.TrimSpace(req.Name) == "" {
+		v.add("name", "is required")
+	}
+	if len(req.Scopes) == 0 {
+		v.add("scopes", "must name at least one scope")
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(allScopes, scope) {
+			v.add("scopes", fmt.Sprintf("unknown scope %q", scope))
+		} else if _, missing := missingScope(c, []Scope{scope}); missing {
+			v.add("scopes", fmt.Sprintf("you do not have the %s scope yourself", scope))
+		}
+	}
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		return err
+	}
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	apiKey := APIKey{
+		Name:      strings.TrimSpace(req.Name),
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		Hash:      hashSecret(key),
+		Scopes:    slices.Compact(scopes),
+		CreatedAt: time.Now().UTC(),
+	}
+	if user := currentUser(c); user != nil {
+		apiKey.CreatedBy = user.ID
+	} else if parent := currentAPIKey(c); parent != nil {
+		apiKey.CreatedBy = parent.CreatedBy
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	apiKey, err = s.apiKeys.Insert(ctx, apiKey)
+	if err != nil {
+		return err
+	}
+
+	// The only time the key itself is ever sent
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"key":     key,
+		"api_key": apiKey,
+	})
+}
+
+func (s *server) revokeAPIKey(c echo.Context) error {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID format")
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	key, err := s.apiKeys.Revoke(ctx, id, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, key)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Entries per page of /api/audit unless ?limit= says otherwise.
+const defaultAuditLimit = 50
+
+// Whoever sent a request, as the audit log records it. Requests with an
+// API key are put down to the user who created the key.
+type Actor struct {
+	UserID   primitive.ObjectID
+	Username string
+	APIKeyID primitive.ObjectID
+}
+
+type actorKey struct{}
+
+// Stores the caller in the context, so the audit log can tell who made the
+// changes done with it. Contexts without an actor, like those of the
+// background jobs, are recorded as changes the server made by itself.
+func withActor(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, a)
+}
+
+func actorFrom(ctx context.Context) Actor {
+	a, _ := ctx.Value(actorKey{}).(Actor)
+	return a
+}
+
+func userActor(u User) Actor {
+	return Actor{UserID: u.ID, Username: u.Username}
+}
+
+func apiKeyActor(k APIKey) Actor {
+	return Actor{UserID: k.CreatedBy, APIKeyID: k.ID}
+}
+
+// Returns the logged in user or the API key of the request.
+func currentActor(c echo.Context) Actor {
+	if user := currentUser(c); user != nil {
+		return userActor(*user)
+	}
+	if key := currentAPIKey(c); key != nil {
+		return apiKeyActor(*key)
+	}
+	return Actor{}
+}
+
+// Like requestContext, for handlers that change books: the changes are put
+// down to whoever sent the request in the audit log. A change runs to the
+// end even if the client gives up on it, so it is never stored without
+// its audit entry.
+func writeContext(c echo.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request().Context()), dbTimeout)
+	return withActor(ctx, currentActor(c)), cancel
+}
+
+// Records every successful change made through the wrapped repository in
+// the audit log, together with the book before and after the change, and
+// counts them for /metrics. The
+// books are looked up right before and after the change, so a concurrent
+// write may slip in between; the version in the snapshots tells. A change
+// that cannot be recorded is logged but not undone.
+type auditedBookRepository struct {
+	BookRepository
+	audit AuditRepository
+}
+
+func newAuditedBookRepository(books BookRepository, audit AuditRepository) *auditedBookRepository {
+	return &auditedBookRepository{BookRepository: books, audit: audit}
+}
+
+func (r *auditedBookRepository) record(ctx context.Context, entries ...AuditEntry) {
+	recordChanges(ctx, r.audit, entries...)
+}
+
+// Puts the changes down to the actor of ctx and adds them to the audit
+// log, for changes that are not made through an auditedBookRepository.
+func recordChanges(ctx context.Context, audit AuditRepository, entries ...AuditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	actor := actorFrom(ctx)
+	at := writeTime()
+	for i := range entries {
+		entries[i].At = at
+		entries[i].UserID = actor.UserID
+		entries[i].Username = actor.Username
+		entries[i].APIKeyID = actor.APIKeyID
+	}
+	for _, e := range entries {
+		bookChanges.WithLabelValues(string(e.Action)).Inc()
+	}
+	if err := audit.Add(ctx, entries); err != nil {
+		log.Printf("Audit: failed to record %d changes: %v", len(entries), err)
+	}
+}
+
+// Returns the book as it is now, or nil if there is none.
+func (r *auditedBookRepository) snapshot(ctx context.Context, id primitive.ObjectID) *BookStore {
+	b, err := r.BookRepository.FindByID(ctx, id)
+	if err != nil {
+		return nil
+	}
+	return &b
+}
+
+func (r *auditedBookRepository) Insert(ctx context.Context, b BookStore) (BookStore, error) {
+	b, err := r.BookRepository.Insert(ctx, b)
+	if err == nil {
+		r.record(ctx, AuditEntry{Action: AuditCreated, BookID: b.ID, After: &b})
+	}
+	return b, err
+}
+
+// The inserted books are looked up afterwards, as only their IDs come back.
+func (r *auditedBookRepository) InsertMany(ctx context.Context, books []BookStore) ([]BulkResult, error) {
+	results, err := r.BookRepository.InsertMany(ctx, books)
+	var entries []AuditEntry
+	for _, res := range results {
+		if res.Error != "" {
+			continue
+		}
+		id, _ := primitive.ObjectIDFromHex(res.ID)
+		entries = append(entries, AuditEntry{Action: AuditCreated, BookID: id, After: r.snapshot(ctx, id)})
+	}
+	r.record(ctx, entries...)
+	return results, err
+}
+
+func (r *auditedBookRepository) Update(ctx context.Context, b BookStore) (BookStore, error) {
+	before := r.snapshot(ctx, b.ID)
+	b, err := r.BookRepository.Update(ctx, b)
+	if err == nil {
+		r.record(ctx, AuditEntry{Action: AuditUpdated, BookID: b.ID, Before: before, After: &b})
+	}
+	return b, err
+}
+
+func (r *auditedBookRepository) Restore(ctx context.Context, b BookStore) (bool, error) {
+	before := r.snapshot(ctx, b.ID)
+	created, err := r.BookRepository.Restore(ctx, b)
+	if err == nil {
+		action := AuditUpdated
+		if created {
+			action = AuditCreated
+		}
+		r.record(ctx, AuditEntry{Action: action, BookID: b.ID, Before: before, After: r.snapshot(ctx, b.ID)})
+	}
+	return created, err
+}
+
+func (r *auditedBookRepository) Patch(ctx context.Context, id primitive.ObjectID, p BookPatch) (BookStore, error) {
+	before := r.snapshot(ctx, id)
+	b, err := r.BookRepository.Patch(ctx, id, p)
+	if err == nil {
+		r.record(ctx, AuditEntry{Action: AuditUpdated, BookID: id, Before: before, After: &b})
+	}
+	return b, err
+}
+
+func (r *auditedBookRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	before := r.snapshot(ctx, id)
+	err := r.BookRepository.Delete(ctx, id)
+	if err == nil {
+		r.record(ctx, AuditEntry{Action: AuditDeleted, BookID: id, Before: before})
+	}
+	return err
+}
+
+func (r *auditedBookRepository) Undelete(ctx context.Context, id primitive.ObjectID) (BookStore, error) {
+	b, err := r.BookRepository.Undelete(ctx, id)
+	if err == nil {
+		r.record(ctx, AuditEntry{Action: AuditRestored, BookID: id, After: &b})
+	}
+	return b, err
+}
+
+// The books about to be purged are looked up in the trash first.
+func (r *auditedBookRepository) Purge(ctx context.Context, before time.Time) ([]primitive.ObjectID, error) {
+	trash, _, err := r.BookRepository.FindAll(ctx, BookQuery{Trash: true})
+	if err != nil {
+		return nil, err
+	}
+	ids, err := r.BookRepository.Purge(ctx, before)
+	if err != nil {
+		return ids, err
+	}
+	purged := map[primitive.ObjectID]BookStore{}
+	for _, b := range trash {
+		purged[b.ID] = b
+	}
+	var entries []AuditEntry
+	for _, id := range ids {
+		entry := AuditEntry{Action: AuditPurged, BookID: id}
+		if b, ok := purged[id]; ok {
+			entry.Before = &b
+		}
+		entries = append(entries, entry)
+	}
+	r.record(ctx, entries...)
+	return ids, nil
+}
+
+// Adding a genre a book already has changes nothing and is not recorded;
+// the same goes for RemoveGenre.
+func (r *auditedBookRepository) AddGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error) {
+	before := r.snapshot(ctx, id)
+	b, err := r.BookRepository.AddGenre(ctx, id, genre)
+	if err == nil && (before == nil || before.Version != b.Version) {
+		r.record(ctx, AuditEntry{Action: AuditUpdated, BookID: id, Before: before, After: &b})
+	}
+	return b, err
+}
+
+func (r *auditedBookRepository) RemoveGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error) {
+	before := r.snapshot(ctx, id)
+	b, err := r.BookRepository.RemoveGenre(ctx, id, genre)
+	if err == nil && (before == nil || before.Version != b.Version) {
+		r.record(ctx, AuditEntry{Action: AuditUpdated, BookID: id, Before: before, After: &b})
+	}
+	return b, err
+}
+
+func (r *auditedBookRepository) RenameAuthor(ctx context.Context, authorID primitive.ObjectID, name string) (int64, error) {
+	books, _, err := r.BookRepository.FindAll(ctx, BookQuery{AuthorID: authorID})
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.BookRepository.RenameAuthor(ctx, authorID, name)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	var entries []AuditEntry
+	for _, b := range books {
+		after := r.snapshot(ctx, b.ID)
+		if after != nil && after.Version != b.Version {
+			entries = append(entries, AuditEntry{Action: AuditUpdated, BookID: b.ID, Before: &b, After: after})
+		}
+	}
+	r.record(ctx, entries...)
+	return n, nil
+}
+
+func (r *auditedBookRepository) DeleteMany(ctx context.Context, q BookQuery) (int64, error) {
+	q.Page, q.Limit, q.Sort = 0, 0, nil
+	matched, _, err := r.BookRepository.FindAll(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.BookRepository.DeleteMany(ctx, q)
+	if err != nil {
+		return n, err
+	}
+	var entries []AuditEntry
+	for _, b := range matched {
+		entries = append(entries, AuditEntry{Action: AuditDeleted, BookID: b.ID, Before: &b})
+	}
+	r.record(ctx, entries...)
+	return n, nil
+}
+
+// Converts the entry for the API, with the snapshots in the format of
+// /api/books. Changes made by the server itself have no user_id.
+func auditEntryJSON(e AuditEntry) map[string]interface{} {
+	entry := map[string]interface{}{
+		"id":      e.ID,
+		"at":      e.At,
+		"action":  e.Action,
+		"book_id": e.BookID,
+	}
+	if !e.UserID.IsZero() {
+		entry["user_id"] = e.UserID
+	}
+	if e.Username != "" {
+		entry["username"] = e.Username
+	}
+	if !e.APIKeyID.IsZero() {
+		entry["api_key_id"] = e.APIKeyID
+	}
+	if e.Before != nil {
+		entry["before"] = newBookDTO(*e.Before)
+	}
+	if e.After != nil {
+		entry["after"] = newBookDTO(*e.After)
+	}
+	if !e.MergedInto.IsZero() {
+		entry["merged_into"] = e.MergedInto
+	}
+	return entry
+}
+
+// Parses an optional ID query parameter such as ?book_id=.
+func parseIDParam(c echo.Context, name string) (primitive.ObjectID, error) {
+	raw := c.QueryParam(name)
+	if raw == "" {
+		return primitive.NilObjectID, nil
+	}
+	id, err := primitive.ObjectIDFromHex(raw)
+	if err != nil {
+		return id, echo.NewHTTPError(http.StatusBadRequest, name+" must be a valid ID")
+	}
+	return id, nil
+}
+
+// Lists the changes to the books, the newest first. Takes ?user_id=,
+// ?book_id=, ?since= and ?before=, the latter two like the time filters
+// of /api/books.
+func (s *server) listAudit(c echo.Context) error {
+	page, err := parsePagination(c, defaultAuditLimit)
+	if err != nil {
+		return err
+	}
+	q := AuditQuery{Page: page.Page, Limit: page.Limit}
+	if q.UserID, err = parseIDParam(c, "user_id"); err != nil {
+		return err
+	}
+	if q.BookID, err = parseIDParam(c, "book_id"); err != nil {
+		return err
+	}
+	times := []struct {
+		param string
+		dst   *time.Time
+	}{
+		{"since", &q.Since},
+		{"before", &q.Before},
+	}
+	for _, t := range times {
+		raw := c.QueryParam(t.param)
+		if raw == "" {
+			continue
+		}
+		if *t.dst, err = parseTimeBound(raw); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, t.param+" must be a date like 2024-01-31 or an RFC 3339 time")
+		}
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	entries, total, err := s.audit.FindAll(ctx, q)
+	if err != nil {
+		return err
+	}
+	result := make([]map[string]interface{}, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, auditEntryJSON(e))
+	}
+	setPaginationHeaders(c, newBookPage(c, page, nil, total))
+	return c.JSON(http.StatusOK, result)
+}
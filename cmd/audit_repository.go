@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AuditAction string
+
+const (
+	AuditCreated AuditAction = "created"
+	AuditUpdated AuditAction = "updated"
+	// Moved to the trash
+	AuditDeleted AuditAction = "deleted"
+	// Taken back out of the trash
+	AuditRestored AuditAction = "restored"
+	// Removed from the trash for good
+	AuditPurged AuditAction = "purged"
+	// Merged into the book MergedInto, see merge.go, right before it is
+	// moved to the trash
+	AuditMerged AuditAction = "merged"
+)
+
+// A single change to a book, see audit.go. Before and After are snapshots
+// of the book; Before is missing for new books and After for books that
+// are gone. Changes the server made by itself, like purging the trash,
+// have no user.
+type AuditEntry struct {
+	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	At     time.Time          `json:"at" bson:"at"`
+	Action AuditAction        `json:"action" bson:"action"`
+	BookID primitive.ObjectID `json:"book_id" bson:"book_id"`
+	// For API keys the user who created the key
+	UserID   primitive.ObjectID `json:"user_id" bson:"user_id,omitempty"`
+	Username string             `json:"username" bson:"username,omitempty"`
+	APIKeyID primitive.ObjectID `json:"api_key_id" bson:"api_key_id,omitempty"`
+	Before   *BookStore         `json:"before" bson:"before,omitempty"`
+	After    *BookStore         `json:"after" bson:"after,omitempty"`
+	// Only for merged books
+	MergedInto primitive.ObjectID `json:"merged_into,omitempty" bson:"merged_into,omitempty"`
+}
+
+// Selects audit entries. Zero fields do not restrict the result; Since is
+// inclusive, Before exclusive. A Limit of 0 means all entries.
+type AuditQuery struct {
+	Page  int
+	Limit int
+
+	UserID primitive.ObjectID
+	BookID primitive.ObjectID
+	Since  time.Time
+	Before time.Time
+}
+
+func (q AuditQuery) matches(e AuditEntry) bool {
+	return (q.UserID.IsZero() || e.UserID == q.UserID) &&
+		(q.BookID.IsZero() || e.BookID == q.BookID) &&
+		(q.Since.IsZero() || !e.At.Before(q.Since)) &&
+		(q.Before.IsZero() || e.At.Before(q.Before))
+}
+
+func (q AuditQuery) skip() int {
+	if q.Limit == 0 {
+		return 0
+	}
+	return (q.Page - 1) * q.Limit
+}
+
+// Stores the audit log. Entries are only ever added, never changed or
+// removed.
+type AuditRepository interface {
+	Add(ctx context.Context, entries []AuditEntry) error
+	// Returns the entries matching the query, newest first, and the total
+	// number of matches ignoring the pagination window.
+	FindAll(ctx context.Context, q AuditQuery) ([]AuditEntry, int64, error)
+}
+
+// Keeps the audit log in memory, for the memory storage.
+type memoryAuditRepository struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+}
+
+func newMemoryAuditRepository() *memoryAuditRepository {
+	return &memoryAuditRepository{}
+}
+
+func (r *memoryAuditRepository) Add(ctx context.Context, entries []AuditEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range entries {
+		e.ID = primitive.NewObjectID()
+		r.entries = append(r.entries, e)
+	}
+	return nil
+}
+
+func (r *memoryAuditRepository) FindAll(ctx context.Context, q AuditQuery) ([]AuditEntry, int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	matched := []AuditEntry{}
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		if q.matches(r.entries[i]) {
+			matched = append(matched, r.entries[i])
+		}
+	}
+	total := int64(len(matched))
+	matched = matched[min(q.skip(), len(matched)):]
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	return matched, total, nil
+}
+
+// Creates the indexes for listing the entries of a book or a user.
+func prepareAudit(ctx context.Context, audit *mongo.Collection) error {
+	return ensureIndexes(ctx, audit, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "at", Value: -1}},
+			Options: options.Index().SetName("audit_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "book_id", Value: 1}, {Key: "at", Value: -1}},
+			Options: options.Index().SetName("audit_book_id"),
+		},
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "at", Value: -1}},
+			Options: options.Index().SetName("audit_user_id"),
+		},
+	}...)
+}
+
+// Stores the audit log in a MongoDB collection.
+type mongoAuditRepository struct {
+	coll mongoCollection
+}
+
+func newMongoAuditRepository(coll *mongo.Collection) *mongoAuditRepository {
+	return &mongoAuditRepository{coll: withPolicy(coll)}
+}
+
+func (r *mongoAuditRepository) Add(ctx context.Context, entries []AuditEntry) error {
+	docs := make([]interface{}, len(entries))
+	for i, e := range entries {
+		e.ID = primitive.NewObjectID()
+		docs[i] = e
+	}
+	_, err := r.coll.InsertMany(ctx, docs)
+	return err
+}
+
+func (r *mongoAuditRepository) FindAll(ctx context.Context, q AuditQuery) ([]AuditEntry, int64, error) {
+	filter := bson.M{}
+	if !q.UserID.IsZero() {
+		filter["user_id"] = q.UserID
+	}
+	if !q.BookID.IsZero() {
+		filter["book_id"] = q.BookID
+	}
+	at := bson.M{}
+	if !q.Since.IsZero() {
+		at["$gte"] = q.Since
+	}
+	if !q.Before.IsZero() {
+		at["$lt"] = q.Before
+	}
+	if len(at) > 0 {
+		filter["at"] = at
+	}
+
+	total, err := r.coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(int64(q.skip())).SetLimit(int64(q.Limit))
+	cursor, err := r.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := []AuditEntry{}
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+// Stores the audit log in the audit_log table, see sqlMigrations. The
+// snapshots are kept as JSON.
+type sqlAuditRepository struct {
+	db *sql.DB
+}
+
+func newSQLAuditRepository(db *sql.DB) *sqlAuditRepository {
+	return &sqlAuditRepository{db: db}
+}
+
+const auditColumns = "id, at, action, book_id, user_id, username, api_key_id, before_doc, after_doc, merged_into"
+
+// Encodes a snapshot for the before_doc and after_doc columns, where an
+// empty string stands for no snapshot.
+func encodeSnapshot(b *BookStore) (string, error) {
+	if b == nil {
+		return "", nil
+	}
+	doc, err := json.Marshal(b)
+	return string(doc), err
+}
+
+func decodeSnapshot(doc string) (*BookStore, error) {
+	if doc == "" {
+		return nil, nil
+	}
+	var b BookStore
+	if err := json.Unmarshal([]byte(doc), &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func scanAuditEntry(row rowScanner) (AuditEntry, error) {
+	var e AuditEntry
+	var id, bookID, userID, apiKeyID, before, after, mergedInto string
+	err := row.Scan(&id, &e.At, &e.Action, &bookID, &userID, &e.Username, &apiKeyID, &before, &after, &mergedInto)
+	if err != nil {
+		return e, err
+	}
+	e.At = e.At.UTC()
+	if e.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return e, err
+	}
+	if e.BookID, err = primitive.ObjectIDFromHex(bookID); err != nil {
+		return e, err
+	}
+	if e.UserID, err = parseOptionalHex(userID); err != nil {
+		return e, err
+	}
+	if e.APIKeyID, err = parseOptionalHex(apiKeyID); err != nil {
+		return e, err
+	}
+	if e.MergedInto, err = parseOptionalHex(mergedInto); err != nil {
+		return e, err
+	}
+	if e.Before, err = decodeSnapshot(before); err != nil {
+		return e, err
+	}
+	e.After, err = decodeSnapshot(after)
+	return e, err
+}
+
+func (r *sqlAuditRepository) Add(ctx context.Context, entries []AuditEntry) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, e := range entries {
+		before, err := encodeSnapshot(e.Before)
+		if err != nil {
+			return err
+		}
+		after, err := encodeSnapshot(e.After)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO audit_log ("+auditColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+			primitive.NewObjectID().Hex(), e.At, e.Action, e.BookID.Hex(), optionalHex(e.UserID), e.Username,
+			optionalHex(e.APIKeyID), before, after, optionalHex(e.MergedInto))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *sqlAuditRepository) FindAll(ctx context.Context, q AuditQuery) ([]AuditEntry, int64, error) {
+	var args sqlArgs
+	var conds []string
+	if !q.UserID.IsZero() {
+		conds = append(conds, "user_id = "+args.add(q.UserID.Hex()))
+	}
+	if !q.BookID.IsZero() {
+		conds = append(conds, "book_id = "+args.add(q.BookID.Hex()))
+	}
+	if !q.Since.IsZero() {
+		conds = append(conds, "at >= "+args.add(q.Since.UTC()))
+	}
+	if !q.Before.IsZero() {
+		conds = append(conds, "at < "+args.add(q.Before.UTC()))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	var total int64
+	if err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_log"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	query := "SELECT " + auditColumns + " FROM audit_log" + where + " ORDER BY at DESC, id DESC"
+	if q.Limit > 0 {
+		query += " LIMIT " + args.add(q.Limit) + " OFFSET " + args.add(q.skip())
+	}
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// How long an access token stays valid. There are no refresh tokens, so
+// clients simply log in again once it expired.
+const tokenTTL = 24 * time.Hour
+
+// Bounds for passwords. bcrypt ignores everything after 72 bytes, so
+// longer passwords would give a false sense of security.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// The longest email address SMTP can deliver to.
+const maxEmailLength = 254
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9._-]{3,32}$`)
+
+// Returned for an unknown user as well as for a wrong password, so the
+// answer does not tell which usernames exist.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// The claims of our access tokens. The subject is the ID of the user.
+type tokenClaims struct {
+	Username string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+// What clients send to register and to log in. The email address is
+// optional, and only taken when registering. The code is only needed to
+// log in with two-factor authentication on, see twofactor.go.
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email"`
+	Code     string `json:"code"`
+}
+
+// Returns the key used to sign tokens, auth.jwt_secret. Without one we make
+// up a random key, which works fine for a single instance but logs
+// everybody out on every restart.
+func loadJWTSecret(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+	log.Println("JWT_SECRET is not set, using a random key; tokens will not survive a restart")
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		log.Fatal(err)
+	}
+	return random
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func checkUsername(v *ValidationError, username string) {
+	if !usernamePattern.MatchString(username) {
+		v.add("username", "must be 3 to 32 letters, digits, dots, dashes or underscores")
+	}
+}
+
+func checkPassword(v *ValidationError, password string) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		v.add("password", fmt.Sprintf("must be between %d and %d characters", minPasswordLength, maxPasswordLength))
+	}
+}
+
+// Takes addresses like alice@example.org, without a display name.
+func checkEmail(v *ValidationError, email string) {
+	if email == "" {
+		return
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > maxEmailLength {
+		v.add("email", "must be an address like alice@example.org")
+	}
+}
+
+func validateCredentials(cred credentials) error {
+	v := &ValidationError{}
+	checkUsername(v, cred.Username)
+	checkPassword(v, cred.Password)
+	checkEmail(v, cred.Email)
+	return v.errOrNil()
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func bindCredentials(c echo.Context) (credentials, error) {
+	var cred credentials
+	if err := c.Bind(&cred); err != nil {
+		return cred, echo.NewHTTPError(http.StatusBadRequest, "Invalid credentials").SetInternal(err)
+	}
+	cred.Username = normalizeUsername(cred.Username)
+	cred.Email = strings.TrimSpace(cred.Email)
+	return cred, nil
+}
+
+func (s *server) issueToken(u User) (string, error) {
+	now := time.Now()
+	claims := tokenClaims{
+		Username: u.Username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   u.ID.Hex(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(tokenTTL)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.jwtSecret)
+}
+
+func (s *server) parseToken(token string) (*tokenClaims, error) {
+	claims := &tokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return s.jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Lets the request through only with a valid API key or a valid bearer
+// token of an existing user. The user is looked up on every request, so
+// deleted users and role changes take effect immediately instead of once
+// the token expired. The user or key is stored in the context, see
+// currentUser and currentAPIKey.
+func (s *server) requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if key := c.Request().Header.Get(headerAPIKey); key != "" {
+			apiKey, err := s.authenticateAPIKey(c.Request().Context(), key)
+			if err != nil {
+				return err
+			}
+			c.Set("apiKey", apiKey)
+			return next(c)
+		}
+
+		header := c.Request().Header.Get(echo.HeaderAuthorization)
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if !found || token == "" {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return echo.NewHTTPError(http.StatusUnauthorized, "Authentication required")
+		}
+		claims, err := s.parseToken(token)
+		if err != nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid or expired token").SetInternal(err)
+		}
+		user, err := s.userFromClaims(c.Request().Context(), claims)
+		if errors.Is(err, ErrUserNotFound) {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return echo.NewHTTPError(http.StatusUnauthorized, "The account no longer exists")
+		}
+		if err != nil {
+			return err
+		}
+		c.Set("user", &user)
+		return next(c)
+	}
+}
+
+// Authenticates requests that carry an API key or a bearer token like
+// requireAuth, and lets requests without either through anonymously. Bad
+// credentials are still rejected instead of being ignored.
+func (s *server) optionalAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	authenticated := s.requireAuth(next)
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Header.Get(headerAPIKey) == "" && req.Header.Get(echo.HeaderAuthorization) == "" {
+			return next(c)
+		}
+		return authenticated(c)
+	}
+}
+
+// Looks up the user a token was issued for.
+func (s *server) userFromClaims(ctx context.Context, claims *tokenClaims) (User, error) {
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return User{}, ErrUserNotFound
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	return s.users.FindByID(ctx, userID)
+}
+
+// Returns the logged in user, or nil on public routes.
+func currentUser(c echo.Context) *User {
+	user, _ := c.Get("user").(*User)
+	return user
+}
+
+// Returns the logged in user for the routes about the user's own things,
+// like their shelves. API keys belong to nobody and are turned away.
+func requireUser(c echo.Context) (*User, error) {
+	user := currentUser(c)
+	if user == nil {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "This requires logging in as a user")
+	}
+	return user, nil
+}
+
+// Creates the admin account from auth.admin_username and
+// auth.admin_password, unless it already exists. Without it nobody could
+// ever hand out the librarian and admin roles.
+func seedAdmin(ctx context.Context, users UserRepository, cfg AuthConfig) error {
+	password := cfg.AdminPassword
+	if password == "" {
+		return nil
+	}
+	username := normalizeUsername(cfg.AdminUsername)
+	cred := credentials{Username: username, Password: password}
+	if err := validateCredentials(cred); err != nil {
+		return fmt.Errorf("invalid admin account: %w", err)
+	}
+
+	if _, err := users.FindByUsername(ctx, username); !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = users.Insert(ctx, User{
+		Username:     username,
+		PasswordHash: hash,
+		Role:         RoleAdmin,
+		CreatedAt:    time.Now().UTC(),
+	})
+	if errors.Is(err, ErrDuplicateUser) {
+		return nil
+	}
+	return err
+}
+
+func (s *server) register(c echo.Context) error {
+	cred, err := bindCredentials(c)
+	if err != nil {
+		return err
+	}
+	if err := validateCredentials(cred); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(cred.Password)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	// Everybody starts out as reader; an admin hands out the other roles
+	user, err := s.users.Insert(ctx, User{
+		Username:     cred.Username,
+		PasswordHash: hash,
+		Role:         RoleReader,
+		Email:        cred.Email,
+		CreatedAt:    time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, user)
+}
+
+func (s *server) login(c echo.Context) error {
+	cred, err := bindCredentials(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	// Too many failed logins lock the account and the address out for a
+	// while, see lockout.go
+	ip := c.RealIP()
+	if wait := s.lockout.wait(ctx, cred.Username, ip); wait > 0 {
+		return lockedOut(c, wait)
+	}
+	user, err := s.users.FindByUsername(ctx, cred.Username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(cred.Password)) != nil {
+		s.lockout.failed(ctx, cred.Username, ip)
+		return ErrInvalidCredentials
+	}
+	if err := s.verifyLoginCode(ctx, &user, cred.Code); err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			s.lockout.failed(ctx, cred.Username, ip)
+		}
+		return err
+	}
+	s.lockout.succeeded(ctx, user.Username)
+
+	token, err := s.issueToken(user)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"token":      token,
+		"token_type": "Bearer",
+		"expires_in": int(tokenTTL.Seconds()),
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrAuthorNotFound = errors.New("author not found")
+
+// An author books can be linked to through their AuthorID. Everything but
+// the name is optional.
+type Author struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name        string             `json:"name" bson:"name"`
+	BirthYear   *int               `json:"birth_year,omitempty" bson:"birth_year,omitempty"`
+	Nationality string             `json:"nationality,omitempty" bson:"nationality,omitempty"`
+	Bio         string             `json:"bio,omitempty" bson:"bio,omitempty"`
+}
+
+// Stores the authors, next to the books of the same backend.
+type AuthorRepository interface {
+	// Returns all authors, ordered by name.
+	FindAll(ctx context.Context) ([]Author, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (Author, error)
+	// Returns the authors with the given IDs, in no particular order. IDs
+	// without an author are skipped.
+	FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]Author, error)
+	// Stores a new author and returns it with its ID set.
+	Insert(ctx context.Context, a Author) (Author, error)
+	// Replaces all fields of the author with the ID of a.
+	Update(ctx context.Context, a Author) (Author, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// Keeps the authors in memory, for the memory storage.
+type memoryAuthorRepository struct {
+	mu      sync.RWMutex
+	authors []Author
+}
+
+func newMemoryAuthorRepository() *memoryAuthorRepository {
+	return &memoryAuthorRepository{}
+}
+
+func (r *memoryAuthorRepository) FindAll(ctx context.Context) ([]Author, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	authors := append([]Author{}, r.authors...)
+	slices.SortStableFunc(authors, func(a, b Author) int { return cmp.Compare(a.Name, b.Name) })
+	return authors, nil
+}
+
+func (r *memoryAuthorRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Author, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	i := slices.IndexFunc(r.authors, func(a Author) bool { return a.ID == id })
+	if i < 0 {
+		return Author{}, ErrAuthorNotFound
+	}
+	return r.authors[i], nil
+}
+
+func (r *memoryAuthorRepository) FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]Author, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	authors := []Author{}
+	for _, a := range r.authors {
+		if slices.Contains(ids, a.ID) {
+			authors = append(authors, a)
+		}
+	}
+	return authors, nil
+}
+
+func (r *memoryAuthorRepository) Insert(ctx context.Context, a Author) (Author, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a.ID = primitive.NewObjectID()
+	r.authors = append(r.authors, a)
+	return a, nil
+}
+
+func (r *memoryAuthorRepository) Update(ctx context.Context, a Author) (Author, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.authors, func(o Author) bool { return o.ID == a.ID })
+	if i < 0 {
+		return a, ErrAuthorNotFound
+	}
+	r.authors[i] = a
+	return a, nil
+}
+
+func (r *memoryAuthorRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.authors, func(a Author) bool { return a.ID == id })
+	if i < 0 {
+		return ErrAuthorNotFound
+	}
+	r.authors = slices.Delete(r.authors, i, i+1)
+	return nil
+}
+
+// Creates the index the authors are listed by.
+func prepareAuthors(ctx context.Context, coll *mongo.Collection) error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetName("authors_name"),
+	}
+	return ensureIndexes(ctx, coll, index)
+}
+
+// Stores the authors in their own MongoDB collection.
+type mongoAuthorRepository struct {
+	coll mongoCollection
+}
+
+func newMongoAuthorRepository(coll *mongo.Collection) *mongoAuthorRepository {
+	return &mongoAuthorRepository{coll: withPolicy(coll)}
+}
+
+func (r *mongoAuthorRepository) find(ctx context.Context, filter bson.M) ([]Author, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := r.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	authors := []Author{}
+	if err = cursor.All(ctx, &authors); err != nil {
+		return nil, err
+	}
+	return authors, nil
+}
+
+func (r *mongoAuthorRepository) FindAll(ctx context.Context) ([]Author, error) {
+	return r.find(ctx, bson.M{})
+}
+
+func (r *mongoAuthorRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Author, error) {
+	var a Author
+	err := r.coll.FindOne(ctx, bson.M{"_id": id}).Decode(&a)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return a, ErrAuthorNotFound
+	}
+	return a, err
+}
+
+func (r *mongoAuthorRepository) FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]Author, error) {
+	if len(ids) == 0 {
+		return []Author{}, nil
+	}
+	return r.find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+}
+
+func (r *mongoAuthorRepository) Insert(ctx context.Context, a Author) (Author, error) {
+	a.ID = primitive.NewObjectID()
+	_, err := r.coll.InsertOne(ctx, a)
+	return a, err
+}
+
+func (r *mongoAuthorRepository) Update(ctx context.Context, a Author) (Author, error) {
+	res, err := r.coll.ReplaceOne(ctx, bson.M{"_id": a.ID}, a)
+	if err != nil {
+		return a, err
+	}
+	if res.MatchedCount == 0 {
+		return a, ErrAuthorNotFound
+	}
+	return a, nil
+}
+
+func (r *mongoAuthorRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrAuthorNotFound
+	}
+	return nil
+}
+
+// Stores the authors in the authors table, see sqlMigrations.
+type sqlAuthorRepository struct {
+	db *sql.DB
+}
+
+func newSQLAuthorRepository(db *sql.DB) *sqlAuthorRepository {
+	return &sqlAuthorRepository{db: db}
+}
+
+const authorColumns = "id, name, birth_year, nationality, bio"
+
+func scanAuthor(row rowScanner) (Author, error) {
+	var a Author
+	var id string
+	var birthYear sql.NullInt64
+	if err := row.Scan(&id, &a.Name, &birthYear, &a.Nationality, &a.Bio); err != nil {
+		return a, err
+	}
+	if birthYear.Valid {
+		year := int(birthYear.Int64)
+		a.BirthYear = &year
+	}
+	objID, err := primitive.ObjectIDFromHex(id)
+	a.ID = objID
+	return a, err
+}
+
+// The condition may use $1 and following for the arguments.
+func (r *sqlAuthorRepository) find(ctx context.Context, where string, args ...interface{}) ([]Author, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+authorColumns+" FROM authors"+where+" ORDER BY name, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	authors := []Author{}
+	for rows.Next() {
+		a, err := scanAuthor(rows)
+		if err != nil {
+			return nil, err
+		}
+		authors = append(authors, a)
+	}
+	return authors, rows.Err()
+}
+
+func (r *sqlAuthorRepository) FindAll(ctx context.Context) ([]Author, error) {
+	return r.find(ctx, "")
+}
+
+func (r *sqlAuthorRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Author, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT "+authorColumns+" FROM authors WHERE id = $1", id.Hex())
+	a, err := scanAuthor(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, ErrAuthorNotFound
+	}
+	return a, err
+}
+
+func (r *sqlAuthorRepository) FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]Author, error) {
+	if len(ids) == 0 {
+		return []Author{}, nil
+	}
+	var args sqlArgs
+	return r.find(ctx, " WHERE id IN ("+idList(ids, &args)+")", args...)
+}
+
+func (r *sqlAuthorRepository) Insert(ctx context.Context, a Author) (Author, error) {
+	a.ID = primitive.NewObjectID()
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO authors ("+authorColumns+") VALUES ($1, $2, $3, $4, $5)",
+		a.ID.Hex(), a.Name, a.BirthYear, a.Nationality, a.Bio)
+	return a, err
+}
+
+func (r *sqlAuthorRepository) Update(ctx context.Context, a Author) (Author, error) {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE authors SET name = $1, birth_year = $2, nationality = $3, bio = $4 WHERE id = $5",
+		a.Name, a.BirthYear, a.Nationality, a.Bio, a.ID.Hex())
+	if err != nil {
+		return a, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return a, err
+	} else if n == 0 {
+		return a, ErrAuthorNotFound
+	}
+	return a, nil
+}
+
+func (r *sqlAuthorRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM authors WHERE id = $1", id.Hex())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAuthorNotFound
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Parses the :id path parameter of the author routes.
+func authorID(c echo.Context) (primitive.ObjectID, error) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return objID, echo.NewHTTPError(http.StatusBadRequest, "Invalid ID format")
+	}
+	return objID, nil
+}
+
+// Copies the name of the linked author into the book, so the author string
+// always matches the authors collection. Unknown authors are reported like
+// any other invalid field.
+func (s *server) linkAuthor(ctx context.Context, b *BookStore) error {
+	if b.AuthorID.IsZero() {
+		return nil
+	}
+	author, err := s.authors.FindByID(ctx, b.AuthorID)
+	if errors.Is(err, ErrAuthorNotFound) {
+		return &ValidationError{Fields: []FieldError{{Field: "author_id", Message: "unknown author"}}}
+	}
+	if err != nil {
+		return err
+	}
+	b.BookAuthor = author.Name
+	return nil
+}
+
+// Does the same as linkAuthor for a patch that links the book to another
+// author. Unlinking a book keeps its author string.
+func (s *server) linkPatchAuthor(ctx context.Context, p *BookPatch) error {
+	if p.AuthorID == nil || p.AuthorID.IsZero() {
+		return nil
+	}
+	b := BookStore{AuthorID: *p.AuthorID}
+	if err := s.linkAuthor(ctx, &b); err != nil {
+		return err
+	}
+	p.BookAuthor = &b.BookAuthor
+	return nil
+}
+
+func (s *server) listAuthors(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	authors, err := s.authors.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, authors)
+}
+
+func (s *server) getAuthor(c echo.Context) error {
+	id, err := authorID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	author, err := s.authors.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, author)
+}
+
+// Lists the books linked to the author, with the same pagination, filters
+// and sorting as /api/books.
+func (s *server) listAuthorBooks(c echo.Context) error {
+	id, err := authorID(c)
+	if err != nil {
+		return err
+	}
+	q, err := parseBookQuery(c, 0)
+	if err != nil {
+		return err
+	}
+	q.AuthorID = id
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	if _, err := s.authors.FindByID(ctx, id); err != nil {
+		return err
+	}
+	results, total, err := s.books.FindAll(ctx, q)
+	if err != nil {
+		return err
+	}
+	books, err := s.bookDTOs(ctx, results)
+	if err != nil {
+		return err
+	}
+	setPaginationHeaders(c, newBookPage(c, q, books, total))
+	return c.JSON(http.StatusOK, books)
+}
+
+func (s *server) createAuthor(c echo.Context) error {
+	var author Author
+	if err := c.Bind(&author); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid author data").SetInternal(err)
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	author, err := s.storeAuthor(ctx, author)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, author)
+}
+
+// Validates and inserts a new author.
+func (s *server) storeAuthor(ctx context.Context, author Author) (Author, error) {
+	normalizeAuthor(&author)
+	if err := validateAuthor(author); err != nil {
+		return author, err
+	}
+	return s.authors.Insert(ctx, author)
+}
+
+// Replaces the author. A new name is copied into every linked book.
+func (s *server) updateAuthor(c echo.Context) error {
+	id, err := authorID(c)
+	if err != nil {
+		return err
+	}
+	var author Author
+	if err := c.Bind(&author); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid author data").SetInternal(err)
+	}
+	author.ID = id
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	if author, err = s.replaceAuthor(ctx, author); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, author)
+}
+
+// Validates the author and replaces the stored author with the same ID.
+func (s *server) replaceAuthor(ctx context.Context, author Author) (Author, error) {
+	normalizeAuthor(&author)
+	if err := validateAuthor(author); err != nil {
+		return author, err
+	}
+	author, err := s.authors.Update(ctx, author)
+	if err != nil {
+		return author, err
+	}
+	_, err = s.books.RenameAuthor(ctx, author.ID, author.Name)
+	return author, err
+}
+
+// Authors that still have books cannot be deleted, as the books would point
+// at nothing afterwards.
+func (s *server) deleteAuthor(c echo.Context) error {
+	id, err := authorID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	if err := s.removeAuthor(ctx, id); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *server) removeAuthor(ctx context.Context, id primitive.ObjectID) error {
+	count, err := s.books.Count(ctx, BookQuery{AuthorID: id})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("The author still has %d books", count))
+	}
+	return s.authors.Delete(ctx, id)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Longest line a dump may contain. Books are far smaller, this only keeps
+// a broken file from eating up memory.
+const maxBackupLine = 1 << 20
+
+const (
+	restoreMerge   = "merge"
+	restoreReplace = "replace"
+)
+
+// Problem with a single line of a dump. Line counts from 1.
+type RestoreFailure struct {
+	Line       int          `json:"line"`
+	Error      string       `json:"error"`
+	Fields     []FieldError `json:"fields,omitempty"`
+	ExistingID string       `json:"existing_id,omitempty"`
+}
+
+// Sends the whole catalog as newline-delimited JSON, one book per line in
+// the shape of GET /api/books/:id. Like the export, the dump is written
+// while the books are read.
+func (s *server) backupBooks(c echo.Context) error {
+	res := c.Response()
+	filename := "books-" + time.Now().UTC().Format("2006-01-02") + ".ndjson"
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.WriteHeader(http.StatusOK)
+
+	w := bufio.NewWriter(res)
+	enc := json.NewEncoder(w)
+	err := s.eachBook(c.Request().Context(), BookQuery{}, func(b BookStore) error {
+		return enc.Encode(newBookDTO(b))
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Reads a dump as written by backupBooks. Every line has to be a valid
+// book with an ID; otherwise the whole dump is rejected before anything is
+// stored. Besides the books, it returns the line each of them was on.
+func readBackup(c echo.Context) ([]BookStore, []int, error) {
+	scanner := bufio.NewScanner(c.Request().Body)
+	scanner.Buffer(make([]byte, 64*1024), maxBackupLine)
+
+	var books []BookStore
+	var lines []int
+	var invalid []RestoreFailure
+	for line := 1; scanner.Scan(); line++ {
+		raw := scanner.Bytes()
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+		var b BookStore
+		if err := json.Unmarshal(raw, &b); err != nil {
+			invalid = append(invalid, RestoreFailure{Line: line, Error: "not a valid book: " + err.Error()})
+			continue
+		}
+		if b.ID.IsZero() {
+			invalid = append(invalid, RestoreFailure{Line: line, Error: "id: is required", Fields: []FieldError{{Field: "id", Message: "is required"}}})
+			continue
+		}
+		if err := validateBook(b); err != nil {
+			failure := RestoreFailure{Line: line, Error: err.Error()}
+			var v *ValidationError
+			if errors.As(err, &v) {
+				failure.Fields = v.Fields
+			}
+			invalid = append(invalid, failure)
+			continue
+		}
+		normalizeBook(&b)
+		books = append(books, b)
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "The dump could not be read").SetInternal(err)
+	}
+	if len(invalid) > 0 {
+		return nil, nil, newAPIError(http.StatusUnprocessableEntity, fmt.Sprintf("%d lines of the dump are invalid, nothing was restored", len(invalid)), invalid)
+	}
+	if len(books) == 0 {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "The dump contains no books")
+	}
+	return books, lines, nil
+}
+
+// Restores books from a dump. Books keep the IDs of the dump, so loans,
+// copies and holds pointing at them stay valid.
+//
+// In merge mode, the default, books of the dump replace the stored books
+// with the same ID and all other books stay. In replace mode, books that
+// are not in the dump are deleted first, together with their copies.
+func (s *server) restoreBooks(c echo.Context) error {
+	mode := c.QueryParam("mode")
+	if mode == "" {
+		mode = restoreMerge
+	}
+	if mode != restoreMerge && mode != restoreReplace {
+		return echo.NewHTTPError(http.StatusBadRequest, "mode must be merge or replace")
+	}
+	books, lines, err := readBackup(c)
+	if err != nil {
+		return err
+	}
+
+	deleted := 0
+	if mode == restoreReplace {
+		keep := make(map[primitive.ObjectID]bool, len(books))
+		for _, b := range books {
+			keep[b.ID] = true
+		}
+		var stale []primitive.ObjectID
+		err := s.eachBook(c.Request().Context(), BookQuery{}, func(b BookStore) error {
+			if !keep[b.ID] {
+				stale = append(stale, b.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if deleted, err = s.deleteBooksByID(c, stale); err != nil {
+			return err
+		}
+	}
+
+	created, updated := 0, 0
+	failed := []RestoreFailure{}
+	for i, b := range books {
+		ctx, cancel := writeContext(c)
+		isNew, err := s.books.Restore(ctx, b)
+		cancel()
+		var duplicate *DuplicateBookError
+		switch {
+		case errors.As(err, &duplicate):
+			failed = append(failed, RestoreFailure{Line: lines[i], Error: err.Error(), ExistingID: duplicate.ExistingID.Hex()})
+		case err != nil:
+			return err
+		case isNew:
+			created++
+		default:
+			updated++
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"mode":    mode,
+		"created": created,
+		"updated": updated,
+		"deleted": deleted,
+		"failed":  failed,
+	})
+}
+
+// Deletes the books and their copies, one batch at a time.
+func (s *server) deleteBooksByID(c echo.Context, ids []primitive.ObjectID) (int, error) {
+	deleted := 0
+	for start := 0; start < len(ids); start += exportBatchSize {
+		batch := ids[start:min(start+exportBatchSize, len(ids))]
+		ctx, cancel := writeContext(c)
+		for _, id := range batch {
+			err := s.books.Delete(ctx, id)
+			if errors.Is(err, ErrBookNotFound) {
+				continue
+			}
+			if err != nil {
+				cancel()
+				return deleted, err
+			}
+			deleted++
+		}
+		err := s.copies.DeleteByBooks(ctx, batch)
+		cancel()
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Defines a "model" that we can use to communicate with the
+// frontend or the database
+type BookStore struct {
+	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	BookName   string             `json:"name" bson:"name"`
+	BookAuthor string             `json:"author" bson:"author"`
+	BookISBN   string             `json:"isbn,omitempty" bson:"isbn,omitempty"`
+	BookPages  int                `json:"pages" bson:"pages"`
+	BookYear   int                `json:"year" bson:"year"`
+	// Links the book to an entry of the authors collection. BookAuthor
+	// then holds a copy of the author's name, which keeps searching and
+	// sorting by author working without a join.
+	AuthorID primitive.ObjectID `json:"author_id,omitempty" bson:"author_id,omitempty"`
+	// Names from the genre vocabulary, sorted and without duplicates.
+	Genres []string `json:"genres,omitempty" bson:"genres,omitempty"`
+	// Starts at 1 and goes up with every change to the book. Writes that
+	// carry the version they are based on are refused with
+	// ErrVersionConflict once the book has moved on.
+	Version int64 `json:"version" bson:"version"`
+	// Stamped by the repositories on every write; whatever a client sends
+	// is ignored.
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+	// Set while the book is in the trash, see BookRepository.Delete.
+	DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+}
+
+// The time the repositories stamp on a write. MongoDB keeps milliseconds,
+// so the other databases get no more than that either.
+func writeTime() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// Fills in what backups made before books had a version or timestamps
+// lack. Such books count as created when their ID was.
+func completeRestoredBook(b *BookStore) {
+	b.Version = max(b.Version, 1)
+	if b.CreatedAt.IsZero() {
+		b.CreatedAt = b.ID.Timestamp().UTC()
+	}
+	if b.UpdatedAt.IsZero() {
+		b.UpdatedAt = b.CreatedAt
+	}
+}
+
+// Same fields as BookStore, but as pointers. This lets us distinguish a
+// field that was left out of a PATCH request (nil) from one that was
+// explicitly sent, so partial updates never zero out the rest of a book.
+type BookPatch struct {
+	BookName   *string `json:"name"`
+	BookAuthor *string `json:"author"`
+	BookISBN   *string `json:"isbn"`
+	BookPages  *int    `json:"pages"`
+	BookYear   *int    `json:"year"`
+	// An empty ID unlinks the book from its author.
+	AuthorID *primitive.ObjectID `json:"author_id"`
+	Genres   *[]string           `json:"genres"`
+	// The version the patch is based on, not a field to change. Without
+	// it the patch applies to whatever version is stored.
+	Version *int64 `json:"version"`
+}
+
+// Reports whether the patch does not touch any field. The expected
+// version alone changes nothing.
+func (p BookPatch) IsEmpty() bool {
+	return p.BookName == nil && p.BookAuthor == nil && p.BookISBN == nil && p.BookPages == nil && p.BookYear == nil && p.AuthorID == nil && p.Genres == nil
+}
+
+// Applies the fields that were sent to the given book.
+func (p BookPatch) Apply(b *BookStore) {
+	if p.BookName != nil {
+		b.BookName = *p.BookName
+	}
+	if p.BookAuthor != nil {
+		b.BookAuthor = *p.BookAuthor
+	}
+	if p.BookISBN != nil {
+		b.BookISBN = *p.BookISBN
+	}
+	if p.BookPages != nil {
+		b.BookPages = *p.BookPages
+	}
+	if p.BookYear != nil {
+		b.BookYear = *p.BookYear
+	}
+	if p.AuthorID != nil {
+		b.AuthorID = *p.AuthorID
+	}
+	if p.Genres != nil {
+		b.Genres = *p.Genres
+	}
+}
+
+// A book as the /api endpoints answer with it and the templates show it.
+// Every response containing books is built from it, see newBookDTO and
+// server.bookDTOs.
+type BookDTO struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Author    string     `json:"author"`
+	AuthorID  string     `json:"author_id,omitempty"`
+	ISBN      string     `json:"isbn"`
+	Pages     int        `json:"pages"`
+	Year      int        `json:"year"`
+	Genres    []string   `json:"genres"`
+	Version   int64      `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// The linked author and the copies of the book, which only
+	// server.bookDTOs fills in
+	AuthorInfo *Author    `json:"author_info,omitempty"`
+	Copies     *CopyCount `json:"copies,omitempty"`
+	// How well the book matches a search, or how similar it is to another
+	Score *float64 `json:"score,omitempty"`
+	// Whether the user may edit and delete the book, for the buttons of
+	// the book table, see bookRowView
+	CanEdit   bool `json:"-"`
+	CanDelete bool `json:"-"`
+}
+
+func newBookDTO(b BookStore) BookDTO {
+	return BookDTO{
+		ID:        b.ID.Hex(),
+		Name:      b.BookName,
+		Author:    b.BookAuthor,
+		AuthorID:  optionalHex(b.AuthorID),
+		ISBN:      b.BookISBN,
+		Pages:     b.BookPages,
+		Year:      b.BookYear,
+		Genres:    append([]string{}, b.Genres...),
+		Version:   b.Version,
+		CreatedAt: b.CreatedAt,
+		UpdatedAt: b.UpdatedAt,
+		DeletedAt: b.DeletedAt,
+	}
+}
+
+// The day the book was added, as the book table shows it.
+func (b BookDTO) Added() string {
+	return b.CreatedAt.Format(time.DateOnly)
+}
+
+// The fields a client can change, by their JSON name, see diffBooks. A
+// book without an author ID lacks the field.
+func (b BookDTO) changeable() map[string]interface{} {
+	fields := map[string]interface{}{
+		"name":   b.Name,
+		"author": b.Author,
+		"isbn":   b.ISBN,
+		"pages":  b.Pages,
+		"year":   b.Year,
+		"genres": b.Genres,
+	}
+	if b.AuthorID != "" {
+		fields["author_id"] = b.AuthorID
+	}
+	return fields
+}
+
+// Largest number of books a single bulk request may contain.
+const maxBulkSize = 1000
+
+// Outcome of inserting a single entry of a bulk request. Index refers to
+// the position of the book in the request body.
+type BulkResult struct {
+	Index      int          `json:"index"`
+	ID         string       `json:"id,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Fields     []FieldError `json:"fields,omitempty"`
+	ExistingID string       `json:"existing_id,omitempty"`
+}
+
+// A book found by a text search, together with its relevance score.
+type SearchHit struct {
+	BookStore `bson:",inline"`
+	Score     float64 `bson:"score"`
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// What happens in a catalog, for whoever wants to follow it without the
+// handlers knowing: the changes to the books, see events.go, and the loans
+// made and returned, as published by the loan repository. Subscribers
+// within the server get them from the event bus of the catalog; with
+// events.backend set to nats or kafka, they are also forwarded there for
+// systems outside, such as analytics.
+//
+// Forwarding is at most once: events that cannot be delivered are logged
+// and dropped. With MongoDB change streams every instance sees every
+// change to the books and forwards it, so consumers should expect the same
+// change more than once.
+
+type EventType string
+
+const (
+	EventBookCreated  EventType = "book.created"
+	EventBookUpdated  EventType = "book.updated"
+	EventBookDeleted  EventType = "book.deleted"
+	EventLoanCreated  EventType = "loan.created"
+	EventLoanReturned EventType = "loan.returned"
+)
+
+// An event on the bus. Library names the branch of the catalog, see
+// tenants.go, and is empty for the main library. Of deleted books only the
+// ID is set.
+type Event struct {
+	ID      string    `json:"id"`
+	Type    EventType `json:"type"`
+	At      time.Time `json:"at"`
+	Library string    `json:"library,omitempty"`
+	Book    *BookDTO  `json:"book,omitempty"`
+	Loan    *Loan     `json:"loan,omitempty"`
+}
+
+// The ID of what the event is about, which keeps the events of the same
+// book or loan in order on Kafka.
+func (e Event) key() string {
+	if e.Loan != nil {
+		return e.Loan.ID.Hex()
+	}
+	if e.Book != nil {
+		return e.Book.ID
+	}
+	return ""
+}
+
+// How many events a subscriber or the forwarder may fall behind before
+// events are dropped.
+const eventBusBuffer = 1024
+
+// Hands the events of a catalog to its subscribers and to the forwarder.
+type eventBus struct {
+	library string
+	forward *eventForwarder
+
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Sets up the bus of the given branch of the library, or of the main
+// library if it is empty. forward may be nil.
+func newEventBus(library string, forward *eventForwarder) *eventBus {
+	return &eventBus{library: library, forward: forward, subs: map[chan Event]struct{}{}}
+}
+
+// Returns a channel receiving every event from now on, and a function to
+// end the subscription. Like with the book events, subscribers that do
+// not keep up are dropped, which closes the channel.
+func (b *eventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBusBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	e.ID = primitive.NewObjectID().Hex()
+	e.At = time.Now().UTC()
+	e.Library = b.library
+	b.mu.Lock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	b.mu.Unlock()
+	if b.forward != nil {
+		b.forward.enqueue(e)
+	}
+}
+
+// Puts the changes to the books on the bus for as long as the server
+// runs.
+func (b *eventBus) followBooks(events *bookEvents) {
+	types := map[BookEventType]EventType{
+		BookCreated: EventBookCreated,
+		BookUpdated: EventBookUpdated,
+		BookDeleted: EventBookDeleted,
+	}
+	for {
+		ch, unsubscribe := events.Subscribe()
+		for e := range ch {
+			book := newBookDTO(e.Book)
+			b.publish(Event{Type: types[e.Type], Book: &book})
+		}
+		// Dropped for being too slow, which the bus never is for long
+		unsubscribe()
+		log.Printf("The event bus missed changes to the books")
+	}
+}
+
+// Publishes the loans made and returned through the wrapped repository.
+type publishedLoanRepository struct {
+	LoanRepository
+	bus *eventBus
+}
+
+func (r *publishedLoanRepository) Insert(ctx context.Context, l Loan) (Loan, error) {
+	l, err := r.LoanRepository.Insert(ctx, l)
+	if err == nil {
+		r.bus.publish(Event{Type: EventLoanCreated, Loan: &l})
+	}
+	return l, err
+}
+
+func (r *publishedLoanRepository) Return(ctx context.Context, id primitive.ObjectID, at time.Time) (Loan, error) {
+	l, err := r.LoanRepository.Return(ctx, id, at)
+	if err == nil {
+		r.bus.publish(Event{Type: EventLoanReturned, Loan: &l})
+	}
+	return l, err
+}
+
+// Where the forwarder delivers the events to.
+type eventSink interface {
+	// Delivers the events, in order.
+	Send(ctx context.Context, events []Event) error
+	// Delivers what is still buffered and disconnects.
+	Close() error
+}
+
+// How long delivering a batch of events may take.
+const eventSendTimeout = 10 * time.Second
+
+// Forwards the events of all catalogs to NATS or Kafka, in the background
+// so that publishing never waits for them.
+type eventForwarder struct {
+	sink  eventSink
+	queue chan Event
+	done  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Connects to the backend events.backend names, and returns nil for
+// inprocess, where the events stay within the server.
+func loadEventForwarder(cfg EventsConfig) (*eventForwarder, error) {
+	var sink eventSink
+	switch cfg.Backend {
+	case "nats":
+		// Connects in the background, and reconnects for as long as it
+		// takes; the client buffers what is published meanwhile
+		conn, err := nats.Connect(cfg.NATS.URL, nats.Name("bookstore"), nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, err
+		}
+		sink = &natsSink{conn: conn, subject: cfg.NATS.Subject}
+	case "kafka":
+		sink = &kafkaSink{writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Kafka.Brokers...),
+			Topic:        cfg.Kafka.Topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		}}
+	default:
+		return nil, nil
+	}
+	f := &eventForwarder{sink: sink, queue: make(chan Event, eventBusBuffer), done: make(chan struct{})}
+	go f.run()
+	return f, nil
+}
+
+func (f *eventForwarder) enqueue(e Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	select {
+	case f.queue <- e:
+	default:
+		log.Printf("Dropped the event %s, forwarding fell behind", e.ID)
+	}
+}
+
+func (f *eventForwarder) run() {
+	defer close(f.done)
+	for e := range f.queue {
+		batch := []Event{e}
+	more:
+		for len(batch) < eventBusBuffer {
+			select {
+			case next, ok := <-f.queue:
+				if !ok {
+					break more
+				}
+				batch = append(batch, next)
+			default:
+				break more
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), eventSendTimeout)
+		if err := f.sink.Send(ctx, batch); err != nil {
+			log.Printf("Failed to forward %d events: %v", len(batch), err)
+		}
+		cancel()
+	}
+}
+
+// Forwards the events still queued and disconnects, on shutdown.
+func (f *eventForwarder) close() {
+	f.mu.Lock()
+	f.closed = true
+	close(f.queue)
+	f.mu.Unlock()
+	<-f.done
+	if err := f.sink.Close(); err != nil {
+		log.Printf("Failed to forward the last events: %v", err)
+	}
+}
+
+// Publishes each event on the subject of its type, below the configured
+// one, as in library.book.created.
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (n *natsSink) Send(ctx context.Context, events []Event) error {
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := n.conn.Publish(n.subject+"."+string(e.Type), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *natsSink) Close() error {
+	return n.conn.Drain()
+}
+
+// Writes the events to a single topic, keyed by the book or loan, with the
+// type in a header.
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func (k *kafkaSink) Send(ctx context.Context, events []Event) error {
+	msgs := make([]kafka.Message, len(events))
+	for i, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		msgs[i] = kafka.Message{
+			Key:     []byte(e.key()),
+			Value:   data,
+			Headers: []kafka.Header{{Key: "type", Value: []byte(e.Type)}},
+		}
+	}
+	return k.writer.WriteMessages(ctx, msgs...)
+}
+
+func (k *kafkaSink) Close() error {
+	return k.writer.Close()
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// The headers of a response that go into the cache along with the body.
+var cachedHeaders = []string{echo.HeaderContentType, headerETag, "X-Total-Count", "Link"}
+
+// How many responses the memory cache holds at most.
+const maxCachedResponses = 1000
+
+// The channel the instances tell each other about changes to the books on.
+const cacheInvalidationChannel = "bookstore:books-changed"
+
+// A response as it is kept in the cache.
+type cachedResponse struct {
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// Sends the response, or a 304 if the client already has it. X-Cache tells
+// whether it came from the cache.
+func (r cachedResponse) send(c echo.Context, state string) error {
+	h := c.Response().Header()
+	for name, values := range r.Header {
+		h[name] = values
+	}
+	h.Set("X-Cache", state)
+	if header := c.Request().Header.Get(headerIfNoneMatch); header != "" && etagMatches(header, h.Get(headerETag), true) {
+		h.Del(echo.HeaderContentType)
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, h.Get(echo.HeaderContentType), r.Body)
+}
+
+// Keeps the responses of the public book endpoints, keyed by their URL.
+type responseCache interface {
+	// Returns the response for the key, and false if there is none.
+	Get(ctx context.Context, key string) (cachedResponse, bool, error)
+	Set(ctx context.Context, key string, r cachedResponse, ttl time.Duration) error
+	// Drops all responses, as any of them may show a book that changed.
+	Clear(ctx context.Context) error
+}
+
+type memoryCacheEntry struct {
+	response cachedResponse
+	expires  time.Time
+}
+
+// Keeps the responses in memory, so every instance caches on its own.
+// Once it is full, no more responses are cached until some expired.
+type memoryResponseCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+func newMemoryResponseCache() *memoryResponseCache {
+	return &memoryResponseCache{entries: map[string]memoryCacheEntry{}}
+}
+
+func (m *memoryResponseCache) Get(ctx context.Context, key string) (cachedResponse, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return cachedResponse{}, false, nil
+	}
+	return entry.response, true, nil
+}
+
+func (m *memoryResponseCache) Set(ctx context.Context, key string, r cachedResponse, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if len(m.entries) >= maxCachedResponses {
+		for k, entry := range m.entries {
+			if now.After(entry.expires) {
+				delete(m.entries, k)
+			}
+		}
+		if len(m.entries) >= maxCachedResponses {
+			return nil
+		}
+	}
+	m.entries[key] = memoryCacheEntry{response: r, expires: now.Add(ttl)}
+	return nil
+}
+
+func (m *memoryResponseCache) Clear(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clear(m.entries)
+	return nil
+}
+
+// Keeps the responses in Redis, shared by all instances. Redis expires
+// them by itself.
+type redisResponseCache struct {
+	client *redis.Client
+	// Starts the keys; the branches of the library, see tenants.go, keep
+	// theirs apart. Clearing the cache of the main library clears those of
+	// the branches as well.
+	prefix string
+}
+
+// Keeps the responses of the given branch of the library, or of the main
+// library if it is empty.
+func newRedisResponseCache(client *redis.Client, tenant string) *redisResponseCache {
+	prefix := "cache:"
+	if tenant != "" {
+		prefix += tenant + ":"
+	}
+	return &redisResponseCache{client: client, prefix: prefix}
+}
+
+func (r *redisResponseCache) Get(ctx context.Context, key string) (cachedResponse, bool, error) {
+	var res cachedResponse
+	data, err := r.client.Get(ctx, r.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return res, false, nil
+	}
+	if err != nil {
+		return res, false, err
+	}
+	if err = json.Unmarshal(data, &res); err != nil {
+		return res, false, err
+	}
+	return res, true, nil
+}
+
+func (r *redisResponseCache) Set(ctx context.Context, key string, res cachedResponse, ttl time.Duration) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, r.prefix+key, data, ttl).Err()
+}
+
+// The keys are collected with SCAN, which unlike KEYS does not block the
+// server while it goes through them.
+func (r *redisResponseCache) Clear(ctx context.Context) error {
+	iter := r.client.Scan(ctx, 0, r.prefix+"*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == 1000 {
+			if err := r.client.Unlink(ctx, keys...).Err(); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return r.client.Unlink(ctx, keys...).Err()
+	}
+	return nil
+}
+
+// Collects what the handler writes instead of sending it, so it can be
+// cached first.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// Set once the handler flushed; from then on the response goes
+	// straight to the client and is not cached
+	streaming bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.streaming {
+		return
+	}
+	r.status = status
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.streaming {
+		return r.ResponseWriter.Write(b)
+	}
+	return r.body.Write(b)
+}
+
+// Handlers only flush responses too large to keep, like the unpaginated
+// listings, see streamBooks. The first flush therefore sends what was
+// recorded so far and lets the rest through, so memory stays flat.
+func (r *responseRecorder) Flush() {
+	if !r.streaming {
+		r.streaming = true
+		r.ResponseWriter.Header().Set("X-Cache", "BYPASS")
+		r.ResponseWriter.WriteHeader(r.status)
+		_, _ = r.ResponseWriter.Write(r.body.Bytes())
+		r.body = bytes.Buffer{}
+	}
+	_ = http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Answers anonymous requests from the cache, and caches the successful
+// responses for ttl. Requests with credentials always go to the handler,
+// as may their responses. If the cache fails, requests are answered as if
+// there was none.
+func cacheResponses(cache responseCache, ttl time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Header.Get(headerAPIKey) != "" || req.Header.Get(echo.HeaderAuthorization) != "" {
+				return next(c)
+			}
+
+			key := req.URL.RequestURI()
+			ctx, cancel := requestContext(c)
+			cached, found, err := cache.Get(ctx, key)
+			cancel()
+			if err != nil {
+				log.Printf("Response cache: failed to look up %s: %v", key, err)
+			}
+			if found {
+				cacheLookups.WithLabelValues("hit").Inc()
+				return cached.send(c, "HIT")
+			}
+			cacheLookups.WithLabelValues("miss").Inc()
+
+			// The cache needs the whole response, not a 304 for this client
+			ifNoneMatch := req.Header.Get(headerIfNoneMatch)
+			req.Header.Del(headerIfNoneMatch)
+			res := c.Response()
+			rec := &responseRecorder{ResponseWriter: res.Writer}
+			res.Writer = rec
+			err = next(c)
+			res.Writer = rec.ResponseWriter
+			if ifNoneMatch != "" {
+				req.Header.Set(headerIfNoneMatch, ifNoneMatch)
+			}
+			if !res.Committed || rec.streaming {
+				// Errors are only turned into responses further out, and
+				// a streamed response has been sent already
+				return err
+			}
+
+			// The handler only wrote into the recorder, the response is
+			// sent for real below
+			res.Committed, res.Size = false, 0
+			if err != nil || rec.status != http.StatusOK {
+				res.WriteHeader(rec.status)
+				_, _ = res.Write(rec.body.Bytes())
+				return err
+			}
+			cached = cachedResponse{Header: http.Header{}, Body: rec.body.Bytes()}
+			for _, name := range cachedHeaders {
+				if values := res.Header().Values(name); len(values) > 0 {
+					cached.Header[http.CanonicalHeaderKey(name)] = values
+				}
+			}
+			ctx, cancel = requestContext(c)
+			defer cancel()
+			if err := cache.Set(ctx, key, cached, ttl); err != nil {
+				log.Printf("Response cache: failed to store %s: %v", key, err)
+			}
+			return cached.send(c, "MISS")
+		}
+	}
+}
+
+// Clears the cache whenever a book changes. Changes that come in at once,
+// like those of an import, clear it only once.
+//
+// A memory cache only learns of the changes made through this instance,
+// unless the database reports them, see watchBooks. With Redis, the
+// instances therefore tell each other about their changes, and everyone
+// clears their own cache. A cache in Redis is shared, so clearing it once
+// is enough.
+func invalidateCache(cache responseCache, events *bookEvents, rdb *redis.Client) {
+	var instance string
+	if _, shared := cache.(*redisResponseCache); !shared && rdb != nil {
+		instance, _ = randomToken()
+		go listenForInvalidations(cache, rdb, instance)
+	}
+
+	clearCache := func() {
+		ctx, cancel := dbContext()
+		defer cancel()
+		if err := cache.Clear(ctx); err != nil {
+			log.Printf("Response cache: failed to clear: %v", err)
+		}
+		if instance != "" {
+			if err := rdb.Publish(ctx, cacheInvalidationChannel, instance).Err(); err != nil {
+				log.Printf("Response cache: failed to notify the other instances: %v", err)
+			}
+		}
+	}
+
+	for {
+		ch, unsubscribe := events.Subscribe()
+		for range ch {
+			drain(ch)
+			clearCache()
+		}
+		// The subscription was dropped for being too slow, which may have
+		// cost some changes
+		unsubscribe()
+		clearCache()
+	}
+}
+
+// Takes whatever is waiting in the channel without blocking.
+func drain(ch <-chan BookEvent) {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Clears the cache whenever another instance reports a change. The
+// subscription reconnects by itself if the connection to Redis breaks;
+// changes made meanwhile are only caught up with once the responses
+// expire.
+func listenForInvalidations(cache responseCache, rdb *redis.Client, instance string) {
+	sub := rdb.Subscribe(context.Background(), cacheInvalidationChannel)
+	defer sub.Close()
+	for msg := range sub.Channel() {
+		if msg.Payload == instance {
+			continue
+		}
+		ctx, cancel := dbContext()
+		_ = cache.Clear(ctx)
+		cancel()
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestListBooksBehindCache(t *testing.T) {
+	books := newMemoryBookRepository()
+	if _, err := books.Insert(context.Background(), BookStore{BookName: "Dune", BookAuthor: "Frank Herbert", BookISBN: "9780441172719"}); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{books: books, authors: newMemoryAuthorRepository(), copies: newMemoryCopyRepository()}
+	e := echo.New()
+	e.GET("/api/books", s.listBooks, cacheResponses(newMemoryResponseCache(), time.Minute))
+
+	get := func(target string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d %s", target, rec.Code, rec.Body)
+		}
+		var got []BookDTO
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || len(got) != 1 || got[0].Name != "Dune" {
+			t.Fatalf("GET %s = %s, %v, want Dune", target, rec.Body, err)
+		}
+		return rec
+	}
+
+	// The whole catalog is streamed past the cache
+	for range 2 {
+		if rec := get("/api/books"); rec.Header().Get("X-Cache") != "BYPASS" || !rec.Flushed {
+			t.Errorf("unpaginated listing: X-Cache %q, flushed %v, want a flushed BYPASS", rec.Header().Get("X-Cache"), rec.Flushed)
+		}
+	}
+
+	// A page is cached
+	for _, want := range []string{"MISS", "HIT"} {
+		if rec := get("/api/books?page=1"); rec.Header().Get("X-Cache") != want {
+			t.Errorf("paginated listing: X-Cache %q, want %q", rec.Header().Get("X-Cache"), want)
+		}
+	}
+}
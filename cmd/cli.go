@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The commands of the binary, e.g.
+//
+//	app import -csv books.csv -storage sqlite
+//
+// They all read the configuration like the server does, see config.go,
+// and work on the same repositories, without starting the web server,
+// those of the main library unless said otherwise. Their flags mix with
+// those of the configuration.
+//
+// Changes made by a command are put down to the server itself in the audit
+// log. Running servers only hear of them through MongoDB change streams;
+// their caches catch up within cache.ttl, an Elasticsearch index with
+// `app reindex`.
+type command struct {
+	name  string
+	usage string
+	// Defines the flags of the command on fs and returns what runs it
+	setup func(fs *flag.FlagSet) func(cfg Config) error
+}
+
+var commands = []command{
+	{"serve", "serve the web UI, the API and gRPC; the default", serveCommand},
+	{"seed", "store the seed books, see seed.file", seedCommand},
+	{"import", "import books from a CSV file", importCommand},
+	{"export", "write all books as CSV, Excel or MARC", exportCommand},
+	{"reindex", "build the Elasticsearch index anew", reindexCommand},
+	{"migrate", "apply the pending database migrations", migrateCommand},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func printCommands() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nSee %s <command> -h for the flags.\n", os.Args[0])
+}
+
+// Tells what went wrong without the status codes the errors of the
+// handlers carry.
+func describeError(err error) string {
+	var he *echo.HTTPError
+	if !errors.As(err, &he) {
+		return err.Error()
+	}
+	msg := fmt.Sprint(he.Message)
+	if he.Internal != nil {
+		msg += ": " + he.Internal.Error()
+	}
+	return msg
+}
+
+// Ends on SIGINT or SIGTERM, so an interrupted command stops talking to
+// the database.
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// Connects to the database and returns a server with the repositories the
+// book handlers need, for the commands to reuse those.
+func openCommandServer(ctx context.Context, cfg Config) (*server, func(), error) {
+	openCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	repos, closeStorage, err := openStorage(openCtx, cfg.Database)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &server{
+		books:   newAuditedBookRepository(repos.books, repos.audit),
+		authors: repos.authors,
+		genres:  repos.genres,
+		copies:  repos.copies,
+		audit:   repos.audit,
+	}, closeStorage, nil
+}
+
+func serveCommand(fs *flag.FlagSet) func(Config) error {
+	return runServe
+}
+
+// Stores the seed books, see seed.go, whether seed.enabled is on or not.
+func seedCommand(fs *flag.FlagSet) func(Config) error {
+	file := fs.String("file", "", "the JSON or CSV file of the books instead of seed.file")
+	return func(cfg Config) error {
+		path := cfg.Seed.File
+		if *file != "" {
+			path = *file
+		}
+		ctx, stop := commandContext()
+		defer stop()
+		s, closeStorage, err := openCommandServer(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer closeStorage()
+		report, err := seedBooks(ctx, s.books, path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Seeded the books of %s: %s\n", path, report)
+		return nil
+	}
+}
+
+// Imports a CSV file like POST /api/books/import, without its limit on
+// the number of rows.
+func importCommand(fs *flag.FlagSet) func(Config) error {
+	file := fs.String("csv", "", "the CSV file to import, - for the standard input")
+	delimiter := fs.String("delimiter", ",", "the field separator")
+	mapping := fs.String("mapping", "", "a JSON object mapping the columns to book fields")
+	return func(cfg Config) error {
+		if *file == "" {
+			return errors.New("-csv is required")
+		}
+		comma, ok := parseDelimiter(*delimiter)
+		if !ok {
+			return errors.New("-delimiter must be a single character")
+		}
+		src := io.Reader(os.Stdin)
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			src = f
+		}
+		imp, err := readImport(src, comma, *mapping, 0)
+		if err != nil {
+			return errors.New(describeError(err))
+		}
+
+		ctx, stop := commandContext()
+		defer stop()
+		s, closeStorage, err := openCommandServer(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer closeStorage()
+		report, err := s.insertImport(ctx, imp)
+		if err != nil {
+			return err
+		}
+		for _, r := range report.Rows {
+			if r.Status != importInserted {
+				fmt.Fprintf(os.Stderr, "Row %d %s: %s\n", r.Row, r.Status, r.Error)
+			}
+		}
+		fmt.Printf("Inserted %d books, skipped %d, %d failed\n", report.Inserted, report.Skipped, report.Failed)
+		return nil
+	}
+}
+
+// Writes all books like GET /api/books/export does.
+func exportCommand(fs *flag.FlagSet) func(Config) error {
+	format := fs.String("format", "csv", "csv, xlsx, marc or marcxml")
+	out := fs.String("out", "-", "the file to write, - for the standard output")
+	return func(cfg Config) error {
+		if _, ok := exportFormats[*format]; !ok {
+			return errors.New("-format must be csv, xlsx, marc or marcxml")
+		}
+		ctx, stop := commandContext()
+		defer stop()
+		s, closeStorage, err := openCommandServer(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer closeStorage()
+
+		w := io.Writer(os.Stdout)
+		if *out != "-" {
+			f, err := os.Create(*out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return s.exportTo(ctx, w, *format, BookQuery{})
+	}
+}
+
+// Builds the Elasticsearch index like POST /api/admin/search/reindex.
+func reindexCommand(fs *flag.FlagSet) func(Config) error {
+	return func(cfg Config) error {
+		if cfg.Search.Backend != "elasticsearch" {
+			return errors.New("search.backend is not elasticsearch, there is no index to build")
+		}
+		ctx, stop := commandContext()
+		defer stop()
+		s, closeStorage, err := openCommandServer(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer closeStorage()
+		index, count, err := newElasticsearchIndex(cfg.Search).Reindex(ctx, s.books)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Indexed %d books in %s\n", count, index)
+		return nil
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo/v4"
+)
+
+// Responses are compressed with Brotli or gzip, whichever the client
+// prefers by its Accept-Encoding, Brotli on a tie, as it compresses JSON
+// and HTML somewhat better. Only responses of the configured types are
+// compressed, and only once they reach the minimum size: below that the
+// headers outweigh what compression saves. Responses streamed with Flush
+// are compressed as they go.
+
+// The levels favour speed, as every response is compressed anew.
+const (
+	brotliLevel = 4
+	gzipLevel   = gzip.DefaultCompression
+)
+
+var (
+	brotliWriters = sync.Pool{New: func() interface{} { return brotli.NewWriterLevel(nil, brotliLevel) }}
+	gzipWriters   = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzipLevel)
+		return w
+	}}
+)
+
+// An encoder of one of the pools; Reset points it at the next response.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// Picks the encoding for the Accept-Encoding header, or "" if the client
+// accepts neither.
+func pickEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, accepted := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "br" && name != "gzip" {
+			continue
+		}
+		q := 1.0
+		if raw, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(raw, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ || (q == bestQ && name == "br") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// Compresses the responses as laid out above.
+func compress(cfg CompressionConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			// WebSockets take over the connection
+			if req.Method == http.MethodHead || req.Header.Get(echo.HeaderUpgrade) != "" {
+				return next(c)
+			}
+			encoding := pickEncoding(req.Header.Get(echo.HeaderAcceptEncoding))
+			if encoding == "" {
+				return next(c)
+			}
+
+			res := c.Response()
+			cw := &compressWriter{ResponseWriter: res.Writer, cfg: cfg, encoding: encoding}
+			res.Writer = cw
+			defer func() {
+				// Errors are only turned into responses further out, with
+				// the writer as it was
+				res.Writer = cw.ResponseWriter
+			}()
+			err := next(c)
+			if closeErr := cw.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		}
+	}
+}
+
+// Holds the response back until it is clear whether to compress it: once
+// its type is known and it reached the minimum size, or it ended or was
+// flushed before.
+type compressWriter struct {
+	http.ResponseWriter
+	cfg      CompressionConfig
+	encoding string
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	// Set if the response is compressed
+	enc encoder
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	w.status = status
+	// Responses without a body go out right away
+	if status == http.StatusNoContent || status == http.StatusNotModified || status < http.StatusOK {
+		w.decide(false)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.decided {
+		if w.enc != nil {
+			return w.enc.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	if !w.compressible() {
+		if err := w.decide(false); err != nil {
+			return 0, err
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf.Write(b)
+	if w.buf.Len() >= w.cfg.MinSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Reports whether the response may be compressed by its headers so far.
+func (w *compressWriter) compressible() bool {
+	h := w.Header()
+	if h.Get(echo.HeaderContentEncoding) != "" || h.Get("Content-Range") != "" || w.status != http.StatusOK {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get(echo.HeaderContentType))
+	return err == nil && slices.Contains(w.cfg.Types, mediaType)
+}
+
+// Sends the headers and what was held back, compressed or not.
+func (w *compressWriter) decide(compressed bool) error {
+	if w.decided {
+		return nil
+	}
+	w.decided = true
+	h := w.Header()
+	if w.compressible() {
+		// Caches must not hand a compressed response to a client that
+		// did not ask for it, nor the other way round
+		h.Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	}
+	if compressed {
+		h.Del(echo.HeaderContentLength)
+		h.Set(echo.HeaderContentEncoding, w.encoding)
+		if w.encoding == "br" {
+			w.enc = brotliWriters.Get().(encoder)
+		} else {
+			w.enc = gzipWriters.Get().(encoder)
+		}
+		w.enc.Reset(w.ResponseWriter)
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+// Sends what was written so far, compressed if it may be even though it
+// is short of the minimum size, as more is likely to follow.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(w.buf.Len() > 0 && w.compressible())
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("the response writer cannot be hijacked")
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Ends the response: a response short of the minimum size goes out as it
+// is, a compressed one gets the end of its stream.
+func (w *compressWriter) Close() error {
+	if !w.decided && (w.status != 0 || w.buf.Len() > 0) {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.enc == nil {
+		return nil
+	}
+	err := w.enc.Close()
+	w.enc.Reset(nil)
+	if w.encoding == "br" {
+		brotliWriters.Put(w.enc)
+	} else {
+		gzipWriters.Put(w.enc)
+	}
+	w.enc = nil
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestRedactURI(t *testing.T) {
+	tests := []struct{ uri, want string }{
+		{"", ""},
+		{"books.db", "books.db"},
+		{"mongodb://localhost:27017", "mongodb://localhost:27017"},
+		{"mongodb://app:s3cret@db:27017/?authSource=admin", "mongodb://app:xxxxx@db:27017/?authSource=admin"},
+		{"postgres://app:s3cret@db/books?sslmode=disable", "postgres://app:xxxxx@db/books?sslmode=disable"},
+		{"postgres://db/books?password=s3cret&user=app", "postgres://db/books?password=xxxxx&user=app"},
+		{"host=db user=app password=s3cret dbname=books", "host=db user=app password=xxxxx dbname=books"},
+		{"host=db PASSWORD = s3cret", "host=db PASSWORD = xxxxx"},
+		{`host=db password='s3 cr\'et' dbname=books`, "host=db password=xxxxx dbname=books"},
+		{"host=db user=app search_path=north", "host=db user=app search_path=north"},
+	}
+	for _, tt := range tests {
+		if got := redactURI(tt.uri); got != tt.want {
+			t.Errorf("redactURI(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestConfigStringHidesSecrets(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Database.URI = "host=db user=app password=s3cret"
+	cfg.Auth.JWTSecret = "jwt-s3cret"
+	cfg.Redis.URL = "redis://:r3dis@cache:6379/0"
+	out := cfg.String()
+	for _, secret := range []string{"s3cret", "r3dis"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("the configuration shows %q:\n%s", secret, out)
+		}
+	}
+}
+
+// The command line is visible to everybody on the machine.
+func TestSecretsHaveNoFlags(t *testing.T) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	// Only the flags matter, not whether the configuration is complete
+	_, _ = loadConfig(fs, nil)
+	for _, name := range []string{"database-uri", "jwt-secret", "admin-password"} {
+		if fs.Lookup(name) != nil {
+			t.Errorf("there is a flag -%s", name)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// What a librarian sends to add a copy. A copy without a condition is in
+// good condition, and new copies are available unless stated otherwise.
+type newCopy struct {
+	Condition Condition `json:"condition"`
+	Location  string    `json:"location"`
+	Available *bool     `json:"available"`
+}
+
+// The changes that can be made to a copy. Fields that are not sent stay as
+// they are.
+type copyPatch struct {
+	Condition *Condition `json:"condition"`
+	Location  *string    `json:"location"`
+	Available *bool      `json:"available"`
+}
+
+func checkCondition(v *ValidationError, condition Condition) {
+	if !slices.Contains(allConditions, condition) {
+		v.add("condition", fmt.Sprintf("must be one of %v", allConditions))
+	}
+}
+
+// Looks up the copy of the :copy path parameter, which has to belong to
+// the book of the :id parameter.
+func (s *server) findCopy(c echo.Context) (Copy, error) {
+	bookObjID, err := bookID(c)
+	if err != nil {
+		return Copy{}, err
+	}
+	copyObjID, err := primitive.ObjectIDFromHex(c.Param("copy"))
+	if err != nil {
+		return Copy{}, echo.NewHTTPError(http.StatusBadRequest, "Invalid ID format")
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	cp, err := s.copies.FindByID(ctx, copyObjID)
+	if err != nil {
+		return cp, err
+	}
+	if cp.BookID != bookObjID {
+		return cp, ErrCopyNotFound
+	}
+	return cp, nil
+}
+
+func (s *server) listCopies(c echo.Context) error {
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	if _, err := s.books.FindByID(ctx, id); err != nil {
+		return err
+	}
+	copies, err := s.copies.FindByBook(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, copies)
+}
+
+func (s *server) addCopy(c echo.Context) error {
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	var req newCopy
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid copy data").SetInternal(err)
+	}
+	if req.Condition == "" {
+		req.Condition = ConditionGood
+	}
+	v := &ValidationError{}
+	checkCondition(v, req.Condition)
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+
+	cp := Copy{
+		BookID:    id,
+		Condition: req.Condition,
+		Location:  strings.TrimSpace(req.Location),
+		Available: req.Available == nil || *req.Available,
+		AddedAt:   time.Now().UTC(),
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	if _, err := s.books.FindByID(ctx, id); err != nil {
+		return err
+	}
+	if cp, err = s.copies.Insert(ctx, cp); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, cp)
+}
+
+func (s *server) patchCopy(c echo.Context) error {
+	var p copyPatch
+	if err := c.Bind(&p); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid copy data").SetInternal(err)
+	}
+	v := &ValidationError{}
+	if p.Condition != nil {
+		checkCondition(v, *p.Condition)
+	}
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+
+	cp, err := s.findCopy(c)
+	if err != nil {
+		return err
+	}
+	if p.Condition != nil {
+		cp.Condition = *p.Condition
+	}
+	if p.Location != nil {
+		cp.Location = strings.TrimSpace(*p.Location)
+	}
+	if p.Available != nil {
+		cp.Available = *p.Available
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	if cp, err = s.copies.Update(ctx, cp); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, cp)
+}
+
+// Copies that are lent or set aside for a hold cannot be removed.
+func (s *server) removeCopy(c echo.Context) error {
+	cp, err := s.findCopy(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	lent, err := s.loans.Count(ctx, LoanQuery{CopyID: cp.ID, Active: true})
+	if err != nil {
+		return err
+	}
+	if lent > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "The copy is lent and has to be returned first")
+	}
+	if hold, err := s.copyHold(ctx, cp.ID); err != nil {
+		return err
+	} else if hold != nil {
+		return echo.NewHTTPError(http.StatusConflict, "The copy is set aside for a hold")
+	}
+	if err := s.copies.Delete(ctx, cp.ID); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrCopyNotFound    = errors.New("copy not found")
+	ErrCopyUnavailable = errors.New("copy is not available")
+)
+
+// The state a physical copy is in.
+type Condition string
+
+const (
+	ConditionNew     Condition = "new"
+	ConditionGood    Condition = "good"
+	ConditionFair    Condition = "fair"
+	ConditionPoor    Condition = "poor"
+	ConditionDamaged Condition = "damaged"
+)
+
+var allConditions = []Condition{ConditionNew, ConditionGood, ConditionFair, ConditionPoor, ConditionDamaged}
+
+// A physical copy of a book on the shelves of the library. A book can have
+// any number of copies, including none for books the library only lists.
+type Copy struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	BookID    primitive.ObjectID `json:"book_id" bson:"book_id"`
+	Condition Condition          `json:"condition" bson:"condition"`
+	Location  string             `json:"location" bson:"location"`
+	Available bool               `json:"available" bson:"available"`
+	AddedAt   time.Time          `json:"added_at" bson:"added_at"`
+}
+
+// How many copies of a book there are, and how many of them can be lent.
+type CopyCount struct {
+	Total     int64 `json:"total"`
+	Available int64 `json:"available"`
+}
+
+// Stores the copies, next to the books of the same backend.
+type CopyRepository interface {
+	// Returns the copies of the book, oldest first.
+	FindByBook(ctx context.Context, bookID primitive.ObjectID) ([]Copy, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (Copy, error)
+	// Counts the copies of each of the books. Books without copies are
+	// left out of the result.
+	Count(ctx context.Context, bookIDs []primitive.ObjectID) (map[primitive.ObjectID]CopyCount, error)
+	// Stores a new copy and returns it with its ID set.
+	Insert(ctx context.Context, c Copy) (Copy, error)
+	// Replaces all fields of the copy with the ID of c.
+	Update(ctx context.Context, c Copy) (Copy, error)
+	// Marks an available copy as lent. Fails with ErrCopyUnavailable if the
+	// copy is lent already or was taken off the shelves, so two loans of
+	// the same copy cannot both succeed.
+	Lend(ctx context.Context, id primitive.ObjectID) error
+	// Makes the copy available again.
+	Release(ctx context.Context, id primitive.ObjectID) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Deletes every copy of the books, once the books themselves are gone.
+	DeleteByBooks(ctx context.Context, bookIDs []primitive.ObjectID) error
+	// Hands the copies of the books over to the book to, when they are
+	// merged into it, and returns how many there were.
+	MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error)
+}
+
+// Keeps the copies in memory, for the memory storage.
+type memoryCopyRepository struct {
+	mu     sync.RWMutex
+	copies []Copy
+}
+
+func newMemoryCopyRepository() *memoryCopyRepository {
+	return &memoryCopyRepository{}
+}
+
+func (r *memoryCopyRepository) FindByBook(ctx context.Context, bookID primitive.ObjectID) ([]Copy, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	copies := []Copy{}
+	for _, c := range r.copies {
+		if c.BookID == bookID {
+			copies = append(copies, c)
+		}
+	}
+	return copies, nil
+}
+
+func (r *memoryCopyRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Copy, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	i := slices.IndexFunc(r.copies, func(c Copy) bool { return c.ID == id })
+	if i < 0 {
+		return Copy{}, ErrCopyNotFound
+	}
+	return r.copies[i], nil
+}
+
+func (r *memoryCopyRepository) Count(ctx context.Context, bookIDs []primitive.ObjectID) (map[primitive.ObjectID]CopyCount, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	counts := map[primitive.ObjectID]CopyCount{}
+	for _, c := range r.copies {
+		if !slices.Contains(bookIDs, c.BookID) {
+			continue
+		}
+		count := counts[c.BookID]
+		count.Total++
+		if c.Available {
+			count.Available++
+		}
+		counts[c.BookID] = count
+	}
+	return counts, nil
+}
+
+func (r *memoryCopyRepository) Insert(ctx context.Context, c Copy) (Copy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c.ID = primitive.NewObjectID()
+	r.copies = append(r.copies, c)
+	return c, nil
+}
+
+func (r *memoryCopyRepository) Update(ctx context.Context, c Copy) (Copy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.copies, func(o Copy) bool { return o.ID == c.ID })
+	if i < 0 {
+		return c, ErrCopyNotFound
+	}
+	r.copies[i] = c
+	return c, nil
+}
+
+func (r *memoryCopyRepository) Lend(ctx context.Context, id primitive.ObjectID) error {
+	return r.setAvailable(id, false)
+}
+
+func (r *memoryCopyRepository) Release(ctx context.Context, id primitive.ObjectID) error {
+	return r.setAvailable(id, true)
+}
+
+func (r *memoryCopyRepository) setAvailable(id primitive.ObjectID, available bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.copies, func(c Copy) bool { return c.ID == id })
+	if i < 0 {
+		return ErrCopyNotFound
+	}
+	if !available && !r.copies[i].Available {
+		return ErrCopyUnavailable
+	}
+	r.copies[i].Available = available
+	return nil
+}
+
+func (r *memoryCopyRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.copies, func(c Copy) bool { return c.ID == id })
+	if i < 0 {
+		return ErrCopyNotFound
+	}
+	r.copies = slices.Delete(r.copies, i, i+1)
+	return nil
+}
+
+func (r *memoryCopyRepository) DeleteByBooks(ctx context.Context, bookIDs []primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.copies = slices.DeleteFunc(r.copies, func(c Copy) bool { return slices.Contains(bookIDs, c.BookID) })
+	return nil
+}
+
+func (r *memoryCopyRepository) MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for i := range r.copies {
+		if slices.Contains(from, r.copies[i].BookID) {
+			r.copies[i].BookID = to
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Creates the index the copies of a book are looked up by.
+func prepareCopies(ctx context.Context, coll *mongo.Collection) error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "book_id", Value: 1}},
+		Options: options.Index().SetName("copies_book_id"),
+	}
+	return ensureIndexes(ctx, coll, index)
+}
+
+// Stores the copies in their own MongoDB collection.
+type mongoCopyRepository struct {
+	coll mongoCollection
+}
+
+func newMongoCopyRepository(coll *mongo.Collection) *mongoCopyRepository {
+	return &mongoCopyRepository{coll: withPolicy(coll)}
+}
+
+func (r *mongoCopyRepository) FindByBook(ctx context.Context, bookID primitive.ObjectID) ([]Copy, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := r.coll.Find(ctx, bson.M{"book_id": bookID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	copies := []Copy{}
+	if err = cursor.All(ctx, &copies); err != nil {
+		return nil, err
+	}
+	return copies, nil
+}
+
+func (r *mongoCopyRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Copy, error) {
+	var c Copy
+	err := r.coll.FindOne(ctx, bson.M{"_id": id}).Decode(&c)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return c, ErrCopyNotFound
+	}
+	return c, err
+}
+
+// Counts the copies of all the books in a single aggregation.
+func (r *mongoCopyRepository) Count(ctx context.Context, bookIDs []primitive.ObjectID) (map[primitive.ObjectID]CopyCount, error) {
+	counts := map[primitive.ObjectID]CopyCount{}
+	if len(bookIDs) == 0 {
+		return counts, nil
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"book_id": bson.M{"$in": bookIDs}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       "$book_id",
+			"total":     bson.M{"$sum": 1},
+			"available": bson.M{"$sum": bson.M{"$cond": bson.A{"$available", 1, 0}}},
+		}}},
+	}
+	cursor, err := r.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		BookID    primitive.ObjectID `bson:"_id"`
+		Total     int64              `bson:"total"`
+		Available int64              `bson:"available"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		counts[g.BookID] = CopyCount{Total: g.Total, Available: g.Available}
+	}
+	return counts, nil
+}
+
+func (r *mongoCopyRepository) Insert(ctx context.Context, c Copy) (Copy, error) {
+	c.ID = primitive.NewObjectID()
+	_, err := r.coll.InsertOne(ctx, c)
+	return c, err
+}
+
+func (r *mongoCopyRepository) Update(ctx context.Context, c Copy) (Copy, error) {
+	res, err := r.coll.ReplaceOne(ctx, bson.M{"_id": c.ID}, c)
+	if err != nil {
+		return c, err
+	}
+	if res.MatchedCount == 0 {
+		return c, ErrCopyNotFound
+	}
+	return c, nil
+}
+
+func (r *mongoCopyRepository) Lend(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.coll.UpdateOne(ctx,
+		bson.M{"_id": id, "available": true},
+		bson.M{"$set": bson.M{"available": false}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		if _, err := r.FindByID(ctx, id); err != nil {
+			return err
+		}
+		return ErrCopyUnavailable
+	}
+	return nil
+}
+
+func (r *mongoCopyRepository) Release(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"available": true}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrCopyNotFound
+	}
+	return nil
+}
+
+func (r *mongoCopyRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrCopyNotFound
+	}
+	return nil
+}
+
+func (r *mongoCopyRepository) DeleteByBooks(ctx context.Context, bookIDs []primitive.ObjectID) error {
+	if len(bookIDs) == 0 {
+		return nil
+	}
+	_, err := r.coll.DeleteMany(ctx, bson.M{"book_id": bson.M{"$in": bookIDs}})
+	return err
+}
+
+func (r *mongoCopyRepository) MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error) {
+	if len(from) == 0 {
+		return 0, nil
+	}
+	res, err := r.coll.UpdateMany(ctx, bson.M{"book_id": bson.M{"$in": from}}, bson.M{"$set": bson.M{"book_id": to}})
+	if err != nil {
+		return 0, err
+	}
+	return res.MatchedCount, nil
+}
+
+// Stores the copies in the copies table, see sqlMigrations.
+type sqlCopyRepository struct {
+	db *sql.DB
+}
+
+func newSQLCopyRepository(db *sql.DB) *sqlCopyRepository {
+	return &sqlCopyRepository{db: db}
+}
+
+const copyColumns = "id, book_id, condition, location, available, added_at"
+
+func scanCopy(row rowScanner) (Copy, error) {
+	var c Copy
+	var id, bookID string
+	if err := row.Scan(&id, &bookID, &c.Condition, &c.Location, &c.Available, &c.AddedAt); err != nil {
+		return c, err
+	}
+	var err error
+	if c.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return c, err
+	}
+	c.BookID, err = primitive.ObjectIDFromHex(bookID)
+	return c, err
+}
+
+func (r *sqlCopyRepository) FindByBook(ctx context.Context, bookID primitive.ObjectID) ([]Copy, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+copyColumns+" FROM copies WHERE book_id = $1 ORDER BY id", bookID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	copies := []Copy{}
+	for rows.Next() {
+		c, err := scanCopy(rows)
+		if err != nil {
+			return nil, err
+		}
+		copies = append(copies, c)
+	}
+	return copies, rows.Err()
+}
+
+func (r *sqlCopyRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Copy, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT "+copyColumns+" FROM copies WHERE id = $1", id.Hex())
+	c, err := scanCopy(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, ErrCopyNotFound
+	}
+	return c, err
+}
+
+func (r *sqlCopyRepository) Count(ctx context.Context, bookIDs []primitive.ObjectID) (map[primitive.ObjectID]CopyCount, error) {
+	counts := map[primitive.ObjectID]CopyCount{}
+	if len(bookIDs) == 0 {
+		return counts, nil
+	}
+	var args sqlArgs
+	query := "SELECT book_id, COUNT(*), SUM(CASE WHEN available THEN 1 ELSE 0 END) FROM copies" +
+		" WHERE book_id IN (" + idList(bookIDs, &args) + ") GROUP BY book_id"
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bookID string
+		var count CopyCount
+		if err := rows.Scan(&bookID, &count.Total, &count.Available); err != nil {
+			return nil, err
+		}
+		id, err := primitive.ObjectIDFromHex(bookID)
+		if err != nil {
+			return nil, err
+		}
+		counts[id] = count
+	}
+	return counts, rows.Err()
+}
+
+func (r *sqlCopyRepository) Insert(ctx context.Context, c Copy) (Copy, error) {
+	c.ID = primitive.NewObjectID()
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO copies ("+copyColumns+") VALUES ($1, $2, $3, $4, $5, $6)",
+		c.ID.Hex(), c.BookID.Hex(), c.Condition, c.Location, c.Available, c.AddedAt)
+	return c, err
+}
+
+func (r *sqlCopyRepository) Update(ctx context.Context, c Copy) (Copy, error) {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE copies SET condition = $1, location = $2, available = $3 WHERE id = $4",
+		c.Condition, c.Location, c.Available, c.ID.Hex())
+	if err != nil {
+		return c, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return c, err
+	} else if n == 0 {
+		return c, ErrCopyNotFound
+	}
+	return c, nil
+}
+
+func (r *sqlCopyRepository) Lend(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE copies SET available = $1 WHERE id = $2 AND available", false, id.Hex())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, err := r.FindByID(ctx, id); err != nil {
+			return err
+		}
+		return ErrCopyUnavailable
+	}
+	return nil
+}
+
+func (r *sqlCopyRepository) Release(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.db.ExecContext(ctx, "UPDATE copies SET available = $1 WHERE id = $2", true, id.Hex())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrCopyNotFound
+	}
+	return nil
+}
+
+func (r *sqlCopyRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM copies WHERE id = $1", id.Hex())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCopyNotFound
+	}
+	return nil
+}
+
+func (r *sqlCopyRepository) DeleteByBooks(ctx context.Context, bookIDs []primitive.ObjectID) error {
+	if len(bookIDs) == 0 {
+		return nil
+	}
+	var args sqlArgs
+	_, err := r.db.ExecContext(ctx, "DELETE FROM copies WHERE book_id IN ("+idList(bookIDs, &args)+")", args...)
+	return err
+}
+
+func (r *sqlCopyRepository) MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error) {
+	if len(from) == 0 {
+		return 0, nil
+	}
+	args := sqlArgs{to.Hex()}
+	res, err := r.db.ExecContext(ctx, "UPDATE copies SET book_id = $1 WHERE book_id IN ("+idList(from, &args)+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
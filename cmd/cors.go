@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Lets web apps served from other origins call /api, see CORSConfig. The
+// pages of the web UI are only ever loaded from the server itself and get
+// no CORS headers.
+
+// The response headers scripts of other origins may read besides the
+// basic ones such as Content-Type.
+var corsExposedHeaders = []string{headerETag, "X-Total-Count", "Link", "Retry-After", "X-Cache", headerReplayed}
+
+// Answers the preflight requests to /api and adds the CORS headers to the
+// responses for the allowed origins.
+func apiCORS(cfg CORSConfig) echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		Skipper: func(c echo.Context) bool {
+			return !strings.HasPrefix(c.Request().URL.Path, "/api/")
+		},
+		AllowOrigins:     cfg.AllowOrigins,
+		AllowMethods:     cfg.AllowMethods,
+		AllowHeaders:     cfg.AllowHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		ExposeHeaders:    corsExposedHeaders,
+		MaxAge:           int(cfg.MaxAge.Seconds()),
+	})
+}
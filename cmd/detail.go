@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The page of a single book, at /books/:id. Opened from the book table it
+// is swapped into the index page like every other page; opened directly,
+// e.g. from a bookmark, it comes within the index page. The page describes
+// the book to search engines as well, as a schema.org Book in JSON-LD; the
+// sitemap lists the pages of all books, see sitemap.go.
+
+// How many similar books the page of a book recommends.
+const detailSimilarBooks = 5
+
+// What the page of a book shows. Row is the book as a row of the book
+// table, which brings the edit and delete buttons along.
+type bookDetail struct {
+	Row      BookDTO
+	Name     string
+	Author   string
+	Genres   []string
+	Version  int64
+	Updated  string
+	CoverURL string
+	// The linked author, if any
+	AuthorInfo *Author
+	Copies     CopyCount
+	// The holds waiting for a copy to come back
+	Holds   int
+	Similar []BookDTO
+	// The book as a schema.org Book, see bookJSONLD
+	JSONLD template.JS
+}
+
+// A schema.org Book, as far as the catalog knows it.
+type schemaBook struct {
+	Context   string        `json:"@context"`
+	Type      string        `json:"@type"`
+	ID        string        `json:"@id"`
+	URL       string        `json:"url"`
+	Name      string        `json:"name"`
+	Author    *schemaPerson `json:"author,omitempty"`
+	ISBN      string        `json:"isbn,omitempty"`
+	Pages     int           `json:"numberOfPages,omitempty"`
+	Published string        `json:"datePublished,omitempty"`
+	Genres    []string      `json:"genre,omitempty"`
+	Image     string        `json:"image,omitempty"`
+	Modified  string        `json:"dateModified"`
+}
+
+type schemaPerson struct {
+	Type        string `json:"@type"`
+	Name        string `json:"name"`
+	BirthDate   string `json:"birthDate,omitempty"`
+	Nationality string `json:"nationality,omitempty"`
+}
+
+// The cover Open Library has for the ISBN. It answers with a blank image
+// for books it does not know.
+func coverURL(isbn string) string {
+	if isbn == "" {
+		return ""
+	}
+	return "https://covers.openlibrary.org/b/isbn/" + isbn + "-M.jpg"
+}
+
+func (s *server) bookDetailPage(c echo.Context) error {
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	book, err := s.books.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	detail := bookDetail{
+		Row:      bookRowView(c, newBookDTO(book)),
+		Name:     book.BookName,
+		Author:   book.BookAuthor,
+		Genres:   book.Genres,
+		Version:  book.Version,
+		Updated:  book.UpdatedAt.Format(time.DateOnly),
+		CoverURL: coverURL(book.BookISBN),
+	}
+	if !book.AuthorID.IsZero() {
+		author, err := s.authors.FindByID(ctx, book.AuthorID)
+		if err == nil {
+			detail.AuthorInfo = &author
+		} else if !errors.Is(err, ErrAuthorNotFound) {
+			return err
+		}
+	}
+	counts, err := s.copies.Count(ctx, []primitive.ObjectID{id})
+	if err != nil {
+		return err
+	}
+	detail.Copies = counts[id]
+	holds, err := s.reservations.FindAll(ctx, ReservationQuery{BookID: id, Statuses: []ReservationStatus{ReservationWaiting}})
+	if err != nil {
+		return err
+	}
+	detail.Holds = len(holds)
+	similar, err := s.books.Similar(ctx, book, detailSimilarBooks)
+	if err != nil {
+		return err
+	}
+	for _, h := range similar {
+		detail.Similar = append(detail.Similar, newBookDTO(h.BookStore))
+	}
+
+	url := strings.TrimSuffix(s.publicURL, "/") + "/books/" + book.ID.Hex()
+	if detail.JSONLD, err = bookJSONLD(book, detail.AuthorInfo, url); err != nil {
+		return err
+	}
+
+	if c.Request().Header.Get("HX-Request") == "true" {
+		return c.Render(http.StatusOK, "book-detail", detail)
+	}
+	return c.Render(http.StatusOK, "index", s.indexView(c, &detail))
+}
+
+// Describes the book at url in JSON-LD, for the script in its page. The
+// linked author, if any, tells more about the author than the name of the
+// book does. The JSON encoder escapes <, > and &, so nothing in it can end
+// the script early.
+func bookJSONLD(book BookStore, author *Author, url string) (template.JS, error) {
+	ld := schemaBook{
+		Context:  "https://schema.org",
+		Type:     "Book",
+		ID:       url,
+		URL:      url,
+		Name:     book.BookName,
+		ISBN:     book.BookISBN,
+		Pages:    book.BookPages,
+		Genres:   book.Genres,
+		Image:    coverURL(book.BookISBN),
+		Modified: book.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+	if book.BookYear > 0 {
+		ld.Published = strconv.Itoa(book.BookYear)
+	}
+	if author != nil {
+		ld.Author = &schemaPerson{Type: "Person", Name: author.Name, Nationality: author.Nationality}
+		if author.BirthYear != nil {
+			ld.Author.BirthDate = strconv.Itoa(*author.BirthYear)
+		}
+	} else if book.BookAuthor != "" {
+		ld.Author = &schemaPerson{Type: "Person", Name: book.BookAuthor}
+	}
+	data, err := json.Marshal(ld)
+	return template.JS(data), err
+}
+
+// What the index page shows: who is logged in and how else they could
+// log in, whether they may see the admin dashboard, and the book whose
+// page was opened directly, if any.
+func (s *server) indexView(c echo.Context, book *bookDetail) map[string]interface{} {
+	return map[string]interface{}{
+		"User":      currentUser(c),
+		"Providers": s.oauthProviders,
+		"CSRF":      csrfToken(c),
+		"Book":      book,
+		"CanAdmin":  hasScope(c, ScopeUsersManage),
+	}
+}
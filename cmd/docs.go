@@ -0,0 +1,43 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The OpenAPI description of everything under /api. Keep it in sync with
+// registerRoutes whenever an endpoint changes.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// Swagger UI is loaded from unpkg, the same way the index page loads htmx,
+// and pointed at our own specification.
+const swaggerPage = `<!DOCTYPE html>
+<html>
+<head>
+  <title>Book Store API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css" />
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.onload = () => {
+      window.ui = SwaggerUIBundle({ url: "/openapi.yaml", dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>
+`
+
+func registerDocs(e *echo.Echo) {
+	e.GET("/openapi.yaml", func(c echo.Context) error {
+		return c.Blob(http.StatusOK, "application/yaml", openAPISpec)
+	})
+	e.GET("/swagger", func(c echo.Context) error {
+		return c.HTML(http.StatusOK, swaggerPage)
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Probable duplicates are books by the same author whose titles are the
+// same or nearly so once normalized, or whose ISBNs differ by a single
+// typo. Normalizing drops case, punctuation, parts in parentheses such as
+// "(Paperback)" and a leading article, and puts the author's names in
+// order, so "Herbert, Frank" is Frank Herbert. The databases cannot
+// normalize like that, so the books are grouped here, by author first,
+// and only the books of an author are compared with each other.
+//
+// Pairs of books score from 0 to 1 by how alike their titles are; an
+// ISBN typo scores at least isbnTypoScore. The books of a cluster
+// are scored against its first book, the one suggested to merge the
+// others into, see merge.go.
+
+// The default of ?min_score=.
+const defaultDuplicateScore = 0.8
+
+// What two books with ISBNs a typo apart score at least.
+const isbnTypoScore = 0.9
+
+// Clusters per page of /api/books/duplicates unless ?limit= says
+// otherwise.
+const defaultDuplicateLimit = 50
+
+// Probable duplicates, the suggested primary first. Score is the lowest
+// score of the others.
+type DuplicateCluster struct {
+	Score float64   `json:"score"`
+	Books []BookDTO `json:"books"`
+}
+
+// Words that start titles without telling them apart.
+var leadingArticles = []string{"the", "a", "an", "der", "die", "das", "le", "la", "les", "el"}
+
+func normalizeTitle(title string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range title {
+		switch r {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth = max(0, depth-1)
+		default:
+			if depth == 0 {
+				b.WriteRune(r)
+			}
+		}
+	}
+	words := fuzzyWords(b.String())
+	if len(words) > 1 && slices.Contains(leadingArticles, words[0]) {
+		words = words[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+func normalizeAuthorName(author string) string {
+	words := fuzzyWords(author)
+	slices.Sort(words)
+	return strings.Join(words, " ")
+}
+
+// How alike two normalized strings are, from 0 to 1 by their edit
+// distance.
+func textSimilarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	longest := max(utf8.RuneCountInString(a), utf8.RuneCountInString(b))
+	d, _ := editDistance(a, b, longest)
+	return 1 - float64(d)/float64(longest)
+}
+
+// Reports whether both ISBNs are set and a single typo apart. The prefix
+// and the check digit are left out, as a typo in the body changes the
+// check digit as well.
+func isbnTypo(a, b string) bool {
+	if len(a) != 13 || len(b) != 13 || a == b {
+		return false
+	}
+	d, ok := editDistance(a[3:12], b[3:12], 1)
+	return ok && d == 1
+}
+
+// A book as it is compared.
+type duplicateCandidate struct {
+	book   BookStore
+	title  string
+	author string
+}
+
+// The books of a cluster, the suggested primary first.
+type duplicateGroup []duplicateCandidate
+
+// The score of the i-th book against the first, rounded for the API.
+func (g duplicateGroup) scoreOf(i int) float64 {
+	if i == 0 {
+		return 1
+	}
+	return math.Round(duplicateScore(g[0], g[i])*1000) / 1000
+}
+
+// The lowest score of the books.
+func (g duplicateGroup) score() float64 {
+	score := 1.0
+	for i := range g[1:] {
+		score = min(score, g.scoreOf(i+1))
+	}
+	return score
+}
+
+func duplicateScore(a, b duplicateCandidate) float64 {
+	score := textSimilarity(a.title, b.title)
+	if isbnTypo(a.book.BookISBN, b.book.BookISBN) {
+		score = max(score, isbnTypoScore)
+	}
+	return score
+}
+
+// Orders the books of a cluster: books with an ISBN, then those linked to
+// an author, then the oldest first.
+func comparePrimaries(a, b duplicateCandidate) int {
+	rank := func(c duplicateCandidate) int {
+		n := 0
+		if c.book.BookISBN != "" {
+			n += 2
+		}
+		if !c.book.AuthorID.IsZero() {
+			n++
+		}
+		return n
+	}
+	return cmp.Or(cmp.Compare(rank(b), rank(a)), a.book.CreatedAt.Compare(b.book.CreatedAt), cmp.Compare(a.book.ID.Hex(), b.book.ID.Hex()))
+}
+
+// Clusters the books, see the top of this file. Books of the same author
+// scoring at least minScore end up in the same cluster, also through
+// others, which is why a cluster may score less.
+func findDuplicates(books []BookStore, minScore float64) []duplicateGroup {
+	byAuthor := map[string][]duplicateCandidate{}
+	for _, b := range books {
+		c := duplicateCandidate{book: b, title: normalizeTitle(b.BookName), author: normalizeAuthorName(b.BookAuthor)}
+		byAuthor[c.author] = append(byAuthor[c.author], c)
+	}
+
+	var clusters []duplicateGroup
+	for _, candidates := range byAuthor {
+		// Union-find over the books of the author
+		parent := make([]int, len(candidates))
+		for i := range parent {
+			parent[i] = i
+		}
+		var root func(int) int
+		root = func(i int) int {
+			if parent[i] != i {
+				parent[i] = root(parent[i])
+			}
+			return parent[i]
+		}
+		for i := range candidates {
+			for j := i + 1; j < len(candidates); j++ {
+				if duplicateScore(candidates[i], candidates[j]) >= minScore {
+					parent[root(j)] = root(i)
+				}
+			}
+		}
+		groups := map[int]duplicateGroup{}
+		for i, c := range candidates {
+			groups[root(i)] = append(groups[root(i)], c)
+		}
+		for _, g := range groups {
+			if len(g) > 1 {
+				slices.SortFunc(g, comparePrimaries)
+				clusters = append(clusters, g)
+			}
+		}
+	}
+	return clusters
+}
+
+func parseMinScore(c echo.Context) (float64, error) {
+	raw := c.QueryParam("min_score")
+	if raw == "" {
+		return defaultDuplicateScore, nil
+	}
+	score, err := strconv.ParseFloat(raw, 64)
+	if err != nil || score <= 0 || score > 1 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "min_score must be a number above 0 and at most 1")
+	}
+	return score, nil
+}
+
+// Lists the clusters of probable duplicates, the most certain first.
+func (s *server) listDuplicates(c echo.Context) error {
+	minScore, err := parseMinScore(c)
+	if err != nil {
+		return err
+	}
+	page, err := parsePagination(c, defaultDuplicateLimit)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	var books []BookStore
+	err = s.books.Each(ctx, BookQuery{Page: 1, Limit: 0}, func(b BookStore) error {
+		books = append(books, b)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	found := findDuplicates(books, minScore)
+	slices.SortFunc(found, func(a, b duplicateGroup) int {
+		return cmp.Or(cmp.Compare(b.score(), a.score()), cmp.Compare(len(b), len(a)), cmp.Compare(a[0].book.ID.Hex(), b[0].book.ID.Hex()))
+	})
+	total := int64(len(found))
+	start := min((page.Page-1)*page.Limit, len(found))
+	end := min(start+page.Limit, len(found))
+	result := make([]DuplicateCluster, 0, end-start)
+	for _, g := range found[start:end] {
+		cluster, err := s.duplicateCluster(ctx, g)
+		if err != nil {
+			return err
+		}
+		result = append(result, cluster)
+	}
+	setPaginationHeaders(c, newBookPage(c, page, nil, total))
+	return c.JSON(http.StatusOK, result)
+}
+
+// Converts the books of a cluster for the API, each with its score.
+func (s *server) duplicateCluster(ctx context.Context, g duplicateGroup) (DuplicateCluster, error) {
+	books := make([]BookStore, len(g))
+	for i, c := range g {
+		books[i] = c.book
+	}
+	dtos, err := s.bookDTOs(ctx, books)
+	if err != nil {
+		return DuplicateCluster{}, err
+	}
+	for i := range dtos {
+		score := g.scoreOf(i)
+		dtos[i].Score = &score
+	}
+	return DuplicateCluster{Score: g.score(), Books: dtos}, nil
+}
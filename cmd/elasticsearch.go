@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Answers the searches from Elasticsearch or OpenSearch instead of the
+// database, for catalogs too large for the text indexes of the database.
+// Both are talked to through their REST API, which they share.
+//
+// The books are indexed under an alias pointing at a concrete index like
+// books-1700000000000. A reindex fills a new index and then moves the
+// alias over, so searches go on while it runs. Changes to the books reach
+// the index through the book events, see follow.
+
+// How long a single request to Elasticsearch may take. Bulk requests of a
+// reindex carry reindexBatchSize books each, so this holds for them too.
+const elasticsearchTimeout = 30 * time.Second
+
+// How many books a reindex reads from the database and sends to
+// Elasticsearch at once.
+const reindexBatchSize = 500
+
+// How many hits Elasticsearch returns at most, its index.max_result_window
+// by default. A search without a limit stops there.
+const maxElasticsearchHits = 10000
+
+// Only the fields searched, filtered or counted on are indexed, the others
+// are merely kept in the _source.
+var elasticsearchMapping = map[string]interface{}{
+	"mappings": map[string]interface{}{
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "text"},
+			"author": map[string]interface{}{
+				"type":   "text",
+				"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword"}},
+			},
+			"isbn":   map[string]interface{}{"type": "keyword"},
+			"year":   map[string]interface{}{"type": "integer"},
+			"genres": map[string]interface{}{"type": "keyword"},
+		},
+	},
+}
+
+// An error answer of Elasticsearch.
+type elasticsearchError struct {
+	Status int
+	Type   string
+	Reason string
+}
+
+func (e *elasticsearchError) Error() string {
+	return fmt.Sprintf("elasticsearch: %d %s: %s", e.Status, e.Type, e.Reason)
+}
+
+// Reads the error from an answer. Most errors come as an object, some,
+// like a missing alias, as a plain string.
+func readElasticsearchError(res *http.Response) error {
+	var body struct {
+		Error json.RawMessage `json:"error"`
+	}
+	e := &elasticsearchError{Status: res.StatusCode, Reason: res.Status}
+	if json.NewDecoder(res.Body).Decode(&body) != nil {
+		return e
+	}
+	var cause struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	}
+	if json.Unmarshal(body.Error, &cause) == nil {
+		e.Type, e.Reason = cause.Type, cause.Reason
+	} else {
+		json.Unmarshal(body.Error, &e.Reason)
+	}
+	return e
+}
+
+func isNotFound(err error) bool {
+	var esErr *elasticsearchError
+	return errors.As(err, &esErr) && esErr.Status == http.StatusNotFound
+}
+
+type elasticsearchIndex struct {
+	client  *http.Client
+	baseURL string
+	alias   string
+
+	// Held by a reindex from start to end and by follow for every batch
+	// of changes, so changes made during a reindex reach the new index
+	mu sync.Mutex
+}
+
+func newElasticsearchIndex(cfg SearchConfig) *elasticsearchIndex {
+	return &elasticsearchIndex{
+		client:  &http.Client{Timeout: elasticsearchTimeout},
+		baseURL: strings.TrimSuffix(cfg.ElasticsearchURL, "/"),
+		alias:   cfg.Index,
+	}
+}
+
+// Sends body, which is marshalled unless it is a reader already, and
+// decodes the answer into v unless that is nil. Credentials in the URL
+// are sent as basic auth by the client.
+func (x *elasticsearchIndex) do(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	contentType := echo.MIMEApplicationJSON
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader, contentType = b, "application/x-ndjson"
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, x.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderContentType, contentType)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	res, err := x.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		return readElasticsearchError(res)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Appends the action putting the book into the index, or taking it out if
+// it is in the trash, to a bulk request.
+func appendBulkAction(buf *bytes.Buffer, b BookStore) error {
+	enc := json.NewEncoder(buf)
+	if b.DeletedAt != nil {
+		return enc.Encode(map[string]interface{}{"delete": map[string]string{"_id": b.ID.Hex()}})
+	}
+	if err := enc.Encode(map[string]interface{}{"index": map[string]string{"_id": b.ID.Hex()}}); err != nil {
+		return err
+	}
+	return enc.Encode(b)
+}
+
+// Sends the actions in buf to the index. Elasticsearch answers 200 even if
+// single actions failed; the first of those is returned. Deleting books
+// the index does not know is no failure.
+func (x *elasticsearchIndex) bulk(ctx context.Context, index string, buf *bytes.Buffer) error {
+	var res struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	// Writing through the alias must not create an index of that name if
+	// the alias is missing
+	if err := x.do(ctx, http.MethodPost, "/"+index+"/_bulk?require_alias="+fmt.Sprint(index == x.alias), buf, &res); err != nil {
+		return err
+	}
+	if !res.Errors {
+		return nil
+	}
+	for _, item := range res.Items {
+		for action, result := range item {
+			if result.Error == nil || (action == "delete" && result.Status == http.StatusNotFound) {
+				continue
+			}
+			return &elasticsearchError{Status: result.Status, Type: result.Error.Type, Reason: result.Error.Reason}
+		}
+	}
+	return nil
+}
+
+// Builds the index anew from the books in the database and moves the alias
+// over to it, then deletes the indexes it pointed at before. Returns the
+// name of the new index and how many books went into it.
+func (x *elasticsearchIndex) Reindex(ctx context.Context, books BookRepository) (string, int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	index := fmt.Sprintf("%s-%d", x.alias, time.Now().UnixMilli())
+	if err := x.do(ctx, http.MethodPut, "/"+index, elasticsearchMapping, nil); err != nil {
+		return "", 0, err
+	}
+	count, err := x.fill(ctx, index, books)
+	if err == nil {
+		err = x.moveAlias(ctx, index)
+	}
+	if err != nil {
+		if delErr := x.do(context.WithoutCancel(ctx), http.MethodDelete, "/"+index, nil, nil); delErr != nil {
+			log.Printf("Failed to delete the unfinished search index %s: %v", index, delErr)
+		}
+		return "", 0, err
+	}
+	return index, count, nil
+}
+
+// Copies the books into the index, a batch at a time.
+func (x *elasticsearchIndex) fill(ctx context.Context, index string, books BookRepository) (int, error) {
+	q := BookQuery{Limit: reindexBatchSize, Sort: []SortField{{Field: "name"}}}
+	count := 0
+	for q.Page = 1; ; q.Page++ {
+		dbCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+		batch, _, err := books.FindAll(dbCtx, q)
+		cancel()
+		if err != nil {
+			return count, err
+		}
+		if len(batch) > 0 {
+			var buf bytes.Buffer
+			for _, b := range batch {
+				if err := appendBulkAction(&buf, b); err != nil {
+					return count, err
+				}
+			}
+			if err := x.bulk(ctx, index, &buf); err != nil {
+				return count, err
+			}
+			count += len(batch)
+		}
+		if len(batch) < reindexBatchSize {
+			return count, nil
+		}
+	}
+}
+
+// Points the alias at the index alone, in a single step, and deletes the
+// indexes it pointed at before.
+func (x *elasticsearchIndex) moveAlias(ctx context.Context, index string) error {
+	var current map[string]interface{}
+	if err := x.do(ctx, http.MethodGet, "/_alias/"+x.alias, nil, &current); err != nil && !isNotFound(err) {
+		return err
+	}
+	actions := []interface{}{}
+	for old := range current {
+		actions = append(actions, map[string]interface{}{"remove": map[string]string{"index": old, "alias": x.alias}})
+	}
+	actions = append(actions, map[string]interface{}{"add": map[string]string{"index": index, "alias": x.alias}})
+	if err := x.do(ctx, http.MethodPost, "/_aliases", map[string]interface{}{"actions": actions}, nil); err != nil {
+		return err
+	}
+
+	for old := range current {
+		if err := x.do(ctx, http.MethodDelete, "/"+old, nil, nil); err != nil && !isNotFound(err) {
+			log.Printf("Failed to delete the old search index %s: %v", old, err)
+		}
+	}
+	return nil
+}
+
+// Reports whether the alias exists, i.e. the books were indexed before.
+func (x *elasticsearchIndex) exists(ctx context.Context) (bool, error) {
+	err := x.do(ctx, http.MethodHead, "/_alias/"+x.alias, nil, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Keeps the index up to date with the changes to the books until the
+// process ends. It builds the index first if there is none yet, and
+// anew whenever changes may have been missed: when the subscription was
+// dropped or a batch of changes could not be indexed.
+func (x *elasticsearchIndex) follow(books BookRepository, events *bookEvents) {
+	ctx, cancel := context.WithTimeout(context.Background(), elasticsearchTimeout)
+	exists, err := x.exists(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("Failed to reach Elasticsearch: %v", err)
+	}
+	stale := !exists
+
+	for {
+		ch, unsubscribe := events.Subscribe()
+		if stale {
+			index, count, err := x.Reindex(context.Background(), books)
+			if err != nil {
+				log.Printf("Failed to build the search index, retrying in a minute: %v", err)
+				unsubscribe()
+				time.Sleep(time.Minute)
+				continue
+			}
+			log.Printf("Indexed %d books in %s", count, index)
+			stale = false
+		}
+		for e := range ch {
+			if err := x.apply(append([]BookEvent{e}, pending(ch)...)); err != nil {
+				log.Printf("Failed to index the changed books, rebuilding the search index: %v", err)
+				break
+			}
+		}
+		unsubscribe()
+		stale = true
+	}
+}
+
+// Takes the events already waiting in the channel, without blocking.
+func pending(ch <-chan BookEvent) []BookEvent {
+	var events []BookEvent
+	for len(events) < reindexBatchSize {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return events
+			}
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+	return events
+}
+
+// Sends the changed books to the index in one bulk request.
+func (x *elasticsearchIndex) apply(events []BookEvent) error {
+	var buf bytes.Buffer
+	for _, e := range events {
+		b := e.Book
+		if e.Type == BookDeleted {
+			b = BookStore{ID: b.ID, DeletedAt: &e.At}
+		}
+		if err := appendBulkAction(&buf, b); err != nil {
+			return err
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), elasticsearchTimeout)
+	defer cancel()
+	return x.bulk(ctx, x.alias, &buf)
+}
+
+// The query matching the text in the name, the author or the ISBN, and
+// matching the filter.
+func elasticsearchQuery(text string, f SearchFilter) map[string]interface{} {
+	filters := []interface{}{}
+	if f.Author != "" {
+		filters = append(filters, map[string]interface{}{"term": map[string]interface{}{"author.keyword": f.Author}})
+	}
+	if f.Genre != "" {
+		filters = append(filters, map[string]interface{}{"term": map[string]interface{}{"genres": f.Genre}})
+	}
+	if f.Decade != nil {
+		filters = append(filters, map[string]interface{}{"range": map[string]interface{}{
+			"year": map[string]int{"gte": *f.Decade, "lt": *f.Decade + 10},
+		}})
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{
+		"must": map[string]interface{}{"multi_match": map[string]interface{}{
+			"query":  text,
+			"fields": []string{"name", "author", "isbn"},
+		}},
+		"filter": filters,
+	}}
+}
+
+type elasticsearchHits struct {
+	Hits []struct {
+		Score  float64   `json:"_score"`
+		Source BookStore `json:"_source"`
+	} `json:"hits"`
+}
+
+func (h elasticsearchHits) searchHits() []SearchHit {
+	hits := []SearchHit{}
+	for _, hit := range h.Hits {
+		hits = append(hits, SearchHit{BookStore: hit.Source, Score: hit.Score})
+	}
+	return hits
+}
+
+func searchSize(limit int) int {
+	if limit <= 0 || limit > maxElasticsearchHits {
+		return maxElasticsearchHits
+	}
+	return limit
+}
+
+func (x *elasticsearchIndex) Search(ctx context.Context, text string, limit int) ([]SearchHit, error) {
+	var res struct {
+		Hits elasticsearchHits `json:"hits"`
+	}
+	query := map[string]interface{}{"size": searchSize(limit), "query": elasticsearchQuery(text, SearchFilter{})}
+	if err := x.do(ctx, http.MethodPost, "/"+x.alias+"/_search", query, &res); err != nil {
+		return nil, err
+	}
+	return res.Hits.searchHits(), nil
+}
+
+// Counts the facets with aggregations next to the hits. Decades are
+// buckets of a histogram over the years, whose keys are the first years of
+// the decades just like decadeOf returns them.
+func (x *elasticsearchIndex) FacetedSearch(ctx context.Context, text string, f SearchFilter, limit int) (SearchResult, error) {
+	type bucket[K any] struct {
+		Key      K     `json:"key"`
+		DocCount int64 `json:"doc_count"`
+	}
+	var res struct {
+		Hits         elasticsearchHits `json:"hits"`
+		Aggregations struct {
+			Authors struct{ Buckets []bucket[string] }  `json:"authors"`
+			Decades struct{ Buckets []bucket[float64] } `json:"decades"`
+			Genres  struct{ Buckets []bucket[string] }  `json:"genres"`
+		} `json:"aggregations"`
+	}
+	query := map[string]interface{}{
+		"size":  searchSize(limit),
+		"query": elasticsearchQuery(text, f),
+		"aggs": map[string]interface{}{
+			"authors": map[string]interface{}{"terms": map[string]interface{}{"field": "author.keyword", "size": maxFacetValues}},
+			"decades": map[string]interface{}{"histogram": map[string]interface{}{"field": "year", "interval": 10, "min_doc_count": 1}},
+			"genres":  map[string]interface{}{"terms": map[string]interface{}{"field": "genres", "size": maxFacetValues}},
+		},
+	}
+	if err := x.do(ctx, http.MethodPost, "/"+x.alias+"/_search", query, &res); err != nil {
+		return SearchResult{}, err
+	}
+
+	// Ordered like facetHits orders them
+	authors, decades, genres := map[string]int64{}, map[int]int64{}, map[string]int64{}
+	for _, b := range res.Aggregations.Authors.Buckets {
+		authors[b.Key] = b.DocCount
+	}
+	for _, b := range res.Aggregations.Decades.Buckets {
+		decades[int(b.Key)] = b.DocCount
+	}
+	for _, b := range res.Aggregations.Genres.Buckets {
+		genres[b.Key] = b.DocCount
+	}
+	return SearchResult{
+		Hits: res.Hits.searchHits(),
+		Facets: SearchFacets{
+			Authors: topFacets(authors, func(author string, n int64) AuthorCount {
+				return AuthorCount{Author: author, Books: n}
+			}),
+			Decades: topFacets(decades, func(decade int, n int64) DecadeCount {
+				return DecadeCount{Decade: decade, Books: n}
+			}),
+			Genres: topFacets(genres, func(genre string, n int64) GenreCount {
+				return GenreCount{Genre: genre, Books: n}
+			}),
+		},
+	}, nil
+}
+
+// Searches with Elasticsearch, and with the database while Elasticsearch
+// cannot answer, e.g. before the index is first built.
+type elasticBookRepository struct {
+	BookRepository
+	index *elasticsearchIndex
+}
+
+func (r *elasticBookRepository) Search(ctx context.Context, text string, limit int) ([]SearchHit, error) {
+	hits, err := r.index.Search(ctx, text, limit)
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Elasticsearch failed, searching the database instead: %v", err)
+		return r.BookRepository.Search(ctx, text, limit)
+	}
+	return hits, err
+}
+
+func (r *elasticBookRepository) FacetedSearch(ctx context.Context, text string, f SearchFilter, limit int) (SearchResult, error) {
+	res, err := r.index.FacetedSearch(ctx, text, f, limit)
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Elasticsearch failed, searching the database instead: %v", err)
+		return r.BookRepository.FacetedSearch(ctx, text, f, limit)
+	}
+	return res, err
+}
+
+// Builds the search index anew from the database, e.g. after changing its
+// mapping or after Elasticsearch lost it. Searches are answered from the
+// old index until the new one is complete.
+func (s *server) reindexSearch(c echo.Context) error {
+	index, count, err := s.search.Reindex(c.Request().Context(), s.books)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "The search index could not be built").SetInternal(err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"index": index, "books": count})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The body of every error response. Details is optional and carries
+// whatever helps the client to fix its request, e.g. the offending fields.
+type APIError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+func newAPIError(code int, message string, details interface{}) *APIError {
+	return &APIError{Code: code, Message: message, Details: details}
+}
+
+// Status codes for the errors the repositories report. Anything not listed
+// here, and not already an HTTP error, is a failure on our side.
+var errorStatus = map[error]int{
+	ErrBookNotFound:         http.StatusNotFound,
+	ErrDuplicateBook:        http.StatusConflict,
+	ErrVersionConflict:      http.StatusConflict,
+	ErrAuthorNotFound:       http.StatusNotFound,
+	ErrGenreNotFound:        http.StatusNotFound,
+	ErrDuplicateGenre:       http.StatusConflict,
+	ErrCopyNotFound:         http.StatusNotFound,
+	ErrCopyUnavailable:      http.StatusConflict,
+	ErrLoanNotFound:         http.StatusNotFound,
+	ErrLoanReturned:         http.StatusConflict,
+	ErrReservationNotFound:  http.StatusNotFound,
+	ErrDuplicateReservation: http.StatusConflict,
+	ErrReservationClosed:    http.StatusConflict,
+	ErrShelfNotFound:        http.StatusNotFound,
+	ErrDuplicateShelf:       http.StatusConflict,
+	ErrSavedSearchNotFound:  http.StatusNotFound,
+	ErrDuplicateSavedSearch: http.StatusConflict,
+	ErrProgressNotFound:     http.StatusNotFound,
+	ErrMetadataNotFound:     http.StatusNotFound,
+	ErrUserNotFound:         http.StatusNotFound,
+	ErrAPIKeyNotFound:       http.StatusNotFound,
+	ErrWebhookNotFound:      http.StatusNotFound,
+	ErrRevisionNotFound:     http.StatusNotFound,
+	ErrTenantNotFound:       http.StatusNotFound,
+	ErrDuplicateTenant:      http.StatusConflict,
+	ErrDuplicateUser:        http.StatusConflict,
+	ErrInvalidCredentials:   http.StatusUnauthorized,
+	ErrCodeRequired:         http.StatusUnauthorized,
+	ErrInvalidCode:          http.StatusUnauthorized,
+}
+
+// Turns any error into an APIError. Handlers can therefore simply return
+// the errors they get from the repositories.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return newAPIError(http.StatusUnprocessableEntity, "Validation failed", validationErr.Fields)
+	}
+
+	var duplicateErr *DuplicateBookError
+	if errors.As(err, &duplicateErr) {
+		return newAPIError(http.StatusConflict, err.Error(), map[string]string{"id": duplicateErr.ExistingID.Hex()})
+	}
+
+	// Errors of reading the body, such as those of c.Bind, come wrapped
+	// into other errors
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return bodyTooLarge(tooLarge.Limit)
+	}
+
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		var details interface{}
+		if inner, ok := httpErr.Internal.(*echo.HTTPError); ok {
+			// Errors of c.Bind are HTTP errors themselves
+			details = fmt.Sprint(inner.Message)
+		} else if httpErr.Internal != nil {
+			details = httpErr.Internal.Error()
+		}
+		return newAPIError(httpErr.Code, fmt.Sprint(httpErr.Message), details)
+	}
+
+	var mongoErr *MongoError
+	if errors.As(err, &mongoErr) && mongoErr.Unavailable() {
+		return newAPIError(http.StatusServiceUnavailable, "The database is unavailable, please try again later", nil)
+	}
+
+	for target, code := range errorStatus {
+		if errors.Is(err, target) {
+			return newAPIError(code, err.Error(), nil)
+		}
+	}
+
+	return newAPIError(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), nil)
+}
+
+// The formats errors are answered in, see APIConfig.
+const (
+	errorFormatEnvelope = "envelope"
+	errorFormatProblem  = "problem"
+)
+
+const mimeProblemJSON = "application/problem+json"
+
+// An error as RFC 7807 lays it out, for the problem error format. Errors
+// carries the details of the APIError, as an extension member.
+type Problem struct {
+	Type     string      `json:"type"`
+	Title    string      `json:"title"`
+	Status   int         `json:"status"`
+	Detail   string      `json:"detail,omitempty"`
+	Instance string      `json:"instance,omitempty"`
+	Errors   interface{} `json:"errors,omitempty"`
+}
+
+// The error as a problem that occurred at the path. Errors are told apart
+// by their status code alone, so the type is about:blank, which makes the
+// title the text of the status.
+func (e *APIError) problem(path string) Problem {
+	return Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(e.Code),
+		Status:   e.Code,
+		Detail:   e.Message,
+		Instance: path,
+		Errors:   e.Details,
+	}
+}
+
+// Replaces echo's default error handler, so every failure, including
+// unknown routes, answers with the same JSON shape and a meaningful
+// status: the APIError envelope, or a Problem in the problem format.
+func httpErrorHandler(format string) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if c.Response().Committed {
+			return
+		}
+
+		apiErr := toAPIError(err)
+		if apiErr.Code >= http.StatusInternalServerError {
+			// The client only gets a generic message; the real cause ends
+			// up in our logs.
+			c.Logger().Error(err)
+		}
+
+		switch {
+		case c.Request().Method == http.MethodHead:
+			err = c.NoContent(apiErr.Code)
+		case format == errorFormatProblem:
+			var body []byte
+			body, err = json.Marshal(apiErr.problem(c.Request().URL.Path))
+			if err == nil {
+				err = c.Blob(apiErr.Code, mimeProblemJSON, body)
+			}
+		default:
+			err = c.JSON(apiErr.Code, apiErr)
+		}
+		if err != nil {
+			c.Logger().Error(err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	headerETag        = "ETag"
+	headerIfMatch     = "If-Match"
+	headerIfNoneMatch = "If-None-Match"
+)
+
+// Derives a strong entity tag from the body of a response. The total count
+// of listings goes into the tag as well, since the same page may belong to
+// a longer list.
+func etagOf(c echo.Context, body []byte) string {
+	h := sha256.New()
+	h.Write(body)
+	h.Write([]byte(c.Response().Header().Get("X-Total-Count")))
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// Reports whether the tag is listed in an If-Match or If-None-Match header.
+// Weak comparison ignores the W/ prefix, as If-None-Match requires; If-Match
+// compares strongly, and a weak tag never matches there.
+func etagMatches(header, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Answers with v as JSON and its entity tag. If the client already has
+// that very content, as its If-None-Match header says, it gets a 304
+// without a body instead.
+func jsonWithETag(c echo.Context, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tag := etagOf(c, body)
+	c.Response().Header().Set(headerETag, tag)
+	if header := c.Request().Header.Get(headerIfNoneMatch); header != "" && etagMatches(header, tag, true) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(http.StatusOK, body)
+}
+
+// Answers a write with the changed resource and its entity tag, which the
+// client can send as If-Match on its next write.
+func taggedJSON(c echo.Context, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(headerETag, etagOf(c, body))
+	return c.JSONBlob(http.StatusOK, body)
+}
+
+// Returns the entity tag of the book as /api/books/:id serves it.
+func (s *server) bookETag(ctx context.Context, c echo.Context, book BookStore) (string, error) {
+	books, err := s.bookDTOs(ctx, []BookStore{book})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(books[0])
+	if err != nil {
+		return "", err
+	}
+	return etagOf(c, body), nil
+}
+
+// Honours the If-Match header of a write: unless the book is still the
+// one the client read, the write is refused with 412. On a match the
+// version of that book is returned, and the write should be made
+// conditional on it, so a change that sneaks in between the check and the
+// write is caught as well. Writes without the header go through as always
+// and get version 0.
+func (s *server) checkIfMatch(ctx context.Context, c echo.Context, id primitive.ObjectID) (int64, error) {
+	header := c.Request().Header.Get(headerIfMatch)
+	if header == "" {
+		return 0, nil
+	}
+	book, err := s.books.FindByID(ctx, id)
+	if errors.Is(err, ErrBookNotFound) {
+		return 0, echo.NewHTTPError(http.StatusPreconditionFailed, "The book does not exist")
+	}
+	if err != nil {
+		return 0, err
+	}
+	tag, err := s.bookETag(ctx, c, book)
+	if err != nil {
+		return 0, err
+	}
+	if !etagMatches(header, tag, false) {
+		return 0, echo.NewHTTPError(http.StatusPreconditionFailed, "The book was changed in the meantime; fetch it again and retry")
+	}
+	return book.Version, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type BookEventType string
+
+const (
+	BookCreated BookEventType = "created"
+	BookUpdated BookEventType = "updated"
+	BookDeleted BookEventType = "deleted"
+)
+
+// A change to the catalog. Book is the book after the change; of deleted
+// books only the ID is set.
+type BookEvent struct {
+	Type BookEventType `json:"type"`
+	Book BookStore     `json:"book"`
+	At   time.Time     `json:"at"`
+}
+
+// Converts the event for the API, with the book in the format of
+// /api/books.
+func bookEventJSON(e BookEvent) map[string]interface{} {
+	return map[string]interface{}{
+		"type": e.Type,
+		"book": newBookDTO(e.Book),
+		"at":   e.At,
+	}
+}
+
+// How many events a subscriber may fall behind before it is dropped.
+const bookEventBuffer = 256
+
+// Hands the changes to the catalog to everyone who subscribed, see
+// watchBooks for where they come from.
+type bookEvents struct {
+	mu   sync.Mutex
+	subs map[chan BookEvent]struct{}
+}
+
+func newBookEvents() *bookEvents {
+	return &bookEvents{subs: map[chan BookEvent]struct{}{}}
+}
+
+// Returns a channel receiving every event from now on, and a function to
+// end the subscription. Subscribers that do not keep up are dropped, which
+// closes the channel.
+func (h *bookEvents) Subscribe() (<-chan BookEvent, func()) {
+	ch := make(chan BookEvent, bookEventBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Reports whether anyone is listening, so changes need not be looked up
+// for nobody.
+func (h *bookEvents) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0
+}
+
+func (h *bookEvents) publish(t BookEventType, b BookStore) {
+	e := BookEvent{Type: t, Book: b, At: time.Now().UTC()}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Implemented by repositories whose database reports changes by itself,
+// like MongoDB with its change streams.
+type bookChangeWatcher interface {
+	WatchChanges(ctx context.Context, publish func(BookEventType, BookStore)) error
+}
+
+// Feeds the changes to the books into events until ctx is done. Databases
+// that report changes by themselves also report those of other instances
+// sharing the database. For all others, and for MongoDB servers without a
+// replica set, the returned repository publishes the changes made through
+// it, which only covers this instance.
+func watchBooks(ctx context.Context, books BookRepository, events *bookEvents) BookRepository {
+	if w, ok := books.(bookChangeWatcher); ok {
+		err := w.WatchChanges(ctx, events.publish)
+		if err == nil {
+			return books
+		}
+		log.Printf("Change streams are unavailable, only changes made by this instance are reported: %v", err)
+	}
+	return &watchedBookRepository{BookRepository: books, events: events}
+}
+
+// Publishes every successful change made through the wrapped repository,
+// whichever route it came from.
+type watchedBookRepository struct {
+	BookRepository
+	events *bookEvents
+}
+
+func (r *watchedBookRepository) Insert(ctx context.Context, b BookStore) (BookStore, error) {
+	b, err := r.BookRepository.Insert(ctx, b)
+	if err == nil {
+		r.events.publish(BookCreated, b)
+	}
+	return b, err
+}
+
+func (r *watchedBookRepository) InsertMany(ctx context.Context, books []BookStore) ([]BulkResult, error) {
+	results, err := r.BookRepository.InsertMany(ctx, books)
+	for _, res := range results {
+		if res.Error != "" {
+			continue
+		}
+		b := books[res.Index]
+		b.ID, _ = primitive.ObjectIDFromHex(res.ID)
+		r.events.publish(BookCreated, b)
+	}
+	return results, err
+}
+
+func (r *watchedBookRepository) Update(ctx context.Context, b BookStore) (BookStore, error) {
+	b, err := r.BookRepository.Update(ctx, b)
+	if err == nil {
+		r.events.publish(BookUpdated, b)
+	}
+	return b, err
+}
+
+func (r *watchedBookRepository) Restore(ctx context.Context, b BookStore) (bool, error) {
+	created, err := r.BookRepository.Restore(ctx, b)
+	if err == nil {
+		t := BookUpdated
+		if created {
+			t = BookCreated
+		}
+		r.events.publish(t, b)
+	}
+	return created, err
+}
+
+func (r *watchedBookRepository) Patch(ctx context.Context, id primitive.ObjectID, p BookPatch) (BookStore, error) {
+	b, err := r.BookRepository.Patch(ctx, id, p)
+	if err == nil {
+		r.events.publish(BookUpdated, b)
+	}
+	return b, err
+}
+
+func (r *watchedBookRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	err := r.BookRepository.Delete(ctx, id)
+	if err == nil {
+		r.events.publish(BookDeleted, BookStore{ID: id})
+	}
+	return err
+}
+
+// A book taken out of the trash shows up again, as if it was created.
+func (r *watchedBookRepository) Undelete(ctx context.Context, id primitive.ObjectID) (BookStore, error) {
+	b, err := r.BookRepository.Undelete(ctx, id)
+	if err == nil {
+		r.events.publish(BookCreated, b)
+	}
+	return b, err
+}
+
+func (r *watchedBookRepository) AddGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error) {
+	b, err := r.BookRepository.AddGenre(ctx, id, genre)
+	if err == nil {
+		r.events.publish(BookUpdated, b)
+	}
+	return b, err
+}
+
+func (r *watchedBookRepository) RemoveGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error) {
+	b, err := r.BookRepository.RemoveGenre(ctx, id, genre)
+	if err == nil {
+		r.events.publish(BookUpdated, b)
+	}
+	return b, err
+}
+
+// The renamed books are looked up afterwards, but only if anyone listens.
+func (r *watchedBookRepository) RenameAuthor(ctx context.Context, authorID primitive.ObjectID, name string) (int64, error) {
+	n, err := r.BookRepository.RenameAuthor(ctx, authorID, name)
+	if err != nil || n == 0 || !r.events.active() {
+		return n, err
+	}
+	books, _, err := r.BookRepository.FindAll(ctx, BookQuery{AuthorID: authorID})
+	if err != nil {
+		return n, err
+	}
+	for _, b := range books {
+		r.events.publish(BookUpdated, b)
+	}
+	return n, nil
+}
+
+// The books to delete are looked up first, but only if anyone listens.
+func (r *watchedBookRepository) DeleteMany(ctx context.Context, q BookQuery) (int64, error) {
+	if !r.events.active() {
+		return r.BookRepository.DeleteMany(ctx, q)
+	}
+	q.Page, q.Limit, q.Sort = 0, 0, nil
+	matched, _, err := r.BookRepository.FindAll(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.BookRepository.DeleteMany(ctx, q)
+	if err != nil {
+		return n, err
+	}
+	for _, b := range matched {
+		r.events.publish(BookDeleted, BookStore{ID: b.ID})
+	}
+	return n, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/xlsx"
+	"github.com/labstack/echo/v4"
+)
+
+// How many books the database sends at once while exporting or streaming
+// a listing.
+const exportBatchSize = 500
+
+// The columns of an export. They match the fields the CSV import knows, so
+// an export can be imported again.
+var exportHeader = []string{"id", "name", "author", "author_id", "isbn", "pages", "year", "genres"}
+
+func exportRecord(b BookStore) []interface{} {
+	return []interface{}{
+		b.ID.Hex(), b.BookName, b.BookAuthor, optionalHex(b.AuthorID), b.BookISBN,
+		b.BookPages, b.BookYear, strings.Join(b.Genres, ";"),
+	}
+}
+
+// The characters that make spreadsheet apps take a cell for a formula.
+const formulaStarts = "=+-@\t\r"
+
+// Turns a value into a CSV cell. Text starting like a formula gets a
+// quote in front, so that opening the file in a spreadsheet app does not
+// run it; the import drops the quote again, see importBook.
+func csvCell(v interface{}) string {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	if s != "" && strings.ContainsRune(formulaStarts, rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// Calls fn for every book matching the filter of the query, sorted by
+// name unless the query is sorted otherwise. The books are streamed from a
+// single cursor, so an export of any size holds only a batch of them in
+// memory. It runs as long as ctx lasts, and not just dbTimeout, as large
+// catalogs take longer than that; ctx ends when the client goes away.
+func (s *server) eachBook(ctx context.Context, q BookQuery, fn func(BookStore) error) error {
+	if len(q.Sort) == 0 {
+		q.Sort = []SortField{{Field: "name"}}
+	}
+	q.Page, q.Limit = 1, 0
+	return s.books.Each(ctx, q, fn)
+}
+
+// File extension and media type of the export formats.
+var exportFormats = map[string]struct{ ext, mime string }{
+	"csv":     {"csv", "text/csv; charset=utf-8"},
+	"xlsx":    {"xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+	"marc":    {"mrc", mimeMARC},
+	"marcxml": {"xml", mimeMARCXML},
+}
+
+// Sends the books matching the filters of /api/books as a CSV (the
+// default) or Excel file, or as MARC 21 records. The file is written while
+// the books are read, so the export of a large catalog does not pile up in
+// memory.
+func (s *server) exportBooks(c echo.Context) error {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "csv"
+	}
+	f, ok := exportFormats[format]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be csv, xlsx, marc or marcxml")
+	}
+	q := BookQuery{Page: 1}
+	if err := parseBookFilter(c, &q); err != nil {
+		return err
+	}
+	if err := parseSort(c, &q); err != nil {
+		return err
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="books.`+f.ext+`"`)
+	res.Header().Set(echo.HeaderContentType, f.mime)
+	res.WriteHeader(http.StatusOK)
+	return s.exportTo(c.Request().Context(), res, format, q)
+}
+
+// Writes the books matching the query in one of the exportFormats.
+func (s *server) exportTo(ctx context.Context, out io.Writer, format string, q BookQuery) error {
+	switch format {
+	case "xlsx":
+		return s.exportXLSX(ctx, out, q)
+	case "marc":
+		return s.exportMARC(ctx, out, q)
+	case "marcxml":
+		return s.exportMARCXML(ctx, out, q)
+	default:
+		return s.exportCSV(ctx, out, q)
+	}
+}
+
+func (s *server) exportCSV(ctx context.Context, out io.Writer, q BookQuery) error {
+	w := csv.NewWriter(out)
+	w.Write(exportHeader)
+	err := s.eachBook(ctx, q, func(b BookStore) error {
+		record := make([]string, 0, len(exportHeader))
+		for _, v := range exportRecord(b) {
+			record = append(record, csvCell(v))
+		}
+		return w.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func (s *server) exportXLSX(ctx context.Context, out io.Writer, q BookQuery) error {
+	w, err := xlsx.NewWriter(out, "Books")
+	if err != nil {
+		return err
+	}
+	header := make([]interface{}, len(exportHeader))
+	for i, h := range exportHeader {
+		header[i] = h
+	}
+	w.WriteRow(header...)
+	err = s.eachBook(ctx, q, func(b BookStore) error {
+		return w.WriteRow(exportRecord(b)...)
+	})
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
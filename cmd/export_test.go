@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"slices"
+	"testing"
+)
+
+func TestExportCSVFormulas(t *testing.T) {
+	ctx := context.Background()
+	books := newMemoryBookRepository()
+	want := []BookStore{
+		{BookName: `=HYPERLINK("http://example.com","Dune")`, BookAuthor: "@Herbert", Genres: []string{"-fiction"}},
+		{BookName: "+1 Story", BookAuthor: "Jane Doe", BookYear: 1999},
+		{BookName: "Plain", BookAuthor: "Al = Bob"},
+	}
+	for _, b := range want {
+		if _, err := books.Insert(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &server{books: books}
+
+	var out bytes.Buffer
+	if err := s.exportCSV(ctx, &out, BookQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(out.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells := map[string]bool{}
+	for _, record := range records[1:] {
+		for _, cell := range record {
+			cells[cell] = true
+		}
+	}
+	for _, cell := range []string{`'=HYPERLINK("http://example.com","Dune")`, "'@Herbert", "'-fiction", "'+1 Story", "Al = Bob", "1999"} {
+		if !cells[cell] {
+			t.Errorf("the export has no cell %q: %v", cell, records)
+		}
+	}
+
+	// The export imports again as it was
+	imp, err := readImport(bytes.NewReader(out.Bytes()), ',', "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imp.books) != len(want) {
+		t.Fatalf("imported %d books, want %d", len(imp.books), len(want))
+	}
+	for _, b := range want {
+		if !slices.ContainsFunc(imp.books, func(got BookStore) bool {
+			return got.BookName == b.BookName && got.BookAuthor == b.BookAuthor && slices.Equal(got.Genres, b.Genres)
+		}) {
+			t.Errorf("%q by %q did not import again: %+v", b.BookName, b.BookAuthor, imp.books)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How many values of each facet a search reports at most.
+const maxFacetValues = 10
+
+// Narrows a search down to the books of an author, a genre or a decade,
+// as offered by the facets.
+type SearchFilter struct {
+	Author string
+	Genre  string
+	// The first year of the decade, see decadeOf; nil for any decade
+	Decade *int
+}
+
+func (f SearchFilter) IsEmpty() bool {
+	return f.Author == "" && f.Genre == "" && f.Decade == nil
+}
+
+func (f SearchFilter) Matches(b BookStore) bool {
+	return (f.Author == "" || b.BookAuthor == f.Author) &&
+		(f.Genre == "" || slices.Contains(b.Genres, f.Genre)) &&
+		(f.Decade == nil || decadeOf(b.BookYear) == *f.Decade)
+}
+
+// Reads the ?author=, ?genre= and ?decade= parameters of a search.
+func parseSearchFilter(c echo.Context) (SearchFilter, error) {
+	f := SearchFilter{Author: c.QueryParam("author"), Genre: normalizeGenre(c.QueryParam("genre"))}
+	if raw := c.QueryParam("decade"); raw != "" {
+		decade, err := strconv.Atoi(raw)
+		if err != nil || decadeOf(decade) != decade {
+			return f, echo.NewHTTPError(http.StatusBadRequest, "decade must be a year divisible by 10")
+		}
+		f.Decade = &decade
+	}
+	return f, nil
+}
+
+type GenreCount struct {
+	Genre string `json:"genre" bson:"_id"`
+	Books int64  `json:"books" bson:"books"`
+}
+
+// How the matches of a search spread over the authors, decades and
+// genres, each by number of books, most first.
+type SearchFacets struct {
+	Authors []AuthorCount `json:"authors" bson:"authors"`
+	Decades []DecadeCount `json:"decades" bson:"decades"`
+	Genres  []GenreCount  `json:"genres" bson:"genres"`
+}
+
+// The best matches of a search, along with the facets of all matches.
+type SearchResult struct {
+	Hits   []SearchHit
+	Facets SearchFacets
+}
+
+// Filters all the matches of a search and counts the facets of what is
+// left, for the repositories that cannot do it by themselves. The hits
+// keep their order.
+func facetHits(hits []SearchHit, f SearchFilter, limit int) SearchResult {
+	res := SearchResult{Hits: []SearchHit{}}
+	authors, decades, genres := map[string]int64{}, map[int]int64{}, map[string]int64{}
+	for _, hit := range hits {
+		if !f.Matches(hit.BookStore) {
+			continue
+		}
+		if limit <= 0 || len(res.Hits) < limit {
+			res.Hits = append(res.Hits, hit)
+		}
+		authors[hit.BookAuthor]++
+		decades[decadeOf(hit.BookYear)]++
+		for _, g := range hit.Genres {
+			genres[g]++
+		}
+	}
+
+	res.Facets.Authors = topFacets(authors, func(author string, n int64) AuthorCount {
+		return AuthorCount{Author: author, Books: n}
+	})
+	res.Facets.Decades = topFacets(decades, func(decade int, n int64) DecadeCount {
+		return DecadeCount{Decade: decade, Books: n}
+	})
+	res.Facets.Genres = topFacets(genres, func(genre string, n int64) GenreCount {
+		return GenreCount{Genre: genre, Books: n}
+	})
+	return res
+}
+
+// Returns the maxFacetValues values with the most books, ties broken by
+// the values themselves.
+func topFacets[K cmp.Ordered, V any](counts map[K]int64, entry func(K, int64) V) []V {
+	keys := make([]K, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b K) int {
+		return cmp.Or(cmp.Compare(counts[b], counts[a]), cmp.Compare(a, b))
+	})
+	ret := []V{}
+	for _, k := range keys[:min(len(keys), maxFacetValues)] {
+		ret = append(ret, entry(k, counts[k]))
+	}
+	return ret
+}
+
+// A facet value on the search page, which narrows the search down to it
+// or, once it does, lifts that again.
+type facetChip struct {
+	Label string
+	Books int64
+	Link  string
+}
+
+// Returns the chips of the facets that are not filtered on yet, and
+// those of the filters in place.
+func facetChips(c echo.Context, facets SearchFacets) ([]facetChip, []facetChip) {
+	link := func(param string, value string) string {
+		params := url.Values{}
+		for k, v := range c.QueryParams() {
+			params[k] = v
+		}
+		if value == "" {
+			params.Del(param)
+		} else {
+			params.Set(param, value)
+		}
+		return c.Request().URL.Path + "?" + params.Encode()
+	}
+
+	var chips, active []facetChip
+	if author := c.QueryParam("author"); author != "" {
+		active = append(active, facetChip{Label: tr(c, "Author: %s", author), Link: link("author", "")})
+	} else {
+		for _, a := range facets.Authors {
+			chips = append(chips, facetChip{Label: tr(c, "Author: %s", a.Author), Books: a.Books, Link: link("author", a.Author)})
+		}
+	}
+	if decade := c.QueryParam("decade"); decade != "" {
+		active = append(active, facetChip{Label: tr(c, "Decade: %ss", decade), Link: link("decade", "")})
+	} else {
+		for _, d := range facets.Decades {
+			chips = append(chips, facetChip{Label: tr(c, "Decade: %ss", strconv.Itoa(d.Decade)), Books: d.Books, Link: link("decade", strconv.Itoa(d.Decade))})
+		}
+	}
+	if genre := c.QueryParam("genre"); genre != "" {
+		active = append(active, facetChip{Label: tr(c, "Genre: %s", genre), Link: link("genre", "")})
+	} else {
+		for _, g := range facets.Genres {
+			chips = append(chips, facetChip{Label: tr(c, "Genre: %s", g.Genre), Books: g.Books, Link: link("genre", g.Genre)})
+		}
+	}
+	return chips, active
+}
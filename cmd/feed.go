@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The books added last, as an Atom feed (RFC 4287) at /feed.xml, so that
+// patrons can follow the new arrivals in their feed readers. Each entry
+// links to the page of the book. Readers poll the feed, so it comes with
+// an entity tag and unchanged feeds are answered with a 304.
+
+const (
+	mimeAtom = "application/atom+xml; charset=utf-8"
+	// How many of the newest books the feed lists
+	feedBooks = 30
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    *atomPerson `xml:"author"`
+	Link      atomLink    `xml:"link"`
+	Summary   string      `xml:"summary,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+// Describes the book in a line, like "by Edgar Allan Poe, 1845, 120
+// pages".
+func feedSummary(b BookStore) string {
+	var parts []string
+	if b.BookAuthor != "" {
+		parts = append(parts, "by "+b.BookAuthor)
+	}
+	if b.BookYear > 0 {
+		parts = append(parts, fmt.Sprint(b.BookYear))
+	}
+	if b.BookPages > 0 {
+		parts = append(parts, fmt.Sprintf("%d pages", b.BookPages))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Builds the feed of the books, newest first. It was last updated when
+// the last of its books changed, or now if there are none.
+func (s *server) newArrivalsFeed(books []BookStore) atomFeed {
+	base := strings.TrimSuffix(s.publicURL, "/")
+	feed := atomFeed{
+		ID:     base + "/feed.xml",
+		Title:  "New in the library",
+		Author: atomPerson{Name: "The library"},
+		Links: []atomLink{
+			{Href: base + "/feed.xml", Rel: "self", Type: "application/atom+xml"},
+			{Href: base + "/", Rel: "alternate", Type: "text/html"},
+		},
+	}
+	var updated time.Time
+	for _, b := range books {
+		if b.UpdatedAt.After(updated) {
+			updated = b.UpdatedAt
+		}
+		url := base + "/books/" + b.ID.Hex()
+		entry := atomEntry{
+			ID:        url,
+			Title:     b.BookName,
+			Published: b.CreatedAt.UTC().Format(time.RFC3339),
+			Updated:   b.UpdatedAt.UTC().Format(time.RFC3339),
+			Link:      atomLink{Href: url, Rel: "alternate", Type: "text/html"},
+			Summary:   feedSummary(b),
+		}
+		if b.BookAuthor != "" {
+			entry.Author = &atomPerson{Name: b.BookAuthor}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	return feed
+}
+
+// Serves the feed of the books added last.
+func (s *server) feed(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	q := BookQuery{Page: 1, Limit: feedBooks, Sort: []SortField{{Field: "created_at", Desc: true}}}
+	books, _, err := s.books.FindAll(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	body, err := xml.MarshalIndent(s.newArrivalsFeed(books), "", "  ")
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+	tag := etagOf(c, body)
+	c.Response().Header().Set(headerETag, tag)
+	if header := c.Request().Header.Get(headerIfNoneMatch); header != "" && etagMatches(header, tag, true) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, mimeAtom, body)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The forms of the book table. They change the books just like the /api
+// endpoints do, but answer with the fragments HTMX swaps into the page.
+// Input the user can fix renders the form again with a 422, which the
+// index page swaps in as well.
+
+// What the book forms show: the values as the user entered them, so a
+// rejected form keeps them, and what was wrong with them.
+type bookForm struct {
+	ID      string
+	Name    string
+	Author  string
+	ISBN    string
+	Pages   string
+	Year    string
+	Version int64
+	// Linked books take their author from the author, so it cannot be
+	// edited here
+	AuthorLinked bool
+	Added        string
+	CSRF         string
+	// The problems with single fields by field name, and with the book as
+	// a whole
+	Errors map[string]string
+	Error  string
+	// Confirms that a book was created
+	Message string
+}
+
+func newBookForm(b BookStore) bookForm {
+	return bookForm{
+		ID:           b.ID.Hex(),
+		Name:         b.BookName,
+		Author:       b.BookAuthor,
+		ISBN:         b.BookISBN,
+		Pages:        strconv.Itoa(b.BookPages),
+		Year:         strconv.Itoa(b.BookYear),
+		Version:      b.Version,
+		AuthorLinked: !b.AuthorID.IsZero(),
+		Added:        b.CreatedAt.Format(time.DateOnly),
+	}
+}
+
+// Takes the values the user entered. The fields are named like those of
+// the JSON the API accepts.
+func (f *bookForm) read(c echo.Context) {
+	f.Name = c.FormValue("name")
+	if !f.AuthorLinked {
+		f.Author = c.FormValue("author")
+	}
+	f.ISBN = strings.TrimSpace(c.FormValue("isbn"))
+	f.Pages = c.FormValue("pages")
+	f.Year = c.FormValue("year")
+	if version, err := strconv.ParseInt(c.FormValue("version"), 10, 64); err == nil {
+		f.Version = version
+	}
+}
+
+// Turns the form into a patch setting every field it shows, and checks
+// it like validatePatch. Numbers that are no numbers are reported along
+// with the other problems.
+func (f bookForm) patch() (BookPatch, error) {
+	v := &ValidationError{}
+	p := BookPatch{BookName: &f.Name, BookISBN: &f.ISBN}
+	if !f.AuthorLinked {
+		p.BookAuthor = &f.Author
+	}
+	p.BookPages = formNumber(v, "pages", f.Pages)
+	p.BookYear = formNumber(v, "year", f.Year)
+	if f.Version != 0 {
+		p.Version = &f.Version
+	}
+	var invalid *ValidationError
+	if errors.As(validatePatch(p), &invalid) {
+		v.Fields = append(v.Fields, invalid.Fields...)
+	}
+	return p, v.errOrNil()
+}
+
+func formNumber(v *ValidationError, field string, value string) *int {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		v.add(field, "must be a whole number")
+		return nil
+	}
+	return &n
+}
+
+// Puts the error into the form if the user can do something about it,
+// and reports whether it did. Failures on our side are left to the error
+// handler.
+func (f *bookForm) showError(err error) bool {
+	apiErr := toAPIError(err)
+	if apiErr.Code >= http.StatusInternalServerError {
+		return false
+	}
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		f.Error = apiErr.Message
+		return true
+	}
+	f.Errors = map[string]string{}
+	for _, field := range validationErr.Fields {
+		f.Errors[field.Field] = field.Message
+	}
+	return true
+}
+
+// Converts a book into a row of the book table, with the buttons the user
+// may use.
+func bookRowView(c echo.Context, book BookDTO) BookDTO {
+	book.CanEdit = hasScope(c, ScopeBooksWrite)
+	book.CanDelete = hasScope(c, ScopeBooksDelete)
+	return book
+}
+
+func (s *server) createBookForm(c echo.Context) error {
+	return c.Render(http.StatusOK, "book-form", bookForm{CSRF: csrfToken(c)})
+}
+
+// Creates a book and answers with an empty form for the next one. The
+// book table reloads itself to show the new book.
+func (s *server) submitBookForm(c echo.Context) error {
+	form := bookForm{CSRF: csrfToken(c)}
+	form.read(c)
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	created, err := s.storeBookForm(ctx, form)
+	if err != nil {
+		if !form.showError(err) {
+			return err
+		}
+		return c.Render(http.StatusUnprocessableEntity, "book-form", form)
+	}
+
+	c.Response().Header().Set("HX-Trigger", "books-changed")
+	return c.Render(http.StatusOK, "book-form", bookForm{
+		CSRF:    csrfToken(c),
+		Message: tr(c, "Added %s by %s", created.BookName, created.BookAuthor),
+	})
+}
+
+func (s *server) storeBookForm(ctx context.Context, form bookForm) (BookStore, error) {
+	p, err := form.patch()
+	if err != nil {
+		return BookStore{}, err
+	}
+	var book BookStore
+	p.Apply(&book)
+	return s.storeBook(ctx, book)
+}
+
+// Answers with the row of the book as the table shows it, e.g. when
+// editing it is cancelled.
+func (s *server) bookRow(c echo.Context) error {
+	objID, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	book, err := s.books.FindByID(ctx, objID)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "book-row", bookRowView(c, newBookDTO(book)))
+}
+
+// Answers with the row of the book turned into a form.
+func (s *server) editBookRow(c echo.Context) error {
+	objID, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	book, err := s.books.FindByID(ctx, objID)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "book-edit-row", newBookForm(book))
+}
+
+// Saves the edited row. The form carries the version the user started
+// from, so changes made meanwhile by someone else are not overwritten.
+func (s *server) saveBookRow(c echo.Context) error {
+	objID, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	book, err := s.books.FindByID(ctx, objID)
+	if err != nil {
+		return err
+	}
+
+	form := newBookForm(book)
+	form.read(c)
+	updated, err := s.patchBookForm(ctx, objID, form)
+	if err != nil {
+		if !form.showError(err) {
+			return err
+		}
+		return c.Render(http.StatusUnprocessableEntity, "book-edit-row", form)
+	}
+	return c.Render(http.StatusOK, "book-row", bookRowView(c, newBookDTO(updated)))
+}
+
+func (s *server) patchBookForm(ctx context.Context, id primitive.ObjectID, form bookForm) (BookStore, error) {
+	p, err := form.patch()
+	if err != nil {
+		return BookStore{}, err
+	}
+	normalizePatch(&p)
+	return s.books.Patch(ctx, id, p)
+}
+
+// Moves the book to the trash. The empty answer replaces its row, which
+// removes it from the table.
+func (s *server) deleteBookRow(c echo.Context) error {
+	objID, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	if err := s.removeBook(ctx, objID); err != nil {
+		return err
+	}
+	return c.HTML(http.StatusOK, "")
+}
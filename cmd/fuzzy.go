@@ -0,0 +1,239 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Reported by a fuzzySearcher whose database turns out not to search with
+// typos after all.
+var errFuzzySearchUnavailable = errors.New("fuzzy search is unavailable")
+
+// Implemented by repositories whose database searches with typos by
+// itself, like MongoDB Atlas with Atlas Search.
+type fuzzySearcher interface {
+	FuzzySearch(ctx context.Context, text string, limit int) ([]SearchHit, error)
+}
+
+// How long the fuzzy index is used before it is built anew. Changes made
+// through this instance drop it right away; this catches up with those
+// of the other instances.
+const fuzzyIndexTTL = time.Minute
+
+// How many results the fuzzy index keeps at most.
+const maxFuzzyResults = 1000
+
+// Searches the books tolerating typos, so "Franknstein" still finds
+// Frankenstein. The database does it if it can, otherwise the fuzzyIndex.
+type fuzzySearch struct {
+	// nil if the database cannot search with typos
+	db          fuzzySearcher
+	unavailable atomic.Bool
+	index       *fuzzyIndex
+}
+
+// Uses the database for fuzzy searches if the repository can, see
+// fuzzySearcher. The fallback index is dropped on every change to the
+// books.
+func newFuzzySearch(books BookRepository, events *bookEvents) *fuzzySearch {
+	f := &fuzzySearch{index: &fuzzyIndex{books: books}}
+	f.db, _ = books.(fuzzySearcher)
+	go f.index.invalidate(events)
+	return f
+}
+
+func (f *fuzzySearch) Search(ctx context.Context, text string, limit int) ([]SearchHit, error) {
+	if f.db != nil && !f.unavailable.Load() {
+		hits, err := f.db.FuzzySearch(ctx, text, limit)
+		if !errors.Is(err, errFuzzySearchUnavailable) {
+			return hits, err
+		}
+		log.Printf("Fuzzy search: the database cannot do it, falling back to the service: %v", err)
+		f.unavailable.Store(true)
+	}
+	return f.index.Search(ctx, text, limit)
+}
+
+// Like Search, filtering the matches and counting their facets with
+// facetHits.
+func (f *fuzzySearch) FacetedSearch(ctx context.Context, text string, filter SearchFilter, limit int) (SearchResult, error) {
+	hits, err := f.Search(ctx, text, 0)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	return facetHits(hits, filter, limit), nil
+}
+
+// Matches the words of the names and authors of all books against the
+// search terms by their edit distance. The words and the results are
+// kept until the books change, or for fuzzyIndexTTL.
+type fuzzyIndex struct {
+	books BookRepository
+
+	mu      sync.Mutex
+	catalog []BookStore
+	// The books each word occurs in, by their index in catalog
+	words   map[string][]int
+	built   time.Time
+	results map[string][]SearchHit
+}
+
+func (x *fuzzyIndex) Search(ctx context.Context, text string, limit int) ([]SearchHit, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.words == nil || time.Since(x.built) > fuzzyIndexTTL {
+		if err := x.build(ctx); err != nil {
+			return nil, err
+		}
+	}
+	key := strconv.Itoa(limit) + ":" + strings.ToLower(text)
+	if hits, ok := x.results[key]; ok {
+		return hits, nil
+	}
+
+	// Every term adds how well it matches its best word in the book
+	terms := fuzzyWords(text)
+	scores := map[int]float64{}
+	for _, term := range terms {
+		best := map[int]float64{}
+		edits := maxEdits(term)
+		for word, books := range x.words {
+			d, ok := editDistance(term, word, edits)
+			if !ok {
+				continue
+			}
+			score := 1 - float64(d)/float64(utf8.RuneCountInString(term)+1)
+			for _, i := range books {
+				best[i] = max(best[i], score)
+			}
+		}
+		for i, score := range best {
+			scores[i] += score
+		}
+	}
+
+	hits := []SearchHit{}
+	for i, score := range scores {
+		hits = append(hits, SearchHit{BookStore: x.catalog[i], Score: score})
+	}
+	slices.SortFunc(hits, func(a, b SearchHit) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(a.BookName, b.BookName))
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	if len(x.results) < maxFuzzyResults {
+		x.results[key] = hits
+	}
+	return hits, nil
+}
+
+// Reads all the books and collects their words. Must be called with mu
+// held.
+func (x *fuzzyIndex) build(ctx context.Context) error {
+	catalog, _, err := x.books.FindAll(ctx, BookQuery{})
+	if err != nil {
+		return err
+	}
+	words := map[string][]int{}
+	for i, b := range catalog {
+		for _, word := range fuzzyWords(b.BookName + " " + b.BookAuthor) {
+			if books := words[word]; len(books) == 0 || books[len(books)-1] != i {
+				words[word] = append(books, i)
+			}
+		}
+	}
+	x.catalog, x.words, x.built = catalog, words, time.Now()
+	x.results = map[string][]SearchHit{}
+	return nil
+}
+
+func (x *fuzzyIndex) drop() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.catalog, x.words, x.results = nil, nil, nil
+}
+
+// Drops the index whenever a book changes, like invalidateCache.
+func (x *fuzzyIndex) invalidate(events *bookEvents) {
+	for {
+		ch, unsubscribe := events.Subscribe()
+		for range ch {
+			drain(ch)
+			x.drop()
+		}
+		unsubscribe()
+		x.drop()
+	}
+}
+
+// Splits the text into lower case words, leaving out punctuation.
+func fuzzyWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// How many typos a search term may contain, like Lucene's AUTO fuzziness:
+// none in words of up to two letters, one in words of up to five and two
+// in longer ones.
+func maxEdits(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Returns the Levenshtein distance of a and b if it is at most limit, and
+// whether it is. It gives up as soon as the distance exceeds the limit.
+func editDistance(a string, b string, limit int) (int, bool) {
+	ra, rb := []rune(a), []rune(b)
+	if abs(len(ra)-len(rb)) > limit {
+		return 0, false
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return 0, false
+		}
+		prev, cur = cur, prev
+	}
+	d := prev[len(rb)]
+	return d, d <= limit
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
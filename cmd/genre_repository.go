@@ -0,0 +1,167 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrGenreNotFound  = errors.New("genre not found")
+	ErrDuplicateGenre = errors.New("genre already exists")
+)
+
+// An entry of the genre vocabulary. Books can only be tagged with genres
+// that exist here, which keeps "horror", "Horror" and "horor" from ending
+// up as three different genres.
+type Genre struct {
+	Name        string `json:"name" bson:"_id"`
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
+}
+
+// Stores the genre vocabulary, next to the books of the same backend.
+type GenreRepository interface {
+	// Returns all genres, ordered by name.
+	FindAll(ctx context.Context) ([]Genre, error)
+	// Stores a new genre. A name that is already taken fails with
+	// ErrDuplicateGenre.
+	Insert(ctx context.Context, g Genre) (Genre, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// Keeps the genres in memory, for the memory storage.
+type memoryGenreRepository struct {
+	mu     sync.RWMutex
+	genres []Genre
+}
+
+func newMemoryGenreRepository() *memoryGenreRepository {
+	return &memoryGenreRepository{}
+}
+
+func (r *memoryGenreRepository) FindAll(ctx context.Context) ([]Genre, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	genres := append([]Genre{}, r.genres...)
+	slices.SortFunc(genres, func(a, b Genre) int { return cmp.Compare(a.Name, b.Name) })
+	return genres, nil
+}
+
+func (r *memoryGenreRepository) Insert(ctx context.Context, g Genre) (Genre, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if slices.ContainsFunc(r.genres, func(o Genre) bool { return o.Name == g.Name }) {
+		return g, ErrDuplicateGenre
+	}
+	r.genres = append(r.genres, g)
+	return g, nil
+}
+
+func (r *memoryGenreRepository) Delete(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.genres, func(g Genre) bool { return g.Name == name })
+	if i < 0 {
+		return ErrGenreNotFound
+	}
+	r.genres = slices.Delete(r.genres, i, i+1)
+	return nil
+}
+
+// Stores the genres in their own MongoDB collection. The name is the _id,
+// so MongoDB keeps it unique without an extra index.
+type mongoGenreRepository struct {
+	coll mongoCollection
+}
+
+func newMongoGenreRepository(coll *mongo.Collection) *mongoGenreRepository {
+	return &mongoGenreRepository{coll: withPolicy(coll)}
+}
+
+func (r *mongoGenreRepository) FindAll(ctx context.Context) ([]Genre, error) {
+	cursor, err := r.coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	genres := []Genre{}
+	if err = cursor.All(ctx, &genres); err != nil {
+		return nil, err
+	}
+	return genres, nil
+}
+
+func (r *mongoGenreRepository) Insert(ctx context.Context, g Genre) (Genre, error) {
+	_, err := r.coll.InsertOne(ctx, g)
+	if mongo.IsDuplicateKeyError(err) {
+		return g, ErrDuplicateGenre
+	}
+	return g, err
+}
+
+func (r *mongoGenreRepository) Delete(ctx context.Context, name string) error {
+	res, err := r.coll.DeleteOne(ctx, bson.M{"_id": name})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrGenreNotFound
+	}
+	return nil
+}
+
+// Stores the genres in the genres table, see sqlMigrations.
+type sqlGenreRepository struct {
+	db *sql.DB
+}
+
+func newSQLGenreRepository(db *sql.DB) *sqlGenreRepository {
+	return &sqlGenreRepository{db: db}
+}
+
+func (r *sqlGenreRepository) FindAll(ctx context.Context) ([]Genre, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT name, description FROM genres ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := []Genre{}
+	for rows.Next() {
+		var g Genre
+		if err := rows.Scan(&g.Name, &g.Description); err != nil {
+			return nil, err
+		}
+		genres = append(genres, g)
+	}
+	return genres, rows.Err()
+}
+
+func (r *sqlGenreRepository) Insert(ctx context.Context, g Genre) (Genre, error) {
+	_, err := r.db.ExecContext(ctx, "INSERT INTO genres (name, description) VALUES ($1, $2)", g.Name, g.Description)
+	if isUniqueViolation(err) {
+		return g, ErrDuplicateGenre
+	}
+	return g, err
+}
+
+func (r *sqlGenreRepository) Delete(ctx context.Context, name string) error {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM genres WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrGenreNotFound
+	}
+	return nil
+}
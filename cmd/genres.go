@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Makes sure every genre is part of the vocabulary. The genres have to be
+// normalized already.
+func (s *server) checkVocabulary(ctx context.Context, genres []string) error {
+	if len(genres) == 0 {
+		return nil
+	}
+	known, err := s.genres.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+	v := &ValidationError{}
+	for _, g := range genres {
+		if !slices.ContainsFunc(known, func(k Genre) bool { return k.Name == g }) {
+			v.add("genres", fmt.Sprintf("unknown genre %q", g))
+		}
+	}
+	return v.errOrNil()
+}
+
+func (s *server) listGenres(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	genres, err := s.genres.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, genres)
+}
+
+// Adds a genre to the vocabulary.
+func (s *server) createGenre(c echo.Context) error {
+	var genre Genre
+	if err := c.Bind(&genre); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid genre data").SetInternal(err)
+	}
+	genre.Name = normalizeGenre(genre.Name)
+	genre.Description = strings.TrimSpace(genre.Description)
+	v := &ValidationError{}
+	if genre.Name == "" {
+		v.add("name", "is required")
+	} else if !validGenre(genre.Name) {
+		v.add("name", fmt.Sprintf("must be lower case words joined by hyphens, at most %d characters", maxGenreLength))
+	}
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	genre, err := s.genres.Insert(ctx, genre)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, genre)
+}
+
+// Removes a genre from the vocabulary. Genres still in use have to be
+// taken off the books first.
+func (s *server) deleteGenre(c echo.Context) error {
+	name := normalizeGenre(c.Param("name"))
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	count, err := s.books.Count(ctx, BookQuery{Genre: name})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("%d books are still tagged with the genre", count))
+	}
+	if err := s.genres.Delete(ctx, name); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Tags a single book with a genre of the vocabulary.
+func (s *server) addBookGenre(c echo.Context) error {
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	genre := normalizeGenre(c.Param("genre"))
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	if err := s.checkVocabulary(ctx, []string{genre}); err != nil {
+		return err
+	}
+	book, err := s.books.AddGenre(ctx, id, genre)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newBookDTO(book))
+}
+
+func (s *server) removeBookGenre(c echo.Context) error {
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	book, err := s.books.RemoveGenre(ctx, id, normalizeGenre(c.Param("genre")))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newBookDTO(book))
+}
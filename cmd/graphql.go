@@ -0,0 +1,608 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/graph-gophers/graphql-go"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The GraphQL schema. It covers the same catalog as the REST API; reading
+// is public, and mutations need the same scopes as the matching routes.
+//
+//go:embed schema.graphql
+var graphqlSchema string
+
+// Deepest nesting a query may have. Authors list their books, which link
+// their authors again, so without a limit a query could grow endlessly.
+const graphqlMaxDepth = 8
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Returns the handler of POST /graphql. The schema is parsed once, a
+// mismatch between schema and resolvers stops the server at startup.
+func (s *server) graphqlHandler() echo.HandlerFunc {
+	schema := graphql.MustParseSchema(graphqlSchema, &graphqlResolver{s: s},
+		graphql.UseStringDescriptions(), graphql.MaxDepth(graphqlMaxDepth))
+
+	return func(c echo.Context) error {
+		var req graphqlRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid GraphQL request").SetInternal(err)
+		}
+		if req.Query == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "query must not be empty")
+		}
+		ctx := c.Request().Context()
+		if currentUser(c) != nil || currentAPIKey(c) != nil {
+			ctx = withActor(withScopes(ctx, currentScopes(c)), currentActor(c))
+		}
+		return c.JSON(http.StatusOK, schema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+	}
+}
+
+// An error as GraphQL reports it. The extensions carry the status code and
+// details the REST API would answer with, so clients can tell a missing
+// book from a validation failure.
+type graphqlError struct {
+	api *APIError
+}
+
+func (e graphqlError) Error() string {
+	return e.api.Message
+}
+
+func (e graphqlError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": e.api.Code}
+	if e.api.Details != nil {
+		ext["details"] = e.api.Details
+	}
+	return ext
+}
+
+// Converts errors of the repositories and handlers for GraphQL, see
+// toAPIError.
+func toGraphQLError(err error) error {
+	if err == nil {
+		return nil
+	}
+	api := toAPIError(err)
+	if api.Code >= http.StatusInternalServerError {
+		log.Printf("graphql: %v", err)
+	}
+	return graphqlError{api: api}
+}
+
+func parseGraphQLID(id graphql.ID) (primitive.ObjectID, error) {
+	objID, err := primitive.ObjectIDFromHex(string(id))
+	if err != nil {
+		return objID, echo.NewHTTPError(http.StatusBadRequest, "Invalid ID format")
+	}
+	return objID, nil
+}
+
+// Checks the page and limit arguments, capping the limit like the REST
+// API does.
+func graphqlPage(page, limit int32) (BookQuery, error) {
+	if page < 1 {
+		return BookQuery{}, echo.NewHTTPError(http.StatusBadRequest, "page must be a positive integer")
+	}
+	if limit < 1 {
+		return BookQuery{}, echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer")
+	}
+	return BookQuery{Page: int(page), Limit: min(int(limit), maxPageLimit)}, nil
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// Resolves the fields of Query and Mutation.
+type graphqlResolver struct {
+	s *server
+}
+
+type bookFilterInput struct {
+	Author   *string
+	AuthorID *graphql.ID
+	Genre    *string
+	YearMin  *int32
+	YearMax  *int32
+	PagesMin *int32
+	PagesMax *int32
+
+	CreatedSince  *string
+	CreatedBefore *string
+	UpdatedSince  *string
+	UpdatedBefore *string
+}
+
+type bookSortInput struct {
+	Field string
+	Desc  bool
+}
+
+func (r *graphqlResolver) Books(ctx context.Context, args struct {
+	Filter *bookFilterInput
+	Sort   *[]bookSortInput
+	Page   int32
+	Limit  int32
+}) (*bookPageResolver, error) {
+	q, err := graphqlPage(args.Page, args.Limit)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	if f := args.Filter; f != nil {
+		if f.Author != nil {
+			q.Author = *f.Author
+		}
+		if f.AuthorID != nil {
+			if q.AuthorID, err = parseGraphQLID(*f.AuthorID); err != nil {
+				return nil, toGraphQLError(err)
+			}
+		}
+		if f.Genre != nil {
+			q.Genre = normalizeGenre(*f.Genre)
+		}
+		q.YearMin, q.YearMax = intOrNil(f.YearMin), intOrNil(f.YearMax)
+		q.PagesMin, q.PagesMax = intOrNil(f.PagesMin), intOrNil(f.PagesMax)
+		if err = f.parseTimes(&q); err != nil {
+			return nil, toGraphQLError(err)
+		}
+	}
+	if args.Sort != nil {
+		for _, sort := range *args.Sort {
+			q.Sort = append(q.Sort, SortField{Field: sort.Field, Desc: sort.Desc})
+		}
+	}
+	return r.s.bookPage(ctx, q)
+}
+
+// Reads the time bounds of the filter into the query.
+func (f bookFilterInput) parseTimes(q *BookQuery) error {
+	v := &ValidationError{}
+	bounds := []struct {
+		field string
+		raw   *string
+		dst   **time.Time
+	}{
+		{"createdSince", f.CreatedSince, &q.CreatedSince},
+		{"createdBefore", f.CreatedBefore, &q.CreatedBefore},
+		{"updatedSince", f.UpdatedSince, &q.UpdatedSince},
+		{"updatedBefore", f.UpdatedBefore, &q.UpdatedBefore},
+	}
+	for _, b := range bounds {
+		if b.raw == nil {
+			continue
+		}
+		t, err := parseTimeBound(*b.raw)
+		if err != nil {
+			v.add(b.field, "must be a date like 2024-01-31 or an RFC 3339 time")
+			continue
+		}
+		*b.dst = &t
+	}
+	return v.errOrNil()
+}
+
+func intOrNil(v *int32) *int {
+	if v == nil {
+		return nil
+	}
+	n := int(*v)
+	return &n
+}
+
+func (r *graphqlResolver) Book(ctx context.Context, args struct{ ID graphql.ID }) (*bookResolver, error) {
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	book, err := r.s.books.FindByID(ctx, id)
+	if errors.Is(err, ErrBookNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	books, err := r.s.bookResolvers(ctx, []BookStore{book})
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return books[0], nil
+}
+
+func (r *graphqlResolver) Search(ctx context.Context, args struct {
+	Q     string
+	Limit int32
+}) ([]*searchHitResolver, error) {
+	q, err := graphqlPage(1, args.Limit)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	text := strings.TrimSpace(args.Q)
+	if text == "" {
+		return nil, toGraphQLError(echo.NewHTTPError(http.StatusBadRequest, "q must not be empty"))
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	hits, err := r.s.books.Search(ctx, text, q.Limit)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	books := make([]BookStore, len(hits))
+	for i, hit := range hits {
+		books[i] = hit.BookStore
+	}
+	resolved, err := r.s.bookResolvers(ctx, books)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	ret := make([]*searchHitResolver, len(hits))
+	for i, hit := range hits {
+		ret[i] = &searchHitResolver{book: resolved[i], score: hit.Score}
+	}
+	return ret, nil
+}
+
+func (r *graphqlResolver) Authors(ctx context.Context) ([]*authorResolver, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	authors, err := r.s.authors.FindAll(ctx)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	ret := make([]*authorResolver, len(authors))
+	for i, a := range authors {
+		ret[i] = &authorResolver{s: r.s, a: a}
+	}
+	return ret, nil
+}
+
+func (r *graphqlResolver) Author(ctx context.Context, args struct{ ID graphql.ID }) (*authorResolver, error) {
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	author, err := r.s.authors.FindByID(ctx, id)
+	if errors.Is(err, ErrAuthorNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return &authorResolver{s: r.s, a: author}, nil
+}
+
+func (r *graphqlResolver) Genres(ctx context.Context) ([]*genreResolver, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	genres, err := r.s.genres.FindAll(ctx)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	ret := make([]*genreResolver, len(genres))
+	for i, g := range genres {
+		ret[i] = &genreResolver{g: g}
+	}
+	return ret, nil
+}
+
+type bookInput struct {
+	Name     string
+	Author   *string
+	AuthorID *graphql.ID
+	Isbn     *string
+	Pages    int32
+	Year     int32
+	Genres   *[]string
+	Version  *int32
+}
+
+func (in bookInput) toBook() (BookStore, error) {
+	b := BookStore{BookName: in.Name, BookPages: int(in.Pages), BookYear: int(in.Year)}
+	if in.Author != nil {
+		b.BookAuthor = *in.Author
+	}
+	if in.AuthorID != nil {
+		id, err := primitive.ObjectIDFromHex(string(*in.AuthorID))
+		if err != nil {
+			return b, &ValidationError{Fields: []FieldError{{Field: "author_id", Message: "must be a valid ID"}}}
+		}
+		b.AuthorID = id
+	}
+	if in.Isbn != nil {
+		b.BookISBN = *in.Isbn
+	}
+	if in.Genres != nil {
+		b.Genres = *in.Genres
+	}
+	if in.Version != nil {
+		b.Version = int64(*in.Version)
+	}
+	return b, nil
+}
+
+func (r *graphqlResolver) CreateBook(ctx context.Context, args struct{ Input bookInput }) (*bookResolver, error) {
+	if err := checkScope(ctx, ScopeBooksWrite); err != nil {
+		return nil, toGraphQLError(err)
+	}
+	book, err := args.Input.toBook()
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	if book, err = r.s.storeBook(ctx, book); err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return r.s.bookResolver(ctx, book)
+}
+
+func (r *graphqlResolver) UpdateBook(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input bookInput
+}) (*bookResolver, error) {
+	if err := checkScope(ctx, ScopeBooksWrite); err != nil {
+		return nil, toGraphQLError(err)
+	}
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	book, err := args.Input.toBook()
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	book.ID = id
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	if book, err = r.s.replaceBook(ctx, book); err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return r.s.bookResolver(ctx, book)
+}
+
+func (r *graphqlResolver) DeleteBook(ctx context.Context, args struct{ ID graphql.ID }) (graphql.ID, error) {
+	if err := checkScope(ctx, ScopeBooksDelete); err != nil {
+		return "", toGraphQLError(err)
+	}
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return "", toGraphQLError(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	if err := r.s.removeBook(ctx, id); err != nil {
+		return "", toGraphQLError(err)
+	}
+	return args.ID, nil
+}
+
+type authorInput struct {
+	Name        string
+	BirthYear   *int32
+	Nationality *string
+	Bio         *string
+}
+
+func (in authorInput) toAuthor() Author {
+	a := Author{Name: in.Name, BirthYear: intOrNil(in.BirthYear)}
+	if in.Nationality != nil {
+		a.Nationality = *in.Nationality
+	}
+	if in.Bio != nil {
+		a.Bio = *in.Bio
+	}
+	return a
+}
+
+func (r *graphqlResolver) CreateAuthor(ctx context.Context, args struct{ Input authorInput }) (*authorResolver, error) {
+	if err := checkScope(ctx, ScopeBooksWrite); err != nil {
+		return nil, toGraphQLError(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	author, err := r.s.storeAuthor(ctx, args.Input.toAuthor())
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return &authorResolver{s: r.s, a: author}, nil
+}
+
+func (r *graphqlResolver) UpdateAuthor(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input authorInput
+}) (*authorResolver, error) {
+	if err := checkScope(ctx, ScopeBooksWrite); err != nil {
+		return nil, toGraphQLError(err)
+	}
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	author := args.Input.toAuthor()
+	author.ID = id
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	if author, err = r.s.replaceAuthor(ctx, author); err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return &authorResolver{s: r.s, a: author}, nil
+}
+
+func (r *graphqlResolver) DeleteAuthor(ctx context.Context, args struct{ ID graphql.ID }) (graphql.ID, error) {
+	if err := checkScope(ctx, ScopeBooksDelete); err != nil {
+		return "", toGraphQLError(err)
+	}
+	id, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return "", toGraphQLError(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	if err := r.s.removeAuthor(ctx, id); err != nil {
+		return "", toGraphQLError(err)
+	}
+	return args.ID, nil
+}
+
+// Resolves a book. The linked author and the copy counts are loaded for
+// all books of a list at once, see bookResolvers.
+type bookResolver struct {
+	b      BookStore
+	author *authorResolver
+	copies CopyCount
+}
+
+// Loads what the books link to with one query per collection, like
+// bookDTOs does.
+func (s *server) bookResolvers(ctx context.Context, books []BookStore) ([]*bookResolver, error) {
+	var bookIDs, authorIDs []primitive.ObjectID
+	for _, b := range books {
+		bookIDs = append(bookIDs, b.ID)
+		if !b.AuthorID.IsZero() {
+			authorIDs = append(authorIDs, b.AuthorID)
+		}
+	}
+	authors, err := s.authors.FindByIDs(ctx, authorIDs)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[primitive.ObjectID]Author{}
+	for _, a := range authors {
+		byID[a.ID] = a
+	}
+	counts, err := s.copies.Count(ctx, bookIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*bookResolver, len(books))
+	for i, b := range books {
+		ret[i] = &bookResolver{b: b, copies: counts[b.ID]}
+		if a, ok := byID[b.AuthorID]; ok {
+			ret[i].author = &authorResolver{s: s, a: a}
+		}
+	}
+	return ret, nil
+}
+
+func (s *server) bookResolver(ctx context.Context, b BookStore) (*bookResolver, error) {
+	books, err := s.bookResolvers(ctx, []BookStore{b})
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return books[0], nil
+}
+
+func (s *server) bookPage(ctx context.Context, q BookQuery) (*bookPageResolver, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	books, total, err := s.books.FindAll(ctx, q)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	items, err := s.bookResolvers(ctx, books)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	pages := int32((total + int64(q.Limit) - 1) / int64(q.Limit))
+	return &bookPageResolver{items: items, page: int32(q.Page), pages: max(pages, 1), limit: int32(q.Limit), total: int32(total)}, nil
+}
+
+func (r *bookResolver) ID() graphql.ID                { return graphql.ID(r.b.ID.Hex()) }
+func (r *bookResolver) Name() string                  { return r.b.BookName }
+func (r *bookResolver) Author() string                { return r.b.BookAuthor }
+func (r *bookResolver) LinkedAuthor() *authorResolver { return r.author }
+func (r *bookResolver) Isbn() *string                 { return optionalString(r.b.BookISBN) }
+func (r *bookResolver) Pages() int32                  { return int32(r.b.BookPages) }
+func (r *bookResolver) Year() int32                   { return int32(r.b.BookYear) }
+func (r *bookResolver) Genres() []string              { return append([]string{}, r.b.Genres...) }
+func (r *bookResolver) Version() int32                { return int32(r.b.Version) }
+func (r *bookResolver) CreatedAt() string             { return r.b.CreatedAt.Format(time.RFC3339Nano) }
+func (r *bookResolver) UpdatedAt() string             { return r.b.UpdatedAt.Format(time.RFC3339Nano) }
+func (r *bookResolver) Copies() *copyCountResolver    { return &copyCountResolver{r.copies} }
+
+type copyCountResolver struct {
+	c CopyCount
+}
+
+func (r *copyCountResolver) Total() int32     { return int32(r.c.Total) }
+func (r *copyCountResolver) Available() int32 { return int32(r.c.Available) }
+
+type bookPageResolver struct {
+	items                     []*bookResolver
+	page, pages, limit, total int32
+}
+
+func (r *bookPageResolver) Items() []*bookResolver { return r.items }
+func (r *bookPageResolver) Page() int32            { return r.page }
+func (r *bookPageResolver) Pages() int32           { return r.pages }
+func (r *bookPageResolver) Limit() int32           { return r.limit }
+func (r *bookPageResolver) Total() int32           { return r.total }
+
+type searchHitResolver struct {
+	book  *bookResolver
+	score float64
+}
+
+func (r *searchHitResolver) Book() *bookResolver { return r.book }
+func (r *searchHitResolver) Score() float64      { return r.score }
+
+type authorResolver struct {
+	s *server
+	a Author
+}
+
+func (r *authorResolver) ID() graphql.ID       { return graphql.ID(r.a.ID.Hex()) }
+func (r *authorResolver) Name() string         { return r.a.Name }
+func (r *authorResolver) BirthYear() *int32    { return int32OrNil(r.a.BirthYear) }
+func (r *authorResolver) Nationality() *string { return optionalString(r.a.Nationality) }
+func (r *authorResolver) Bio() *string         { return optionalString(r.a.Bio) }
+
+func (r *authorResolver) Books(ctx context.Context, args struct {
+	Page  int32
+	Limit int32
+}) (*bookPageResolver, error) {
+	q, err := graphqlPage(args.Page, args.Limit)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	q.AuthorID = r.a.ID
+	q.Sort = []SortField{{Field: "name"}}
+	return r.s.bookPage(ctx, q)
+}
+
+func int32OrNil(v *int) *int32 {
+	if v == nil {
+		return nil
+	}
+	n := int32(*v)
+	return &n
+}
+
+type genreResolver struct {
+	g Genre
+}
+
+func (r *genreResolver) Name() string         { return r.g.Name }
+func (r *genreResolver) Description() *string { return optionalString(r.g.Description) }
@@ -0,0 +1,373 @@
+package main
+
+//go:generate protoc -I ../proto --go_out=../internal/bookspb --go_opt=paths=source_relative --go-grpc_out=../internal/bookspb --go-grpc_opt=paths=source_relative books.proto
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/bookspb"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Page size of List if the request leaves it open.
+const grpcDefaultLimit = 20
+
+// Starts the gRPC server of proto/books.proto on the given port, 3031 by
+// default, next to the HTTP server.
+func (s *server) startGRPC(port string) *grpc.Server {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("gRPC: %v", err)
+	}
+
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(s.grpcUnaryAuth),
+		grpc.ChainStreamInterceptor(s.grpcStreamAuth),
+	)
+	bookspb.RegisterBookServiceServer(srv, &grpcBookService{s: s})
+	// Lets tools like grpcurl find the services without the proto file
+	reflection.Register(srv)
+
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Fatalf("gRPC: %v", err)
+		}
+	}()
+	return srv
+}
+
+// Authenticates calls that carry an API key or a bearer token in their
+// metadata, like optionalAuth does for HTTP, and stores the scopes of the
+// caller in the context, along with the caller for the audit log.
+func (s *server) grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if keys := md.Get(strings.ToLower(headerAPIKey)); len(keys) > 0 && keys[0] != "" {
+		key, err := s.authenticateAPIKey(ctx, keys[0])
+		if err != nil {
+			return ctx, err
+		}
+		return withActor(withScopes(ctx, key.Scopes), apiKeyActor(*key)), nil
+	}
+
+	auth := md.Get("authorization")
+	if len(auth) == 0 || auth[0] == "" {
+		return ctx, nil
+	}
+	token, found := strings.CutPrefix(auth[0], "Bearer ")
+	if !found || token == "" {
+		return ctx, status.Error(codes.Unauthenticated, "Authentication required")
+	}
+	claims, err := s.parseToken(token)
+	if err != nil {
+		return ctx, status.Error(codes.Unauthenticated, "Invalid or expired token")
+	}
+	user, err := s.userFromClaims(ctx, claims)
+	if errors.Is(err, ErrUserNotFound) {
+		return ctx, status.Error(codes.Unauthenticated, "The account no longer exists")
+	}
+	if err != nil {
+		return ctx, err
+	}
+	return withActor(withScopes(ctx, user.Role.Scopes()), userActor(user)), nil
+}
+
+func (s *server) grpcUnaryAuth(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return handler(ctx, req)
+}
+
+func (s *server) grpcStreamAuth(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.grpcAuthenticate(ss.Context())
+	if err != nil {
+		return toGRPCError(err)
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// Hands the context with the scopes of the caller to stream handlers.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// Status codes for the HTTP status codes the handlers and repositories
+// report, see toAPIError.
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.FailedPrecondition,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusUnprocessableEntity:   codes.InvalidArgument,
+	http.StatusBadGateway:            codes.Unavailable,
+}
+
+// Converts any error into a gRPC status. Invalid fields are listed in a
+// BadRequest detail, and a duplicate names the stored book in a
+// ResourceInfo detail. A version conflict is ABORTED, which tells the
+// client to read the book again and retry.
+func toGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	api := toAPIError(err)
+	code, ok := grpcCodes[api.Code]
+	if !ok {
+		log.Printf("gRPC: %v", err)
+		return status.Error(codes.Internal, api.Message)
+	}
+
+	var validationErr *ValidationError
+	var duplicateErr *DuplicateBookError
+	switch {
+	case errors.Is(err, ErrVersionConflict):
+		return status.Error(codes.Aborted, api.Message)
+	case errors.As(err, &validationErr):
+		bad := &errdetails.BadRequest{}
+		for _, f := range validationErr.Fields {
+			bad.FieldViolations = append(bad.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: f.Field, Description: f.Message})
+		}
+		st, _ := status.New(code, validationErr.Error()).WithDetails(bad)
+		return st.Err()
+	case errors.As(err, &duplicateErr):
+		info := &errdetails.ResourceInfo{ResourceType: "book", ResourceName: duplicateErr.ExistingID.Hex(), Description: "stored book with the same ISBN"}
+		st, _ := status.New(codes.AlreadyExists, api.Message).WithDetails(info)
+		return st.Err()
+	}
+	return status.Error(code, api.Message)
+}
+
+func bookToProto(b BookStore) *bookspb.Book {
+	pb := &bookspb.Book{
+		Id:        b.ID.Hex(),
+		Name:      b.BookName,
+		Author:    b.BookAuthor,
+		Isbn:      b.BookISBN,
+		Pages:     int32(b.BookPages),
+		Year:      int32(b.BookYear),
+		Genres:    append([]string{}, b.Genres...),
+		Version:   b.Version,
+		CreatedAt: timestamppb.New(b.CreatedAt),
+		UpdatedAt: timestamppb.New(b.UpdatedAt),
+	}
+	if !b.AuthorID.IsZero() {
+		pb.AuthorId = b.AuthorID.Hex()
+	}
+	return pb
+}
+
+func bookFromProto(pb *bookspb.Book) (BookStore, error) {
+	b := BookStore{
+		BookName:   pb.GetName(),
+		BookAuthor: pb.GetAuthor(),
+		BookISBN:   pb.GetIsbn(),
+		BookPages:  int(pb.GetPages()),
+		BookYear:   int(pb.GetYear()),
+		Genres:     pb.GetGenres(),
+		Version:    pb.GetVersion(),
+	}
+	if pb.GetAuthorId() != "" {
+		id, err := primitive.ObjectIDFromHex(pb.GetAuthorId())
+		if err != nil {
+			return b, &ValidationError{Fields: []FieldError{{Field: "author_id", Message: "must be a valid ID"}}}
+		}
+		b.AuthorID = id
+	}
+	return b, nil
+}
+
+func timeOrNil(ts *timestamppb.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.AsTime()
+	return &t
+}
+
+func parseGRPCID(id string) (primitive.ObjectID, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return objID, status.Error(codes.InvalidArgument, "Invalid ID format")
+	}
+	return objID, nil
+}
+
+// Implements the BookService of proto/books.proto on top of the same
+// repositories and checks as the REST API.
+type grpcBookService struct {
+	bookspb.UnimplementedBookServiceServer
+	s *server
+}
+
+func (g *grpcBookService) List(ctx context.Context, req *bookspb.ListBooksRequest) (*bookspb.ListBooksResponse, error) {
+	q := BookQuery{Page: int(req.GetPage()), Limit: int(req.GetLimit())}
+	if q.Page == 0 {
+		q.Page = 1
+	}
+	if q.Limit == 0 {
+		q.Limit = grpcDefaultLimit
+	}
+	if q.Page < 0 || q.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "page and limit must not be negative")
+	}
+	q.Limit = min(q.Limit, maxPageLimit)
+
+	if f := req.GetFilter(); f != nil {
+		q.Author = f.GetAuthor()
+		q.Genre = normalizeGenre(f.GetGenre())
+		if f.GetAuthorId() != "" {
+			id, err := parseGRPCID(f.GetAuthorId())
+			if err != nil {
+				return nil, err
+			}
+			q.AuthorID = id
+		}
+		q.YearMin, q.YearMax = intOrNil(f.YearMin), intOrNil(f.YearMax)
+		q.PagesMin, q.PagesMax = intOrNil(f.PagesMin), intOrNil(f.PagesMax)
+		q.CreatedSince, q.CreatedBefore = timeOrNil(f.CreatedSince), timeOrNil(f.CreatedBefore)
+		q.UpdatedSince, q.UpdatedBefore = timeOrNil(f.UpdatedSince), timeOrNil(f.UpdatedBefore)
+	}
+	for _, sort := range req.GetSort() {
+		if !slices.Contains(sortableFields, sort.GetField()) {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot sort by %q", sort.GetField())
+		}
+		q.Sort = append(q.Sort, SortField{Field: sort.GetField(), Desc: sort.GetDesc()})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	books, total, err := g.s.books.FindAll(ctx, q)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	res := &bookspb.ListBooksResponse{
+		Total: total,
+		Page:  int32(q.Page),
+		Pages: int32(max((total+int64(q.Limit)-1)/int64(q.Limit), 1)),
+	}
+	for _, b := range books {
+		res.Books = append(res.Books, bookToProto(b))
+	}
+	return res, nil
+}
+
+func (g *grpcBookService) Get(ctx context.Context, req *bookspb.GetBookRequest) (*bookspb.Book, error) {
+	id, err := parseGRPCID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	book, err := g.s.books.FindByID(ctx, id)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return bookToProto(book), nil
+}
+
+func (g *grpcBookService) Create(ctx context.Context, req *bookspb.CreateBookRequest) (*bookspb.Book, error) {
+	if err := checkScope(ctx, ScopeBooksWrite); err != nil {
+		return nil, toGRPCError(err)
+	}
+	book, err := bookFromProto(req.GetBook())
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	if book, err = g.s.storeBook(ctx, book); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return bookToProto(book), nil
+}
+
+func (g *grpcBookService) Update(ctx context.Context, req *bookspb.UpdateBookRequest) (*bookspb.Book, error) {
+	if err := checkScope(ctx, ScopeBooksWrite); err != nil {
+		return nil, toGRPCError(err)
+	}
+	id, err := parseGRPCID(req.GetBook().GetId())
+	if err != nil {
+		return nil, err
+	}
+	book, err := bookFromProto(req.GetBook())
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	book.ID = id
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	if book, err = g.s.replaceBook(ctx, book); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return bookToProto(book), nil
+}
+
+func (g *grpcBookService) Delete(ctx context.Context, req *bookspb.DeleteBookRequest) (*bookspb.DeleteBookResponse, error) {
+	if err := checkScope(ctx, ScopeBooksDelete); err != nil {
+		return nil, toGRPCError(err)
+	}
+	id, err := parseGRPCID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	if err := g.s.removeBook(ctx, id); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &bookspb.DeleteBookResponse{}, nil
+}
+
+var grpcEventTypes = map[BookEventType]bookspb.BookEvent_Type{
+	BookCreated: bookspb.BookEvent_CREATED,
+	BookUpdated: bookspb.BookEvent_UPDATED,
+	BookDeleted: bookspb.BookEvent_DELETED,
+}
+
+func (g *grpcBookService) Watch(_ *bookspb.WatchBooksRequest, stream bookspb.BookService_WatchServer) error {
+	events, unsubscribe := g.s.events.Subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "The watcher fell behind")
+			}
+			err := stream.Send(&bookspb.BookEvent{
+				Type: grpcEventTypes[e.Type],
+				Book: bookToProto(e.Book),
+				Time: timestamppb.New(e.At),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,992 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How long a single request may spend talking to the database, set from
+// timeouts.database on startup.
+var dbTimeout = 10 * time.Second
+
+// For the work done outside of requests, such as delivering webhooks.
+func dbContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), dbTimeout)
+}
+
+// Like dbContext, but derived from the request's context: the database
+// calls show up in the request's trace, and they are cancelled once the
+// client gives up on the request or the server cuts it off on shutdown.
+func requestContext(c echo.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request().Context(), dbTimeout)
+}
+
+// Bundles everything the handlers depend on. Handlers are methods on the
+// server, so they reach the storage through the repository interface
+// instead of capturing a database collection.
+type server struct {
+	books        BookRepository
+	authors      AuthorRepository
+	genres       GenreRepository
+	copies       CopyRepository
+	loans        LoanRepository
+	reservations ReservationRepository
+	shelves      ShelfRepository
+	progress     ProgressRepository
+	users        UserRepository
+	apiKeys      APIKeyRepository
+	sessions     SessionRepository
+	webhooks     WebhookRepository
+	// The searches the users keep, see searches.go
+	savedSearches SavedSearchRepository
+	// Who changed which book, see audit.go
+	audit AuditRepository
+	// Checks the connection to the database, see health.go
+	ping func(context.Context) error
+	// Checks the connection to Redis; nil without Redis
+	pingRedis func(context.Context) error
+	// How long /readyz waits for the database
+	readyTimeout time.Duration
+	// The base URL the server is reachable at from the outside
+	publicURL string
+	// The policies sent along with the pages, see security.go
+	securityHeaders SecurityHeadersConfig
+	// Signs and verifies the access tokens, see auth.go
+	jwtSecret []byte
+	// Encrypts the TOTP secrets, see twofactor.go; nil to store them in
+	// the clear
+	totpKey cipher.AEAD
+	// Refuses the logins after too many failed ones, see lockout.go; nil
+	// if off
+	lockout *lockout
+	// The providers offered for logging into the web UI, see oauth.go
+	oauthProviders []oauthProvider
+	// How long copies may be kept and how many at once, see loans.go
+	loanPolicy loanPolicy
+	// The external catalogs books are looked up in, see lookup.go
+	metadataSources []metadataSource
+	// Emails the users about their loans and holds, see mail.go; nil if
+	// the library sends no emails
+	mailer mailer
+	// How many days before a loan is due its borrower is reminded
+	remindDays int
+	// Changes to the books for whoever watches them, see events.go
+	events *bookEvents
+	// What happens in the catalog, for whoever follows it, see bus.go
+	bus *eventBus
+	// Forwards the events of all catalogs to NATS or Kafka; nil if they
+	// stay within the server
+	forwarder *eventForwarder
+	// The browsers following the changes, see websocket.go
+	ws *wsHub
+	// Closed once the server shuts down, which ends the event streams, see
+	// sse.go
+	stopping chan struct{}
+	// Searches tolerating typos, see fuzzy.go
+	fuzzy *fuzzySearch
+	// The Elasticsearch index the searches are answered from, see
+	// elasticsearch.go; nil if the database answers them
+	search *elasticsearchIndex
+	// Caches the responses of the public book endpoints, see cache.go; nil
+	// if they are not cached
+	cached echo.MiddlewareFunc
+	// Replays the responses to requests sent again with the same
+	// Idempotency-Key, see idempotency.go
+	idempotent echo.MiddlewareFunc
+	// The chores done on a schedule, see jobs.go
+	jobs *scheduler
+	// The statistics as last computed by the stats job
+	stats *statsSnapshot
+	// Serves the library branches, see tenants.go; nil without tenancy
+	// and for the servers of the branches themselves
+	tenants *tenantRouter
+}
+
+// Endpoint definition. Here, we divided into two groups: top-level routes
+// starting with /, which usually serve webpages. For our RESTful endpoints,
+// we prefix the route with /api to indicate more information or resources
+// are available under such route.
+func (s *server) registerRoutes(e *echo.Echo) {
+	// The HTML pages come with the security headers, see security.go, know
+	// who is logged in through the session cookie, are protected against
+	// cross-site request forgery and speak the language of the user, see
+	// i18n.go
+	pages := e.Group("", s.setSecurityHeaders, s.loadSession, s.csrf(), s.detectLanguage)
+	pages.GET("/", func(c echo.Context) error {
+		return c.Render(200, "index", s.indexView(c, nil))
+	})
+	pages.GET("/login", s.loginPage)
+	pages.POST("/login", s.loginForm)
+	pages.POST("/logout", s.logout)
+	pages.GET("/auth/:provider/login", s.oauthLogin)
+	pages.GET("/auth/:provider/callback", s.oauthCallback)
+
+	// The book table is edited in place, see forms.go
+	pageWrite := requirePageScope(ScopeBooksWrite)
+	pageRemove := requirePageScope(ScopeBooksDelete)
+	pages.GET("/books", s.booksPage)
+	pages.POST("/books", s.submitBookForm, pageWrite)
+	pages.GET("/books/:id", s.bookDetailPage)
+	pages.GET("/books/:id/row", s.bookRow)
+	pages.GET("/books/:id/edit", s.editBookRow, pageWrite)
+	pages.PUT("/books/:id", s.saveBookRow, pageWrite)
+	pages.DELETE("/books/:id", s.deleteBookRow, pageRemove)
+	pages.GET("/authors", s.authorsPage)
+	pages.GET("/years", s.yearsPage)
+	pages.GET("/stats", s.statsPage)
+	pages.GET("/search", func(c echo.Context) error {
+		return c.Render(200, "search-bar", nil)
+	})
+	pages.GET("/search/results", s.searchResults)
+	pages.GET("/create", s.createBookForm, pageWrite)
+	// Reading lists, see shelves.go; shared ones are public
+	pages.GET("/shelves", s.shelvesPage)
+	pages.GET("/shelves/shared/:token", s.sharedShelfPage)
+	// How the library is doing, see admin.go
+	pages.GET("/admin", s.adminPage, requirePageScope(ScopeUsersManage))
+	// Tells the pages when to reload the book table
+	e.GET("/ws", s.serveWS)
+	// The new arrivals for feed readers, see feed.go
+	e.GET("/feed.xml", s.feed)
+	// For search engines, see sitemap.go
+	e.GET("/sitemap.xml", s.sitemap)
+	e.GET("/robots.txt", s.robots)
+
+	// Probed by Kubernetes and load balancers, see health.go
+	e.GET("/healthz", liveness)
+	e.GET("/readyz", s.readiness)
+
+	// The REST API, in every version it is served in, see versions.go
+	for _, v := range apiVersions() {
+		v.mount(s, e)
+	}
+
+	// Reading needs no credentials, mutations check their scopes
+	// themselves, see graphql.go
+	e.POST("/graphql", s.graphqlHandler(), s.optionalAuth)
+
+	// Scraped by Prometheus, see metrics.go
+	e.GET("/metrics", metricsHandler())
+
+	registerDocs(e)
+}
+
+// Registers the routes of version 1 of the REST API on the group, which
+// carries the prefix of the version.
+func (s *server) registerAPIv1(api *echo.Group) {
+	api.POST("/auth/register", s.register)
+	api.POST("/auth/login", s.login)
+
+	// Reading the catalog is public, changing it requires a scope, see
+	// roles.go
+	write := s.requireScope(ScopeBooksWrite)
+	remove := s.requireScope(ScopeBooksDelete)
+	cached := s.cached
+	if cached == nil {
+		cached = func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+	api.GET("/books", s.listBooks, cached)
+	api.GET("/books/search", s.searchBooks, cached)
+	api.GET("/books/suggest", s.suggestBooks, cached)
+	api.GET("/books/export", s.exportBooks)
+	api.GET("/books/events", s.streamBookEvents)
+	api.GET("/books/trash", s.listTrash, remove)
+	api.GET("/books/duplicates", s.listDuplicates, write)
+	api.GET("/books/:id", s.getBook, cached)
+	api.GET("/books/:id/marc", s.getBookMARC)
+	// For the shelf labels, see labels.go
+	api.GET("/books/:id/qr", s.bookQR, cached)
+	api.GET("/books/:id/barcode", s.bookBarcode, cached)
+	api.GET("/books/:id/similar", s.similarBooks, cached)
+	api.POST("/books", s.createBook, write, s.idempotent)
+	api.POST("/books/bulk", s.createBooks, write)
+	api.POST("/books/import", s.importBooks, write)
+	api.POST("/books/merge", s.mergeBooks, write, remove)
+	api.PUT("/books", s.updateBook, write)
+	api.PATCH("/books/:id", s.patchBook, write)
+	api.DELETE("/books", s.deleteBooks, remove)
+	api.DELETE("/books/:id", s.deleteBook, remove)
+	api.POST("/books/:id/restore", s.undeleteBook, remove)
+	api.GET("/books/:id/history", s.listBookHistory, write)
+	api.GET("/books/:id/history/diff", s.diffBookRevisions, write)
+	api.POST("/books/:id/history/:version/rollback", s.rollbackBook, write)
+	api.PUT("/books/:id/genres/:genre", s.addBookGenre, write)
+	api.DELETE("/books/:id/genres/:genre", s.removeBookGenre, write)
+	api.GET("/books/:id/copies", s.listCopies)
+	api.POST("/books/:id/copies", s.addCopy, write)
+	api.PATCH("/books/:id/copies/:copy", s.patchCopy, write)
+	api.DELETE("/books/:id/copies/:copy", s.removeCopy, write)
+
+	api.GET("/authors", s.listAuthors)
+	api.GET("/authors/:id", s.getAuthor)
+	api.GET("/authors/:id/books", s.listAuthorBooks)
+	api.POST("/authors", s.createAuthor, write)
+	api.PUT("/authors/:id", s.updateAuthor, write)
+	api.DELETE("/authors/:id", s.deleteAuthor, remove)
+
+	api.GET("/genres", s.listGenres)
+
+	api.GET("/stats", s.getStats, cached)
+	api.POST("/genres", s.createGenre, write)
+	api.DELETE("/genres/:name", s.deleteGenre, remove)
+
+	loans := api.Group("/loans", s.requireScope(ScopeLoansManage))
+	loans.GET("", s.listLoans)
+	loans.POST("", s.checkOut)
+	loans.GET("/overdue", s.listOverdueLoans)
+	loans.GET("/:id", s.getLoan)
+	loans.POST("/:id/return", s.returnLoan)
+
+	// Holds are placed and cancelled by the users themselves, see
+	// reservations.go
+	api.GET("/books/:id/reservations", s.listBookReservations, s.requireScope(ScopeLoansManage))
+	api.POST("/books/:id/reservations", s.placeHold, s.requireAuth)
+	api.GET("/reservations", s.listReservations, s.requireAuth)
+	api.DELETE("/reservations/:id", s.cancelHold, s.requireAuth)
+
+	// Users keep track of their reading themselves, see progress.go
+	api.GET("/books/:id/progress", s.getProgress, s.requireAuth)
+	api.PUT("/books/:id/progress", s.saveProgress, s.requireAuth)
+	api.DELETE("/books/:id/progress", s.deleteProgress, s.requireAuth)
+	api.GET("/reading", s.getReadingDashboard, s.requireAuth)
+
+	// Users set their own preferences, see me.go
+	api.GET("/me", s.getMe, s.requireAuth)
+	api.PATCH("/me", s.patchMe, s.requireAuth)
+	// and their second factor, see twofactor.go
+	api.POST("/me/2fa", s.enrollTOTP, s.requireAuth)
+	api.POST("/me/2fa/confirm", s.confirmTOTP, s.requireAuth)
+	api.DELETE("/me/2fa", s.disableTOTP, s.requireAuth)
+	api.POST("/me/2fa/recovery-codes", s.renewRecoveryCodes, s.requireAuth)
+
+	shelves := api.Group("/shelves", s.requireAuth)
+	shelves.GET("", s.listShelves)
+	shelves.POST("", s.createShelf)
+	shelves.GET("/:id", s.getShelf)
+	shelves.PATCH("/:id", s.patchShelf)
+	shelves.DELETE("/:id", s.deleteShelf)
+	shelves.PUT("/:id/books", s.reorderShelf)
+	shelves.PUT("/:id/books/:book", s.addShelfBook)
+	shelves.DELETE("/:id/books/:book", s.removeShelfBook)
+
+	// Users keep searches to run again, see searches.go
+	searches := api.Group("/searches", s.requireAuth)
+	searches.GET("", s.listSavedSearches)
+	searches.POST("", s.createSavedSearch)
+	searches.GET("/:id", s.getSavedSearch)
+	searches.PATCH("/:id", s.patchSavedSearch)
+	searches.DELETE("/:id", s.deleteSavedSearch)
+	searches.GET("/:id/books", s.runSavedSearch)
+
+	users := api.Group("/users", s.requireScope(ScopeUsersManage))
+	users.GET("", s.listUsers)
+	users.POST("", s.createUser)
+	users.GET("/:id", s.getUser)
+	users.PATCH("/:id", s.patchUser)
+	users.DELETE("/:id", s.deleteUser)
+
+	keys := api.Group("/keys", s.requireScope(ScopeUsersManage))
+	keys.GET("", s.listAPIKeys)
+	keys.POST("", s.createAPIKey)
+	keys.DELETE("/:id", s.revokeAPIKey)
+
+	// Integrations are managed like API keys, see webhooks.go
+	hooks := api.Group("/webhooks", s.requireScope(ScopeUsersManage))
+	hooks.GET("", s.listWebhooks)
+	hooks.POST("", s.createWebhook)
+	hooks.GET("/:id", s.getWebhook)
+	hooks.DELETE("/:id", s.deleteWebhook)
+	hooks.GET("/:id/deliveries", s.listWebhookDeliveries)
+
+	// Who changed which book, for compliance reviews, see audit.go
+	api.GET("/audit", s.listAudit, s.requireScope(ScopeAuditRead))
+
+	// Snapshots of the catalog, see backup.go
+	admin := api.Group("/admin", remove)
+	admin.GET("/backup", s.backupBooks)
+	admin.POST("/restore", s.restoreBooks)
+	if s.search != nil {
+		admin.POST("/search/reindex", s.reindexSearch)
+	}
+	// The chores done on a schedule, see jobs.go
+	admin.GET("/jobs", s.listJobs)
+	admin.POST("/jobs/:name/run", s.runJob)
+	// The library branches concern all users, see tenants.go
+	if s.tenants != nil {
+		tenants := api.Group("/admin/tenants", s.requireScope(ScopeUsersManage))
+		tenants.GET("", s.listTenants)
+		tenants.POST("", s.createTenant)
+		tenants.GET("/:slug", s.getTenant)
+		tenants.PATCH("/:slug", s.patchTenant)
+		tenants.DELETE("/:slug", s.deleteTenant)
+	}
+	// Accounts and IP addresses locked out after failed logins, see
+	// lockout.go
+	if s.lockout != nil {
+		lockouts := api.Group("/admin/lockouts", s.requireScope(ScopeUsersManage))
+		lockouts.GET("", s.listLockouts)
+		lockouts.DELETE("/:kind/:name", s.unlock)
+	}
+
+	api.GET("/isbn/validate", validateISBN)
+	// Asking the external catalogs is meant for entering books, see
+	// lookup.go
+	api.GET("/isbn/:isbn/lookup", s.lookupBook, write)
+	api.POST("/books/from-isbn", s.createBookFromISBN, write)
+}
+
+// Parses the :id path parameter.
+func bookID(c echo.Context) (primitive.ObjectID, error) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return objID, echo.NewHTTPError(http.StatusBadRequest, "Invalid ID format")
+	}
+	return objID, nil
+}
+
+// Converts the books for the API. Every book gets the number of its
+// copies, and the linked authors are embedded as author_info; both are
+// fetched with a single query for all the books.
+func (s *server) bookDTOs(ctx context.Context, books []BookStore) ([]BookDTO, error) {
+	var bookIDs, authorIDs []primitive.ObjectID
+	for _, b := range books {
+		bookIDs = append(bookIDs, b.ID)
+		if !b.AuthorID.IsZero() {
+			authorIDs = append(authorIDs, b.AuthorID)
+		}
+	}
+	authors, err := s.authors.FindByIDs(ctx, authorIDs)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[primitive.ObjectID]Author{}
+	for _, a := range authors {
+		byID[a.ID] = a
+	}
+	counts, err := s.copies.Count(ctx, bookIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []BookDTO{}
+	for _, b := range books {
+		book := newBookDTO(b)
+		if a, ok := byID[b.AuthorID]; ok {
+			book.AuthorInfo = &a
+		}
+		copies := counts[b.ID]
+		book.Copies = &copies
+		ret = append(ret, book)
+	}
+	return ret, nil
+}
+
+// Serves a page of the book table, or the books on it as JSON, like
+// /api/books does, or as CSV, like /api/books/export does, see
+// negotiate.go.
+func (s *server) booksPage(c echo.Context) error {
+	format, err := pageFormat(c)
+	if err != nil {
+		return err
+	}
+	q, err := parseBookQuery(c, pageSize(c, 10))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	results, total, err := s.books.FindAll(ctx, q)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		return s.booksJSON(ctx, c, q, results, total)
+	case "csv":
+		records := make([][]interface{}, len(results))
+		for i, b := range results {
+			records[i] = exportRecord(b)
+		}
+		return writeCSV(c, "books", exportHeader, records)
+	}
+
+	var books []BookDTO
+	for _, b := range results {
+		books = append(books, bookRowView(c, newBookDTO(b)))
+	}
+	page := newBookPage(c, q, books, total)
+	page.CanWrite = hasScope(c, ScopeBooksWrite)
+	page.CanDelete = hasScope(c, ScopeBooksDelete)
+	return c.Render(200, "book-table", page)
+}
+
+func (s *server) authorsPage(c echo.Context) error {
+	format, err := pageFormat(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	authors, err := s.books.GroupByAuthor(ctx)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		return jsonWithETag(c, authors)
+	case "csv":
+		records := make([][]interface{}, len(authors))
+		for i, a := range authors {
+			records[i] = []interface{}{a.Author, a.Books, strings.Join(a.Titles, ";")}
+		}
+		return writeCSV(c, "authors", []string{"author", "books", "titles"}, records)
+	}
+	return c.Render(200, "author-table", authors)
+}
+
+func (s *server) yearsPage(c echo.Context) error {
+	format, err := pageFormat(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	decades, err := s.books.GroupByDecade(ctx)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		return jsonWithETag(c, decades)
+	case "csv":
+		records := make([][]interface{}, len(decades))
+		for i, d := range decades {
+			records[i] = []interface{}{d.Decade, d.Books, strings.Join(d.Titles, ";")}
+		}
+		return writeCSV(c, "years", []string{"decade", "books", "titles"}, records)
+	}
+	return c.Render(200, "year-table", decades)
+}
+
+func (s *server) searchResults(c echo.Context) error {
+	text := strings.TrimSpace(c.QueryParam("q"))
+	if text == "" {
+		return c.Render(200, "search-results", nil)
+	}
+	filter, err := parseSearchFilter(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	limit := pageSize(c, 20)
+	res, err := s.books.FacetedSearch(ctx, text, filter, limit)
+	if err != nil {
+		return err
+	}
+	// Maybe it was misspelled
+	if len(res.Hits) == 0 {
+		if res, err = s.fuzzy.FacetedSearch(ctx, text, filter, limit); err != nil {
+			return err
+		}
+	}
+
+	var books []BookDTO
+	for _, hit := range res.Hits {
+		books = append(books, newBookDTO(hit.BookStore))
+	}
+	chips, active := facetChips(c, res.Facets)
+	return c.Render(200, "search-results", map[string]interface{}{
+		"Books":  books,
+		"Chips":  chips,
+		"Active": active,
+	})
+}
+
+func (s *server) listBooks(c echo.Context) error {
+	q, err := parseBookQuery(c, 0)
+	if err != nil {
+		return err
+	}
+
+	if q.Limit == 0 {
+		return s.streamBooks(c, q)
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	results, total, err := s.books.FindAll(ctx, q)
+	if err != nil {
+		return err
+	}
+	return s.booksJSON(ctx, c, q, results, total)
+}
+
+// Answers an unpaginated listing, which can be the whole catalog, by
+// writing the books out while they are read, a batch at a time. The body
+// is not known before it is sent, so it comes without an ETag, and an
+// error halfway through cuts it short.
+func (s *server) streamBooks(c echo.Context, q BookQuery) error {
+	ctx := c.Request().Context()
+	countCtx, cancel := requestContext(c)
+	total, err := s.books.Count(countCtx, q)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	res.WriteHeader(http.StatusOK)
+	res.Write([]byte("["))
+
+	var batch []BookStore
+	first := true
+	flush := func() error {
+		books, err := s.bookDTOs(ctx, batch)
+		if err != nil {
+			return err
+		}
+		batch = batch[:0]
+		for _, book := range books {
+			body, err := json.Marshal(book)
+			if err != nil {
+				return err
+			}
+			if !first {
+				res.Write([]byte(","))
+			}
+			first = false
+			res.Write(body)
+		}
+		res.Flush()
+		return nil
+	}
+	err = s.books.Each(ctx, q, func(b BookStore) error {
+		batch = append(batch, b)
+		if len(batch) < exportBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = res.Write([]byte("]"))
+	return err
+}
+
+// Answers with a page of books as /api/books serves them, the pagination
+// in the headers.
+func (s *server) booksJSON(ctx context.Context, c echo.Context, q BookQuery, results []BookStore, total int64) error {
+	books, err := s.bookDTOs(ctx, results)
+	if err != nil {
+		return err
+	}
+	setPaginationHeaders(c, newBookPage(c, q, books, total))
+	return jsonWithETag(c, books)
+}
+
+func (s *server) searchBooks(c echo.Context) error {
+	text := strings.TrimSpace(c.QueryParam("q"))
+	if text == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "q must not be empty")
+	}
+	q, err := parsePagination(c, maxPageLimit)
+	if err != nil {
+		return err
+	}
+	fuzzy, err := parseFlag(c, "fuzzy")
+	if err != nil {
+		return err
+	}
+	facets, err := parseFlag(c, "facets")
+	if err != nil {
+		return err
+	}
+	filter, err := parseSearchFilter(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	search, facetedSearch := s.books.Search, s.books.FacetedSearch
+	if fuzzy {
+		search, facetedSearch = s.fuzzy.Search, s.fuzzy.FacetedSearch
+	}
+	var res SearchResult
+	if facets || !filter.IsEmpty() {
+		res, err = facetedSearch(ctx, text, filter, q.Limit)
+	} else {
+		res.Hits, err = search(ctx, text, q.Limit)
+	}
+	if err != nil {
+		return err
+	}
+
+	hits := []BookDTO{}
+	for _, hit := range res.Hits {
+		book := newBookDTO(hit.BookStore)
+		book.Score = &hit.Score
+		hits = append(hits, book)
+	}
+	// The plain array stays the default, for the clients that came before
+	// the facets
+	if !facets {
+		return c.JSON(http.StatusOK, hits)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"hits": hits, "facets": res.Facets})
+}
+
+func (s *server) getBook(c echo.Context) error {
+	objID, err := bookID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	book, err := s.books.FindByID(ctx, objID)
+	if err != nil {
+		return err
+	}
+	books, err := s.bookDTOs(ctx, []BookStore{book})
+	if err != nil {
+		return err
+	}
+	return jsonWithETag(c, books[0])
+}
+
+// With ?mode=upsert, a book with the ISBN of a stored one replaces that
+// instead of being turned away, for jobs pushing snapshots of another
+// catalog. Books in the trash are left there and still conflict.
+func (s *server) createBook(c echo.Context) error {
+	mode := c.QueryParam("mode")
+	if mode != "" && mode != "create" && mode != "upsert" {
+		return echo.NewHTTPError(http.StatusBadRequest, "mode must be create or upsert")
+	}
+	var newBook BookStore
+	if err := c.Bind(&newBook); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid book data").SetInternal(err)
+	}
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	created, err := s.storeBook(ctx, newBook)
+	var dup *DuplicateBookError
+	if mode == "upsert" && errors.As(err, &dup) {
+		if _, findErr := s.books.FindByID(ctx, dup.ExistingID); findErr != nil {
+			if errors.Is(findErr, ErrBookNotFound) {
+				return err
+			}
+			return findErr
+		}
+		newBook.ID = dup.ExistingID
+		updated, err := s.replaceBook(ctx, newBook)
+		if err != nil {
+			return err
+		}
+		tag, err := s.bookETag(ctx, c, updated)
+		if err != nil {
+			return err
+		}
+		c.Response().Header().Set(headerETag, tag)
+		return c.JSON(http.StatusOK, map[string]interface{}{"message": "Book modified successfully", "id": updated.ID.Hex()})
+	}
+	if err != nil {
+		return err
+	}
+
+	// Response
+	return c.JSON(http.StatusCreated, map[string]interface{}{"message": "Book created successfully", "id": created.ID.Hex()})
+}
+
+// Validates and inserts a new book.
+func (s *server) storeBook(ctx context.Context, newBook BookStore) (BookStore, error) {
+	// Data Validation, a linked author provides the author name
+	if err := s.linkAuthor(ctx, &newBook); err != nil {
+		return newBook, err
+	}
+	if err := validateBook(newBook); err != nil {
+		return newBook, err
+	}
+	normalizeBook(&newBook)
+	if err := s.checkVocabulary(ctx, newBook.Genres); err != nil {
+		return newBook, err
+	}
+
+	// Data Insertion, the repository takes care of rejecting duplicates
+	return s.books.Insert(ctx, newBook)
+}
+
+func (s *server) createBooks(c echo.Context) error {
+	var books []BookStore
+	if err := c.Bind(&books); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Expected a JSON array of books").SetInternal(err)
+	}
+	if len(books) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "No books given")
+	}
+	if len(books) > maxBulkSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d books can be inserted at once", maxBulkSize))
+	}
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	results, err := s.insertBooks(ctx, books)
+	if err != nil {
+		return err
+	}
+
+	inserted := 0
+	for _, r := range results {
+		if r.Error == "" {
+			inserted++
+		}
+	}
+	status := http.StatusCreated
+	if inserted < len(results) {
+		status = http.StatusMultiStatus
+	}
+	return c.JSON(status, map[string]interface{}{
+		"inserted": inserted,
+		"failed":   len(results) - inserted,
+		"results":  results,
+	})
+}
+
+// Validates the books and inserts the valid ones. Invalid books never
+// reach the repository; we remember where the valid ones came from to
+// merge both kinds of results afterwards.
+func (s *server) insertBooks(ctx context.Context, books []BookStore) ([]BulkResult, error) {
+	results := make([]BulkResult, len(books))
+	var valid []BookStore
+	var validIndex []int
+	for i, book := range books {
+		results[i].Index = i
+		err := s.linkAuthor(ctx, &book)
+		if err == nil {
+			err = validateBook(book)
+		}
+		if err == nil {
+			normalizeBook(&book)
+			err = s.checkVocabulary(ctx, book.Genres)
+		}
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			results[i].Error = err.Error()
+			results[i].Fields = validationErr.Fields
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		valid = append(valid, book)
+		validIndex = append(validIndex, i)
+	}
+
+	if len(valid) > 0 {
+		inserted, err := s.books.InsertMany(ctx, valid)
+		if err != nil {
+			return nil, err
+		}
+		for j, r := range inserted {
+			results[validIndex[j]].ID = r.ID
+			results[validIndex[j]].Error = r.Error
+			results[validIndex[j]].ExistingID = r.ExistingID
+		}
+	}
+	return results, nil
+}
+
+func (s *server) updateBook(c echo.Context) error {
+	var newBook BookStore
+	if err := c.Bind(&newBook); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid book data").SetInternal(err)
+	}
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	version, err := s.checkIfMatch(ctx, c, newBook.ID)
+	if err != nil {
+		return err
+	}
+	if newBook.Version == 0 {
+		newBook.Version = version
+	}
+	updated, err := s.replaceBook(ctx, newBook)
+	if err != nil {
+		return err
+	}
+	tag, err := s.bookETag(ctx, c, updated)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(headerETag, tag)
+
+	// Response
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Book modified successfully", "id": newBook.ID})
+}
+
+// Validates the book and replaces the stored book with the same ID.
+func (s *server) replaceBook(ctx context.Context, newBook BookStore) (BookStore, error) {
+	if err := s.linkAuthor(ctx, &newBook); err != nil {
+		return newBook, err
+	}
+	if err := validateBook(newBook); err != nil {
+		return newBook, err
+	}
+	normalizeBook(&newBook)
+	if err := s.checkVocabulary(ctx, newBook.Genres); err != nil {
+		return newBook, err
+	}
+	return s.books.Update(ctx, newBook)
+}
+
+func (s *server) patchBook(c echo.Context) error {
+	objID, err := bookID(c)
+	if err != nil {
+		return err
+	}
+
+	var patch BookPatch
+	if err := c.Bind(&patch); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid book data").SetInternal(err)
+	}
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	if err := s.linkPatchAuthor(ctx, &patch); err != nil {
+		return err
+	}
+	if err := validatePatch(patch); err != nil {
+		return err
+	}
+	normalizePatch(&patch)
+	if patch.IsEmpty() {
+		return echo.NewHTTPError(http.StatusBadRequest, "Nothing to update")
+	}
+	if patch.Genres != nil {
+		if err := s.checkVocabulary(ctx, *patch.Genres); err != nil {
+			return err
+		}
+	}
+
+	version, err := s.checkIfMatch(ctx, c, objID)
+	if err != nil {
+		return err
+	}
+	if patch.Version == nil && version != 0 {
+		patch.Version = &version
+	}
+	updated, err := s.books.Patch(ctx, objID, patch)
+	if err != nil {
+		return err
+	}
+	books, err := s.bookDTOs(ctx, []BookStore{updated})
+	if err != nil {
+		return err
+	}
+	return taggedJSON(c, books[0])
+}
+
+// Deletes every book matching the same filters /api/books understands.
+// Since this can wipe large parts of the catalog, the caller has to
+// either ask for a dry run, which only reports how many books would be
+// removed, or explicitly confirm the deletion.
+func (s *server) deleteBooks(c echo.Context) error {
+	var q BookQuery
+	if err := parseBookFilter(c, &q); err != nil {
+		return err
+	}
+	if !q.HasFilter() {
+		return echo.NewHTTPError(http.StatusBadRequest, "At least one filter is required")
+	}
+	dryRun, err := parseFlag(c, "dry_run")
+	if err != nil {
+		return err
+	}
+	confirm, err := parseFlag(c, "confirm")
+	if err != nil {
+		return err
+	}
+	if !dryRun && !confirm {
+		return echo.NewHTTPError(http.StatusBadRequest, "Pass confirm=true to delete or dry_run=true to preview")
+	}
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+
+	if dryRun {
+		count, err := s.books.Count(ctx, q)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"dry_run": true, "matched": count, "deleted": 0})
+	}
+
+	// The copies stay until the books are purged from the trash
+	deleted, err := s.books.DeleteMany(ctx, q)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"dry_run": false, "matched": deleted, "deleted": deleted})
+}
+
+func (s *server) deleteBook(c echo.Context) error {
+	objID, err := bookID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	if err = s.removeBook(ctx, objID); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Book deleted successfully", "id": objID.Hex()})
+}
+
+// Moves the book to the trash. Its copies are kept for when it is
+// undeleted, and only removed together with it by purgeTrash.
+func (s *server) removeBook(ctx context.Context, id primitive.ObjectID) error {
+	return s.books.Delete(ctx, id)
+}
+
+// Lets the frontend check an ISBN while the user is still typing it. The
+// answer also contains both forms of a valid ISBN.
+func validateISBN(c echo.Context) error {
+	raw := c.QueryParam("isbn")
+	if raw == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "isbn must not be empty")
+	}
+
+	ret := map[string]interface{}{"isbn": raw, "valid": true}
+	isbn13, err := isbn.ToISBN13(raw)
+	if err != nil {
+		ret["valid"] = false
+		ret["error"] = err.Error()
+		return c.JSON(http.StatusOK, ret)
+	}
+	ret["isbn13"] = isbn13
+	if isbn10, err := isbn.ToISBN10(raw); err == nil {
+		ret["isbn10"] = isbn10
+	}
+	return c.JSON(http.StatusOK, ret)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The templates the pages render; an instance missing one cannot serve
+// the web UI.
+var pageTemplates = []string{"index", "book-table", "book-row", "book-edit-row", "book-form", "author-table", "year-table", "stats", "search-bar", "search-results", "login-form"}
+
+// The outcome of checking a single dependency.
+type healthCheck struct {
+	Status string `json:"status"`
+	// How long the check took, in milliseconds
+	Latency int64  `json:"latency_ms,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func checkResult(err error, took time.Duration) healthCheck {
+	check := healthCheck{Status: "ok", Latency: took.Milliseconds()}
+	if err != nil {
+		check.Status = "unavailable"
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// Tells whether all the page templates were loaded.
+func checkTemplates(r echo.Renderer) healthCheck {
+	t, ok := r.(*Template)
+	if !ok || t == nil || len(t.tmpl) == 0 {
+		return healthCheck{Status: "unavailable", Error: "no templates loaded"}
+	}
+	for lang, tmpl := range t.tmpl {
+		for _, name := range pageTemplates {
+			if tmpl.Lookup(name) == nil {
+				return healthCheck{Status: "unavailable", Error: "template " + name + " is missing for " + lang}
+			}
+		}
+	}
+	return healthCheck{Status: "ok"}
+}
+
+// Answers as long as the process serves requests at all. It checks no
+// dependencies, so an outage of the database does not get the instance
+// restarted; that is what /readyz is for.
+func liveness(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Checks the dependencies an instance needs to serve requests: the
+// database and Redis, if there is one, which must answer a ping within
+// timeouts.ready, and the page templates. Answers 503 as soon as one of them is unavailable, so no
+// traffic is routed to the instance until it recovers.
+func (s *server) readiness(c echo.Context) error {
+	checks := map[string]healthCheck{}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), s.readyTimeout)
+	defer cancel()
+	if s.ping != nil {
+		start := time.Now()
+		err := s.ping(ctx)
+		checks["database"] = checkResult(err, time.Since(start))
+	} else {
+		checks["database"] = healthCheck{Status: "ok"}
+	}
+	if s.pingRedis != nil {
+		start := time.Now()
+		err := s.pingRedis(ctx)
+		checks["redis"] = checkResult(err, time.Since(start))
+	}
+	checks["templates"] = checkTemplates(c.Echo().Renderer)
+
+	status, code := "ok", http.StatusOK
+	for _, check := range checks {
+		if check.Status != "ok" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	return c.JSON(code, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
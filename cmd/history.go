@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The history of a book is read from the audit log: every entry with a
+// snapshot after the change is a revision of the book, numbered with the
+// version the change gave the book. Changes made before the audit log
+// existed have no revision, and asking for one fails with
+// ErrRevisionNotFound.
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// The fields a diff compares, i.e. those a client can change. The version
+// and the timestamps differ between any two revisions anyway.
+var diffFields = []string{"name", "author", "author_id", "isbn", "pages", "year", "genres"}
+
+// A field that differs between two revisions, in the format of
+// /api/books. From or To is nil if the revision lacks the field.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+func diffBooks(from, to BookStore) []FieldChange {
+	a, b := newBookDTO(from).changeable(), newBookDTO(to).changeable()
+	changes := []FieldChange{}
+	for _, field := range diffFields {
+		if !reflect.DeepEqual(a[field], b[field]) {
+			changes = append(changes, FieldChange{Field: field, From: a[field], To: b[field]})
+		}
+	}
+	return changes
+}
+
+// Converts an audit entry for the history of its book. Entries of
+// revisions carry the version and the book as it was then.
+func revisionJSON(e AuditEntry) map[string]interface{} {
+	rev := auditEntryJSON(e)
+	delete(rev, "book_id")
+	delete(rev, "before")
+	delete(rev, "after")
+	if e.After != nil {
+		rev["version"] = e.After.Version
+		rev["book"] = newBookDTO(*e.After)
+	}
+	return rev
+}
+
+// Looks up the given revision of the book. A book's history is short, so
+// it is searched as a whole.
+func (s *server) findRevision(ctx context.Context, id primitive.ObjectID, version int64) (BookStore, error) {
+	entries, _, err := s.audit.FindAll(ctx, AuditQuery{BookID: id})
+	if err != nil {
+		return BookStore{}, err
+	}
+	for _, e := range entries {
+		if e.After != nil && e.After.Version == version {
+			return *e.After, nil
+		}
+	}
+	return BookStore{}, ErrRevisionNotFound
+}
+
+func parseRevision(raw string, name string) (int64, error) {
+	version, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || version < 1 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, name+" must be a positive integer")
+	}
+	return version, nil
+}
+
+// Lists the changes to a book, the newest first, including those to books
+// in the trash or purged from it.
+func (s *server) listBookHistory(c echo.Context) error {
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	page, err := parsePagination(c, defaultAuditLimit)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	entries, total, err := s.audit.FindAll(ctx, AuditQuery{Page: page.Page, Limit: page.Limit, BookID: id})
+	if err != nil {
+		return err
+	}
+	result := make([]map[string]interface{}, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, revisionJSON(e))
+	}
+	setPaginationHeaders(c, newBookPage(c, page, nil, total))
+	return c.JSON(http.StatusOK, result)
+}
+
+// Compares the revisions ?from= and ?to= of a book field by field.
+func (s *server) diffBookRevisions(c echo.Context) error {
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	from, err := parseRevision(c.QueryParam("from"), "from")
+	if err != nil {
+		return err
+	}
+	to, err := parseRevision(c.QueryParam("to"), "to")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	older, err := s.findRevision(ctx, id, from)
+	if err != nil {
+		return err
+	}
+	newer, err := s.findRevision(ctx, id, to)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"book_id": id,
+		"from":    from,
+		"to":      to,
+		"changes": diffBooks(older, newer),
+	})
+}
+
+// Sets the fields of a book back to those of an earlier revision. This is
+// a change like any other: the book gets a new version, and the revisions
+// in between stay in the history. The rollback honours If-Match like PUT.
+func (s *server) rollbackBook(c echo.Context) error {
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	version, err := parseRevision(c.Param("version"), "version")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	revision, err := s.findRevision(ctx, id, version)
+	if err != nil {
+		return err
+	}
+	current, err := s.checkIfMatch(ctx, c, id)
+	if err != nil {
+		return err
+	}
+	book := BookStore{
+		ID:         id,
+		BookName:   revision.BookName,
+		BookAuthor: revision.BookAuthor,
+		BookISBN:   revision.BookISBN,
+		BookPages:  revision.BookPages,
+		BookYear:   revision.BookYear,
+		AuthorID:   revision.AuthorID,
+		Genres:     revision.Genres,
+		Version:    current,
+	}
+	updated, err := s.replaceBook(ctx, book)
+	if err != nil {
+		return err
+	}
+	books, err := s.bookDTOs(ctx, []BookStore{updated})
+	if err != nil {
+		return err
+	}
+	return taggedJSON(c, books[0])
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/language"
+)
+
+// The web UI speaks English and German. Its strings are written in English
+// right in the views and in the handlers, and the English string is the
+// key to its translation in the catalogs below, see messages_de.go. A
+// string without a translation is shown in English.
+//
+// The language of a page is, in this order:
+//
+//   - the one asked for with ?lang=, which is remembered in a cookie, and
+//     as the preference of the user who is logged in
+//   - the one the user who is logged in prefers, see me.go
+//   - the one remembered in the cookie
+//   - the one the browser prefers the most, by its Accept-Language
+//   - English
+//
+// The API is not translated.
+
+// The languages of the web UI, the first one being the default.
+var languages = []language.Tag{language.English, language.German}
+
+var languageMatcher = language.NewMatcher(languages)
+
+// The translations by language. English needs none.
+var catalogs = map[string]map[string]string{
+	"de": messagesDE,
+}
+
+// Remembers the language asked for with ?lang= for a year.
+const (
+	languageCookie    = "lang"
+	languageCookieAge = 365 * 24 * time.Hour
+)
+
+// The code of a language, e.g. "de".
+func languageCode(tag language.Tag) string {
+	base, _ := tag.Base()
+	return base.String()
+}
+
+// The codes of the languages of the web UI.
+func languageCodes() []string {
+	codes := make([]string, len(languages))
+	for i, tag := range languages {
+		codes[i] = languageCode(tag)
+	}
+	return codes
+}
+
+// Translates the English string into the language. The arguments are
+// formatted into the translation like fmt.Sprintf does.
+func translate(lang string, key string, args ...interface{}) string {
+	msg, ok := catalogs[lang][key]
+	if !ok {
+		msg = key
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// Translates the English string into the language of the page, for the
+// strings the handlers put into it.
+func tr(c echo.Context, key string, args ...interface{}) string {
+	return translate(pageLanguage(c), key, args...)
+}
+
+// Returns the language detected by detectLanguage.
+func pageLanguage(c echo.Context) string {
+	if c == nil {
+		return languageCode(languages[0])
+	}
+	lang, ok := c.Get("lang").(string)
+	if !ok {
+		return languageCode(languages[0])
+	}
+	return lang
+}
+
+// Detects the language of the pages, as laid out above.
+func (s *server) detectLanguage(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var remembered string
+		if cookie, err := c.Cookie(languageCookie); err == nil {
+			remembered = cookie.Value
+		}
+		user := currentUser(c)
+		if user != nil && user.Language != "" {
+			remembered = user.Language
+		}
+		if asked := c.QueryParam("lang"); asked != "" {
+			if tag, _, confidence := languageMatcher.Match(language.Make(asked)); confidence >= language.High {
+				remembered = languageCode(tag)
+				c.SetCookie(s.newCookie(languageCookie, remembered, languageCookieAge))
+				if user != nil && user.Language != remembered {
+					s.rememberLanguage(c, user, remembered)
+				}
+			}
+		}
+		tag, _ := language.MatchStrings(languageMatcher, remembered, c.Request().Header.Get("Accept-Language"))
+		lang := languageCode(tag)
+		c.Set("lang", lang)
+
+		c.Response().Header().Set("Content-Language", lang)
+		c.Response().Header().Add("Vary", "Accept-Language")
+		return next(c)
+	}
+}
+
+// Stores the language as the user's preference. Failing to is no reason
+// to fail the page, which is shown in the language anyway. The other
+// preferences are read again, as they may have changed since the user was
+// loaded for this request.
+func (s *server) rememberLanguage(c echo.Context, user *User, lang string) {
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	updated, err := s.users.FindByID(ctx, user.ID)
+	if err == nil {
+		updated.Language = lang
+		_, err = s.users.SetPreferences(ctx, updated)
+	}
+	if err != nil {
+		log.Printf("Failed to remember the language of %s: %v", user.Username, err)
+		return
+	}
+	user.Language = lang
+}
+
+// The functions the views translate with: t translates like translate,
+// lang is the code of the language, for the lang attribute.
+func templateFuncs(lang string) template.FuncMap {
+	return template.FuncMap{
+		"t": func(key string, args ...interface{}) string {
+			return translate(lang, key, args...)
+		},
+		"lang": func() string {
+			return lang
+		},
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// Clients retrying a request that timed out cannot tell whether it went
+// through. With an Idempotency-Key header, the first request is handled
+// and its response kept; retries with the same key get that response
+// again, marked by Idempotent-Replayed, instead of being handled anew.
+// The keys are those of the user or API key sending them, and each belongs
+// to the request it first came with: a different request with a used key
+// is turned away.
+
+const (
+	headerIdempotencyKey = "Idempotency-Key"
+	headerReplayed       = "Idempotent-Replayed"
+)
+
+// The longest key accepted; UUIDs, as clients usually send, are 36.
+const maxIdempotencyKeyLength = 255
+
+// How many keys the memory store holds at most.
+const maxIdempotencyKeys = 10000
+
+// How long a key is held for a request that is still being handled. Should
+// the instance handling it go down, the key is free again afterwards.
+const idempotencyLockTTL = time.Minute
+
+// The headers of a response that are kept along with the body.
+var idempotentHeaders = []string{echo.HeaderContentType, echo.HeaderLocation, headerETag}
+
+// A request seen with a key. Until it was handled, only the fingerprint is
+// set.
+type idempotencyRecord struct {
+	Fingerprint string      `json:"fingerprint"`
+	Done        bool        `json:"done"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// Keeps the requests seen with a key.
+type idempotencyStore interface {
+	// Claims the key for a request with the given fingerprint, and returns
+	// false. If the key was claimed before, returns its record and true
+	// instead.
+	Begin(ctx context.Context, key, fingerprint string) (idempotencyRecord, bool, error)
+	// Keeps the response to the request the key was claimed for.
+	Finish(ctx context.Context, key string, r idempotencyRecord, ttl time.Duration) error
+	// Frees the key, for requests that failed and may be tried again.
+	Forget(ctx context.Context, key string) error
+}
+
+type memoryIdempotencyEntry struct {
+	record  idempotencyRecord
+	expires time.Time
+}
+
+// Keeps the keys in memory, so retries are only recognized by the
+// instance that handled the request. Once it is full, keys are not kept
+// until some expired.
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryIdempotencyEntry
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{entries: map[string]memoryIdempotencyEntry{}}
+}
+
+func (m *memoryIdempotencyStore) Begin(ctx context.Context, key, fingerprint string) (idempotencyRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if entry, ok := m.entries[key]; ok && now.Before(entry.expires) {
+		return entry.record, true, nil
+	}
+	if len(m.entries) >= maxIdempotencyKeys {
+		for k, entry := range m.entries {
+			if now.After(entry.expires) {
+				delete(m.entries, k)
+			}
+		}
+		if len(m.entries) >= maxIdempotencyKeys {
+			return idempotencyRecord{}, false, nil
+		}
+	}
+	m.entries[key] = memoryIdempotencyEntry{
+		record:  idempotencyRecord{Fingerprint: fingerprint},
+		expires: now.Add(idempotencyLockTTL),
+	}
+	return idempotencyRecord{}, false, nil
+}
+
+// Only keys Begin claimed are kept; those it had no room for are not.
+func (m *memoryIdempotencyStore) Finish(ctx context.Context, key string, r idempotencyRecord, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[key]; !ok {
+		return nil
+	}
+	m.entries[key] = memoryIdempotencyEntry{record: r, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (m *memoryIdempotencyStore) Forget(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// Keeps the keys in Redis, so retries are recognized by every instance.
+// Redis expires them by itself.
+type redisIdempotencyStore struct {
+	client *redis.Client
+	// Starts the keys; the branches of the library, see tenants.go, keep
+	// theirs apart
+	prefix string
+}
+
+// Keeps the keys of the given branch of the library, or of the main
+// library if it is empty.
+func newRedisIdempotencyStore(client *redis.Client, tenant string) *redisIdempotencyStore {
+	prefix := "idempotency:"
+	if tenant != "" {
+		prefix += tenant + ":"
+	}
+	return &redisIdempotencyStore{client: client, prefix: prefix}
+}
+
+// SETNX claims the key, so of two instances getting the same request at
+// once, only one handles it.
+func (r *redisIdempotencyStore) Begin(ctx context.Context, key, fingerprint string) (idempotencyRecord, bool, error) {
+	data, err := json.Marshal(idempotencyRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return idempotencyRecord{}, false, err
+	}
+	claimed, err := r.client.SetNX(ctx, r.prefix+key, data, idempotencyLockTTL).Result()
+	if err != nil || claimed {
+		return idempotencyRecord{}, false, err
+	}
+	var rec idempotencyRecord
+	data, err = r.client.Get(ctx, r.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// Expired just now; taken as still being handled, the client
+		// will try again
+		return idempotencyRecord{Fingerprint: fingerprint}, true, nil
+	}
+	if err != nil {
+		return rec, false, err
+	}
+	if err = json.Unmarshal(data, &rec); err != nil {
+		return rec, false, err
+	}
+	return rec, true, nil
+}
+
+func (r *redisIdempotencyStore) Finish(ctx context.Context, key string, rec idempotencyRecord, ttl time.Duration) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, r.prefix+key, data, ttl).Err()
+}
+
+func (r *redisIdempotencyStore) Forget(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.prefix+key).Err()
+}
+
+// Tells requests apart by their method, path and body.
+func requestFingerprint(req *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, req.Method+" "+req.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Names who sent the request, as the keys of different clients may well be
+// the same. Runs after requireAuth.
+func idempotencyScope(c echo.Context) string {
+	if key := currentAPIKey(c); key != nil {
+		return "key:" + key.ID.Hex()
+	}
+	if user := currentUser(c); user != nil {
+		return "user:" + user.ID.Hex()
+	}
+	return "ip:" + c.RealIP()
+}
+
+// Handles the requests with an Idempotency-Key as laid out above, and
+// keeps their responses for ttl. Only successful responses and those
+// rejecting the request are kept; after errors on our side the request
+// may be tried again. If the store fails, requests are handled as if they
+// came without a key.
+func idempotent(store idempotencyStore, ttl time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			idemKey := strings.TrimSpace(req.Header.Get(headerIdempotencyKey))
+			if idemKey == "" {
+				return next(c)
+			}
+			if len(idemKey) > maxIdempotencyKeyLength {
+				return echo.NewHTTPError(http.StatusBadRequest, "The Idempotency-Key must not be longer than 255 characters")
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return err
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+
+			key := idempotencyScope(c) + ":" + idemKey
+			fingerprint := requestFingerprint(req, body)
+			ctx, cancel := requestContext(c)
+			seen, found, err := store.Begin(ctx, key, fingerprint)
+			cancel()
+			if err != nil {
+				log.Printf("Idempotency: failed to claim %s: %v", key, err)
+				return next(c)
+			}
+			if found {
+				switch {
+				case seen.Fingerprint != fingerprint:
+					return echo.NewHTTPError(http.StatusUnprocessableEntity, "The Idempotency-Key was already used for a different request")
+				case !seen.Done:
+					return echo.NewHTTPError(http.StatusConflict, "A request with this Idempotency-Key is still being handled")
+				}
+				h := c.Response().Header()
+				for name, values := range seen.Header {
+					h[name] = values
+				}
+				h.Set(headerReplayed, "true")
+				return c.Blob(seen.Status, h.Get(echo.HeaderContentType), seen.Body)
+			}
+
+			res := c.Response()
+			rec := &responseRecorder{ResponseWriter: res.Writer}
+			res.Writer = rec
+			err = next(c)
+			res.Writer = rec.ResponseWriter
+
+			// Like the request itself, the key is dealt with even if the
+			// client gave up waiting
+			ctx, cancel = writeContext(c)
+			defer cancel()
+			if !res.Committed || err != nil || rec.status >= http.StatusInternalServerError {
+				if forgetErr := store.Forget(ctx, key); forgetErr != nil {
+					log.Printf("Idempotency: failed to free %s: %v", key, forgetErr)
+				}
+				if !res.Committed {
+					// Errors are only turned into responses further out
+					return err
+				}
+			} else {
+				done := idempotencyRecord{Fingerprint: fingerprint, Done: true, Status: rec.status, Header: http.Header{}, Body: rec.body.Bytes()}
+				for _, name := range idempotentHeaders {
+					if values := res.Header().Values(name); len(values) > 0 {
+						done.Header[http.CanonicalHeaderKey(name)] = values
+					}
+				}
+				if finishErr := store.Finish(ctx, key, done, ttl); finishErr != nil {
+					log.Printf("Idempotency: failed to keep the response for %s: %v", key, finishErr)
+				}
+			}
+
+			// The handler only wrote into the recorder, the response is
+			// sent for real below
+			res.Committed, res.Size = false, 0
+			res.WriteHeader(rec.status)
+			_, _ = res.Write(rec.body.Bytes())
+			return err
+		}
+	}
+}
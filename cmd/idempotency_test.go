@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryIdempotencyStoreLimit(t *testing.T) {
+	ctx := context.Background()
+	m := newMemoryIdempotencyStore()
+	for i := range maxIdempotencyKeys + 500 {
+		key := strconv.Itoa(i)
+		if _, seen, err := m.Begin(ctx, key, "fingerprint"); err != nil || seen {
+			t.Fatalf("Begin(%s) = %v, %v", key, seen, err)
+		}
+		if err := m.Finish(ctx, key, idempotencyRecord{Fingerprint: "fingerprint", Done: true}, 24*time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.entries) != maxIdempotencyKeys {
+		t.Errorf("the store holds %d keys, want %d", len(m.entries), maxIdempotencyKeys)
+	}
+
+	// The keys kept are replayed, the others are handled again
+	if rec, seen, _ := m.Begin(ctx, "0", "fingerprint"); !seen || !rec.Done {
+		t.Errorf("Begin of a kept key = %+v, %v, want the finished record", rec, seen)
+	}
+	if _, seen, _ := m.Begin(ctx, strconv.Itoa(maxIdempotencyKeys), "fingerprint"); seen {
+		t.Error("a key the store had no room for was kept")
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The book fields a CSV column can be mapped to.
+var importFields = []string{"name", "author", "author_id", "isbn", "pages", "year", "genres"}
+
+// Outcome of importing a single CSV row. Row is the line number in the
+// file, counting the header as line 1.
+type ImportRow struct {
+	Row        int          `json:"row"`
+	Status     string       `json:"status"`
+	ID         string       `json:"id,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Fields     []FieldError `json:"fields,omitempty"`
+	ExistingID string       `json:"existing_id,omitempty"`
+}
+
+const (
+	importInserted = "inserted"
+	importSkipped  = "skipped"
+	importFailed   = "failed"
+)
+
+// Opens the uploaded CSV. It is either the "file" field of a multipart
+// form or the whole request body.
+func importSource(c echo.Context) (io.ReadCloser, error) {
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		if err := c.Request().ParseMultipartForm(uploadMemory); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "The form is not valid").SetInternal(err)
+		}
+		header, err := c.FormFile("file")
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "The form lacks the file field").SetInternal(err)
+		}
+		return header.Open()
+	}
+	return c.Request().Body, nil
+}
+
+// Works out which column goes into which book field. Without a mapping,
+// columns named like a field are used. The mapping, a JSON object from
+// column to field, takes the mapped columns instead.
+func importColumns(header []string, mapping string) (map[int]string, []string, error) {
+	byName := map[string]string{}
+	if mapping != "" {
+		if err := json.Unmarshal([]byte(mapping), &byName); err != nil {
+			return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "mapping must be a JSON object from column to field").SetInternal(err)
+		}
+		for column, field := range byName {
+			if !slices.Contains(importFields, field) {
+				return nil, nil, echo.NewHTTPError(http.StatusBadRequest,
+					fmt.Sprintf("Column %q is mapped to %q, which is none of %s", column, field, strings.Join(importFields, ", ")))
+			}
+		}
+	}
+
+	columns := map[int]string{}
+	ignored := []string{}
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		field, ok := byName[name]
+		if mapping == "" {
+			field, ok = strings.ToLower(name), slices.Contains(importFields, strings.ToLower(name))
+		}
+		if !ok {
+			ignored = append(ignored, name)
+			continue
+		}
+		if slices.Contains(mapValues(columns), field) {
+			return nil, nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("More than one column is mapped to %q", field))
+		}
+		columns[i] = field
+	}
+	if len(columns) == 0 {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "No column maps to a book field")
+	}
+	return columns, ignored, nil
+}
+
+func mapValues(m map[int]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// Turns a CSV record into a book. Values that cannot be converted are
+// reported like invalid fields. Genres are separated by semicolons. The
+// quote the export puts in front of text starting like a formula, see
+// csvCell, is dropped.
+func importBook(record []string, columns map[int]string) (BookStore, *ValidationError) {
+	var b BookStore
+	v := &ValidationError{}
+	for i, field := range columns {
+		if i >= len(record) {
+			continue
+		}
+		value := strings.TrimSpace(record[i])
+		if len(value) > 1 && value[0] == '\'' && strings.ContainsRune(formulaStarts, rune(value[1])) {
+			value = value[1:]
+		}
+		switch field {
+		case "name":
+			b.BookName = value
+		case "author":
+			b.BookAuthor = value
+		case "isbn":
+			b.BookISBN = value
+		case "author_id":
+			if value == "" {
+				continue
+			}
+			id, err := primitive.ObjectIDFromHex(value)
+			if err != nil {
+				v.add("author_id", "must be a valid ID")
+			}
+			b.AuthorID = id
+		case "pages", "year":
+			if value == "" {
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				v.add(field, "must be a whole number")
+			}
+			if field == "pages" {
+				b.BookPages = n
+			} else {
+				b.BookYear = n
+			}
+		case "genres":
+			for _, g := range strings.Split(value, ";") {
+				if g = strings.TrimSpace(g); g != "" {
+					b.Genres = append(b.Genres, g)
+				}
+			}
+		}
+	}
+	if len(v.Fields) > 0 {
+		return b, v
+	}
+	return b, nil
+}
+
+// A CSV file read and checked row by row, whose valid books are yet to be
+// inserted.
+type csvImport struct {
+	rows  []ImportRow
+	books []BookStore
+	// The row of each book, by its index in rows
+	bookRows []int
+	ignored  []string
+}
+
+// Reads the books from a CSV file with the given field separator and
+// column mapping, see importColumns. Files with more than maxRows rows
+// are refused, unless maxRows is 0.
+func readImport(src io.Reader, delimiter rune, mapping string, maxRows int) (*csvImport, error) {
+	reader := csv.NewReader(src)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "The file is empty")
+	}
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "The file is not valid CSV").SetInternal(err)
+	}
+	columns, ignored, err := importColumns(slices.Clone(header), mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	imp := &csvImport{ignored: ignored}
+	seenISBN := map[string]int{}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "The file is not valid CSV").SetInternal(err)
+		}
+		line, _ := reader.FieldPos(0)
+		if maxRows > 0 && len(imp.rows) == maxRows {
+			return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d books can be imported at once", maxRows))
+		}
+
+		row := ImportRow{Row: line}
+		book, invalid := importBook(record, columns)
+		if invalid != nil {
+			row.Status = importFailed
+			row.Error = invalid.Error()
+			row.Fields = invalid.Fields
+			imp.rows = append(imp.rows, row)
+			continue
+		}
+		if canonical, err := isbn.Normalize(book.BookISBN); err == nil && canonical != "" {
+			if first, ok := seenISBN[canonical]; ok {
+				row.Status = importSkipped
+				row.Error = fmt.Sprintf("repeats the ISBN of row %d", first)
+				imp.rows = append(imp.rows, row)
+				continue
+			}
+			seenISBN[canonical] = line
+		}
+		imp.rows = append(imp.rows, row)
+		imp.books = append(imp.books, book)
+		imp.bookRows = append(imp.bookRows, len(imp.rows)-1)
+	}
+	if len(imp.rows) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "The file has no rows")
+	}
+	return imp, nil
+}
+
+// The outcome of an import, row by row.
+type ImportReport struct {
+	Inserted       int         `json:"inserted"`
+	Skipped        int         `json:"skipped"`
+	Failed         int         `json:"failed"`
+	IgnoredColumns []string    `json:"ignored_columns"`
+	Rows           []ImportRow `json:"rows"`
+}
+
+// Inserts the valid books of the import, maxBulkSize at a time, and
+// reports how each row fared.
+func (s *server) insertImport(ctx context.Context, imp *csvImport) (ImportReport, error) {
+	for start := 0; start < len(imp.books); start += maxBulkSize {
+		end := min(start+maxBulkSize, len(imp.books))
+		results, err := s.insertBooks(ctx, imp.books[start:end])
+		if err != nil {
+			return ImportReport{}, err
+		}
+		for j, r := range results {
+			row := &imp.rows[imp.bookRows[start+j]]
+			row.ID, row.Error, row.Fields, row.ExistingID = r.ID, r.Error, r.Fields, r.ExistingID
+			switch {
+			case r.ExistingID != "":
+				row.Status = importSkipped
+			case r.Error != "":
+				row.Status = importFailed
+			default:
+				row.Status = importInserted
+			}
+		}
+	}
+
+	report := ImportReport{IgnoredColumns: imp.ignored, Rows: imp.rows}
+	for _, r := range imp.rows {
+		switch r.Status {
+		case importInserted:
+			report.Inserted++
+		case importSkipped:
+			report.Skipped++
+		case importFailed:
+			report.Failed++
+		}
+	}
+	return report, nil
+}
+
+// Imports books from a CSV file. Every row is validated on its own; rows
+// repeating the ISBN of an earlier row or of a stored book are skipped,
+// and the response reports the outcome of each row.
+//
+// The optional mapping parameter maps column names to book fields, the
+// delimiter parameter sets the field separator if it is not a comma.
+func (s *server) importBooks(c echo.Context) error {
+	delimiter := ','
+	if d := c.QueryParam("delimiter"); d != "" {
+		r, ok := parseDelimiter(d)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "delimiter must be a single character")
+		}
+		delimiter = r
+	}
+	mapping := c.FormValue("mapping")
+
+	src, err := importSource(c)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	imp, err := readImport(src, delimiter, mapping, maxBulkSize)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	report, err := s.insertImport(ctx, imp)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// Reads a field separator, which is a single character other than a quote
+// or a line break.
+func parseDelimiter(d string) (rune, bool) {
+	r, size := utf8.DecodeRuneInString(d)
+	return r, size == len(d) && r != '"' && r != '\n' && r != '\r'
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The chores the server does by itself, each on a schedule of its own set
+// under jobs in the configuration. Schedules are written like in crontab,
+// as minute, hour, day of month, month and day of week in the server's
+// time zone, e.g. "30 2 * * 1-5", or as @hourly, @daily, @weekly,
+// @monthly or "@every 10m". Every catalog, that of each library branch as
+// well, runs its own jobs; so does every instance.
+//
+// Admins see when each job ran last and how it went under
+// /api/v1/admin/jobs, and may run a job at once, also one that is
+// disabled.
+
+const (
+	// How many books the metadata job looks up per run
+	refreshMetadataBatch = 100
+	// How long a run of the metadata job may take at most
+	refreshMetadataTimeout = 30 * time.Minute
+)
+
+// A job as configured, with what its last run did.
+type job struct {
+	name     string
+	enabled  bool
+	spec     string
+	schedule schedule
+	// Does the work, and sums it up for the status
+	run func() (string, error)
+
+	mu      sync.Mutex
+	running bool
+	last    *JobRun
+	next    time.Time
+}
+
+// A run of a job. Result sums up what it did, Error why it failed.
+type JobRun struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	OK         bool      `json:"ok"`
+	Result     string    `json:"result,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// A job as /api/v1/admin/jobs lists it. NextRun is only set for enabled
+// jobs.
+type JobStatus struct {
+	Name     string     `json:"name"`
+	Enabled  bool       `json:"enabled"`
+	Schedule string     `json:"schedule"`
+	Running  bool       `json:"running"`
+	LastRun  *JobRun    `json:"last_run,omitempty"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+}
+
+func (j *job) status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st := JobStatus{Name: j.name, Enabled: j.enabled, Schedule: j.spec, Running: j.running, LastRun: j.last}
+	if j.enabled && !j.next.IsZero() {
+		next := j.next
+		st.NextRun = &next
+	}
+	return st
+}
+
+// Runs the job unless it is running already, and reports whether it did.
+func (j *job) start() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running {
+		return false
+	}
+	j.running = true
+	return true
+}
+
+func (j *job) execute() {
+	run := JobRun{StartedAt: time.Now()}
+	result, err := j.run()
+	run.FinishedAt, run.OK, run.Result = time.Now(), err == nil, result
+	if err != nil {
+		run.Error = err.Error()
+		log.Printf("Job %s failed: %v", j.name, err)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.running, j.last = false, &run
+}
+
+// Runs the job on its schedule for as long as the server runs. A run that
+// is due while the previous one is still going is skipped.
+func (j *job) loop() {
+	for {
+		now := time.Now()
+		next := j.schedule.next(now)
+		if next.IsZero() {
+			return
+		}
+		j.mu.Lock()
+		j.next = next
+		j.mu.Unlock()
+		time.Sleep(next.Sub(now))
+		if j.start() {
+			j.execute()
+		}
+	}
+}
+
+// The jobs of a catalog.
+type scheduler struct {
+	jobs []*job
+}
+
+// Starts the enabled jobs.
+func (sc *scheduler) start() {
+	for _, j := range sc.jobs {
+		if j.enabled {
+			go j.loop()
+		}
+	}
+}
+
+func (sc *scheduler) statuses() []JobStatus {
+	jobs := make([]JobStatus, len(sc.jobs))
+	for i, j := range sc.jobs {
+		jobs[i] = j.status()
+	}
+	return jobs
+}
+
+func (sc *scheduler) find(name string) *job {
+	i := slices.IndexFunc(sc.jobs, func(j *job) bool { return j.name == name })
+	if i < 0 {
+		return nil
+	}
+	return sc.jobs[i]
+}
+
+// Sets up the jobs of the catalog s serves. The schedules were checked
+// along with the configuration.
+func (s *server) loadJobs(cfg Config) *scheduler {
+	runs := map[string]func() (string, error){
+		"purge_trash":       s.purgeTrashJob(loadTrashRetention(cfg.Library)),
+		"stats":             s.statsJob,
+		"due_reminders":     s.dueRemindersJob,
+		"overdue_reminders": s.overdueRemindersJob,
+		"refresh_metadata":  s.refreshMetadataJob(),
+		"search_alerts":     s.searchAlertsJob,
+	}
+	sc := &scheduler{}
+	for _, named := range cfg.Jobs.list() {
+		sched, _ := parseSchedule(named.Schedule)
+		sc.jobs = append(sc.jobs, &job{
+			name:     named.name,
+			enabled:  named.Enabled,
+			spec:     named.Schedule,
+			schedule: sched,
+			run:      runs[named.name],
+		})
+	}
+	return sc
+}
+
+// Removes the books that were deleted more than retention ago, see
+// trash.go.
+func (s *server) purgeTrashJob(retention time.Duration) func() (string, error) {
+	return func() (string, error) {
+		n, err := s.purgeTrashBefore(time.Now().Add(-retention))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("purged %d books", n), nil
+	}
+}
+
+// Computes the statistics anew; until the job first ran, they are computed
+// on every request.
+func (s *server) statsJob() (string, error) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	stats, err := s.books.Stats(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.stats.set(stats)
+	return fmt.Sprintf("counted %d books", stats.Books), nil
+}
+
+// Sends the borrowers of the loans that are overdue a notice, once per
+// run, see mail.go.
+func (s *server) overdueRemindersJob() (string, error) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	now := time.Now()
+	loans, err := s.loans.FindAll(ctx, LoanQuery{OverdueAt: now})
+	if err != nil {
+		return "", err
+	}
+	if s.mailer == nil {
+		// Without emails, the reminders go to the log for the librarians
+		for _, l := range loans {
+			log.Printf("Overdue: loan %s of user %s, %d days past due", l.ID.Hex(), l.UserID.Hex(), daysOverdue(l, now))
+		}
+		return fmt.Sprintf("logged %d overdue loans", len(loans)), nil
+	}
+	sent := 0
+	for _, l := range loans {
+		sent += s.notifyLoan(mailOverdueNotice, l, mailData{Due: l.DueAt, Days: daysOverdue(l, now)})
+	}
+	return fmt.Sprintf("emailed %d of %d overdue loans", sent, len(loans)), nil
+}
+
+func daysOverdue(l Loan, now time.Time) int {
+	return int(now.Sub(l.DueAt).Hours() / 24)
+}
+
+// Emails the borrower about the loan, and returns 1 if it did. Failures
+// are logged, the other borrowers are still emailed.
+func (s *server) notifyLoan(kind string, l Loan, data mailData) int {
+	ctx, cancel := notifyContext()
+	defer cancel()
+	mailed, err := s.notify(ctx, kind, l.UserID, l.BookID, data)
+	if err != nil {
+		log.Printf("Failed to email about loan %s: %v", l.ID.Hex(), err)
+	}
+	if !mailed {
+		return 0
+	}
+	return 1
+}
+
+// Reminds the borrowers of the loans due on the day mail.remind_days from
+// today. Meant to run once a day, as each run reminds of all of them.
+func (s *server) dueRemindersJob() (string, error) {
+	if s.mailer == nil {
+		return "mail is off", nil
+	}
+	ctx, cancel := dbContext()
+	defer cancel()
+	y, m, d := time.Now().Date()
+	from := time.Date(y, m, d+s.remindDays, 0, 0, 0, 0, time.Local)
+	until := from.AddDate(0, 0, 1)
+	loans, err := s.loans.FindAll(ctx, LoanQuery{OverdueAt: until})
+	if err != nil {
+		return "", err
+	}
+	due, sent := 0, 0
+	for _, l := range loans {
+		if l.DueAt.Before(from) {
+			continue
+		}
+		due++
+		sent += s.notifyLoan(mailDueReminder, l, mailData{Due: l.DueAt})
+	}
+	return fmt.Sprintf("emailed %d of %d loans due on %s", sent, due, from.Format(time.DateOnly)), nil
+}
+
+// Takes the pages and the year from the external catalogs for the books
+// nobody changed since they were stored, which mostly came from imports.
+// Books a librarian edited keep what they have. Each run looks up
+// refreshMetadataBatch books, carrying on after those of the run before.
+func (s *server) refreshMetadataJob() func() (string, error) {
+	var after primitive.ObjectID
+	return func() (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), refreshMetadataTimeout)
+		defer cancel()
+		batch, err := s.nextMetadataBatch(ctx, after)
+		if err == nil && len(batch) == 0 && !after.IsZero() {
+			// Once through, start over
+			batch, err = s.nextMetadataBatch(ctx, primitive.NilObjectID)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		updated := 0
+		for _, b := range batch {
+			after = b.ID
+			changed, err := s.refreshMetadata(ctx, b)
+			if err != nil {
+				return "", err
+			}
+			if changed {
+				updated++
+			}
+		}
+		return fmt.Sprintf("looked up %d books, updated %d", len(batch), updated), nil
+	}
+}
+
+// Returns the first refreshMetadataBatch books nobody changed after the
+// given ID, in the order of their IDs. The books are streamed from the
+// storage, so only those of the batch are held at a time.
+func (s *server) nextMetadataBatch(ctx context.Context, after primitive.ObjectID) ([]BookStore, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	byID := func(b BookStore, id primitive.ObjectID) int { return bytes.Compare(b.ID[:], id[:]) }
+	var batch []BookStore
+	q := BookQuery{Fields: []string{"isbn", "pages", "year", "version"}}
+	err := s.books.Each(ctx, q, func(b BookStore) error {
+		if b.BookISBN == "" || b.Version != 1 || byID(b, after) <= 0 {
+			return nil
+		}
+		i, _ := slices.BinarySearchFunc(batch, b.ID, byID)
+		if i < refreshMetadataBatch {
+			batch = slices.Insert(batch, i, b)
+			batch = batch[:min(len(batch), refreshMetadataBatch)]
+		}
+		return nil
+	})
+	return batch, err
+}
+
+// Updates the book where the catalogs know better, and reports whether it
+// did. Books no catalog knows are left alone.
+func (s *server) refreshMetadata(ctx context.Context, b BookStore) (bool, error) {
+	// Each catalog may take up to lookupTimeout
+	lookupCtx, cancel := context.WithTimeout(ctx, time.Duration(len(s.metadataSources))*lookupTimeout)
+	m, err := s.lookupISBN(lookupCtx, b.BookISBN)
+	cancel()
+	if errors.Is(err, ErrMetadataNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	p := BookPatch{Version: &b.Version}
+	if m.Pages > 0 && m.Pages != b.BookPages {
+		p.BookPages = &m.Pages
+	}
+	if m.Year != 0 && m.Year != b.BookYear {
+		p.BookYear = &m.Year
+	}
+	if p.BookPages == nil && p.BookYear == nil {
+		return false, nil
+	}
+	ctx, cancel = context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	_, err = s.books.Patch(ctx, b.ID, p)
+	if errors.Is(err, ErrVersionConflict) || errors.Is(err, ErrBookNotFound) {
+		// Changed or deleted meanwhile, which wins
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Lists the jobs with their last runs.
+func (s *server) listJobs(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.jobs.statuses())
+}
+
+// Runs a job now, in the background; its status tells when it is done.
+func (s *server) runJob(c echo.Context) error {
+	j := s.jobs.find(c.Param("name"))
+	if j == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Job not found")
+	}
+	if !j.start() {
+		return echo.NewHTTPError(http.StatusConflict, "The job is running already")
+	}
+	go j.execute()
+	return c.JSON(http.StatusAccepted, j.status())
+}
+
+// When a job runs next, after a given time; the zero time if never.
+type schedule interface {
+	next(after time.Time) time.Time
+}
+
+// Runs at a fixed interval, counted from the start of the server.
+type everySchedule time.Duration
+
+func (e everySchedule) next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// The minutes, hours, days of the month, months and days of the week a
+// crontab schedule runs at, one bit each. Like cron, a day matches if
+// either day field does, unless one of them is *.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+// The shorthands crontab knows.
+var scheduleMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames   = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// Parses a schedule as described at the top of this file.
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("@every needs a duration of at least 1s, got %q", rest)
+		}
+		return everySchedule(d), nil
+	}
+	if macro, ok := scheduleMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q is not a schedule like \"30 2 * * *\" or @daily", spec)
+	}
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	// Sunday is 0 and 7
+	if s.dow, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny, s.dowAny = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%q never runs", spec)
+	}
+	return s, nil
+}
+
+// Parses a comma separated list of values, ranges like 1-5 and steps like
+// */15 or 0-30/10 into a bit set. names, if given, stand for the values
+// from lo on.
+func parseCronField(field string, lo, hi int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		if i := slices.Index(names, strings.ToLower(s)); i >= 0 {
+			return lo + i, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("%q is not a value from %d to %d", s, lo, hi)
+		}
+		return n, nil
+	}
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("%q is not a step", stepText)
+			}
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = value(first); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = value(last); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// 5/15 means from 5 on
+				to = hi
+			}
+			if to < from {
+				return 0, fmt.Errorf("%q runs backwards", rng)
+			}
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func inSet(set uint64, v int) bool {
+	return set&(1<<v) != 0
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := inSet(s.dom, t.Day()), inSet(s.dow, int(t.Weekday()))
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Finds the next minute matching the schedule, skipping whole months, days
+// and hours that do not. Schedules that match nothing within five years,
+// such as February 30th, never run.
+func (s cronSchedule) next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	// Moves on to the given time, or at least a minute on where daylight
+	// saving time would have it go back
+	advance := func(to time.Time) {
+		if !to.After(t) {
+			to = t.Add(time.Minute)
+		}
+		t = to
+	}
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case !inSet(s.month, int(m)):
+			advance(time.Date(y, m+1, 1, 0, 0, 0, 0, loc))
+		case !s.dayMatches(t):
+			advance(time.Date(y, m, d+1, 0, 0, 0, 0, loc))
+		case !inSet(s.hour, t.Hour()):
+			advance(time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc))
+		case !inSet(s.minute, t.Minute()):
+			// The next minute set in the hour, if any
+			rest := s.minute >> (t.Minute() + 1) << (t.Minute() + 1)
+			if rest == 0 {
+				advance(time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc))
+			} else {
+				advance(t.Add(time.Duration(bits.TrailingZeros64(rest)-t.Minute()) * time.Minute))
+			}
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The values of a bit set of parseCronField, in order.
+func cronValues(set uint64) []int {
+	var values []int
+	for v := 0; v < 64; v++ {
+		if inSet(set, v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field  string
+		lo, hi int
+		names  []string
+		want   []int
+	}{
+		{"*", 1, 5, nil, []int{1, 2, 3, 4, 5}},
+		{"7", 0, 59, nil, []int{7}},
+		{"1-5", 0, 59, nil, []int{1, 2, 3, 4, 5}},
+		{"1,3,5", 0, 59, nil, []int{1, 3, 5}},
+		{"*/15", 0, 59, nil, []int{0, 15, 30, 45}},
+		{"0-30/10", 0, 59, nil, []int{0, 10, 20, 30}},
+		{"5/15", 0, 59, nil, []int{5, 20, 35, 50}},
+		{"*/5", 1, 12, nil, []int{1, 6, 11}},
+		{"1-3,10-12/2,7", 1, 12, nil, []int{1, 2, 3, 7, 10, 12}},
+		{"jan,JUL", 1, 12, monthNames, []int{1, 7}},
+		{"mon-fri", 0, 7, weekdayNames, []int{1, 2, 3, 4, 5}},
+		{"sun,7", 0, 7, weekdayNames, []int{0, 7}},
+	}
+	for _, tt := range tests {
+		set, err := parseCronField(tt.field, tt.lo, tt.hi, tt.names)
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", tt.field, err)
+			continue
+		}
+		if got := cronValues(set); !slices.Equal(got, tt.want) {
+			t.Errorf("parseCronField(%q) = %v, want %v", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronFieldErrors(t *testing.T) {
+	for _, field := range []string{"", "60", "-1", "x", "5-1", "*/0", "*/x", "1-", "1,,2", "mon"} {
+		if _, err := parseCronField(field, 0, 59, nil); err == nil {
+			t.Errorf("parseCronField(%q) succeeded, want an error", field)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@sometimes",
+		"@every 10",
+		"@every 500ms",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		// February 30th
+		"0 0 30 2 *",
+	} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	// 2024-01-01 is a Monday
+	tests := []struct {
+		spec  string
+		after time.Time
+		want  time.Time
+	}{
+		{"30 2 * * *", at(2024, 1, 1, 0, 0), at(2024, 1, 1, 2, 30)},
+		{"30 2 * * *", at(2024, 1, 1, 2, 30), at(2024, 1, 2, 2, 30)},
+		{"30 2 * * *", time.Date(2024, 1, 1, 2, 29, 59, 0, time.UTC), at(2024, 1, 1, 2, 30)},
+		{"*/15 * * * *", at(2024, 1, 1, 10, 7), at(2024, 1, 1, 10, 15)},
+		{"*/15 * * * *", at(2024, 1, 1, 10, 50), at(2024, 1, 1, 11, 0)},
+		{"*/15 * * * *", at(2024, 12, 31, 23, 59), at(2025, 1, 1, 0, 0)},
+		{"0 9-17/4 * * *", at(2024, 1, 1, 9, 0), at(2024, 1, 1, 13, 0)},
+		{"0 9-17/4 * * *", at(2024, 1, 1, 17, 0), at(2024, 1, 2, 9, 0)},
+		{"0 0 1 * *", at(2024, 1, 15, 0, 0), at(2024, 2, 1, 0, 0)},
+		{"0 0 1 jan,jul *", at(2024, 2, 1, 0, 0), at(2024, 7, 1, 0, 0)},
+		{"0 0 31 * *", at(2024, 4, 1, 0, 0), at(2024, 5, 31, 0, 0)},
+		{"0 0 29 2 *", at(2024, 3, 1, 0, 0), at(2028, 2, 29, 0, 0)},
+		// The day of the month alone
+		{"0 0 13 * *", at(2024, 1, 1, 0, 0), at(2024, 1, 13, 0, 0)},
+		// The day of the week alone
+		{"0 9 * * 1-5", at(2024, 1, 6, 12, 0), at(2024, 1, 8, 9, 0)},
+		{"0 9 * * mon-fri", at(2024, 1, 5, 9, 0), at(2024, 1, 8, 9, 0)},
+		// Either day: the 13th or a Friday
+		{"0 0 13 * 5", at(2024, 1, 1, 0, 0), at(2024, 1, 5, 0, 0)},
+		{"0 0 13 * 5", at(2024, 1, 12, 0, 0), at(2024, 1, 13, 0, 0)},
+		{"0 0 13 * 5", at(2024, 1, 13, 0, 0), at(2024, 1, 19, 0, 0)},
+		// Sunday as 7
+		{"0 0 * * 7", at(2024, 1, 1, 0, 0), at(2024, 1, 7, 0, 0)},
+		{"@weekly", at(2024, 1, 3, 8, 0), at(2024, 1, 7, 0, 0)},
+		{"@daily", at(2024, 1, 3, 8, 0), at(2024, 1, 4, 0, 0)},
+		{"@hourly", at(2024, 1, 3, 8, 0), at(2024, 1, 3, 9, 0)},
+		{"@monthly", at(2024, 1, 3, 8, 0), at(2024, 2, 1, 0, 0)},
+		{"@yearly", at(2024, 1, 3, 8, 0), at(2025, 1, 1, 0, 0)},
+		{"@every 10m", at(2024, 1, 3, 8, 1), at(2024, 1, 3, 8, 11)},
+		{"@every 1h30m", at(2024, 1, 3, 8, 1), at(2024, 1, 3, 9, 31)},
+	}
+	for _, tt := range tests {
+		sched, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := sched.next(tt.after); !got.Equal(tt.want) {
+			t.Errorf("%q after %s = %s, want %s", tt.spec, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestNextMetadataBatch(t *testing.T) {
+	ctx := context.Background()
+	books := newMemoryBookRepository()
+	var want []primitive.ObjectID
+	for i := 0; i < 2*refreshMetadataBatch+50; i++ {
+		b := BookStore{BookName: fmt.Sprint("Book ", i)}
+		if i%5 != 0 {
+			b.BookISBN = fmt.Sprintf("978%010d", i)
+		}
+		b, err := books.Insert(ctx, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%7 == 0 {
+			// Edited since, so left alone
+			year := 1999
+			if b, err = books.Patch(ctx, b.ID, BookPatch{BookYear: &year}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if b.BookISBN != "" && b.Version == 1 {
+			want = append(want, b.ID)
+		}
+	}
+	slices.SortFunc(want, func(a, b primitive.ObjectID) int { return bytes.Compare(a[:], b[:]) })
+
+	s := &server{books: books}
+	var got []primitive.ObjectID
+	var after primitive.ObjectID
+	for {
+		batch, err := s.nextMetadataBatch(ctx, after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) > refreshMetadataBatch {
+			t.Fatalf("batch of %d books, want at most %d", len(batch), refreshMetadataBatch)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, b := range batch {
+			got = append(got, b.ID)
+		}
+		after = batch[len(batch)-1].ID
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("the batches have %d books, want the %d unchanged ones with an ISBN in the order of their IDs", len(got), len(want))
+	}
+}
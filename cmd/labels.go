@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/CAPS-Cloud/exercises/internal/ean"
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+	"github.com/CAPS-Cloud/exercises/internal/qr"
+	"github.com/labstack/echo/v4"
+)
+
+// The images printed on the shelf labels of a book: a QR code linking to
+// its page, and its ISBN as the EAN-13 barcode found on the back of books.
+// ?scale= sets how many pixels wide a module, the smallest square or bar
+// of the code, is drawn, to suit the printer.
+
+const maxLabelScale = 20
+
+// Reads ?scale=, falling back to def.
+func labelScale(c echo.Context, def int) (int, error) {
+	raw := c.QueryParam("scale")
+	if raw == "" {
+		return def, nil
+	}
+	scale, err := strconv.Atoi(raw)
+	if err != nil || scale < 1 || scale > maxLabelScale {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "scale must be an integer from 1 to "+strconv.Itoa(maxLabelScale))
+	}
+	return scale, nil
+}
+
+// Looks up the book of the :id path parameter.
+func (s *server) labelBook(c echo.Context) (BookStore, error) {
+	id, err := bookID(c)
+	if err != nil {
+		return BookStore{}, err
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	return s.books.FindByID(ctx, id)
+}
+
+func pngBlob(c echo.Context, img image.Image) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, "image/png", buf.Bytes())
+}
+
+// Returns a QR code of the link to the page of the book.
+func (s *server) bookQR(c echo.Context) error {
+	scale, err := labelScale(c, 8)
+	if err != nil {
+		return err
+	}
+	book, err := s.labelBook(c)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(s.publicURL, "/") + "/books/" + book.ID.Hex()
+	code, err := qr.Encode([]byte(url), qr.Medium)
+	if err != nil {
+		return err
+	}
+	return pngBlob(c, code.Image(scale))
+}
+
+// Returns the ISBN of the book as an EAN-13 barcode. Books without an ISBN
+// have none.
+func (s *server) bookBarcode(c echo.Context) error {
+	scale, err := labelScale(c, 3)
+	if err != nil {
+		return err
+	}
+	book, err := s.labelBook(c)
+	if err != nil {
+		return err
+	}
+	if book.BookISBN == "" {
+		return echo.NewHTTPError(http.StatusNotFound, "The book has no ISBN")
+	}
+	// Books stored before ISBNs were checked may have an ISBN-10, or a
+	// wrong one
+	isbn13, err := isbn.ToISBN13(book.BookISBN)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "The ISBN of the book is not valid: "+err.Error())
+	}
+	code, err := ean.Encode(isbn13)
+	if err != nil {
+		return err
+	}
+	return pngBlob(c, code.Image(scale))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	gbytes "github.com/labstack/gommon/bytes"
+)
+
+// Caps the size of the request bodies, so that no client can make the
+// server read more than it ever needs, see LimitsConfig. The API takes
+// JSON of a few kilobytes, so the limit for bodies is small; the routes
+// taking files get the larger one for uploads. Bodies that announce their
+// size are refused right away, the others once they grow too large.
+
+// The routes of the API taking files, which get the limit for uploads.
+var uploadRoutes = []string{"/books/import", "/admin/restore"}
+
+// How much of an uploaded multipart form is kept in memory; the rest goes
+// to temporary files.
+const uploadMemory = 1 << 20
+
+func limitBodies(cfg LimitsConfig) echo.MiddlewareFunc {
+	// Checked by Config.validate
+	body, _ := gbytes.Parse(cfg.Body)
+	upload, _ := gbytes.Parse(cfg.Upload)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			limit := body
+			if route, ok := apiRoute(c.Path()); ok && slices.Contains(uploadRoutes, route) {
+				limit = upload
+			}
+			req := c.Request()
+			if req.ContentLength > limit {
+				return bodyTooLarge(limit)
+			}
+			req.Body = http.MaxBytesReader(c.Response(), req.Body, limit)
+			return next(c)
+		}
+	}
+}
+
+// The error of a request whose body exceeds the limit. Reading past the
+// limit fails with an *http.MaxBytesError, which toAPIError turns into
+// the same.
+func bodyTooLarge(limit int64) *APIError {
+	return newAPIError(http.StatusRequestEntityTooLarge, fmt.Sprintf("The request body must not be larger than %s", gbytes.FormatDecimal(limit)), nil)
+}
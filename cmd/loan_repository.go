@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrLoanNotFound = errors.New("loan not found")
+	ErrLoanReturned = errors.New("loan was already returned")
+)
+
+// A copy lent to a user. ReturnedAt stays nil until the copy is back.
+type Loan struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	CopyID     primitive.ObjectID `json:"copy_id" bson:"copy_id"`
+	BookID     primitive.ObjectID `json:"book_id" bson:"book_id"`
+	UserID     primitive.ObjectID `json:"user_id" bson:"user_id"`
+	LoanedAt   time.Time          `json:"loaned_at" bson:"loaned_at"`
+	DueAt      time.Time          `json:"due_at" bson:"due_at"`
+	ReturnedAt *time.Time         `json:"returned_at,omitempty" bson:"returned_at,omitempty"`
+}
+
+// Selects loans. Zero fields do not restrict the result; OverdueAt selects
+// the loans that are not returned and were due before that time.
+type LoanQuery struct {
+	UserID    primitive.ObjectID
+	CopyID    primitive.ObjectID
+	Active    bool
+	OverdueAt time.Time
+}
+
+func (q LoanQuery) matches(l Loan) bool {
+	active := l.ReturnedAt == nil
+	return (q.UserID.IsZero() || l.UserID == q.UserID) &&
+		(q.CopyID.IsZero() || l.CopyID == q.CopyID) &&
+		(!q.Active || active) &&
+		(q.OverdueAt.IsZero() || (active && l.DueAt.Before(q.OverdueAt)))
+}
+
+// Stores the loans, next to the copies of the same backend.
+type LoanRepository interface {
+	// Returns the loans matching the query, the earliest due first.
+	FindAll(ctx context.Context, q LoanQuery) ([]Loan, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (Loan, error)
+	Count(ctx context.Context, q LoanQuery) (int64, error)
+	// Stores a new loan and returns it with its ID set.
+	Insert(ctx context.Context, l Loan) (Loan, error)
+	// Marks the loan as returned. Returning a loan twice fails with
+	// ErrLoanReturned.
+	Return(ctx context.Context, id primitive.ObjectID, at time.Time) (Loan, error)
+	// Hands the loans of the books over to the book to, when they are
+	// merged into it, and returns how many there were.
+	MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error)
+}
+
+// Keeps the loans in memory, for the memory storage.
+type memoryLoanRepository struct {
+	mu    sync.RWMutex
+	loans []Loan
+}
+
+func newMemoryLoanRepository() *memoryLoanRepository {
+	return &memoryLoanRepository{}
+}
+
+func (r *memoryLoanRepository) FindAll(ctx context.Context, q LoanQuery) ([]Loan, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	loans := []Loan{}
+	for _, l := range r.loans {
+		if q.matches(l) {
+			loans = append(loans, l)
+		}
+	}
+	slices.SortStableFunc(loans, func(a, b Loan) int { return a.DueAt.Compare(b.DueAt) })
+	return loans, nil
+}
+
+func (r *memoryLoanRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Loan, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	i := slices.IndexFunc(r.loans, func(l Loan) bool { return l.ID == id })
+	if i < 0 {
+		return Loan{}, ErrLoanNotFound
+	}
+	return r.loans[i], nil
+}
+
+func (r *memoryLoanRepository) Count(ctx context.Context, q LoanQuery) (int64, error) {
+	loans, err := r.FindAll(ctx, q)
+	return int64(len(loans)), err
+}
+
+func (r *memoryLoanRepository) Insert(ctx context.Context, l Loan) (Loan, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l.ID = primitive.NewObjectID()
+	r.loans = append(r.loans, l)
+	return l, nil
+}
+
+func (r *memoryLoanRepository) Return(ctx context.Context, id primitive.ObjectID, at time.Time) (Loan, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.loans, func(l Loan) bool { return l.ID == id })
+	if i < 0 {
+		return Loan{}, ErrLoanNotFound
+	}
+	if r.loans[i].ReturnedAt != nil {
+		return r.loans[i], ErrLoanReturned
+	}
+	r.loans[i].ReturnedAt = &at
+	return r.loans[i], nil
+}
+
+func (r *memoryLoanRepository) MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for i := range r.loans {
+		if slices.Contains(from, r.loans[i].BookID) {
+			r.loans[i].BookID = to
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Creates the indexes for looking up the loans of a user or a copy, and for
+// finding overdue loans.
+func prepareLoans(ctx context.Context, coll *mongo.Collection) error {
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetName("loans_user_id")},
+		{Keys: bson.D{{Key: "copy_id", Value: 1}}, Options: options.Index().SetName("loans_copy_id")},
+		{Keys: bson.D{{Key: "due_at", Value: 1}}, Options: options.Index().SetName("loans_due_at")},
+	}
+	return ensureIndexes(ctx, coll, indexes...)
+}
+
+// Stores the loans in their own MongoDB collection.
+type mongoLoanRepository struct {
+	coll mongoCollection
+}
+
+func newMongoLoanRepository(coll *mongo.Collection) *mongoLoanRepository {
+	return &mongoLoanRepository{coll: withPolicy(coll)}
+}
+
+func loanFilter(q LoanQuery) bson.M {
+	filter := bson.M{}
+	if !q.UserID.IsZero() {
+		filter["user_id"] = q.UserID
+	}
+	if !q.CopyID.IsZero() {
+		filter["copy_id"] = q.CopyID
+	}
+	if q.Active || !q.OverdueAt.IsZero() {
+		filter["returned_at"] = bson.M{"$exists": false}
+	}
+	if !q.OverdueAt.IsZero() {
+		filter["due_at"] = bson.M{"$lt": q.OverdueAt}
+	}
+	return filter
+}
+
+func (r *mongoLoanRepository) FindAll(ctx context.Context, q LoanQuery) ([]Loan, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "due_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := r.coll.Find(ctx, loanFilter(q), opts)
+	if err != nil {
+		return nil, err
+	}
+	loans := []Loan{}
+	if err = cursor.All(ctx, &loans); err != nil {
+		return nil, err
+	}
+	return loans, nil
+}
+
+func (r *mongoLoanRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Loan, error) {
+	var l Loan
+	err := r.coll.FindOne(ctx, bson.M{"_id": id}).Decode(&l)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return l, ErrLoanNotFound
+	}
+	return l, err
+}
+
+func (r *mongoLoanRepository) Count(ctx context.Context, q LoanQuery) (int64, error) {
+	return r.coll.CountDocuments(ctx, loanFilter(q))
+}
+
+func (r *mongoLoanRepository) Insert(ctx context.Context, l Loan) (Loan, error) {
+	l.ID = primitive.NewObjectID()
+	_, err := r.coll.InsertOne(ctx, l)
+	return l, err
+}
+
+// Only loans that are not yet returned get the date, so two librarians
+// returning the same copy cannot both succeed.
+func (r *mongoLoanRepository) Return(ctx context.Context, id primitive.ObjectID, at time.Time) (Loan, error) {
+	res, err := r.coll.UpdateOne(ctx,
+		bson.M{"_id": id, "returned_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"returned_at": at}})
+	if err != nil {
+		return Loan{}, err
+	}
+	l, err := r.FindByID(ctx, id)
+	if err == nil && res.ModifiedCount == 0 {
+		return l, ErrLoanReturned
+	}
+	return l, err
+}
+
+func (r *mongoLoanRepository) MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error) {
+	if len(from) == 0 {
+		return 0, nil
+	}
+	res, err := r.coll.UpdateMany(ctx, bson.M{"book_id": bson.M{"$in": from}}, bson.M{"$set": bson.M{"book_id": to}})
+	if err != nil {
+		return 0, err
+	}
+	return res.MatchedCount, nil
+}
+
+// Stores the loans in the loans table, see sqlMigrations.
+type sqlLoanRepository struct {
+	db *sql.DB
+}
+
+func newSQLLoanRepository(db *sql.DB) *sqlLoanRepository {
+	return &sqlLoanRepository{db: db}
+}
+
+const loanColumns = "id, copy_id, book_id, user_id, loaned_at, due_at, returned_at"
+
+func scanLoan(row rowScanner) (Loan, error) {
+	var l Loan
+	var id, copyID, bookID, userID string
+	var returnedAt sql.NullTime
+	err := row.Scan(&id, &copyID, &bookID, &userID, &l.LoanedAt, &l.DueAt, &returnedAt)
+	if err != nil {
+		return l, err
+	}
+	for _, f := range []struct {
+		dst *primitive.ObjectID
+		hex string
+	}{{&l.ID, id}, {&l.CopyID, copyID}, {&l.BookID, bookID}, {&l.UserID, userID}} {
+		if *f.dst, err = primitive.ObjectIDFromHex(f.hex); err != nil {
+			return l, err
+		}
+	}
+	if returnedAt.Valid {
+		l.ReturnedAt = &returnedAt.Time
+	}
+	return l, nil
+}
+
+// Mirrors loanFilter of the Mongo repository. Times are compared in UTC, as
+// SQLite compares them as text.
+func loanWhere(q LoanQuery, args *sqlArgs) string {
+	var conds []string
+	if !q.UserID.IsZero() {
+		conds = append(conds, "user_id = "+args.add(q.UserID.Hex()))
+	}
+	if !q.CopyID.IsZero() {
+		conds = append(conds, "copy_id = "+args.add(q.CopyID.Hex()))
+	}
+	if q.Active || !q.OverdueAt.IsZero() {
+		conds = append(conds, "returned_at IS NULL")
+	}
+	if !q.OverdueAt.IsZero() {
+		conds = append(conds, "due_at < "+args.add(q.OverdueAt.UTC()))
+	}
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+func (r *sqlLoanRepository) FindAll(ctx context.Context, q LoanQuery) ([]Loan, error) {
+	var args sqlArgs
+	query := "SELECT " + loanColumns + " FROM loans" + loanWhere(q, &args) + " ORDER BY due_at, id"
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	loans := []Loan{}
+	for rows.Next() {
+		l, err := scanLoan(rows)
+		if err != nil {
+			return nil, err
+		}
+		loans = append(loans, l)
+	}
+	return loans, rows.Err()
+}
+
+func (r *sqlLoanRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Loan, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT "+loanColumns+" FROM loans WHERE id = $1", id.Hex())
+	l, err := scanLoan(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return l, ErrLoanNotFound
+	}
+	return l, err
+}
+
+func (r *sqlLoanRepository) Count(ctx context.Context, q LoanQuery) (int64, error) {
+	var args sqlArgs
+	var count int64
+	err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM loans"+loanWhere(q, &args), args...).Scan(&count)
+	return count, err
+}
+
+func (r *sqlLoanRepository) Insert(ctx context.Context, l Loan) (Loan, error) {
+	l.ID = primitive.NewObjectID()
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO loans ("+loanColumns+") VALUES ($1, $2, $3, $4, $5, $6, NULL)",
+		l.ID.Hex(), l.CopyID.Hex(), l.BookID.Hex(), l.UserID.Hex(), l.LoanedAt.UTC(), l.DueAt.UTC())
+	return l, err
+}
+
+func (r *sqlLoanRepository) Return(ctx context.Context, id primitive.ObjectID, at time.Time) (Loan, error) {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE loans SET returned_at = $1 WHERE id = $2 AND returned_at IS NULL", at.UTC(), id.Hex())
+	if err != nil {
+		return Loan{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Loan{}, err
+	}
+	l, err := r.FindByID(ctx, id)
+	if err == nil && n == 0 {
+		return l, ErrLoanReturned
+	}
+	return l, err
+}
+
+func (r *sqlLoanRepository) MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error) {
+	if len(from) == 0 {
+		return 0, nil
+	}
+	args := sqlArgs{to.Hex()}
+	res, err := r.db.ExecContext(ctx, "UPDATE loans SET book_id = $1 WHERE book_id IN ("+idList(from, &args)+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
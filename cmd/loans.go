@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultLoanDays  = 14
+	defaultLoanLimit = 5
+)
+
+// How long a copy may be kept and how many copies a user may have at once.
+type loanPolicy struct {
+	Period time.Duration
+	Limit  int64
+}
+
+// Takes the policy from library.loan_days and library.loan_limit, two
+// weeks and five copies by default.
+func loadLoanPolicy(cfg LibraryConfig) loanPolicy {
+	return loanPolicy{
+		Period: time.Duration(cfg.LoanDays) * 24 * time.Hour,
+		Limit:  int64(cfg.LoanLimit),
+	}
+}
+
+// What a librarian sends to check a copy out to a user.
+type newLoan struct {
+	CopyID primitive.ObjectID `json:"copy_id"`
+	UserID primitive.ObjectID `json:"user_id"`
+}
+
+// Parses the :id path parameter of the loan routes.
+func loanID(c echo.Context) (primitive.ObjectID, error) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return objID, echo.NewHTTPError(http.StatusBadRequest, "Invalid ID format")
+	}
+	return objID, nil
+}
+
+// Lists the loans, optionally only those of one user (?user_id=) or only
+// those not yet returned (?active=true).
+func (s *server) listLoans(c echo.Context) error {
+	var q LoanQuery
+	if v := c.QueryParam("user_id"); v != "" {
+		id, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "user_id must be a valid ID")
+		}
+		q.UserID = id
+	}
+	if v := c.QueryParam("active"); v != "" {
+		active, err := strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "active must be true or false")
+		}
+		q.Active = active
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	loans, err := s.loans.FindAll(ctx, q)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, loans)
+}
+
+// Lists the loans that are past their due date, the longest overdue first.
+func (s *server) listOverdueLoans(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	loans, err := s.loans.FindAll(ctx, LoanQuery{OverdueAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, loans)
+}
+
+func (s *server) getLoan(c echo.Context) error {
+	id, err := loanID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	loan, err := s.loans.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, loan)
+}
+
+// Lends an available copy, or the copy set aside for the user's hold, to a
+// user who has not reached the loan limit. The copy is marked as lent
+// before the loan is stored, so two librarians cannot lend the same copy
+// at once.
+func (s *server) checkOut(c echo.Context) error {
+	var req newLoan
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid loan data").SetInternal(err)
+	}
+	v := &ValidationError{}
+	if req.CopyID.IsZero() {
+		v.add("copy_id", "is required")
+	}
+	if req.UserID.IsZero() {
+		v.add("user_id", "is required")
+	}
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	cp, err := s.copies.FindByID(ctx, req.CopyID)
+	if errors.Is(err, ErrCopyNotFound) {
+		return &ValidationError{Fields: []FieldError{{Field: "copy_id", Message: "unknown copy"}}}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.users.FindByID(ctx, req.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		return &ValidationError{Fields: []FieldError{{Field: "user_id", Message: "unknown user"}}}
+	}
+	if err != nil {
+		return err
+	}
+
+	active, err := s.loans.Count(ctx, LoanQuery{UserID: req.UserID, Active: true})
+	if err != nil {
+		return err
+	}
+	if active >= s.loanPolicy.Limit {
+		return echo.NewHTTPError(http.StatusConflict,
+			fmt.Sprintf("The user already has %d of at most %d copies", active, s.loanPolicy.Limit))
+	}
+	// Copies set aside for a hold are already off the shelf, but only go
+	// to the user the hold belongs to
+	hold, err := s.copyHold(ctx, cp.ID)
+	if err != nil {
+		return err
+	}
+	if hold != nil && hold.UserID != req.UserID {
+		return echo.NewHTTPError(http.StatusConflict, "The copy is held for another user")
+	}
+	if hold == nil {
+		if err := s.copies.Lend(ctx, cp.ID); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	loan, err := s.loans.Insert(ctx, Loan{
+		CopyID:   cp.ID,
+		BookID:   cp.BookID,
+		UserID:   req.UserID,
+		LoanedAt: now,
+		DueAt:    now.Add(s.loanPolicy.Period),
+	})
+	if err != nil {
+		// Put the copy back on the shelf, the loan does not exist
+		if hold == nil {
+			if releaseErr := s.copies.Release(ctx, cp.ID); releaseErr != nil {
+				log.Printf("failed to release copy %s: %v", cp.ID.Hex(), releaseErr)
+			}
+		}
+		return err
+	}
+	if err := s.closeHolds(ctx, cp, req.UserID); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, loan)
+}
+
+// Records that the copy is back and hands it to the next hold on the book,
+// or makes it available again.
+func (s *server) returnLoan(c echo.Context) error {
+	id, err := loanID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	loan, err := s.loans.Return(ctx, id, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if err := s.passOnCopy(ctx, loan.BookID, loan.CopyID); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, loan)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Refused while an account or an IP address is locked out.
+const lockedOutMessage = "Too many failed logins, please try again later"
+
+// The kinds of keys failed logins are counted against.
+const (
+	lockoutAccount = "account"
+	lockoutIP      = "ip"
+)
+
+// Locks accounts and IP addresses out for a while once too many logins
+// failed, which makes guessing passwords and one-time codes slow. Failures
+// are counted per username, existing or not, so the answers do not tell
+// which usernames exist, and per IP address, which catches trying many
+// usernames from one place. While locked, logins are refused even with the
+// right password. A successful login forgets the failures of the account,
+// but not those of the address.
+//
+// Failing to reach the store must not keep everybody from logging in, so
+// errors are only logged.
+type lockout struct {
+	failures         LoginFailureRepository
+	maxFailures      int
+	maxFailuresPerIP int
+	window           time.Duration
+	duration         time.Duration
+}
+
+// Returns nil if the lockout is off.
+func loadLockout(cfg LockoutConfig, failures LoginFailureRepository) *lockout {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &lockout{
+		failures:         failures,
+		maxFailures:      cfg.MaxFailures,
+		maxFailuresPerIP: cfg.MaxFailuresPerIP,
+		window:           cfg.Window,
+		duration:         cfg.Duration,
+	}
+}
+
+func lockoutKey(kind, name string) string {
+	return kind + ":" + name
+}
+
+// Returns how long logins to the account or from the address are still
+// refused, zero if they are not.
+func (l *lockout) wait(ctx context.Context, username, ip string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range []string{lockoutKey(lockoutAccount, username), lockoutKey(lockoutIP, ip)} {
+		f, err := l.failures.Find(ctx, key)
+		if err != nil {
+			log.Printf("Lockout: failed to look up %s: %v", key, err)
+			continue
+		}
+		if f.locked(now) {
+			wait = max(wait, f.LockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// Counts a failed login against the account and the address, and locks
+// either once it reached its limit.
+func (l *lockout) failed(ctx context.Context, username, ip string) {
+	failedLogins.Inc()
+	if l == nil {
+		return
+	}
+	l.count(ctx, lockoutAccount, username, l.maxFailures)
+	l.count(ctx, lockoutIP, ip, l.maxFailuresPerIP)
+}
+
+func (l *lockout) count(ctx context.Context, kind, name string, limit int) {
+	key := lockoutKey(kind, name)
+	f, err := l.failures.Add(ctx, key, l.window)
+	if err != nil {
+		log.Printf("Lockout: failed to count the failure of %s: %v", key, err)
+		return
+	}
+	// Only the failure that reaches the limit locks, so failures while
+	// locked do not keep extending the lock
+	if f.Failures != limit {
+		return
+	}
+	if err := l.failures.Lock(ctx, key, time.Now().Add(l.duration)); err != nil {
+		log.Printf("Lockout: failed to lock %s: %v", key, err)
+		return
+	}
+	loginLockouts.WithLabelValues(kind).Inc()
+	log.Printf("Lockout: locked %s for %s after %d failed logins", key, l.duration, f.Failures)
+}
+
+// Forgets the failures of the account once its user logged in.
+func (l *lockout) succeeded(ctx context.Context, username string) {
+	if l == nil {
+		return
+	}
+	key := lockoutKey(lockoutAccount, username)
+	if err := l.failures.Delete(ctx, key); err != nil {
+		log.Printf("Lockout: failed to reset %s: %v", key, err)
+	}
+}
+
+// Refuses a login with a 429 and tells the client when to try again.
+func lockedOut(c echo.Context, wait time.Duration) error {
+	setRetryAfter(c, wait)
+	return echo.NewHTTPError(http.StatusTooManyRequests, lockedOutMessage)
+}
+
+func setRetryAfter(c echo.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+}
+
+// An account or IP address that is locked out, as listed to admins.
+type lockoutEntry struct {
+	Kind        string    `json:"kind"`
+	Name        string    `json:"name"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+func (s *server) listLockouts(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	locked, err := s.lockout.failures.FindLocked(ctx)
+	if err != nil {
+		return err
+	}
+	entries := make([]lockoutEntry, 0, len(locked))
+	for _, f := range locked {
+		kind, name, _ := strings.Cut(f.Key, ":")
+		entries = append(entries, lockoutEntry{Kind: kind, Name: name, Failures: f.Failures, LockedUntil: f.LockedUntil})
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+// Lets an account or IP address log in again right away, forgetting its
+// failures. Unlocking what is not locked is fine.
+func (s *server) unlock(c echo.Context) error {
+	kind, name := c.Param("kind"), c.Param("name")
+	switch kind {
+	case lockoutAccount:
+		name = normalizeUsername(name)
+	case lockoutIP:
+	default:
+		return echo.NewHTTPError(http.StatusNotFound, "Lockouts are of an account or an ip")
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	key := lockoutKey(kind, name)
+	if err := s.lockout.failures.Delete(ctx, key); err != nil {
+		return err
+	}
+	loginUnlocks.WithLabelValues(kind).Inc()
+	log.Printf("Lockout: %s unlocked", key)
+	return c.NoContent(http.StatusNoContent)
+}
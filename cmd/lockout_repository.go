@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The failed logins of an account or an IP address, see lockout.go. Key is
+// like account:alice or ip:192.0.2.1. The record goes away once it
+// expires: at the end of the window the failures are counted in, or of the
+// lock.
+type LoginFailures struct {
+	Key         string    `bson:"_id"`
+	Failures    int       `bson:"failures"`
+	LockedUntil time.Time `bson:"locked_until,omitempty"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+}
+
+// Reports whether the key is locked at the given time.
+func (f LoginFailures) locked(now time.Time) bool {
+	return f.LockedUntil.After(now)
+}
+
+// Stores the failed logins, next to the users of the same backend or in
+// Redis.
+type LoginFailureRepository interface {
+	// Counts a failed login against the key. The count starts over once
+	// the window since the first failure passed. Returns the failures
+	// including this one.
+	Add(ctx context.Context, key string, window time.Duration) (LoginFailures, error)
+	// Locks the key until the given time. The failures are forgotten once
+	// the lock ends.
+	Lock(ctx context.Context, key string, until time.Time) error
+	// Returns the failures of the key, none if there were none lately.
+	Find(ctx context.Context, key string) (LoginFailures, error)
+	// Returns the keys that are locked, the first to be unlocked first.
+	FindLocked(ctx context.Context) ([]LoginFailures, error)
+	// Forgets the failures and the lock of the key.
+	Delete(ctx context.Context, key string) error
+}
+
+// Keeps the failed logins in memory, for the memory storage.
+type memoryLoginFailureRepository struct {
+	mu       sync.Mutex
+	failures map[string]LoginFailures
+}
+
+func newMemoryLoginFailureRepository() *memoryLoginFailureRepository {
+	return &memoryLoginFailureRepository{failures: map[string]LoginFailures{}}
+}
+
+// Expired records are dropped whenever a failure is counted, which keeps
+// the map from growing forever.
+func (r *memoryLoginFailureRepository) Add(ctx context.Context, key string, window time.Duration) (LoginFailures, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for k, f := range r.failures {
+		if !f.ExpiresAt.After(now) {
+			delete(r.failures, k)
+		}
+	}
+	f, ok := r.failures[key]
+	if !ok {
+		f = LoginFailures{Key: key, ExpiresAt: now.Add(window)}
+	}
+	f.Failures++
+	r.failures[key] = f
+	return f, nil
+}
+
+func (r *memoryLoginFailureRepository) Lock(ctx context.Context, key string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.failures[key]
+	f.Key, f.LockedUntil, f.ExpiresAt = key, until, until
+	r.failures[key] = f
+	return nil
+}
+
+func (r *memoryLoginFailureRepository) Find(ctx context.Context, key string) (LoginFailures, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.failures[key]
+	if !ok || !f.ExpiresAt.After(time.Now()) {
+		return LoginFailures{Key: key}, nil
+	}
+	return f, nil
+}
+
+func (r *memoryLoginFailureRepository) FindLocked(ctx context.Context) ([]LoginFailures, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	locked := []LoginFailures{}
+	for _, f := range r.failures {
+		if f.locked(now) {
+			locked = append(locked, f)
+		}
+	}
+	sortLockedFirst(locked)
+	return locked, nil
+}
+
+func (r *memoryLoginFailureRepository) Delete(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.failures, key)
+	return nil
+}
+
+func sortLockedFirst(failures []LoginFailures) {
+	slices.SortFunc(failures, func(a, b LoginFailures) int {
+		if c := a.LockedUntil.Compare(b.LockedUntil); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+}
+
+// Lets MongoDB remove the expired records by itself.
+func prepareLoginFailures(ctx context.Context, coll *mongo.Collection) error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetName("login_failures_ttl").SetExpireAfterSeconds(0),
+	}
+	return ensureIndexes(ctx, coll, index)
+}
+
+// Stores the failed logins in their own MongoDB collection, keyed by the
+// key.
+type mongoLoginFailureRepository struct {
+	coll mongoCollection
+}
+
+func newMongoLoginFailureRepository(coll *mongo.Collection) *mongoLoginFailureRepository {
+	return &mongoLoginFailureRepository{coll: withPolicy(coll)}
+}
+
+// Counts in a single update, so that failures at the same time on several
+// instances are all counted. As the TTL monitor only runs once a minute,
+// an expired record is started over here as well.
+func (r *mongoLoginFailureRepository) Add(ctx context.Context, key string, window time.Duration) (LoginFailures, error) {
+	now := time.Now()
+	live := bson.M{"$gt": bson.A{"$expires_at", now}}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"failures":     bson.M{"$cond": bson.A{live, bson.M{"$add": bson.A{"$failures", 1}}, 1}},
+		"locked_until": bson.M{"$cond": bson.A{live, "$locked_until", "$$REMOVE"}},
+		"expires_at":   bson.M{"$cond": bson.A{live, "$expires_at", now.Add(window)}},
+	}}}}
+	var f LoginFailures
+	err := r.coll.FindOneAndUpdate(ctx, bson.M{"_id": key}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&f)
+	return f, err
+}
+
+func (r *mongoLoginFailureRepository) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := r.coll.UpdateOne(ctx, bson.M{"_id": key},
+		bson.M{"$set": bson.M{"locked_until": until, "expires_at": until}}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (r *mongoLoginFailureRepository) Find(ctx context.Context, key string) (LoginFailures, error) {
+	var f LoginFailures
+	err := r.coll.FindOne(ctx, bson.M{"_id": key, "expires_at": bson.M{"$gt": time.Now()}}).Decode(&f)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return LoginFailures{Key: key}, nil
+	}
+	return f, err
+}
+
+func (r *mongoLoginFailureRepository) FindLocked(ctx context.Context) ([]LoginFailures, error) {
+	cursor, err := r.coll.Find(ctx, bson.M{"locked_until": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "locked_until", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	locked := []LoginFailures{}
+	if err = cursor.All(ctx, &locked); err != nil {
+		return nil, err
+	}
+	return locked, nil
+}
+
+func (r *mongoLoginFailureRepository) Delete(ctx context.Context, key string) error {
+	_, err := r.coll.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+// Stores the failed logins in the login_failures table, see
+// sqlMigrations.
+type sqlLoginFailureRepository struct {
+	db *sql.DB
+}
+
+func newSQLLoginFailureRepository(db *sql.DB) *sqlLoginFailureRepository {
+	return &sqlLoginFailureRepository{db: db}
+}
+
+func scanLoginFailures(row rowScanner) (LoginFailures, error) {
+	var f LoginFailures
+	var lockedUntil sql.NullTime
+	err := row.Scan(&f.Key, &f.Failures, &lockedUntil, &f.ExpiresAt)
+	if lockedUntil.Valid {
+		f.LockedUntil = lockedUntil.Time
+	}
+	return f, err
+}
+
+// Counts in a single statement, like the MongoDB repository. Times are
+// always compared in UTC, as SQLite compares them as text.
+func (r *sqlLoginFailureRepository) Add(ctx context.Context, key string, window time.Duration) (LoginFailures, error) {
+	now := time.Now().UTC()
+	row := r.db.QueryRowContext(ctx,
+		"INSERT INTO login_failures (id, failures, locked_until, expires_at) VALUES ($1, 1, NULL, $2)"+
+			" ON CONFLICT (id) DO UPDATE SET"+
+			" failures = CASE WHEN login_failures.expires_at > $3 THEN login_failures.failures + 1 ELSE 1 END,"+
+			" locked_until = CASE WHEN login_failures.expires_at > $3 THEN login_failures.locked_until ELSE NULL END,"+
+			" expires_at = CASE WHEN login_failures.expires_at > $3 THEN login_failures.expires_at ELSE excluded.expires_at END"+
+			" RETURNING id, failures, locked_until, expires_at",
+		key, now.Add(window), now)
+	return scanLoginFailures(row)
+}
+
+func (r *sqlLoginFailureRepository) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO login_failures (id, failures, locked_until, expires_at) VALUES ($1, 0, $2, $2)"+
+			" ON CONFLICT (id) DO UPDATE SET locked_until = excluded.locked_until, expires_at = excluded.expires_at",
+		key, until.UTC())
+	return err
+}
+
+func (r *sqlLoginFailureRepository) Find(ctx context.Context, key string) (LoginFailures, error) {
+	row := r.db.QueryRowContext(ctx,
+		"SELECT id, failures, locked_until, expires_at FROM login_failures WHERE id = $1 AND expires_at > $2",
+		key, time.Now().UTC())
+	f, err := scanLoginFailures(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginFailures{Key: key}, nil
+	}
+	return f, err
+}
+
+// Expired records are cleaned up whenever the locked ones are listed.
+func (r *sqlLoginFailureRepository) FindLocked(ctx context.Context) ([]LoginFailures, error) {
+	now := time.Now().UTC()
+	if _, err := r.db.ExecContext(ctx, "DELETE FROM login_failures WHERE expires_at <= $1", now); err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT id, failures, locked_until, expires_at FROM login_failures WHERE locked_until > $1 ORDER BY locked_until, id", now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locked := []LoginFailures{}
+	for rows.Next() {
+		f, err := scanLoginFailures(rows)
+		if err != nil {
+			return nil, err
+		}
+		locked = append(locked, f)
+	}
+	return locked, rows.Err()
+}
+
+func (r *sqlLoginFailureRepository) Delete(ctx context.Context, key string) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM login_failures WHERE id = $1", key)
+	return err
+}
+
+// Counts the failures in a hash that expires at the end of the window,
+// which the first failure sets.
+var addLoginFailureScript = redis.NewScript(`
+local n = redis.call('HINCRBY', KEYS[1], 'failures', 1)
+if n == 1 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return {n, redis.call('PTTL', KEYS[1])}
+`)
+
+// Stores the failed logins in Redis, shared by all instances. Redis
+// expires them by itself.
+type redisLoginFailureRepository struct {
+	client *redis.Client
+}
+
+func newRedisLoginFailureRepository(client *redis.Client) *redisLoginFailureRepository {
+	return &redisLoginFailureRepository{client: client}
+}
+
+func (r *redisLoginFailureRepository) Add(ctx context.Context, key string, window time.Duration) (LoginFailures, error) {
+	res, err := addLoginFailureScript.Run(ctx, r.client, []string{"lockout:" + key}, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return LoginFailures{}, err
+	}
+	return LoginFailures{Key: key, Failures: int(res[0]), ExpiresAt: time.Now().Add(time.Duration(res[1]) * time.Millisecond)}, nil
+}
+
+func (r *redisLoginFailureRepository) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, "lockout:"+key, "locked_until", until.UnixMilli())
+		pipe.PExpireAt(ctx, "lockout:"+key, until)
+		return nil
+	})
+	return err
+}
+
+func (r *redisLoginFailureRepository) Find(ctx context.Context, key string) (LoginFailures, error) {
+	f := LoginFailures{Key: key}
+	pipe := r.client.Pipeline()
+	fields := pipe.HGetAll(ctx, "lockout:"+key)
+	ttl := pipe.PTTL(ctx, "lockout:"+key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return f, err
+	}
+	values := fields.Val()
+	if len(values) == 0 {
+		return f, nil
+	}
+	f.Failures, _ = strconv.Atoi(values["failures"])
+	if ms, err := strconv.ParseInt(values["locked_until"], 10, 64); err == nil {
+		f.LockedUntil = time.UnixMilli(ms)
+	}
+	f.ExpiresAt = time.Now().Add(ttl.Val())
+	return f, nil
+}
+
+// Scans the keys, which is fine for the few there are at any time.
+func (r *redisLoginFailureRepository) FindLocked(ctx context.Context) ([]LoginFailures, error) {
+	now := time.Now()
+	locked := []LoginFailures{}
+	iter := r.client.Scan(ctx, 0, "lockout:*", 100).Iterator()
+	for iter.Next(ctx) {
+		f, err := r.Find(ctx, strings.TrimPrefix(iter.Val(), "lockout:"))
+		if err != nil {
+			return nil, err
+		}
+		if f.locked(now) {
+			locked = append(locked, f)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sortLockedFirst(locked)
+	return locked, nil
+}
+
+func (r *redisLoginFailureRepository) Delete(ctx context.Context, key string) error {
+	return r.client.Del(ctx, "lockout:"+key).Err()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+	"github.com/labstack/echo/v4"
+)
+
+var ErrMetadataNotFound = errors.New("no catalog knows the ISBN")
+
+// How long a single catalog may take to answer.
+const lookupTimeout = 5 * time.Second
+
+// What an external catalog knows about a book.
+type BookMetadata struct {
+	ISBN     string   `json:"isbn"`
+	Title    string   `json:"title"`
+	Authors  []string `json:"authors"`
+	Year     int      `json:"year,omitempty"`
+	Pages    int      `json:"pages,omitempty"`
+	CoverURL string   `json:"cover_url,omitempty"`
+	// The catalog the data came from
+	Source string `json:"source"`
+}
+
+// Prefills a book with the metadata. Fields the book already has win.
+func (m BookMetadata) fill(b *BookStore) {
+	b.BookISBN = m.ISBN
+	if b.BookName == "" {
+		b.BookName = m.Title
+	}
+	if b.BookAuthor == "" && b.AuthorID.IsZero() {
+		b.BookAuthor = strings.Join(m.Authors, ", ")
+	}
+	if b.BookPages == 0 {
+		b.BookPages = m.Pages
+	}
+	if b.BookYear == 0 {
+		b.BookYear = m.Year
+	}
+}
+
+// An external catalog books can be looked up in by their ISBN-13. Unknown
+// ISBNs are reported as ErrMetadataNotFound.
+type metadataSource interface {
+	Lookup(ctx context.Context, isbn13 string) (BookMetadata, error)
+}
+
+// Returns the catalogs to ask, in order. Open Library is always asked
+// first; Google Books is asked next if lookup.google_books_api_key is set,
+// as it hardly answers anonymous requests. lookup.openlibrary_url points
+// the lookups at a mirror.
+func loadMetadataSources(cfg LookupConfig) []metadataSource {
+	client := &http.Client{Timeout: lookupTimeout}
+	sources := []metadataSource{&openLibrary{client: client, baseURL: strings.TrimSuffix(cfg.OpenLibraryURL, "/")}}
+	if key := cfg.GoogleBooksAPIKey; key != "" {
+		sources = append(sources, &googleBooks{client: client, baseURL: "https://www.googleapis.com", apiKey: key})
+	}
+	return sources
+}
+
+// Catalogs write the publication date in all kinds of ways, the year is
+// the only part we rely on.
+var yearPattern = regexp.MustCompile(`\b(\d{4})\b`)
+
+func parseYear(date string) int {
+	m := yearPattern.FindStringSubmatch(date)
+	if m == nil {
+		return 0
+	}
+	year, _ := strconv.Atoi(m[1])
+	return year
+}
+
+// Looks books up with the Books API of Open Library, see
+// https://openlibrary.org/dev/docs/api/books.
+type openLibrary struct {
+	client  *http.Client
+	baseURL string
+}
+
+func (o *openLibrary) Lookup(ctx context.Context, isbn13 string) (BookMetadata, error) {
+	key := "ISBN:" + isbn13
+	query := url.Values{"bibkeys": {key}, "format": {"json"}, "jscmd": {"data"}}
+	var result map[string]struct {
+		Title   string `json:"title"`
+		Authors []struct {
+			Name string `json:"name"`
+		} `json:"authors"`
+		PublishDate   string `json:"publish_date"`
+		NumberOfPages int    `json:"number_of_pages"`
+		Cover         struct {
+			Large string `json:"large"`
+		} `json:"cover"`
+	}
+	if err := getJSON(ctx, o.client, o.baseURL+"/api/books?"+query.Encode(), &result); err != nil {
+		return BookMetadata{}, err
+	}
+	book, ok := result[key]
+	if !ok {
+		return BookMetadata{}, ErrMetadataNotFound
+	}
+
+	m := BookMetadata{
+		ISBN:     isbn13,
+		Title:    book.Title,
+		Authors:  []string{},
+		Year:     parseYear(book.PublishDate),
+		Pages:    book.NumberOfPages,
+		CoverURL: book.Cover.Large,
+		Source:   "openlibrary",
+	}
+	for _, a := range book.Authors {
+		m.Authors = append(m.Authors, a.Name)
+	}
+	return m, nil
+}
+
+// Looks books up with the Google Books API, see
+// https://developers.google.com/books/docs/v1/using.
+type googleBooks struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+}
+
+func (g *googleBooks) Lookup(ctx context.Context, isbn13 string) (BookMetadata, error) {
+	query := url.Values{"q": {"isbn:" + isbn13}, "key": {g.apiKey}}
+	var result struct {
+		Items []struct {
+			VolumeInfo struct {
+				Title         string   `json:"title"`
+				Authors       []string `json:"authors"`
+				PublishedDate string   `json:"publishedDate"`
+				PageCount     int      `json:"pageCount"`
+				ImageLinks    struct {
+					Thumbnail string `json:"thumbnail"`
+				} `json:"imageLinks"`
+			} `json:"volumeInfo"`
+		} `json:"items"`
+	}
+	if err := getJSON(ctx, g.client, g.baseURL+"/books/v1/volumes?"+query.Encode(), &result); err != nil {
+		return BookMetadata{}, err
+	}
+	if len(result.Items) == 0 {
+		return BookMetadata{}, ErrMetadataNotFound
+	}
+
+	info := result.Items[0].VolumeInfo
+	return BookMetadata{
+		ISBN:     isbn13,
+		Title:    info.Title,
+		Authors:  append([]string{}, info.Authors...),
+		Year:     parseYear(info.PublishedDate),
+		Pages:    info.PageCount,
+		CoverURL: info.ImageLinks.Thumbnail,
+		Source:   "googlebooks",
+	}, nil
+}
+
+// Asks the catalogs one after another until one knows the ISBN. Catalogs
+// that cannot be reached are skipped; only if none answered is that an
+// error of its own.
+func (s *server) lookupISBN(ctx context.Context, isbn13 string) (BookMetadata, error) {
+	var unreachable error
+	for _, source := range s.metadataSources {
+		lookupCtx, cancel := context.WithTimeout(ctx, lookupTimeout)
+		m, err := source.Lookup(lookupCtx, isbn13)
+		cancel()
+		if err == nil {
+			return m, nil
+		}
+		if !errors.Is(err, ErrMetadataNotFound) {
+			log.Printf("ISBN lookup failed: %v", err)
+			unreachable = err
+		}
+	}
+	if unreachable != nil {
+		return BookMetadata{}, echo.NewHTTPError(http.StatusBadGateway, "The book catalogs could not be reached").SetInternal(unreachable)
+	}
+	return BookMetadata{}, ErrMetadataNotFound
+}
+
+// Parses an ISBN from the request into its ISBN-13.
+func parseLookupISBN(raw string) (string, error) {
+	if raw == "" {
+		return "", &ValidationError{Fields: []FieldError{{Field: "isbn", Message: "is required"}}}
+	}
+	isbn13, err := isbn.ToISBN13(raw)
+	if err != nil {
+		return "", &ValidationError{Fields: []FieldError{{Field: "isbn", Message: err.Error()}}}
+	}
+	return isbn13, nil
+}
+
+// Returns what the external catalogs know about the ISBN, without storing
+// anything.
+func (s *server) lookupBook(c echo.Context) error {
+	isbn13, err := parseLookupISBN(c.Param("isbn"))
+	if err != nil {
+		return err
+	}
+	m, err := s.lookupISBN(c.Request().Context(), isbn13)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, m)
+}
+
+// Creates a book from its ISBN. The request is a book like for POST
+// /api/books; whatever it leaves out is taken from the external catalogs.
+func (s *server) createBookFromISBN(c echo.Context) error {
+	var newBook BookStore
+	if err := c.Bind(&newBook); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid book data").SetInternal(err)
+	}
+	isbn13, err := parseLookupISBN(newBook.BookISBN)
+	if err != nil {
+		return err
+	}
+	m, err := s.lookupISBN(c.Request().Context(), isbn13)
+	if err != nil {
+		return err
+	}
+	m.fill(&newBook)
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	created, err := s.storeBook(ctx, newBook)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"message": "Book created successfully",
+		"id":      created.ID.Hex(),
+		"book":    newBookDTO(created),
+	})
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The library emails its users about their loans: shortly before a loan
+// is due, once it is overdue, see jobs.go, and when a copy is set aside
+// for their hold, see reservations.go. Users who asked for it also hear
+// about the new books matching their saved searches, see searches.go.
+// Users without an address and those who opted out get none. The emails
+// are sent through an SMTP server or SendGrid as mail.driver says; in
+// dry-run mode they are only written to the log.
+
+// The kinds of emails, each a pair of templates in mail.tmpl.
+const (
+	mailDueReminder   = "due_reminder"
+	mailOverdueNotice = "overdue_notice"
+	mailHoldReady     = "hold_ready"
+	mailSearchAlert   = "search_alert"
+)
+
+var mailKinds = []string{mailDueReminder, mailOverdueNotice, mailHoldReady, mailSearchAlert}
+
+// How long sending a single email may take.
+const mailTimeout = 30 * time.Second
+
+//go:embed mail.tmpl
+var mailTemplates string
+
+var mailTmpl = template.Must(template.New("mail").Parse(mailTemplates))
+
+// An email, in plain text.
+type mailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends emails from the library's address.
+type mailer interface {
+	Send(ctx context.Context, m mailMessage) error
+}
+
+// Returns the mailer mail.driver asks for, or nil if the library sends no
+// emails. The configuration was checked before.
+func loadMailer(cfg MailConfig) mailer {
+	if cfg.Driver == "" && !cfg.DryRun {
+		return nil
+	}
+	from, _ := mail.ParseAddress(cfg.From)
+	if cfg.DryRun {
+		return logMailer{from: from}
+	}
+	if cfg.Driver == "sendgrid" {
+		return &sendGridMailer{
+			client:  &http.Client{Timeout: mailTimeout},
+			baseURL: "https://api.sendgrid.com",
+			apiKey:  cfg.SendGridAPIKey,
+			from:    from,
+		}
+	}
+	m := &smtpMailer{addr: net.JoinHostPort(cfg.SMTP.Host, strconv.Itoa(cfg.SMTP.Port)), from: from}
+	if cfg.SMTP.Username != "" {
+		m.auth = smtp.PlainAuth("", cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.Host)
+	}
+	return m
+}
+
+// Writes the emails to the log instead of sending them.
+type logMailer struct {
+	from *mail.Address
+}
+
+func (l logMailer) Send(ctx context.Context, m mailMessage) error {
+	log.Printf("Mail (dry run) from %s to %s: %s\n%s", l.from, m.To, m.Subject, m.Body)
+	return nil
+}
+
+// Sends the emails through an SMTP server, with STARTTLS if the server
+// offers it. The login is only sent over TLS, or to localhost.
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from *mail.Address
+}
+
+func (s *smtpMailer) Send(ctx context.Context, m mailMessage) error {
+	msg, err := composeMail(s.from, m)
+	if err != nil {
+		return err
+	}
+	// net/smtp knows no contexts, the timeout of the caller is only
+	// checked before
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.from.Address, []string{m.To}, msg)
+}
+
+// Puts the email together as it goes over SMTP: the headers, then the body
+// as quoted-printable UTF-8.
+func composeMail(from *mail.Address, m mailMessage) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	_, domain, _ := strings.Cut(from.Address, "@")
+
+	var b bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+	header("From", from.String())
+	header("To", m.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+hex.EncodeToString(id)+"@"+domain+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	b.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&b)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Sends the emails through the SendGrid API.
+type sendGridMailer struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+	from    *mail.Address
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+func (s *sendGridMailer) Send(ctx context.Context, m mailMessage) error {
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	type personalization struct {
+		To []sendGridAddress `json:"to"`
+	}
+	body, err := json.Marshal(struct {
+		Personalizations []personalization `json:"personalizations"`
+		From             sendGridAddress   `json:"from"`
+		Subject          string            `json:"subject"`
+		Content          []content         `json:"content"`
+	}{
+		Personalizations: []personalization{{To: []sendGridAddress{{Email: m.To}}}},
+		From:             sendGridAddress{Email: s.from.Address, Name: s.from.Name},
+		Subject:          m.Subject,
+		Content:          []content{{Type: "text/plain", Value: m.Body}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+"/v3/mail/send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("SendGrid: %s", res.Status)
+	}
+	return nil
+}
+
+// What the templates are filled in with. Due is the due date of the loan
+// and Days how long it is overdue; URL points to the book's page. The
+// alerts of a saved search list the first of the Total new Books, and
+// URL points to the search instead.
+type mailData struct {
+	User   User
+	Book   BookStore
+	Due    time.Time
+	Days   int
+	URL    string
+	Search SavedSearch
+	Books  []BookStore
+	Total  int64
+}
+
+func renderMail(kind string, data mailData) (mailMessage, error) {
+	var subject, body strings.Builder
+	if err := mailTmpl.ExecuteTemplate(&subject, kind+".subject", data); err != nil {
+		return mailMessage{}, err
+	}
+	if err := mailTmpl.ExecuteTemplate(&body, kind+".body", data); err != nil {
+		return mailMessage{}, err
+	}
+	return mailMessage{To: data.User.Email, Subject: subject.String(), Body: body.String()}, nil
+}
+
+// Emails the user about the book, unless there is no mailer, no address or
+// the user opted out of all emails or those of the kind, and reports
+// whether it did. The user and the book
+// are looked up; data only needs what is particular to the email.
+func (s *server) notify(ctx context.Context, kind string, userID, bookID primitive.ObjectID, data mailData) (bool, error) {
+	user, ok, err := s.mailRecipient(ctx, kind, userID)
+	if !ok || err != nil {
+		return false, err
+	}
+	book, err := s.books.FindByID(ctx, bookID)
+	if err != nil {
+		return false, err
+	}
+	data.User, data.Book = user, book
+	data.URL = strings.TrimSuffix(s.publicURL, "/") + "/books/" + book.ID.Hex()
+	if err := s.sendMail(ctx, kind, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Looks up the user to email, and reports whether they get emails of the
+// kind at all.
+func (s *server) mailRecipient(ctx context.Context, kind string, userID primitive.ObjectID) (User, bool, error) {
+	if s.mailer == nil {
+		return User{}, false, nil
+	}
+	user, err := s.users.FindByID(ctx, userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return user, false, nil
+	}
+	if err != nil {
+		return user, false, err
+	}
+	if user.Email == "" || user.EmailOptOut || slices.Contains(user.MutedEmails, kind) {
+		return user, false, nil
+	}
+	return user, true, nil
+}
+
+// Renders the email of the kind for data.User and sends it.
+func (s *server) sendMail(ctx context.Context, kind string, data mailData) error {
+	m, err := renderMail(kind, data)
+	if err != nil {
+		return err
+	}
+	sendCtx, cancel := context.WithTimeout(ctx, mailTimeout)
+	defer cancel()
+	if err := s.mailer.Send(sendCtx, m); err != nil {
+		return fmt.Errorf("mailing %s: %w", data.User.Username, err)
+	}
+	return nil
+}
+
+// For emailing a user in the background: long enough to look them up and
+// send the email.
+func notifyContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), dbTimeout+mailTimeout)
+}
+
+// Tells the user their hold is ready, in the background, so the copy
+// coming back does not wait for the email.
+func (s *server) notifyHoldReady(r Reservation) {
+	if s.mailer == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := notifyContext()
+		defer cancel()
+		if _, err := s.notify(ctx, mailHoldReady, r.UserID, r.BookID, mailData{}); err != nil {
+			log.Printf("Failed to tell that hold %s is ready: %v", r.ID.Hex(), err)
+		}
+	}()
+}
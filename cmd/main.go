@@ -2,39 +2,56 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
-	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/CAPS-Cloud/exercises"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
 )
 
-// Defines a "model" that we can use to communicate with the
-// frontend or the database
-type BookStore struct {
-	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
-	BookName   string             `json:"name" bson:"name"`
-	BookAuthor string             `json:"author" bson:"author"`
-	BookISBN   string             `json:"isbn,omitempty" bson:"isbn,omitempty"`
-	BookPages  int                `json:"pages" bson:"pages"`
-	BookYear   int                `json:"year" bson:"year"`
-}
-
 // Wraps the "Template" struct to associate a necessary method
 // to determine the rendering procedure
 type Template struct {
-	tmpl *template.Template
+	// The templates by language, see i18n.go
+	tmpl map[string]*template.Template
+	// Where the templates are parsed from, see loadAssets
+	assets fs.FS
+	// In development mode the templates are parsed again once the views
+	// changed, so they can be edited without restarting the server
+	dev      bool
+	mu       sync.Mutex
+	modified time.Time
+}
+
+// Where the templates are read from, within the assets
+const viewsPattern = "views/*.html"
+
+// Returns the views and the stylesheets: those embedded into the binary,
+// unless a directory to read them from is configured. In development mode
+// they are read from the working directory by default, so they can be
+// edited.
+func loadAssets(cfg Config) fs.FS {
+	dir := cfg.Assets
+	if dir == "" && cfg.Dev {
+		dir = "."
+	}
+	if dir == "" {
+		return exercises.Assets
+	}
+	return os.DirFS(dir)
 }
 
 // Preload the available templates for the view folder.
@@ -45,170 +62,132 @@ type Template struct {
 // to get to know more about templating
 // You can also read Golang's documentation on their templating
 // https://pkg.go.dev/text/template
-func loadTemplates() *Template {
-	return &Template{
-		tmpl: template.Must(template.ParseGlob("views/*.html")),
+func loadTemplates(assets fs.FS, dev bool) *Template {
+	t := &Template{assets: assets, dev: dev}
+	modified, err := t.viewsModified()
+	if err != nil {
+		log.Fatal(err)
 	}
-}
-
-// Method definition of the required "Render" to be passed for the Rendering
-// engine.
-// Contraire to method declaration, such syntax defines methods for a given
-// struct. "Interfaces" and "structs" can have methods associated with it.
-// The difference lies that interfaces declare methods whether struct only
-// implement them, i.e., only define them. Such differentiation is important
-// for a compiler to ensure types provide implementations of such methods.
-func (t *Template) Render(w io.Writer, name string, data interface{}, ctx echo.Context) error {
-	return t.tmpl.ExecuteTemplate(w, name, data)
-}
-
-// Here we make sure the connection to the database is correct and initial
-// configurations exists. Otherwise, we create the proper database and collection
-// we will store the data.
-// To ensure correct management of the collection, we create a return a
-// reference to the collection to always be used. Make sure if you create other
-// files, that you pass the proper value to ensure communication with the
-// database
-// More on what bson means: https://www.mongodb.com/docs/drivers/go/current/fundamentals/bson/
-func prepareDatabase(client *mongo.Client, dbName string, collecName string) (*mongo.Collection, error) {
-	db := client.Database(dbName)
-
-	names, err := db.ListCollectionNames(context.TODO(), bson.D{{}})
+	tmpl, err := t.parse()
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
 	}
-	if !slices.Contains(names, collecName) {
-		cmd := bson.D{{"create", collecName}}
-		var result bson.M
-		if err = db.RunCommand(context.TODO(), cmd).Decode(&result); err != nil {
-			log.Fatal(err)
+	t.tmpl, t.modified = tmpl, modified
+	return t
+}
+
+// Every language gets templates of its own, which translate into it.
+func (t *Template) parse() (map[string]*template.Template, error) {
+	tmpl := map[string]*template.Template{}
+	for _, tag := range languages {
+		lang := languageCode(tag)
+		parsed, err := template.New("").Funcs(templateFuncs(lang)).ParseFS(t.assets, viewsPattern)
+		if err != nil {
 			return nil, err
 		}
+		tmpl[lang] = parsed
 	}
-
-	coll := db.Collection(collecName)
-	return coll, nil
+	return tmpl, nil
 }
 
-// Here we prepare some fictional data and we insert it into the database
-// the first time we connect to it. Otherwise, we check if it already exists.
-func prepareData(client *mongo.Client, coll *mongo.Collection) {
-	startData := []BookStore{
-		{
-			BookName:   "The Vortex",
-			BookAuthor: "José Eustasio Rivera",
-			BookISBN:   "958-30-0804-4",
-			BookPages:  292,
-			BookYear:   1924,
-		},
-		{
-			BookName:   "Frankenstein",
-			BookAuthor: "Mary Shelley",
-			BookISBN:   "978-3-649-64609-9",
-			BookPages:  280,
-			BookYear:   1818,
-		},
-		{
-			BookName:   "The Black Cat",
-			BookAuthor: "Edgar Allan Poe",
-			BookISBN:   "978-3-99168-238-7",
-			BookPages:  280,
-			BookYear:   1843,
-		},
+// Returns when the views were last changed. The embedded ones never are.
+func (t *Template) viewsModified() (time.Time, error) {
+	files, err := fs.Glob(t.assets, viewsPattern)
+	if err != nil {
+		return time.Time{}, err
 	}
-
-	// This syntax helps us iterate over arrays. It behaves similar to Python
-	// However, range always returns a tuple: (idx, elem). You can ignore the idx
-	// by using _.
-	// In the topic of function returns: sadly, there is no standard on return types from function. Most functions
-	// return a tuple with (res, err), but this is not granted. Some functions
-	// might return a ret value that includes res and the err, others might have
-	// an out parameter.
-	for _, book := range startData {
-		cursor, err := coll.Find(context.TODO(), book)
-		var results []BookStore
-		if err = cursor.All(context.TODO(), &results); err != nil {
-			panic(err)
+	var modified time.Time
+	for _, f := range files {
+		info, err := fs.Stat(t.assets, f)
+		if err != nil {
+			return time.Time{}, err
 		}
-		if len(results) > 1 {
-			log.Fatal("more records were found")
-		} else if len(results) == 0 {
-			result, err := coll.InsertOne(context.TODO(), book)
-			if err != nil {
-				panic(err)
-			} else {
-				fmt.Printf("%+v\n", result)
-			}
-
-		} else {
-			for _, res := range results {
-				cursor.Decode(&res)
-				fmt.Printf("%+v\n", res)
-			}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
 		}
 	}
+	return modified, nil
 }
 
-// Generic method to perform "SELECT * FROM BOOKS" (if this was SQL, which
-// it is not :D ), and then we convert it into an array of map. In Golang, you
-// define a map by writing map[<key type>]<value type>{<key>:<value>}.
-// interface{} is a special type in Golang, basically a wildcard...
-func findAllBooks(coll *mongo.Collection) []map[string]interface{} {
-	cursor, err := coll.Find(context.TODO(), bson.D{{}})
-	var results []BookStore
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		panic(err)
+// Returns the templates for the language, parsing them again first if
+// the views changed in development mode. A view that does not parse fails
+// the request, so the mistake shows right in the browser.
+func (t *Template) templates(lang string) (*template.Template, error) {
+	if !t.dev {
+		return t.tmpl[lang], nil
 	}
-
-	var ret []map[string]interface{}
-	for _, res := range results {
-		ret = append(ret, map[string]interface{}{
-			"ID":         res.ID.Hex(),
-			"BookName":   res.BookName,
-			"BookAuthor": res.BookAuthor,
-			"BookISBN":   res.BookISBN,
-			"BookPages":  res.BookPages,
-			"BookYears":  res.BookYear,
-		})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	modified, err := t.viewsModified()
+	if err != nil {
+		return nil, err
 	}
-
-	return ret
+	if modified.After(t.modified) {
+		tmpl, err := t.parse()
+		if err != nil {
+			return nil, err
+		}
+		t.tmpl, t.modified = tmpl, modified
+	}
+	return t.tmpl[lang], nil
 }
 
-func getBooks(coll *mongo.Collection) []map[string]interface{} {
-	cursor, err := coll.Find(context.TODO(), bson.D{{}})
-	var results []BookStore
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		panic(err)
+// Method definition of the required "Render" to be passed for the Rendering
+// engine.
+// Contraire to method declaration, such syntax defines methods for a given
+// struct. "Interfaces" and "structs" can have methods associated with it.
+// The difference lies that interfaces declare methods whether struct only
+// implement them, i.e., only define them. Such differentiation is important
+// for a compiler to ensure types provide implementations of such methods.
+func (t *Template) Render(w io.Writer, name string, data interface{}, ctx echo.Context) error {
+	tmpl, err := t.templates(pageLanguage(ctx))
+	if err != nil {
+		return err
 	}
-
-	var ret []map[string]interface{}
-	for _, res := range results {
-		ret = append(ret, map[string]interface{}{
-			"id":     res.ID.Hex(),
-			"name":   res.BookName,
-			"author": res.BookAuthor,
-			"isbn":   res.BookISBN,
-			"pages":  res.BookPages,
-			"year":   res.BookYear,
-		})
-	}
-	return ret
+	return tmpl.ExecuteTemplate(w, name, data)
 }
 
-func updateDocument(coll *mongo.Collection, filter bson.M, update bson.M) (*mongo.SingleResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// Runs the command named by the first argument, see cli.go, or serves if
+// there is none.
+func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printCommands()
+		return
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		printCommands()
+		os.Exit(2)
+	}
+
+	// Read the configuration from the file, the environment and the flags,
+	// see config.go
+	fs := flag.NewFlagSet(os.Args[0]+" "+name, flag.ExitOnError)
+	run := cmd.setup(fs)
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	dbTimeout = cfg.Timeouts.Database
+	mongoOps = mongoPolicy{Timeout: cfg.Timeouts.DatabaseOperation, Retries: cfg.Database.Retries, Backoff: cfg.Database.RetryBackoff}
+	slowQueryThreshold = cfg.Database.SlowQuery
 
-	opts := options.FindOneAndUpdate().SetReturnDocument(options.After) // Return the updated document
-	result := coll.FindOneAndUpdate(ctx, filter, update, opts)
-	if result.Err() != nil {
-		return nil, result.Err()
+	if err := run(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
 	}
-	return result, nil
 }
 
-func main() {
+// Serves the web UI, the API and gRPC until SIGINT or SIGTERM.
+func runServe(cfg Config) error {
+	log.Printf("Effective configuration:\n%s", cfg)
+
 	// Connect to the database. Such defer keywords are used once the local
 	// context returns; for this case, the local context is the main function
 	// By user defer function, we make sure we don't leave connections
@@ -216,176 +195,250 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	uri := os.Getenv("DATABASE_URI")
-	if len(uri) == 0 {
-		fmt.Printf("failure to load env variable\n")
-		os.Exit(1)
+	// Traces go to the OTLP endpoint from the environment, see tracing.go
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		return err
 	}
+	defer shutdownTracing(context.Background())
 
-	// TODO: make sure to pass the proper username, password, and port
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	repos, closeStorage, err := openStorage(ctx, cfg.Database)
 	if err != nil {
-		fmt.Printf("failed to create client for MongoDB\n")
-		os.Exit(1)
+		return err
+	}
+	defer closeStorage()
+	// Without migrating on startup, see migrations.go
+	if !cfg.Database.Migrate {
+		if err = checkMigrations(ctx, repos); err != nil {
+			return err
+		}
 	}
 
-	err = client.Ping(ctx, readpref.Primary())
+	rdb, err := openRedis(ctx, cfg.Redis)
 	if err != nil {
-		fmt.Printf("failed to connect to MongoDB, please make sure the database is running\n")
-		os.Exit(1)
+		return err
+	}
+	if rdb != nil {
+		defer rdb.Close()
+	}
+	if cfg.Auth.SessionStore == "redis" {
+		repos.sessions = newRedisSessionRepository(rdb)
+	}
+	if cfg.Auth.Lockout.Store == "redis" {
+		repos.loginFailures = newRedisLoginFailureRepository(rdb)
+	}
+	// Forward the events to NATS or Kafka if configured, see bus.go
+	forwarder, err := loadEventForwarder(cfg.Events)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", cfg.Events.Backend, err)
+	}
+	if forwarder != nil {
+		defer forwarder.close()
 	}
 
-	// This is another way to specify the call of a function. You can define inline
-	// functions (or anonymous functions, similar to the behavior in Python)
-	defer func() {
-		if err = client.Disconnect(ctx); err != nil {
-			panic(err)
+	if cfg.Seed.Enabled {
+		report, err := seedBooks(ctx, repos.books, cfg.Seed.File)
+		if err != nil {
+			return fmt.Errorf("failed to seed the books: %w", err)
 		}
-	}()
-
-	// You can use such name for the database and collection, or come up with
-	// one by yourself!
-	coll, err := prepareDatabase(client, "exercise-2", "information")
-
-	prepareData(client, coll)
-
-	// Here we prepare the server
-	e := echo.New()
-
-	// Define our custom renderer
-	e.Renderer = loadTemplates()
-
-	// Log the requests. Please have a look at echo's documentation on more
-	// middleware
-	e.Use(middleware.Logger())
-
-	e.Static("/css", "css")
-
-	// Endpoint definition. Here, we divided into two groups: top-level routes
-	// starting with /, which usually serve webpages. For our RESTful endpoints,
-	// we prefix the route with /api to indicate more information or resources
-	// are available under such route.
-	e.GET("/", func(c echo.Context) error {
-		return c.Render(200, "index", nil)
-	})
-
-	e.GET("/books", func(c echo.Context) error {
-		books := findAllBooks(coll)
-		return c.Render(200, "book-table", books)
-	})
-
-	e.GET("/authors", func(c echo.Context) error {
-		books := findAllBooks(coll)
-		return c.Render(200, "author-table", books)
-	})
-
-	e.GET("/years", func(c echo.Context) error {
-		books := findAllBooks(coll)
-		return c.Render(200, "year-table", books)
-	})
-
-	e.GET("/search", func(c echo.Context) error {
-		return c.Render(200, "search-bar", nil)
-	})
-
-	e.GET("/create", func(c echo.Context) error {
-		return c.NoContent(http.StatusNoContent)
-	})
-
-	e.GET("/api/books", func(c echo.Context) error {
-		books := getBooks(coll)
-		return c.JSON(http.StatusOK, books)
-	})
+		log.Printf("Seeded the books of %s: %s", cfg.Seed.File, report)
+	}
+	if err = seedAdmin(ctx, repos.users, cfg.Auth); err != nil {
+		return err
+	}
 
-	e.POST("/api/books", func(c echo.Context) error {
-		var newBook BookStore
-		if err := c.Bind(&newBook); err != nil {
-			return echo.NewHTTPError(http.StatusNotModified, "Invalid book data")
+	s := &server{
+		users:           repos.users,
+		apiKeys:         repos.apiKeys,
+		sessions:        repos.sessions,
+		ping:            repos.ping,
+		pingRedis:       pingRedis(rdb),
+		readyTimeout:    cfg.Timeouts.Ready,
+		publicURL:       cfg.PublicURL,
+		securityHeaders: cfg.SecurityHeaders,
+		jwtSecret:       loadJWTSecret(cfg.Auth.JWTSecret),
+		totpKey:         loadTOTPKey(cfg.Auth.TOTPKey),
+		oauthProviders:  loadOAuthProviders(ctx, cfg.OAuth, cfg.PublicURL),
+		loanPolicy:      loadLoanPolicy(cfg.Library),
+		metadataSources: loadMetadataSources(cfg.Lookup),
+		mailer:          loadMailer(cfg.Mail),
+		remindDays:      cfg.Mail.RemindDays,
+		forwarder:       forwarder,
+		lockout:         loadLockout(cfg.Auth.Lockout, repos.loginFailures),
+		stopping:        make(chan struct{}),
+	}
+	s.serveCatalog(cfg, repos, rdb, "")
+	// Limit the requests per client, see ratelimit.go
+	var limits rateLimitStore
+	if cfg.RateLimit.Enabled {
+		limits = newMemoryRateLimitStore()
+		if cfg.RateLimit.Store == "redis" {
+			limits = newRedisRateLimitStore(rdb)
 		}
+	}
+	// The catalogs of the library branches, see tenants.go
+	if cfg.Tenancy.Enabled {
+		s.tenants = newTenantRouter(s, cfg, repos, rdb, limits)
+		defer s.tenants.close()
+	}
+	e := s.newEcho(cfg, limits)
+	if s.tenants != nil {
+		e.Pre(s.tenants.dispatch)
+	}
 
-		// Data Validation
-		if newBook.BookName == "" || newBook.BookAuthor == "" || newBook.BookPages == 0 || newBook.BookYear == 0 {
-			return echo.NewHTTPError(http.StatusNotModified, "Name, author, pages and year cannot be empty!")
+	// Internal services may talk gRPC on a second port instead
+	var grpcServer *grpc.Server
+	if cfg.Features.GRPC {
+		grpcServer = s.startGRPC(cfg.GRPCPort)
+	}
+
+	// HTTPS if configured, see tls.go
+	redirect := startRedirect(e, cfg)
+	go func() {
+		if err := serve(e, cfg); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
 		}
+	}()
 
-		//Data Duplication
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		count, err := coll.CountDocuments(ctx, bson.M{"name": newBook.BookName,
-			"author": newBook.BookAuthor,
-			"year":   newBook.BookYear,
-			"pages":  newBook.BookPages,
-		})
+	// Serve until SIGINT or SIGTERM, then let the requests in flight finish
+	// before the deferred calls above disconnect from the database, see
+	// shutdown.go
+	waitForShutdown(e, redirect, grpcServer, s.stopping, cfg.Timeouts.Shutdown)
+	return nil
+}
 
-		if err != nil {
-			return echo.NewHTTPError(http.StatusNotModified, "Error checking for same book!")
-		}
-		if count > 0 {
-			return echo.NewHTTPError(http.StatusNotModified, "There already exists the exact book!")
+// Sets the server up to serve the catalog in repos: the books, as seen
+// through the search and the events, and everything else that belongs to
+// a library. Starts what follows the changes to the books. tenant names the
+// branch the catalog belongs to, see tenants.go, and is empty for the main
+// library.
+func (s *server) serveCatalog(cfg Config, repos *repositories, rdb *redis.Client, tenant string) {
+	events := newBookEvents()
+	books := watchBooks(context.Background(), repos.books, events)
+	// The systems outside may follow the change stream instead, see sync.go
+	syncer := newSyncWorker(cfg.Sync, repos.books, books, tenant)
+	// Searches go to Elasticsearch if configured, see elasticsearch.go
+	var search *elasticsearchIndex
+	if cfg.Search.Backend == "elasticsearch" {
+		searchCfg := cfg.Search
+		if tenant != "" {
+			searchCfg.Index += "-" + tenant
 		}
-
-		// Data Insertion
-		result, err := coll.InsertOne(ctx, newBook)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusNotModified, "Error creating book")
+		search = newElasticsearchIndex(searchCfg)
+		books = &elasticBookRepository{BookRepository: books, index: search}
+		if syncer.takes("search") {
+			syncer.add(searchSync(search, repos.books))
+		} else {
+			go search.follow(repos.books, events)
 		}
-
-		// Response
-		return c.JSON(http.StatusCreated, map[string]interface{}{"message": "Book created successfully", "id": result.InsertedID.(primitive.ObjectID).Hex()})
-	})
-
-	e.PUT("/api/books", func(c echo.Context) error {
-		var newBook BookStore
-		if err := c.Bind(&newBook); err != nil {
-			return echo.NewHTTPError(http.StatusNotModified, "Invalid book data")
+	}
+	s.books = newAuditedBookRepository(books, repos.audit)
+	s.authors = repos.authors
+	s.genres = repos.genres
+	// What happens in the catalog goes on its event bus, see bus.go
+	bus := newEventBus(tenant, s.forwarder)
+	s.copies = repos.copies
+	s.loans = &publishedLoanRepository{LoanRepository: repos.loans, bus: bus}
+	s.reservations = repos.reservations
+	s.shelves = repos.shelves
+	s.savedSearches = repos.savedSearches
+	s.progress = repos.progress
+	s.webhooks = repos.webhooks
+	s.audit = repos.audit
+	s.fuzzy = newFuzzySearch(repos.books, events)
+	s.search = search
+	s.events = events
+	s.ws = newWSHub()
+	s.cached = nil
+
+	s.bus = bus
+
+	go s.ws.run(events)
+	go bus.followBooks(events)
+	if cfg.Features.Webhooks {
+		webhooks := newWebhookDispatcher(repos.webhooks)
+		if syncer.takes("webhooks") {
+			webhooks.start()
+			syncer.add(webhookSync(webhooks))
+		} else {
+			go webhooks.run(events)
 		}
-
-		filter := bson.M{"_id": newBook.ID}
-		update := bson.M{"$set": bson.M{"name": newBook.BookName,
-			"author": newBook.BookAuthor,
-			"year":   newBook.BookYear,
-			"isbn":   newBook.BookISBN,
-			"pages":  newBook.BookPages,
-		}}
-
-		result, err := updateDocument(coll, filter, update)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusNotModified, "Unable to update")
+	}
+	// Cache the public book endpoints, see cache.go
+	if cfg.Cache.Enabled {
+		var cache responseCache = newMemoryResponseCache()
+		if cfg.Cache.Store == "redis" {
+			cache = newRedisResponseCache(rdb, tenant)
 		}
-
-		var updatedDoc bson.M
-		if err := result.Decode(&updatedDoc); err != nil {
-			return echo.NewHTTPError(http.StatusNotModified, "Unable to update")
+		if cfg.Cache.Store == "redis" && syncer.takes("cache") {
+			syncer.add(cacheSync(cache))
+		} else {
+			go invalidateCache(cache, events, rdb)
 		}
+		s.cached = cacheResponses(cache, cfg.Cache.TTL)
+	}
+	// Recognize retried requests, see idempotency.go
+	var idempotency idempotencyStore = newMemoryIdempotencyStore()
+	if cfg.Idempotency.Store == "redis" {
+		idempotency = newRedisIdempotencyStore(rdb, tenant)
+	}
+	s.idempotent = idempotent(idempotency, cfg.Idempotency.TTL)
+	// Do the chores on their schedules, see jobs.go
+	s.stats = &statsSnapshot{}
+	s.jobs = s.loadJobs(cfg)
+	s.jobs.start()
+	syncer.start()
+}
 
-		// Response
-		return c.JSON(http.StatusOK, map[string]interface{}{"message": "Book modified successfully", "id": newBook.ID})
-
-	})
+// Prepares the echo instance serving s, with the middleware every request
+// goes through. Requests are only limited if limits is set.
+func (s *server) newEcho(cfg Config, limits rateLimitStore) *echo.Echo {
+	e := echo.New()
+	e.Logger.SetLevel(logLevel(cfg.LogLevel))
+	// Only a proxy in front of the server may tell the client's address
+	if cfg.BehindProxy {
+		e.IPExtractor = echo.ExtractIPFromXFFHeader()
+	} else {
+		e.IPExtractor = echo.ExtractIPDirect()
+	}
 
-	e.DELETE("/api/books/:id", func(c echo.Context) error {
-		id := c.Param("id")
-		fmt.Println(id)
-		objID, err := primitive.ObjectIDFromHex(id)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusNotModified, "Invalid ID format")
-		}
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+	// Define our custom renderer
+	assets := loadAssets(cfg)
+	e.Renderer = loadTemplates(assets, cfg.Dev)
 
-		deleteResult, err := coll.DeleteOne(ctx, bson.M{"_id": objID})
-		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				return echo.NewHTTPError(http.StatusNotModified, "Book not found")
-			}
-			return echo.NewHTTPError(http.StatusNotModified, "Error deleting book")
-		}
+	// Every error, no matter where it comes from, is answered with the
+	// same JSON envelope
+	e.HTTPErrorHandler = httpErrorHandler(cfg.API.ErrorFormat)
 
-		if deleteResult.DeletedCount == 0 {
-			return echo.NewHTTPError(http.StatusNotModified, "Book not found")
-		}
-		return c.JSON(http.StatusOK, map[string]interface{}{"message": "Book deleted successfully", "id": id})
-	})
+	// Log the requests, unless the log level asks for warnings and errors
+	// only. Please have a look at echo's documentation on more middleware
+	if cfg.LogLevel == "debug" || cfg.LogLevel == "info" {
+		e.Use(middleware.Logger())
+	}
+	// Count and time the requests for /metrics, see metrics.go
+	e.Use(instrumentRequests)
+	// Open a span for every request, see tracing.go
+	e.Use(traceRequests)
+	// Keep browsers on HTTPS once they got there, see tls.go
+	if cfg.TLS.enabled() && cfg.TLS.HSTSMaxAge > 0 {
+		e.Use(hsts(cfg.TLS))
+	}
+	// Let other origins call /api, see cors.go. Preflight requests are
+	// answered before they count against the rate limit.
+	if len(cfg.CORS.AllowOrigins) > 0 {
+		e.Use(apiCORS(cfg.CORS))
+	}
+	if limits != nil {
+		e.Use(s.rateLimit(cfg.RateLimit, limits))
+	}
+	// Cap the request bodies, see limits.go
+	e.Use(limitBodies(cfg.Limits))
+	// Compress the responses, see compress.go
+	if cfg.Compression.Enabled {
+		e.Use(compress(cfg.Compression))
+	}
 
-	e.Logger.Fatal(e.Start(":3030"))
+	e.StaticFS("/css", echo.MustSubFS(assets, "css"))
+	s.registerRoutes(e)
+	return e
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/marc"
+	"github.com/labstack/echo/v4"
+)
+
+// Media types of MARC 21 records, see RFC 2220 and RFC 6207.
+const (
+	mimeMARC    = "application/marc"
+	mimeMARCXML = "application/marcxml+xml; charset=utf-8"
+)
+
+// Describes a book as a minimal MARC 21 bibliographic record. created is
+// the date written as the day the record was entered, as the catalog does
+// not keep track of that.
+//
+// The fields used are 001 (our ID), 008 (the year), 020 (ISBN), 100
+// (author), 245 (title), 264 (publication year), 300 (pages) and 655 (one
+// per genre).
+func bookToMARC(b BookStore, created time.Time) marc.Record {
+	r := marc.Record{Leader: marc.MonographLeader}
+	r.Fields = append(r.Fields,
+		marc.ControlField("001", b.ID.Hex()),
+		marc.ControlField("008", fixedLengthData(b, created)),
+	)
+	if b.BookISBN != "" {
+		r.Fields = append(r.Fields, marc.DataField("020", ' ', ' ', marc.Sub('a', b.BookISBN)))
+	}
+
+	// Names written as "Surname, Forename" are marked as such, others are
+	// kept in the order we have them
+	titleInd := byte('0')
+	if b.BookAuthor != "" {
+		nameInd := byte('0')
+		if strings.Contains(b.BookAuthor, ",") {
+			nameInd = '1'
+		}
+		r.Fields = append(r.Fields, marc.DataField("100", nameInd, ' ', marc.Sub('a', b.BookAuthor)))
+		titleInd = '1'
+	}
+	title := marc.DataField("245", titleInd, '0', marc.Sub('a', b.BookName))
+	if b.BookAuthor != "" {
+		title.Subfields = append(title.Subfields, marc.Sub('c', b.BookAuthor))
+	}
+	r.Fields = append(r.Fields, title)
+
+	if b.BookYear > 0 {
+		r.Fields = append(r.Fields, marc.DataField("264", ' ', '1', marc.Sub('c', strconv.Itoa(b.BookYear))))
+	}
+	if b.BookPages > 0 {
+		r.Fields = append(r.Fields, marc.DataField("300", ' ', ' ', marc.Sub('a', fmt.Sprintf("%d pages", b.BookPages))))
+	}
+	for _, g := range b.Genres {
+		r.Fields = append(r.Fields, marc.DataField("655", ' ', '4', marc.Sub('a', g)))
+	}
+	return r
+}
+
+// Returns field 008 for books. Everything but the dates, which come from
+// the year of the book, is coded as unknown or not applicable.
+func fixedLengthData(b BookStore, created time.Time) string {
+	dates := "nuuuu    "
+	if b.BookYear > 0 && b.BookYear <= 9999 {
+		dates = fmt.Sprintf("s%04d    ", b.BookYear)
+	}
+	// Positions 18 to 34 are specific to books; only 33, the literary
+	// form, is not blank or zero
+	return created.Format("060102") + dates + "xx " + "           000 u " + "und" + " d"
+}
+
+// Parses the format parameter of the MARC routes: marcxml, the default,
+// or marc for the binary format.
+func marcFormat(c echo.Context) (string, error) {
+	switch format := c.QueryParam("format"); format {
+	case "", "marcxml":
+		return "marcxml", nil
+	case "marc":
+		return format, nil
+	default:
+		return "", echo.NewHTTPError(http.StatusBadRequest, "format must be marcxml or marc")
+	}
+}
+
+// Returns the book as a MARC 21 record, by default in MARCXML.
+func (s *server) getBookMARC(c echo.Context) error {
+	format, err := marcFormat(c)
+	if err != nil {
+		return err
+	}
+	objID, err := bookID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	book, err := s.books.FindByID(ctx, objID)
+	if err != nil {
+		return err
+	}
+	record := bookToMARC(book, time.Now())
+	data, err := record.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if format == "marc" {
+		return c.Blob(http.StatusOK, mimeMARC, data)
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, mimeMARCXML)
+	res.WriteHeader(http.StatusOK)
+	w, err := marc.NewXMLWriter(res)
+	if err != nil {
+		return err
+	}
+	if err := w.Write(record); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (s *server) exportMARC(ctx context.Context, out io.Writer, q BookQuery) error {
+	now := time.Now()
+	return s.eachBook(ctx, q, func(b BookStore) error {
+		data, err := bookToMARC(b, now).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	})
+}
+
+func (s *server) exportMARCXML(ctx context.Context, out io.Writer, q BookQuery) error {
+	w, err := marc.NewXMLWriter(out)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = s.eachBook(ctx, q, func(b BookStore) error {
+		return w.Write(bookToMARC(b, now))
+	})
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Users look at their own account under /api/me and set their
+// preferences there: the name the pages greet them with, their email
+// address and which emails they want, the language of the pages, which
+// otherwise follows the browser, and how many books the pages list at
+// once. Only users have preferences, API keys get 403.
+
+const maxDisplayNameLength = 100
+
+// The changes users can make to their own account. Fields that are not
+// sent stay as they are; empty strings and a page size of 0 go back to
+// the defaults.
+type mePatch struct {
+	DisplayName *string   `json:"display_name"`
+	Email       *string   `json:"email"`
+	Language    *string   `json:"language"`
+	PageSize    *int      `json:"page_size"`
+	EmailOptOut *bool     `json:"email_opt_out"`
+	MutedEmails *[]string `json:"muted_emails"`
+}
+
+func (s *server) getMe(c echo.Context) error {
+	user, err := requireUser(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+func (s *server) patchMe(c echo.Context) error {
+	me, err := requireUser(c)
+	if err != nil {
+		return err
+	}
+	var p mePatch
+	if err := c.Bind(&p); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user data").SetInternal(err)
+	}
+
+	v := &ValidationError{}
+	if p.DisplayName != nil {
+		*p.DisplayName = strings.TrimSpace(*p.DisplayName)
+		if utf8.RuneCountInString(*p.DisplayName) > maxDisplayNameLength {
+			v.add("display_name", "must be at most 100 characters")
+		}
+	}
+	if p.Email != nil {
+		*p.Email = strings.TrimSpace(*p.Email)
+		checkEmail(v, *p.Email)
+	}
+	if p.Language != nil && *p.Language != "" && !slices.Contains(languageCodes(), *p.Language) {
+		v.add("language", "must be one of "+strings.Join(languageCodes(), ", ")+", or empty")
+	}
+	if p.PageSize != nil && (*p.PageSize < 0 || *p.PageSize > maxPageLimit) {
+		v.add("page_size", "must be between 1 and 100, or 0")
+	}
+	if p.MutedEmails != nil {
+		for _, kind := range *p.MutedEmails {
+			if !slices.Contains(mailKinds, kind) {
+				v.add("muted_emails", "must only list "+strings.Join(mailKinds, ", "))
+				break
+			}
+		}
+	}
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	user, err := s.users.FindByID(ctx, me.ID)
+	if err != nil {
+		return err
+	}
+	if p.DisplayName != nil {
+		user.DisplayName = *p.DisplayName
+	}
+	if p.Email != nil {
+		user.Email = *p.Email
+	}
+	if p.Language != nil {
+		user.Language = *p.Language
+	}
+	if p.PageSize != nil {
+		user.PageSize = *p.PageSize
+	}
+	if p.EmailOptOut != nil {
+		user.EmailOptOut = *p.EmailOptOut
+	}
+	if p.MutedEmails != nil {
+		muted := slices.Clone(*p.MutedEmails)
+		slices.Sort(muted)
+		user.MutedEmails = slices.Compact(muted)
+	}
+	if user, err = s.users.SetPreferences(ctx, user); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+// How many books a page lists at once: as many as the user asked for, or
+// the page's own default.
+func pageSize(c echo.Context, fallback int) int {
+	if user := currentUser(c); user != nil && user.PageSize > 0 {
+		return user.PageSize
+	}
+	return fallback
+}
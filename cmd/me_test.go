@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The preferences a user sets must not undo what happened to the account
+// since the user was loaded for the request.
+func TestPreferencesKeepTheAccount(t *testing.T) {
+	ctx := context.Background()
+	db, err := connectSQLite(ctx, filepath.Join(t.TempDir(), "books.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for name, users := range map[string]UserRepository{
+		"memory": newMemoryUserRepository(),
+		"sql":    newSQLUserRepository(db),
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := &server{users: users}
+			u, err := users.Insert(ctx, User{
+				Username:      "alice",
+				PasswordHash:  "old",
+				Role:          RoleReader,
+				TOTPEnabled:   true,
+				TOTPSecret:    "JBSWY3DPEHPK3PXP",
+				RecoveryCodes: []string{"a", "b"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			session := u
+
+			// Meanwhile an admin promotes her, she resets her password
+			// and uses a recovery code
+			changed := u
+			changed.Role, changed.PasswordHash = RoleLibrarian, "new"
+			if _, err := users.Update(ctx, changed); err != nil {
+				t.Fatal(err)
+			}
+			next := changed
+			next.TOTPStep, next.RecoveryCodes = 42, []string{"b"}
+			if ok, err := users.UseSecondFactor(ctx, changed, next); err != nil || !ok {
+				t.Fatalf("UseSecondFactor = %v, %v", ok, err)
+			}
+
+			e := echo.New()
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, "/?lang=de", nil), httptest.NewRecorder())
+			s.rememberLanguage(c, &session, "de")
+
+			req := httptest.NewRequest(http.MethodPatch, "/api/me", strings.NewReader(`{"display_name":"Alice","page_size":25}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c = e.NewContext(req, rec)
+			c.Set("user", &session)
+			if err := s.patchMe(c); err != nil || rec.Code != http.StatusOK {
+				t.Fatalf("patchMe = %d, %v", rec.Code, err)
+			}
+
+			got, err := users.FindByID(ctx, u.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Language != "de" || got.DisplayName != "Alice" || got.PageSize != 25 {
+				t.Errorf("preferences %q, %q, %d, want de, Alice, 25", got.Language, got.DisplayName, got.PageSize)
+			}
+			if got.Role != RoleLibrarian || got.PasswordHash != "new" || got.TOTPStep != 42 || !slices.Equal(got.RecoveryCodes, []string{"b"}) {
+				t.Errorf("account reverted to role %s, password %q, step %d, recovery codes %v", got.Role, got.PasswordHash, got.TOTPStep, got.RecoveryCodes)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Imports leave the catalog with books listed more than once under
+// slightly different names. Merging keeps one of them, the primary, and
+// moves the duplicates to the trash: the primary takes over their copies,
+// loans and holds, and fills in what it lacks from them. Shelves and
+// reading progress keep pointing to the duplicates.
+
+// How many books can be merged into one at once.
+const maxMergeSize = 100
+
+type mergeRequest struct {
+	Primary    string   `json:"primary"`
+	Duplicates []string `json:"duplicates"`
+}
+
+// What merging the books moved over to the primary.
+type MergeResult struct {
+	Copies       int64 `json:"copies"`
+	Loans        int64 `json:"loans"`
+	Reservations int64 `json:"reservations"`
+}
+
+// The changes that complete the primary with what the duplicates know, in
+// the order they were given: the ISBN if it has none, the author if it is
+// not linked to one, and the genres of all of them.
+func mergePatch(primary BookStore, duplicates []BookStore) BookPatch {
+	var p BookPatch
+	genres := slices.Clone(primary.Genres)
+	for _, d := range duplicates {
+		if primary.BookISBN == "" && p.BookISBN == nil && d.BookISBN != "" {
+			p.BookISBN = &d.BookISBN
+		}
+		if primary.AuthorID.IsZero() && p.AuthorID == nil && !d.AuthorID.IsZero() {
+			p.AuthorID, p.BookAuthor = &d.AuthorID, &d.BookAuthor
+		}
+		genres = append(genres, d.Genres...)
+	}
+	if genres = normalizeGenres(genres); !slices.Equal(genres, normalizeGenres(primary.Genres)) {
+		p.Genres = &genres
+	}
+	return p
+}
+
+// Parses the IDs of a merge request, which must name every book once.
+func (r mergeRequest) ids() (primitive.ObjectID, []primitive.ObjectID, error) {
+	primary, err := primitive.ObjectIDFromHex(r.Primary)
+	if err != nil {
+		return primary, nil, echo.NewHTTPError(http.StatusBadRequest, "primary must be the ID of a book")
+	}
+	if len(r.Duplicates) == 0 {
+		return primary, nil, echo.NewHTTPError(http.StatusBadRequest, "No duplicates given")
+	}
+	if len(r.Duplicates) > maxMergeSize {
+		return primary, nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d books can be merged at once", maxMergeSize))
+	}
+	duplicates := make([]primitive.ObjectID, 0, len(r.Duplicates))
+	for _, raw := range r.Duplicates {
+		id, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			return primary, nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%q is not the ID of a book", raw))
+		}
+		if id == primary || slices.Contains(duplicates, id) {
+			return primary, nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s is named more than once", raw))
+		}
+		duplicates = append(duplicates, id)
+	}
+	return primary, duplicates, nil
+}
+
+// Merges the duplicates into the primary as laid out above. The catalog
+// keeps no reviews of books, so there are none to move over. The steps are
+// not one transaction: should one fail, sending the request again finishes
+// the merge, as the duplicates only go to the trash at the end.
+func (s *server) mergeBooks(c echo.Context) error {
+	var req mergeRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid merge request").SetInternal(err)
+	}
+	primaryID, duplicateIDs, err := req.ids()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	primary, err := s.books.FindByID(ctx, primaryID)
+	if err != nil {
+		return err
+	}
+	duplicates := make([]BookStore, 0, len(duplicateIDs))
+	for _, id := range duplicateIDs {
+		d, err := s.books.FindByID(ctx, id)
+		if err != nil {
+			return fmt.Errorf("duplicate %s: %w", id.Hex(), err)
+		}
+		duplicates = append(duplicates, d)
+	}
+
+	merged, result, err := s.mergeInto(ctx, primary, duplicates)
+	if err != nil {
+		return err
+	}
+	books, err := s.bookDTOs(ctx, []BookStore{merged})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message": "Books merged successfully",
+		"book":    books[0],
+		"moved":   result,
+	})
+}
+
+// Does the merge once the books are looked up, and returns the primary
+// as it is afterwards.
+func (s *server) mergeInto(ctx context.Context, primary BookStore, duplicates []BookStore) (BookStore, MergeResult, error) {
+	var result MergeResult
+	p := mergePatch(primary, duplicates)
+	if p.BookISBN != nil {
+		// ISBNs are unique, also in the trash, so the duplicate gives it up
+		// first
+		i := slices.IndexFunc(duplicates, func(d BookStore) bool { return d.BookISBN == *p.BookISBN })
+		none := ""
+		if _, err := s.books.Patch(ctx, duplicates[i].ID, BookPatch{BookISBN: &none}); err != nil {
+			return primary, result, err
+		}
+	}
+	if !p.IsEmpty() {
+		var err error
+		if primary, err = s.books.Patch(ctx, primary.ID, p); err != nil {
+			return primary, result, err
+		}
+	}
+
+	ids := make([]primitive.ObjectID, len(duplicates))
+	for i, d := range duplicates {
+		ids[i] = d.ID
+	}
+	var err error
+	if result.Copies, err = s.copies.MoveBooks(ctx, ids, primary.ID); err != nil {
+		return primary, result, err
+	}
+	if result.Loans, err = s.loans.MoveBooks(ctx, ids, primary.ID); err != nil {
+		return primary, result, err
+	}
+	if result.Reservations, err = s.reservations.MoveBooks(ctx, ids, primary.ID); err != nil {
+		return primary, result, err
+	}
+	if err = s.dropSecondHolds(ctx, primary.ID); err != nil {
+		return primary, result, err
+	}
+
+	for _, d := range duplicates {
+		recordChanges(ctx, s.audit, AuditEntry{Action: AuditMerged, BookID: d.ID, Before: &d, MergedInto: primary.ID})
+		if err := s.removeBook(ctx, d.ID); err != nil {
+			return primary, result, err
+		}
+	}
+	return primary, result, nil
+}
+
+// Users who waited for more than one of the merged books now wait twice
+// for the same book. Only their first hold in the queue is kept, or the
+// one that has a copy set aside already.
+func (s *server) dropSecondHolds(ctx context.Context, bookID primitive.ObjectID) error {
+	holds, err := s.reservations.FindAll(ctx, ReservationQuery{BookID: bookID, Statuses: activeReservations})
+	if err != nil {
+		return err
+	}
+	keep := map[primitive.ObjectID]bool{}
+	for _, r := range holds {
+		if r.Status == ReservationReady {
+			keep[r.UserID] = true
+		}
+	}
+	for _, r := range holds {
+		if r.Status != ReservationWaiting {
+			continue
+		}
+		if !keep[r.UserID] {
+			keep[r.UserID] = true
+			continue
+		}
+		r.Status = ReservationCancelled
+		if _, err := s.reservations.Update(ctx, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+// The German translations of the web UI, see i18n.go. The keys are the
+// English strings as the views and handlers use them, formatting verbs
+// included; a translation has to keep the verbs in the same order.
+var messagesDE = map[string]string{
+	// The index page
+	"First exercise on Cloud Computing!": "Erste Übung zu Cloud Computing!",
+	"Cloud Computing Exercise Website":   "Webseite der Übung zu Cloud Computing",
+	"Signed in as":                       "Angemeldet als",
+	"Log out":                            "Abmelden",
+	"Log in":                             "Anmelden",
+	"Log in with %s":                     "Mit %s anmelden",
+	"Books":                              "Bücher",
+	"Recently added":                     "Zuletzt hinzugefügt",
+	"Authors":                            "Autoren",
+	"Years":                              "Jahre",
+	"Statistics":                         "Statistik",
+	"Search":                             "Suche",
+	"Create":                             "Anlegen",
+	"Reading lists":                      "Leselisten",
+	"Administration":                     "Verwaltung",
+	"Made with love from Garching for Cloud Computing": "Mit Liebe aus Garching für Cloud Computing gemacht",
+
+	// The book table and the page of a book
+	"Add a book":                     "Buch hinzufügen",
+	"Book Name":                      "Titel",
+	"Author":                         "Autor",
+	"Pages":                          "Seiten",
+	"Year":                           "Jahr",
+	"Added":                          "Hinzugefügt",
+	"Previous":                       "Zurück",
+	"Next":                           "Weiter",
+	"Page %d of %d (%d books)":       "Seite %d von %d (%d Bücher)",
+	"Edit":                           "Bearbeiten",
+	"Delete":                         "Löschen",
+	"Move %s to the trash?":          "%s in den Papierkorb verschieben?",
+	"Cover":                          "Einband",
+	"%s by %s":                       "%s von %s",
+	"Last changed on %s, version %d": "Zuletzt geändert am %s, Version %d",
+	"About %s":                       "Über %s",
+	"Born":                           "Geboren",
+	"Availability":                   "Verfügbarkeit",
+	"%d of %d copies available":      "%d von %d Exemplaren verfügbar",
+	"%d holds waiting":               "%d Vormerkungen",
+	"The library has no copies of this book.": "Die Bibliothek hat keine Exemplare dieses Buches.",
+	"You may also like":                       "Das könnte dir auch gefallen",
+
+	// The book forms
+	"Taken from the linked author": "Vom verknüpften Autor übernommen",
+	"Save":                         "Speichern",
+	"Cancel":                       "Abbrechen",
+	"Book name":                    "Titel",
+	"Add book":                     "Buch hinzufügen",
+	"Added %s by %s":               "%s von %s hinzugefügt",
+
+	// What can be wrong with a book, see validation.go
+	"is required":                          "fehlt",
+	"must be greater than 0":               "muss größer als 0 sein",
+	"must be a whole number":               "muss eine ganze Zahl sein",
+	"book already exists":                  "Das Buch gibt es schon",
+	"the book was changed in the meantime": "Das Buch wurde inzwischen geändert",
+	"an ISBN must have 10 or 13 digits":    "eine ISBN hat 10 oder 13 Ziffern",
+	"an ISBN may only contain digits, hyphens and spaces, and an X as last character of an ISBN-10": "eine ISBN besteht nur aus Ziffern, Bindestrichen und Leerzeichen, und eine ISBN-10 aus einem X als letztem Zeichen",
+	"the check digit of the ISBN is wrong": "die Prüfziffer der ISBN ist falsch",
+
+	// The authors, the years and the statistics
+	"Titles":                              "Titel",
+	"Decade":                              "Jahrzehnt",
+	"%ds":                                 "%der",
+	"%d books with %.0f pages on average": "%d Bücher mit durchschnittlich %.0f Seiten",
+	"Books per author":                    "Bücher pro Autor",
+	"Books per decade":                    "Bücher pro Jahrzehnt",
+	"Newest books":                        "Neueste Bücher",
+	"Oldest books":                        "Älteste Bücher",
+
+	// The search
+	"Search parameter": "Suchbegriff",
+	"Author: %s":       "Autor: %s",
+	"Decade: %ss":      "Jahrzehnt: %ser",
+	"Genre: %s":        "Genre: %s",
+
+	// Logging in
+	"Username":                     "Benutzername",
+	"Password":                     "Passwort",
+	"invalid username or password": "Benutzername oder Passwort ist falsch",
+	"invalid one-time code":        "Der Einmalcode ist falsch",
+	"Code of the authenticator app or recovery code": "Code der Authenticator-App oder Wiederherstellungscode",
+	"Too many failed logins, please try again later": "Zu viele fehlgeschlagene Anmeldungen, bitte versuchen Sie es später erneut",
+	"The login took too long, please log in again":   "Die Anmeldung hat zu lange gedauert, bitte melden Sie sich erneut an",
+
+	// The reading lists
+	"Shared as":                      "Geteilt als",
+	"You have no reading lists yet.": "Du hast noch keine Leselisten.",
+	"No books on this list.":         "Auf dieser Liste stehen keine Bücher.",
+	"A reading list of %s":           "Eine Leseliste von %s",
+
+	// The admin dashboard
+	"Latest changes":               "Letzte Änderungen",
+	"When":                         "Wann",
+	"Change":                       "Änderung",
+	"By":                           "Von",
+	"API key":                      "API-Schlüssel",
+	"No changes yet.":              "Noch keine Änderungen.",
+	"Failing webhooks":             "Fehlschlagende Webhooks",
+	"Failed in a row":              "Fehlschläge in Folge",
+	"Last attempt":                 "Letzter Versuch",
+	"Error":                        "Fehler",
+	"All webhooks are delivering.": "Alle Webhooks werden zugestellt.",
+	"Background jobs":              "Hintergrundaufgaben",
+	"Job":                          "Aufgabe",
+	"Schedule":                     "Zeitplan",
+	"Last run":                     "Letzter Lauf",
+	"Result":                       "Ergebnis",
+	"Next run":                     "Nächster Lauf",
+	"disabled":                     "abgeschaltet",
+	"running":                      "läuft",
+	"failed: %s":                   "fehlgeschlagen: %s",
+	"Slow queries":                 "Langsame Abfragen",
+	"Queries that took longer than %s, since this instance started": "Abfragen, die länger als %s gedauert haben, seit diese Instanz läuft",
+	"No query took longer than %s since this instance started.":     "Keine Abfrage hat länger als %s gedauert, seit diese Instanz läuft.",
+	"Command": "Befehl",
+	"Count":   "Anzahl",
+}
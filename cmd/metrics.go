@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// The metrics served on /metrics for Prometheus to scrape. Besides these,
+// the Go runtime and the process report their own, as do the connection
+// pools of the SQL databases, see registerDBStats.
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bookstore",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bookstore",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to answer HTTP requests by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	mongoCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bookstore",
+		Subsystem: "mongodb",
+		Name:      "command_duration_seconds",
+		Help:      "Time taken by MongoDB commands by command and outcome.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command", "outcome"})
+	dbSlowQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bookstore",
+		Subsystem: "db",
+		Name:      "slow_queries_total",
+		Help:      "Database queries and MongoDB commands that took longer than database.slow_query, by command.",
+	}, []string{"command"})
+	mongoConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bookstore",
+		Subsystem: "mongodb",
+		Name:      "pool_connections",
+		Help:      "Connections of the MongoDB pool that are open, and of those the ones in use.",
+	}, []string{"state"})
+
+	bookChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bookstore",
+		Name:      "book_changes_total",
+		Help:      "Changes made to books by this instance, by the action of the audit log.",
+	}, []string{"action"})
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bookstore",
+		Name:      "response_cache_lookups_total",
+		Help:      "Lookups in the response cache, by whether they were a hit or a miss.",
+	}, []string{"result"})
+	failedLogins = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "bookstore",
+		Name:      "login_failures_total",
+		Help:      "Logins refused for a wrong password or one-time code.",
+	})
+	loginLockouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bookstore",
+		Name:      "login_lockouts_total",
+		Help:      "Accounts and IP addresses locked out after failed logins, by kind.",
+	}, []string{"kind"})
+	loginUnlocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bookstore",
+		Name:      "login_unlocks_total",
+		Help:      "Accounts and IP addresses unlocked by an admin, by kind.",
+	}, []string{"kind"})
+)
+
+// Serves the metrics in the Prometheus text format.
+func metricsHandler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
+
+// Counts and times every request. Routes are labeled with their pattern,
+// e.g. /api/books/:id, so the number of series stays bounded; requests no
+// route matched share one label.
+func instrumentRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		// Errors are only turned into responses further out, see
+		// httpErrorHandler
+		status := c.Response().Status
+		if err != nil {
+			status = toAPIError(err).Code
+		}
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request().Method
+		httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// Times the commands the MongoDB client sends.
+func mongoCommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mongoCommandDuration.WithLabelValues(e.CommandName, "succeeded").Observe(e.Duration.Seconds())
+			countSlowMongoCommand(e.CommandName, e.Duration)
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			mongoCommandDuration.WithLabelValues(e.CommandName, "failed").Observe(e.Duration.Seconds())
+			countSlowMongoCommand(e.CommandName, e.Duration)
+		},
+	}
+}
+
+// Follows the connections of the MongoDB pool as they are opened, closed,
+// checked out and returned.
+func mongoPoolMonitor() *event.PoolMonitor {
+	open, inUse := mongoConnections.WithLabelValues("open"), mongoConnections.WithLabelValues("in_use")
+	return &event.PoolMonitor{
+		Event: func(e *event.PoolEvent) {
+			switch e.Type {
+			case event.ConnectionCreated:
+				open.Inc()
+			case event.ConnectionClosed:
+				open.Dec()
+			case event.GetSucceeded:
+				inUse.Inc()
+			case event.ConnectionReturned:
+				inUse.Dec()
+			}
+		},
+	}
+}
+
+// Reports the statistics of the connection pool of a SQL database, like
+// the open and idle connections and the time spent waiting for one.
+func registerDBStats(db *sql.DB, name string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
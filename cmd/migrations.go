@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Changes to the stored data are rolled out as migrations: numbered steps
+// that are applied in order and recorded in schema_migrations, a table for
+// the SQL backends and a collection for MongoDB, so none runs twice. They
+// run on startup, or with `app migrate` if database.migrate is off, in
+// which case the server refuses to start while migrations are pending.
+//
+// A migration that was released is never changed; changes to the data,
+// like splitting the authors out of the books, are appended as new
+// migrations instead. The SQL ones are in sqlMigrations, the MongoDB ones
+// in mongoMigrations. MongoDB indexes need no migration, see
+// ensureIndexes.
+
+// A migration and whether it was applied to the database.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	Applied bool
+	// When it was applied, if the database recorded it
+	AppliedAt time.Time
+}
+
+// Counts the migrations not applied yet.
+func pendingMigrations(status []MigrationStatus) int {
+	pending := 0
+	for _, m := range status {
+		if !m.Applied {
+			pending++
+		}
+	}
+	return pending
+}
+
+// A migration of the MongoDB database. books is the collection of the
+// books, whose name is configurable; the other collections have fixed
+// names in db.
+type mongoMigration struct {
+	name string
+	up   func(ctx context.Context, db *mongo.Database, books *mongo.Collection) error
+}
+
+// The migrations of the MongoDB database; a migration's version is its
+// position in the list, counting from 1.
+var mongoMigrations = []mongoMigration{
+	{"give the books a version", func(ctx context.Context, db *mongo.Database, books *mongo.Collection) error {
+		_, err := books.UpdateMany(ctx, bson.M{"version": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"version": 1}})
+		return err
+	}},
+	// Books count as created, and last updated, when their ID was
+	{"give the books timestamps", func(ctx context.Context, db *mongo.Database, books *mongo.Collection) error {
+		idTime := bson.M{"$toDate": "$_id"}
+		_, err := books.UpdateMany(ctx,
+			bson.M{"created_at": bson.M{"$exists": false}},
+			mongo.Pipeline{{{Key: "$set", Value: bson.M{"created_at": idTime, "updated_at": idTime}}}})
+		return err
+	}},
+	// Books stored before ISBNs were normalized would slip past the unique
+	// index on the ISBN
+	{"normalize the ISBNs", func(ctx context.Context, db *mongo.Database, books *mongo.Collection) error {
+		return normalizeStoredISBNs(ctx, books)
+	}},
+}
+
+// How long an instance may hold the migration lock before others take it
+// over, in case it died while migrating.
+const migrationLease = 10 * time.Minute
+
+// The document of schema_migrations recording an applied migration.
+type mongoMigrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+func mongoMigrationStatus(ctx context.Context, db *mongo.Database) ([]MigrationStatus, error) {
+	cursor, err := db.Collection("schema_migrations").Find(ctx, bson.M{"_id": bson.M{"$type": "number"}})
+	if err != nil {
+		return nil, err
+	}
+	var records []mongoMigrationRecord
+	if err = cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	for _, r := range records {
+		applied[r.Version] = r.AppliedAt
+	}
+
+	status := make([]MigrationStatus, len(mongoMigrations))
+	for i, m := range mongoMigrations {
+		at, ok := applied[i+1]
+		status[i] = MigrationStatus{Version: i + 1, Name: m.name, Applied: ok, AppliedAt: at}
+	}
+	return status, nil
+}
+
+// Applies the pending migrations. Instances starting at the same time
+// take turns through a lock document, so each migration runs once.
+func migrateMongo(ctx context.Context, db *mongo.Database, books *mongo.Collection) error {
+	unlock, err := lockMongoMigrations(ctx, db.Collection("schema_migrations"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	status, err := mongoMigrationStatus(ctx, db)
+	if err != nil {
+		return err
+	}
+	for i, m := range status {
+		if m.Applied {
+			continue
+		}
+		start := time.Now()
+		if err := mongoMigrations[i].up(ctx, db, books); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		record := mongoMigrationRecord{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()}
+		if _, err := db.Collection("schema_migrations").InsertOne(ctx, record); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d (%s) in %v", m.Version, m.Name, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// Takes the lock, waiting while another instance holds it, and returns
+// the function releasing it. A lock held longer than migrationLease is
+// taken over.
+func lockMongoMigrations(ctx context.Context, coll *mongo.Collection) (func(), error) {
+	for {
+		now := time.Now()
+		_, err := coll.UpdateOne(ctx,
+			bson.M{"_id": "lock", "until": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"until": now.Add(migrationLease)}},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			return func() {
+				if _, err := coll.DeleteOne(context.WithoutCancel(ctx), bson.M{"_id": "lock"}); err != nil {
+					log.Printf("Failed to release the migration lock: %v", err)
+				}
+			}, nil
+		}
+		// The lock is held, so the upsert ran into the existing document
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Names an SQL migration by its first line, e.g. CREATE TABLE books.
+func sqlMigrationName(stmt string) string {
+	name, _, _ := strings.Cut(strings.TrimSpace(stmt), "\n")
+	name, _, _ = strings.Cut(name, "(")
+	return strings.TrimSpace(name)
+}
+
+func sqlMigrationStatus(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	if _, err := db.ExecContext(ctx, createSchemaMigrations); err != nil {
+		return nil, err
+	}
+	applied := map[int]bool{}
+	rows, err := db.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, len(sqlMigrations))
+	for i, stmt := range sqlMigrations {
+		status[i] = MigrationStatus{Version: i + 1, Name: sqlMigrationName(stmt), Applied: applied[i+1]}
+	}
+	return status, nil
+}
+
+// Refuses to serve a database with pending migrations, which the code
+// may depend on.
+func checkMigrations(ctx context.Context, repos *repositories) error {
+	if repos.migrations == nil {
+		return nil
+	}
+	status, err := repos.migrations(ctx)
+	if err != nil {
+		return err
+	}
+	if n := pendingMigrations(status); n > 0 {
+		return fmt.Errorf("%d migrations are pending, please run `migrate` first or turn database.migrate on", n)
+	}
+	return nil
+}
+
+// Applies the pending migrations, or only lists them with -status.
+func migrateCommand(fs *flag.FlagSet) func(Config) error {
+	statusOnly := fs.Bool("status", false, "list the migrations and whether they were applied, without applying any")
+	return func(cfg Config) error {
+		cfg.Database.Migrate = !*statusOnly
+		ctx, stop := commandContext()
+		defer stop()
+		repos, closeStorage, err := openStorage(ctx, cfg.Database)
+		if err != nil {
+			return err
+		}
+		defer closeStorage()
+		if repos.migrations == nil {
+			return errors.New("the memory storage has nothing to migrate")
+		}
+
+		status, err := repos.migrations(ctx)
+		if err != nil {
+			return err
+		}
+		printMigrations(status)
+		if !cfg.Tenancy.Enabled {
+			return nil
+		}
+
+		// The branches have databases of their own, see tenants.go, which
+		// are migrated on opening them
+		if pendingMigrations(status) > 0 {
+			fmt.Println("\nThe library branches are listed once the main library is migrated.")
+			return nil
+		}
+		tenants, err := repos.tenants.FindAll(ctx)
+		if err != nil {
+			return err
+		}
+		for _, t := range tenants {
+			tenant, closeTenant, err := repos.openTenant(ctx, t.Slug)
+			if err != nil {
+				return fmt.Errorf("library %s: %w", t.Slug, err)
+			}
+			status, err := tenant.migrations(ctx)
+			closeTenant()
+			if err != nil {
+				return fmt.Errorf("library %s: %w", t.Slug, err)
+			}
+			fmt.Printf("\nLibrary %s:\n", t.Slug)
+			printMigrations(status)
+		}
+		return nil
+	}
+}
+
+func printMigrations(status []MigrationStatus) {
+	for _, m := range status {
+		state := "pending"
+		if m.Applied {
+			state = "applied"
+			if !m.AppliedAt.IsZero() {
+				state += " " + m.AppliedAt.Format(time.DateTime)
+			}
+		}
+		fmt.Printf("%4d  %-28s  %s\n", m.Version, state, m.Name)
+	}
+}
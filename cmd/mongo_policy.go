@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every operation the MongoDB repositories run goes through the same
+// policy instead of each of them handling timeouts and failures its own
+// way: an attempt may take up to the operation timeout, and an attempt
+// that failed for a passing reason is tried again after a backoff. The
+// driver already retries once by itself; this covers the longer outages,
+// such as the election of a new primary, which takes a few seconds.
+//
+// Reads are retried after any transient failure. Writes only when the
+// server refused them before applying them, as retrying a write that got
+// lost on the way back would apply it twice.
+
+// The policy the MongoDB repositories operate with, set from the
+// configuration on startup.
+var mongoOps = mongoPolicy{Timeout: 5 * time.Second, Retries: 2, Backoff: 100 * time.Millisecond}
+
+type mongoPolicy struct {
+	// How long a single attempt may take
+	Timeout time.Duration
+	// How often a failed operation is tried again
+	Retries int
+	// How long to wait before the first retry; doubles with every retry
+	Backoff time.Duration
+}
+
+// The error codes of a server that refused an operation because it is
+// not, or no longer, the primary or is shutting down. The operation was
+// not applied.
+var notPrimaryCodes = map[int32]bool{
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+// Reports whether an operation that failed with err may succeed when
+// tried again.
+func retryable(err error, write bool) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && notPrimaryCodes[cmdErr.Code] {
+		return true
+	}
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) && writeErr.WriteConcernError != nil && notPrimaryCodes[int32(writeErr.WriteConcernError.Code)] {
+		return true
+	}
+	if write {
+		return false
+	}
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.Is(err, mongo.ErrClientDisconnected)
+}
+
+// An operation that failed for good, with what it was and how often it
+// was tried. It wraps the error of the driver, so errors.Is and errors.As
+// see through it.
+type MongoError struct {
+	Op         string
+	Collection string
+	Attempts   int
+	Err        error
+}
+
+func (e *MongoError) Error() string {
+	return fmt.Sprintf("mongo %s on %s failed after %d attempts: %v", e.Op, e.Collection, e.Attempts, e.Err)
+}
+
+func (e *MongoError) Unwrap() error {
+	return e.Err
+}
+
+// Reports whether the database could not be reached or did not answer in
+// time, which clients are told to try again later for, see toAPIError.
+func (e *MongoError) Unavailable() bool {
+	return retryable(e.Err, false) || errors.Is(e.Err, context.DeadlineExceeded)
+}
+
+// Runs the operation under the policy. The context of the caller bounds
+// all attempts and the waits between them.
+func runMongo[T any](ctx context.Context, coll *mongo.Collection, op string, write bool, fn func(context.Context) (T, error)) (T, error) {
+	backoff := mongoOps.Backoff
+	for attempt := 1; ; attempt++ {
+		opCtx, cancel := context.WithTimeout(ctx, mongoOps.Timeout)
+		result, err := fn(opCtx)
+		cancel()
+		if err == nil || errors.Is(err, mongo.ErrNoDocuments) {
+			return result, err
+		}
+		if attempt > mongoOps.Retries || !retryable(err, write) || ctx.Err() != nil {
+			return result, &MongoError{Op: op, Collection: coll.Name(), Attempts: attempt, Err: err}
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return result, &MongoError{Op: op, Collection: coll.Name(), Attempts: attempt, Err: err}
+		}
+		backoff *= 2
+	}
+}
+
+// A collection whose operations go through the policy. It offers the
+// operations the repositories use; everything else, such as the indexes
+// and change streams, goes to the collection as is.
+type mongoCollection struct {
+	*mongo.Collection
+}
+
+func withPolicy(coll *mongo.Collection) mongoCollection {
+	return mongoCollection{Collection: coll}
+}
+
+func (c mongoCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	return runMongo(ctx, c.Collection, "find", false, func(ctx context.Context) (*mongo.Cursor, error) {
+		return c.Collection.Find(ctx, filter, opts...)
+	})
+}
+
+// Returns the result of the last attempt; its error, if any, shows when
+// it is decoded, like with mongo.Collection.FindOne.
+func (c mongoCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	result, _ := runMongo(ctx, c.Collection, "findOne", false, func(ctx context.Context) (*mongo.SingleResult, error) {
+		result := c.Collection.FindOne(ctx, filter, opts...)
+		return result, result.Err()
+	})
+	return result
+}
+
+func (c mongoCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	return runMongo(ctx, c.Collection, "aggregate", false, func(ctx context.Context) (*mongo.Cursor, error) {
+		return c.Collection.Aggregate(ctx, pipeline, opts...)
+	})
+}
+
+func (c mongoCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	return runMongo(ctx, c.Collection, "countDocuments", false, func(ctx context.Context) (int64, error) {
+		return c.Collection.CountDocuments(ctx, filter, opts...)
+	})
+}
+
+func (c mongoCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	return runMongo(ctx, c.Collection, "insertOne", true, func(ctx context.Context) (*mongo.InsertOneResult, error) {
+		return c.Collection.InsertOne(ctx, document, opts...)
+	})
+}
+
+func (c mongoCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	return runMongo(ctx, c.Collection, "insertMany", true, func(ctx context.Context) (*mongo.InsertManyResult, error) {
+		return c.Collection.InsertMany(ctx, documents, opts...)
+	})
+}
+
+func (c mongoCollection) ReplaceOne(ctx context.Context, filter interface{}, replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	return runMongo(ctx, c.Collection, "replaceOne", true, func(ctx context.Context) (*mongo.UpdateResult, error) {
+		return c.Collection.ReplaceOne(ctx, filter, replacement, opts...)
+	})
+}
+
+func (c mongoCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return runMongo(ctx, c.Collection, "updateOne", true, func(ctx context.Context) (*mongo.UpdateResult, error) {
+		return c.Collection.UpdateOne(ctx, filter, update, opts...)
+	})
+}
+
+func (c mongoCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return runMongo(ctx, c.Collection, "updateMany", true, func(ctx context.Context) (*mongo.UpdateResult, error) {
+		return c.Collection.UpdateMany(ctx, filter, update, opts...)
+	})
+}
+
+func (c mongoCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return runMongo(ctx, c.Collection, "deleteOne", true, func(ctx context.Context) (*mongo.DeleteResult, error) {
+		return c.Collection.DeleteOne(ctx, filter, opts...)
+	})
+}
+
+func (c mongoCollection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return runMongo(ctx, c.Collection, "deleteMany", true, func(ctx context.Context) (*mongo.DeleteResult, error) {
+		return c.Collection.DeleteMany(ctx, filter, opts...)
+	})
+}
+
+// Returns the result of the last attempt, like FindOne.
+func (c mongoCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	result, _ := runMongo(ctx, c.Collection, "findOneAndUpdate", true, func(ctx context.Context) (*mongo.SingleResult, error) {
+		result := c.Collection.FindOneAndUpdate(ctx, filter, update, opts...)
+		return result, result.Err()
+	})
+	return result
+}
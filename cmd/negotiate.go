@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/csv"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The pages /books, /authors and /years serve what they show as JSON or
+// CSV as well, so the same URL can be opened in the browser, fetched by a
+// script or loaded into a spreadsheet. ?format= picks the format, or else
+// the Accept header; HTML is the default, which is what htmx and browsers
+// get.
+
+// The formats of the pages, by the media type asking for them.
+var pageFormats = map[string]string{
+	echo.MIMETextHTML:        "html",
+	echo.MIMEApplicationJSON: "json",
+	"text/csv":               "csv",
+}
+
+// Returns the format the client asked for, as laid out above.
+func pageFormat(c echo.Context) (string, error) {
+	c.Response().Header().Add("Vary", echo.HeaderAccept)
+	if format := c.QueryParam("format"); format != "" {
+		switch format {
+		case "html", "json", "csv":
+			return format, nil
+		}
+		return "", echo.NewHTTPError(http.StatusBadRequest, "format must be html, json or csv")
+	}
+
+	// The media type with the highest quality wins, the first one listed
+	// on a tie. Wildcards get HTML.
+	best, bestQ := "html", -1.0
+	for _, accepted := range strings.Split(c.Request().Header.Get(echo.HeaderAccept), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		format, ok := pageFormats[mediaType]
+		if !ok && (mediaType == "*/*" || mediaType == "text/*") {
+			format, ok = "html", true
+		}
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if raw, found := params["q"]; found {
+			if q, err = strconv.ParseFloat(raw, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	if bestQ == 0 {
+		return "", echo.NewHTTPError(http.StatusNotAcceptable, "the page is served as HTML, JSON or CSV")
+	}
+	return best, nil
+}
+
+// Sends the records as a CSV file named after the page.
+func writeCSV(c echo.Context, name string, header []string, records [][]interface{}) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+name+`.csv"`)
+	res.Header().Set(echo.HeaderContentType, exportFormats["csv"].mime)
+	res.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(res)
+	w.Write(header)
+	for _, record := range records {
+		row := make([]string, len(record))
+		for i, v := range record {
+			row[i] = csvCell(v)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+// The state cookie only lives for the round trip to the provider.
+const stateCookie = "oauth_state"
+
+// How long the user may take to log in at the provider.
+const oauthStateTTL = 10 * time.Minute
+
+// The account at a provider, as far as we care about it.
+type identity struct {
+	// Stable ID of the account at the provider; names and emails can change
+	Subject string
+	// Used to come up with a username on the first login
+	Name string
+	// Taken over on the first login, if the provider tells
+	Email string
+}
+
+// A provider users can log in with. Identify fetches the account the token
+// belongs to.
+type oauthProvider struct {
+	Name     string
+	Label    string
+	Config   *oauth2.Config
+	Identify func(ctx context.Context, client *http.Client) (identity, error)
+}
+
+// Sets up every provider with a client ID in the configuration, see
+// OAuthConfig. The redirect URLs registered at the providers start with
+// the public URL of the server.
+//
+// Providers that fail to set up are logged and left out, so a broken SSO
+// does not keep the catalog from starting.
+func loadOAuthProviders(ctx context.Context, cfg OAuthConfig, publicURL string) []oauthProvider {
+	var providers []oauthProvider
+	add := func(name string, label string, client OAuthClient, endpoint oauth2.Endpoint, scopes []string, identify func(context.Context, *http.Client) (identity, error)) {
+		providers = append(providers, oauthProvider{
+			Name:  name,
+			Label: label,
+			Config: &oauth2.Config{
+				ClientID:     client.ClientID,
+				ClientSecret: client.ClientSecret,
+				Endpoint:     endpoint,
+				RedirectURL:  strings.TrimSuffix(publicURL, "/") + "/auth/" + name + "/callback",
+				Scopes:       scopes,
+			},
+			Identify: identify,
+		})
+	}
+
+	if cfg.Google.ClientID != "" {
+		add("google", "Google", cfg.Google, endpoints.Google, []string{"openid", "email", "profile"},
+			oidcIdentity("https://openidconnect.googleapis.com/v1/userinfo"))
+	}
+	if cfg.GitHub.ClientID != "" {
+		add("github", "GitHub", cfg.GitHub, endpoints.GitHub, []string{"read:user"}, githubIdentity)
+	}
+	if oidc := cfg.OIDC; oidc.Issuer != "" && oidc.ClientID != "" {
+		label := oidc.Label
+		if label == "" {
+			label = "Single sign-on"
+		}
+		discovery, err := discoverOIDC(ctx, oidc.Issuer)
+		if err != nil {
+			log.Printf("OpenID Connect login is disabled: %v", err)
+		} else {
+			endpoint := oauth2.Endpoint{AuthURL: discovery.AuthURL, TokenURL: discovery.TokenURL}
+			add("oidc", label, oidc, endpoint, []string{"openid", "email", "profile"}, oidcIdentity(discovery.UserInfoURL))
+		}
+	}
+	return providers
+}
+
+func (s *server) findProvider(name string) (oauthProvider, error) {
+	for _, p := range s.oauthProviders {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return oauthProvider{}, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Unknown login provider %q", name))
+}
+
+// The parts of an OpenID Connect discovery document we need.
+type oidcDiscovery struct {
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	UserInfoURL string `json:"userinfo_endpoint"`
+}
+
+func discoverOIDC(ctx context.Context, issuer string) (oidcDiscovery, error) {
+	var d oidcDiscovery
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(ctx, http.DefaultClient, url, &d); err != nil {
+		return d, err
+	}
+	if d.AuthURL == "" || d.TokenURL == "" || d.UserInfoURL == "" {
+		return d, fmt.Errorf("%s lacks the authorization, token or userinfo endpoint", url)
+	}
+	return d, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Reads the account from the userinfo endpoint of an OpenID Connect
+// provider.
+func oidcIdentity(userInfoURL string) func(context.Context, *http.Client) (identity, error) {
+	return func(ctx context.Context, client *http.Client) (identity, error) {
+		var info struct {
+			Subject           string `json:"sub"`
+			PreferredUsername string `json:"preferred_username"`
+			Email             string `json:"email"`
+			EmailVerified     bool   `json:"email_verified"`
+		}
+		if err := getJSON(ctx, client, userInfoURL, &info); err != nil {
+			return identity{}, err
+		}
+		name := info.PreferredUsername
+		if name == "" {
+			name, _, _ = strings.Cut(info.Email, "@")
+		}
+		id := identity{Subject: info.Subject, Name: name}
+		// Mail about loans should not go to an address somebody merely
+		// claimed
+		if info.EmailVerified {
+			id.Email = info.Email
+		}
+		return id, nil
+	}
+}
+
+// GitHub does not speak OpenID Connect, but its user API has all we need.
+func githubIdentity(ctx context.Context, client *http.Client) (identity, error) {
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		// Only if the user made it public
+		Email string `json:"email"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &user); err != nil {
+		return identity{}, err
+	}
+	return identity{Subject: strconv.FormatInt(user.ID, 10), Name: user.Login, Email: user.Email}, nil
+}
+
+// Sends the user to the provider. The state ties the callback to this
+// browser, which keeps others from logging the user into their account.
+func (s *server) oauthLogin(c echo.Context) error {
+	provider, err := s.findProvider(c.Param("provider"))
+	if err != nil {
+		return err
+	}
+	state, err := randomToken()
+	if err != nil {
+		return err
+	}
+	c.SetCookie(s.newCookie(stateCookie, state, oauthStateTTL))
+	return c.Redirect(http.StatusFound, provider.Config.AuthCodeURL(state))
+}
+
+// Completes the login once the provider sends the user back: the code is
+// exchanged for a token, the account is looked up at the provider and the
+// matching user is created on the first login.
+func (s *server) oauthCallback(c echo.Context) error {
+	provider, err := s.findProvider(c.Param("provider"))
+	if err != nil {
+		return err
+	}
+
+	cookie, err := c.Cookie(stateCookie)
+	if err != nil || cookie.Value == "" || cookie.Value != c.QueryParam("state") {
+		return echo.NewHTTPError(http.StatusBadRequest, "The login expired or was started in another browser, please try again")
+	}
+	c.SetCookie(s.newCookie(stateCookie, "", -1))
+	if reason := c.QueryParam("error"); reason != "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "The login was cancelled: "+reason)
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	token, err := provider.Config.Exchange(ctx, c.QueryParam("code"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "The provider rejected the login").SetInternal(err)
+	}
+	id, err := provider.Identify(ctx, provider.Config.Client(ctx, token))
+	if err != nil {
+		return err
+	}
+	if id.Subject == "" {
+		return errors.New(provider.Name + " returned an account without ID")
+	}
+
+	user, err := s.provisionUser(ctx, provider.Name, id)
+	if err != nil {
+		return err
+	}
+	if err := s.startSession(c, user); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, "/")
+}
+
+var invalidUsernameChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// Turns the name at the provider into a valid username.
+func usernameFor(provider string, name string) string {
+	username := invalidUsernameChars.ReplaceAllString(normalizeUsername(name), "-")
+	username = strings.Trim(username, "-")
+	if len(username) > 28 {
+		username = username[:28]
+	}
+	if len(username) < 3 {
+		username = provider + "-" + username
+	}
+	return username
+}
+
+// Returns the user of the identity, creating a reader on the first login.
+// If the name is taken, a number is appended until it is unique.
+func (s *server) provisionUser(ctx context.Context, provider string, id identity) (User, error) {
+	user, err := s.users.FindByIdentity(ctx, provider, id.Subject)
+	if !errors.Is(err, ErrUserNotFound) {
+		return user, err
+	}
+
+	base := usernameFor(provider, id.Name)
+	for n := 1; n < 100; n++ {
+		username := base
+		if n > 1 {
+			username = fmt.Sprintf("%s-%d", base, n)
+		}
+		user, err = s.users.Insert(ctx, User{
+			Username:   username,
+			Role:       RoleReader,
+			Provider:   provider,
+			ExternalID: id.Subject,
+			Email:      id.Email,
+			CreatedAt:  time.Now().UTC(),
+		})
+		if !errors.Is(err, ErrDuplicateUser) {
+			return user, err
+		}
+	}
+	return user, fmt.Errorf("no free username for %q", base)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Users record how far they got with a book, as a page or as a
+// percentage; the other one is worked out from the pages of the book. A
+// book read to its last page, or to 100%, counts as finished. The
+// dashboard under /api/reading sums it all up, like the reading
+// challenges of Goodreads.
+
+// What can be sent to record the progress on a book: either the page or
+// the percentage, or finished to mark the book as read.
+type progressRequest struct {
+	Page     *int     `json:"page"`
+	Percent  *float64 `json:"percent"`
+	Finished bool     `json:"finished"`
+}
+
+// The progress on a book, with the book it refers to.
+type progressJSON struct {
+	ReadingProgress
+	Book *BookDTO `json:"book,omitempty"`
+}
+
+// Sums up the reading of a user. Books that were deleted are left out.
+type readingDashboard struct {
+	// Most recently read first
+	InProgress []progressJSON `json:"in_progress"`
+	// Most recently finished first
+	Finished []progressJSON `json:"finished"`
+	Totals   readingTotals  `json:"totals"`
+}
+
+type readingTotals struct {
+	InProgress int `json:"in_progress"`
+	Finished   int `json:"finished"`
+	// The pages read in all books, finished or not
+	PagesRead int `json:"pages_read"`
+	// The books finished in the current calendar year
+	FinishedThisYear int `json:"finished_this_year"`
+}
+
+// Works out the page and the percentage of the request for a book of the
+// given number of pages.
+func (req progressRequest) resolve(pages int) (int, float64, error) {
+	v := &ValidationError{}
+	switch {
+	case req.Finished:
+		if req.Page != nil || req.Percent != nil {
+			v.add("finished", "cannot be combined with page or percent")
+		}
+		return pages, 100, v.errOrNil()
+	case req.Page != nil && req.Percent != nil:
+		v.add("percent", "cannot be combined with page")
+	case req.Page != nil:
+		if *req.Page < 0 || *req.Page > pages {
+			v.add("page", fmt.Sprintf("must be between 0 and %d", pages))
+			break
+		}
+		if pages == 0 {
+			return 0, 0, nil
+		}
+		return *req.Page, math.Round(float64(*req.Page)*1000/float64(pages)) / 10, nil
+	case req.Percent != nil:
+		if *req.Percent < 0 || *req.Percent > 100 {
+			v.add("percent", "must be between 0 and 100")
+			break
+		}
+		return int(math.Round(*req.Percent * float64(pages) / 100)), *req.Percent, nil
+	default:
+		v.add("page", "or percent is required")
+	}
+	return 0, 0, v.errOrNil()
+}
+
+// Returns the progress of the logged in user on the book.
+func (s *server) getProgress(c echo.Context) error {
+	user, err := requireUser(c)
+	if err != nil {
+		return err
+	}
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	progress, err := s.progress.Find(ctx, user.ID, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, progress)
+}
+
+// Records how far the logged in user got with the book.
+func (s *server) saveProgress(c echo.Context) error {
+	user, err := requireUser(c)
+	if err != nil {
+		return err
+	}
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	var req progressRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid progress data").SetInternal(err)
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	book, err := s.books.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	page, percent, err := req.resolve(book.BookPages)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	progress, err := s.progress.Find(ctx, user.ID, id)
+	if errors.Is(err, ErrProgressNotFound) {
+		progress = ReadingProgress{UserID: user.ID, BookID: id, StartedAt: now}
+	} else if err != nil {
+		return err
+	}
+	progress.Page = page
+	progress.Percent = percent
+	progress.UpdatedAt = now
+	if percent < 100 {
+		progress.FinishedAt = nil
+	} else if progress.FinishedAt == nil {
+		progress.FinishedAt = &now
+	}
+
+	progress, err = s.progress.Save(ctx, progress)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, progress)
+}
+
+// Forgets the progress of the logged in user on the book.
+func (s *server) deleteProgress(c echo.Context) error {
+	user, err := requireUser(c)
+	if err != nil {
+		return err
+	}
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	if err := s.progress.Delete(ctx, user.ID, id); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Lists the books the logged in user is reading and has finished, with
+// their totals.
+func (s *server) getReadingDashboard(c echo.Context) error {
+	user, err := requireUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	dashboard, err := s.readingDashboard(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, dashboard)
+}
+
+func (s *server) readingDashboard(ctx context.Context, userID primitive.ObjectID) (readingDashboard, error) {
+	dashboard := readingDashboard{InProgress: []progressJSON{}, Finished: []progressJSON{}}
+	all, err := s.progress.FindByUser(ctx, userID)
+	if err != nil {
+		return dashboard, err
+	}
+	var progress []ReadingProgress
+	var books []BookStore
+	for _, p := range all {
+		book, err := s.books.FindByID(ctx, p.BookID)
+		if errors.Is(err, ErrBookNotFound) {
+			continue
+		}
+		if err != nil {
+			return dashboard, err
+		}
+		progress = append(progress, p)
+		books = append(books, book)
+	}
+	// Fetches the authors and copies of all books at once
+	dtos, err := s.bookDTOs(ctx, books)
+	if err != nil {
+		return dashboard, err
+	}
+
+	year := time.Now().UTC().Year()
+	for i, p := range progress {
+		entry := progressJSON{ReadingProgress: p, Book: &dtos[i]}
+		dashboard.Totals.PagesRead += p.Page
+		if p.FinishedAt == nil {
+			dashboard.InProgress = append(dashboard.InProgress, entry)
+			continue
+		}
+		dashboard.Finished = append(dashboard.Finished, entry)
+		if p.FinishedAt.Year() == year {
+			dashboard.Totals.FinishedThisYear++
+		}
+	}
+	slices.SortStableFunc(dashboard.Finished, func(a, b progressJSON) int {
+		return b.FinishedAt.Compare(*a.FinishedAt)
+	})
+	dashboard.Totals.InProgress = len(dashboard.InProgress)
+	dashboard.Totals.Finished = len(dashboard.Finished)
+	return dashboard, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrProgressNotFound = errors.New("no reading progress recorded for the book")
+
+// How far a user got with a book, see progress.go. Every user has at most
+// one per book. FinishedAt is set once the user read it to the end.
+type ReadingProgress struct {
+	UserID     primitive.ObjectID `json:"user_id" bson:"user_id"`
+	BookID     primitive.ObjectID `json:"book_id" bson:"book_id"`
+	Page       int                `json:"page" bson:"page"`
+	Percent    float64            `json:"percent" bson:"percent"`
+	StartedAt  time.Time          `json:"started_at" bson:"started_at"`
+	UpdatedAt  time.Time          `json:"updated_at" bson:"updated_at"`
+	FinishedAt *time.Time         `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+}
+
+// Stores the reading progress, next to the books it refers to.
+type ProgressRepository interface {
+	// Returns the progress of the user on all books, most recently
+	// updated first.
+	FindByUser(ctx context.Context, userID primitive.ObjectID) ([]ReadingProgress, error)
+	Find(ctx context.Context, userID, bookID primitive.ObjectID) (ReadingProgress, error)
+	// Stores the progress of the user on the book, replacing what was
+	// stored before.
+	Save(ctx context.Context, p ReadingProgress) (ReadingProgress, error)
+	Delete(ctx context.Context, userID, bookID primitive.ObjectID) error
+}
+
+// Keeps the reading progress in memory, for the memory storage.
+type memoryProgressRepository struct {
+	mu       sync.RWMutex
+	progress map[[2]primitive.ObjectID]ReadingProgress
+}
+
+func newMemoryProgressRepository() *memoryProgressRepository {
+	return &memoryProgressRepository{progress: map[[2]primitive.ObjectID]ReadingProgress{}}
+}
+
+func (r *memoryProgressRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]ReadingProgress, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	progress := []ReadingProgress{}
+	for _, p := range r.progress {
+		if p.UserID == userID {
+			progress = append(progress, p)
+		}
+	}
+	slices.SortFunc(progress, func(a, b ReadingProgress) int {
+		return cmp.Or(b.UpdatedAt.Compare(a.UpdatedAt), cmp.Compare(a.BookID.Hex(), b.BookID.Hex()))
+	})
+	return progress, nil
+}
+
+func (r *memoryProgressRepository) Find(ctx context.Context, userID, bookID primitive.ObjectID) (ReadingProgress, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.progress[[2]primitive.ObjectID{userID, bookID}]
+	if !ok {
+		return p, ErrProgressNotFound
+	}
+	return p, nil
+}
+
+func (r *memoryProgressRepository) Save(ctx context.Context, p ReadingProgress) (ReadingProgress, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress[[2]primitive.ObjectID{p.UserID, p.BookID}] = p
+	return p, nil
+}
+
+func (r *memoryProgressRepository) Delete(ctx context.Context, userID, bookID primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := [2]primitive.ObjectID{userID, bookID}
+	if _, ok := r.progress[key]; !ok {
+		return ErrProgressNotFound
+	}
+	delete(r.progress, key)
+	return nil
+}
+
+// Creates the index that keeps a single progress per user and book and
+// lists the progress of a user.
+func prepareProgress(ctx context.Context, coll *mongo.Collection) error {
+	return ensureIndexes(ctx, coll, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "book_id", Value: 1}},
+		Options: options.Index().SetName("reading_progress_user_id_book_id").SetUnique(true),
+	})
+}
+
+// Stores the reading progress in its own MongoDB collection.
+type mongoProgressRepository struct {
+	coll mongoCollection
+}
+
+func newMongoProgressRepository(coll *mongo.Collection) *mongoProgressRepository {
+	return &mongoProgressRepository{coll: withPolicy(coll)}
+}
+
+func (r *mongoProgressRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]ReadingProgress, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "updated_at", Value: -1}, {Key: "book_id", Value: 1}})
+	cursor, err := r.coll.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	progress := []ReadingProgress{}
+	if err = cursor.All(ctx, &progress); err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+func (r *mongoProgressRepository) Find(ctx context.Context, userID, bookID primitive.ObjectID) (ReadingProgress, error) {
+	var p ReadingProgress
+	err := r.coll.FindOne(ctx, bson.M{"user_id": userID, "book_id": bookID}).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return p, ErrProgressNotFound
+	}
+	return p, err
+}
+
+func (r *mongoProgressRepository) Save(ctx context.Context, p ReadingProgress) (ReadingProgress, error) {
+	_, err := r.coll.ReplaceOne(ctx, bson.M{"user_id": p.UserID, "book_id": p.BookID}, p, options.Replace().SetUpsert(true))
+	return p, err
+}
+
+func (r *mongoProgressRepository) Delete(ctx context.Context, userID, bookID primitive.ObjectID) error {
+	result, err := r.coll.DeleteOne(ctx, bson.M{"user_id": userID, "book_id": bookID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrProgressNotFound
+	}
+	return nil
+}
+
+// Stores the reading progress in the reading_progress table, see
+// sqlMigrations.
+type sqlProgressRepository struct {
+	db *sql.DB
+}
+
+func newSQLProgressRepository(db *sql.DB) *sqlProgressRepository {
+	return &sqlProgressRepository{db: db}
+}
+
+const progressColumns = "user_id, book_id, page, percent, started_at, updated_at, finished_at"
+
+func scanProgress(row rowScanner) (ReadingProgress, error) {
+	var p ReadingProgress
+	var userID, bookID string
+	var finishedAt sql.NullTime
+	err := row.Scan(&userID, &bookID, &p.Page, &p.Percent, &p.StartedAt, &p.UpdatedAt, &finishedAt)
+	if err != nil {
+		return p, err
+	}
+	if p.UserID, err = primitive.ObjectIDFromHex(userID); err != nil {
+		return p, err
+	}
+	if p.BookID, err = primitive.ObjectIDFromHex(bookID); err != nil {
+		return p, err
+	}
+	if finishedAt.Valid {
+		p.FinishedAt = &finishedAt.Time
+	}
+	return p, nil
+}
+
+func (r *sqlProgressRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]ReadingProgress, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+progressColumns+" FROM reading_progress WHERE user_id = $1 ORDER BY updated_at DESC, book_id", userID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	progress := []ReadingProgress{}
+	for rows.Next() {
+		p, err := scanProgress(rows)
+		if err != nil {
+			return nil, err
+		}
+		progress = append(progress, p)
+	}
+	return progress, rows.Err()
+}
+
+func (r *sqlProgressRepository) Find(ctx context.Context, userID, bookID primitive.ObjectID) (ReadingProgress, error) {
+	row := r.db.QueryRowContext(ctx,
+		"SELECT "+progressColumns+" FROM reading_progress WHERE user_id = $1 AND book_id = $2", userID.Hex(), bookID.Hex())
+	p, err := scanProgress(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, ErrProgressNotFound
+	}
+	return p, err
+}
+
+func (r *sqlProgressRepository) Save(ctx context.Context, p ReadingProgress) (ReadingProgress, error) {
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO reading_progress ("+progressColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7)"+
+			" ON CONFLICT (user_id, book_id) DO UPDATE SET page = excluded.page, percent = excluded.percent,"+
+			" started_at = excluded.started_at, updated_at = excluded.updated_at, finished_at = excluded.finished_at",
+		p.UserID.Hex(), p.BookID.Hex(), p.Page, p.Percent, p.StartedAt.UTC(), p.UpdatedAt.UTC(), utcOrNil(p.FinishedAt))
+	return p, err
+}
+
+func (r *sqlProgressRepository) Delete(ctx context.Context, userID, bookID primitive.ObjectID) error {
+	result, err := r.db.ExecContext(ctx,
+		"DELETE FROM reading_progress WHERE user_id = $1 AND book_id = $2", userID.Hex(), bookID.Hex())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrProgressNotFound
+	}
+	return nil
+}
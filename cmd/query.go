@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Upper bound for the page size a client can ask for. Anything larger
+// would defeat the purpose of paginating in the first place.
+const maxPageLimit = 100
+
+// Describes which slice of the catalog a listing endpoint should return.
+// A Limit of 0 means "everything", which keeps the old behavior for
+// clients that do not know about pagination yet. The filter fields are
+// optional: an empty Name, Author, AuthorID, ISBN or Genre or a nil bound
+// does not restrict the result. The lower time bounds are inclusive, the
+// upper ones exclusive.
+type BookQuery struct {
+	Page  int
+	Limit int
+
+	Name     string
+	Author   string
+	AuthorID primitive.ObjectID
+	ISBN     string
+	Genre    string
+	YearMin  *int
+	YearMax  *int
+	PagesMin *int
+	PagesMax *int
+
+	CreatedSince  *time.Time
+	CreatedBefore *time.Time
+	UpdatedSince  *time.Time
+	UpdatedBefore *time.Time
+
+	// Selects the books in the trash instead of the others.
+	Trash bool
+
+	Sort []SortField
+
+	// The fields a view needs, by their JSON names like in SortField. The
+	// repositories may leave the others empty, which saves reading and
+	// decoding them. Nil fetches every field; the ID always comes along.
+	Fields []string
+}
+
+// Reports whether any of the filter fields is set.
+func (q BookQuery) HasFilter() bool {
+	return q.Name != "" || q.Author != "" || !q.AuthorID.IsZero() || q.ISBN != "" || q.Genre != "" || q.YearMin != nil || q.YearMax != nil || q.PagesMin != nil || q.PagesMax != nil ||
+		q.CreatedSince != nil || q.CreatedBefore != nil || q.UpdatedSince != nil || q.UpdatedBefore != nil
+}
+
+// A single sort key. Field is one of the names in sortableFields, i.e. the
+// JSON name of the attribute, not the Go one.
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// Attributes a client is allowed to sort by. Anything else is rejected so
+// that arbitrary user input never ends up in a database query.
+var sortableFields = []string{"name", "author", "isbn", "pages", "year", "created_at", "updated_at", "deleted_at"}
+
+// Offset of the first document of the requested page.
+func (q BookQuery) Skip() int64 {
+	if q.Limit == 0 {
+		return 0
+	}
+	return int64((q.Page - 1) * q.Limit)
+}
+
+// Reads the ?page= and ?limit= query parameters. When neither is given,
+// defaultLimit decides how many books end up on the first page.
+func parsePagination(c echo.Context, defaultLimit int) (BookQuery, error) {
+	q := BookQuery{Page: 1, Limit: defaultLimit}
+
+	if raw := c.QueryParam("page"); raw != "" {
+		page, err := strconv.Atoi(raw)
+		if err != nil || page < 1 {
+			return q, echo.NewHTTPError(http.StatusBadRequest, "page must be a positive integer")
+		}
+		q.Page = page
+		if q.Limit == 0 {
+			q.Limit = maxPageLimit
+		}
+	}
+
+	if raw := c.QueryParam("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return q, echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer")
+		}
+		q.Limit = min(limit, maxPageLimit)
+	}
+
+	return q, nil
+}
+
+// Reads pagination and the filter parameters (?author=, ?author_id=,
+// ?genre=, ?year_min=, ?year_max=, ?pages_min=, ?pages_max=,
+// ?created_since=, ?created_before=, ?updated_since=, ?updated_before=,
+// and ?q=, see querylang.go) of a listing request.
+func parseBookQuery(c echo.Context, defaultLimit int) (BookQuery, error) {
+	q, err := parsePagination(c, defaultLimit)
+	if err != nil {
+		return q, err
+	}
+	if err = parseBookFilter(c, &q); err != nil {
+		return q, err
+	}
+	if err = parseSort(c, &q); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// Reads ?sort= and ?order=. Both take comma-separated lists, e.g.
+// ?sort=author,year&order=asc,desc. A single order applies to every sort
+// field, and a missing one defaults to ascending.
+func parseSort(c echo.Context, q *BookQuery) error {
+	return parseSortOrder(c.QueryParam("sort"), c.QueryParam("order"), q)
+}
+
+// Like parseSort, for a sort and an order given some other way.
+func parseSortOrder(rawSort, rawOrder string, q *BookQuery) error {
+	if rawSort == "" {
+		return nil
+	}
+	fields := strings.Split(rawSort, ",")
+
+	var orders []string
+	if rawOrder != "" {
+		orders = strings.Split(rawOrder, ",")
+	}
+	if len(orders) > 1 && len(orders) != len(fields) {
+		return echo.NewHTTPError(http.StatusBadRequest, "order must be given once or once per sort field")
+	}
+
+	q.Sort = nil
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		if !slices.Contains(sortableFields, field) {
+			return echo.NewHTTPError(http.StatusBadRequest, "cannot sort by "+strconv.Quote(field))
+		}
+
+		order := "asc"
+		if len(orders) == 1 {
+			order = orders[0]
+		} else if len(orders) > 1 {
+			order = orders[i]
+		}
+		switch strings.ToLower(strings.TrimSpace(order)) {
+		case "asc":
+			q.Sort = append(q.Sort, SortField{Field: field})
+		case "desc":
+			q.Sort = append(q.Sort, SortField{Field: field, Desc: true})
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "order must be asc or desc")
+		}
+	}
+	return nil
+}
+
+func parseBookFilter(c echo.Context, q *BookQuery) error {
+	q.Author = c.QueryParam("author")
+	if raw := c.QueryParam("author_id"); raw != "" {
+		id, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "author_id must be a valid ID")
+		}
+		q.AuthorID = id
+	}
+	q.Genre = normalizeGenre(c.QueryParam("genre"))
+
+	bounds := []struct {
+		param string
+		dst   **int
+	}{
+		{"year_min", &q.YearMin},
+		{"year_max", &q.YearMax},
+		{"pages_min", &q.PagesMin},
+		{"pages_max", &q.PagesMax},
+	}
+	for _, b := range bounds {
+		raw := c.QueryParam(b.param)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, b.param+" must be an integer")
+		}
+		*b.dst = &v
+	}
+
+	times := []struct {
+		param string
+		dst   **time.Time
+	}{
+		{"created_since", &q.CreatedSince},
+		{"created_before", &q.CreatedBefore},
+		{"updated_since", &q.UpdatedSince},
+		{"updated_before", &q.UpdatedBefore},
+	}
+	for _, t := range times {
+		raw := c.QueryParam(t.param)
+		if raw == "" {
+			continue
+		}
+		v, err := parseTimeBound(raw)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, t.param+" must be a date like 2024-01-31 or an RFC 3339 time")
+		}
+		*t.dst = &v
+	}
+
+	// The query language comes last; its bounds narrow those of the
+	// parameters above, its text terms win over them
+	if raw := strings.TrimSpace(c.QueryParam("q")); raw != "" {
+		return parseQueryLanguage(raw, q)
+	}
+	return nil
+}
+
+// Parses a bound of a time filter, either a full RFC 3339 time or a date,
+// which stands for midnight UTC.
+func parseTimeBound(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(time.DateOnly, raw)
+}
+
+// Reads an optional boolean query parameter such as ?confirm=true.
+func parseFlag(c echo.Context, name string) (bool, error) {
+	raw := c.QueryParam(name)
+	if raw == "" {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusBadRequest, name+" must be true or false")
+	}
+	return v, nil
+}
+
+// Holds a single page of books together with everything a client or
+// template needs to navigate to the neighbouring pages.
+type BookPage struct {
+	Books []BookDTO
+	Page  int
+	Pages int
+	Limit int
+	Total int64
+	Prev  string
+	Next  string
+	// The link to this very page, for reloading it
+	Self string
+	// Whether the user may add and edit books, and delete them
+	CanWrite  bool
+	CanDelete bool
+}
+
+// Builds the page description for the given query. The links keep every
+// other query parameter of the current request untouched, so filters
+// survive when navigating between pages.
+func newBookPage(c echo.Context, q BookQuery, books []BookDTO, total int64) BookPage {
+	page := BookPage{Books: books, Page: q.Page, Pages: 1, Limit: q.Limit, Total: total, Self: c.Request().URL.RequestURI()}
+	if q.Limit == 0 {
+		return page
+	}
+
+	page.Pages = int((total + int64(q.Limit) - 1) / int64(q.Limit))
+	if page.Pages == 0 {
+		page.Pages = 1
+	}
+	if q.Page > 1 {
+		page.Prev = pageLink(c, q.Page-1, q.Limit)
+	}
+	if q.Page < page.Pages {
+		page.Next = pageLink(c, q.Page+1, q.Limit)
+	}
+	return page
+}
+
+func pageLink(c echo.Context, page int, limit int) string {
+	params := url.Values{}
+	for k, v := range c.QueryParams() {
+		params[k] = v
+	}
+	params.Set("page", strconv.Itoa(page))
+	params.Set("limit", strconv.Itoa(limit))
+	return c.Request().URL.Path + "?" + params.Encode()
+}
+
+// Exposes the pagination information as headers, so that the body of the
+// JSON endpoints can stay a plain array.
+func setPaginationHeaders(c echo.Context, page BookPage) {
+	h := c.Response().Header()
+	h.Set("X-Total-Count", strconv.FormatInt(page.Total, 10))
+
+	if page.Prev != "" {
+		h.Add("Link", fmt.Sprintf(`<%s>; rel="prev"`, page.Prev))
+	}
+	if page.Next != "" {
+		h.Add("Link", fmt.Sprintf(`<%s>; rel="next"`, page.Next))
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+	"github.com/labstack/echo/v4"
+)
+
+// The ?q= parameter of the book listings takes the filters as terms
+// separated by spaces, like
+//
+//	author:"Edgar Allan Poe" year:>1840 pages:<300 created:>=2024-01-01
+//
+// instead of one parameter each. The text fields name, author, isbn and
+// genre take a value, quoted if it has spaces. The numbers year and pages
+// and the dates created and updated also take a comparison with >, >=, <
+// or <=, or a range like year:1840..1850 that includes both ends. Dates
+// are written like 2024-01-31 or as RFC 3339 times, and a date stands for
+// the whole day.
+//
+// The terms end up in the fields of BookQuery, so every storage filters
+// them the same way. Terms on the same field narrow each other down, like
+// year:>=1840 year:<1850, and so do the terms and the parameters like
+// ?year_min= next to ?q=, except for the text fields, where the last
+// term wins.
+
+// The fields the query language knows, in the order the errors list them.
+var queryFields = []string{"name", "author", "isbn", "genre", "year", "pages", "created", "updated"}
+
+// A single term, like year:>1840.
+type queryTerm struct {
+	field string
+	// One of >, >=, < and <=, or empty to match the value
+	op    string
+	value string
+}
+
+// Fills in the filter fields of the query from the terms.
+func parseQueryLanguage(raw string, q *BookQuery) error {
+	terms, err := splitQueryTerms(raw)
+	if err != nil {
+		return err
+	}
+	for _, t := range terms {
+		switch t.field {
+		case "name", "author", "isbn", "genre":
+			if t.op != "" {
+				return queryError("%s cannot be compared with %s, only matched like %s:%q", t.field, t.op, t.field, t.value)
+			}
+		}
+		switch t.field {
+		case "name":
+			q.Name = t.value
+		case "author":
+			q.Author = t.value
+		case "isbn":
+			canonical, err := isbn.Normalize(t.value)
+			if err != nil {
+				return queryError("isbn must be an ISBN-10 or ISBN-13, got %q", t.value)
+			}
+			q.ISBN = canonical
+		case "genre":
+			q.Genre = normalizeGenre(t.value)
+		case "year":
+			err = t.intBounds(&q.YearMin, &q.YearMax)
+		case "pages":
+			err = t.intBounds(&q.PagesMin, &q.PagesMax)
+		case "created":
+			err = t.timeBounds(&q.CreatedSince, &q.CreatedBefore)
+		case "updated":
+			err = t.timeBounds(&q.UpdatedSince, &q.UpdatedBefore)
+		default:
+			return queryError("unknown field %q, expected one of %s", t.field, strings.Join(queryFields, ", "))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryError(format string, args ...interface{}) error {
+	return echo.NewHTTPError(http.StatusBadRequest, "q: "+fmt.Sprintf(format, args...))
+}
+
+// Splits the parameter into its terms. Within quotes a backslash escapes
+// the next character, so author:"Robert \"Bob\" Smith" works.
+func splitQueryTerms(raw string) ([]queryTerm, error) {
+	var terms []queryTerm
+	rest := strings.TrimSpace(raw)
+	for rest != "" {
+		field, after, found := strings.Cut(rest, ":")
+		if !found || field == "" || strings.ContainsAny(field, " \t\"") {
+			word, _, _ := strings.Cut(rest, " ")
+			return nil, queryError("%q has no field, write it like name:%s", word, word)
+		}
+		t := queryTerm{field: strings.ToLower(field)}
+		for _, op := range []string{">=", "<=", ">", "<"} {
+			if strings.HasPrefix(after, op) {
+				t.op, after = op, after[len(op):]
+				break
+			}
+		}
+
+		if strings.HasPrefix(after, `"`) {
+			var value strings.Builder
+			closed := false
+			i := 1
+			for ; i < len(after); i++ {
+				if after[i] == '\\' && i+1 < len(after) {
+					i++
+				} else if after[i] == '"' {
+					closed = true
+					break
+				}
+				value.WriteByte(after[i])
+			}
+			if !closed {
+				return nil, queryError("the quote after %s: is not closed", t.field)
+			}
+			t.value, rest = value.String(), after[i+1:]
+		} else {
+			end := strings.IndexAny(after, " \t")
+			if end < 0 {
+				end = len(after)
+			}
+			t.value, rest = after[:end], after[end:]
+		}
+		if t.value == "" {
+			return nil, queryError("%s: needs a value", t.field)
+		}
+		terms = append(terms, t)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return terms, nil
+}
+
+// Narrows the inclusive bounds of a number down to the term, keeping
+// those that are narrower already.
+func (t queryTerm) intBounds(lo, hi **int) error {
+	bad := queryError("%s takes a number like %[1]s:1850, %[1]s:>1850 or %[1]s:1850..1860, got %q", t.field, t.op+t.value)
+	from, to, isRange := strings.Cut(t.value, "..")
+	if isRange && t.op != "" {
+		return bad
+	}
+	a, err := strconv.Atoi(from)
+	if err != nil {
+		return bad
+	}
+	b := a
+	if isRange {
+		if b, err = strconv.Atoi(to); err != nil {
+			return bad
+		}
+	}
+
+	switch t.op {
+	case "":
+		raiseInt(lo, a)
+		lowerInt(hi, b)
+	case ">=":
+		raiseInt(lo, a)
+	case ">":
+		raiseInt(lo, a+1)
+	case "<=":
+		lowerInt(hi, a)
+	case "<":
+		lowerInt(hi, a-1)
+	}
+	return nil
+}
+
+// Raises the lower bound to v, unless it is higher already.
+func raiseInt(lo **int, v int) {
+	if *lo == nil || **lo < v {
+		*lo = &v
+	}
+}
+
+// Lowers the upper bound to v, unless it is lower already.
+func lowerInt(hi **int, v int) {
+	if *hi == nil || **hi > v {
+		*hi = &v
+	}
+}
+
+// Narrows the bounds of a time down to the term. The lower bound is
+// inclusive and the upper one exclusive, like in BookQuery.
+func (t queryTerm) timeBounds(since, before **time.Time) error {
+	bad := queryError("%s takes a date like %[1]s:2024-01-31, %[1]s:>=2024-01-31 or %[1]s:2024-01-01..2024-01-31, got %q", t.field, t.op+t.value)
+	from, to, isRange := strings.Cut(t.value, "..")
+	if isRange && t.op != "" {
+		return bad
+	}
+	start, err := parseTimeBound(from)
+	if err != nil {
+		return bad
+	}
+	end := timeBoundEnd(from, start)
+	if isRange {
+		last, err := parseTimeBound(to)
+		if err != nil {
+			return bad
+		}
+		end = timeBoundEnd(to, last)
+	}
+
+	switch t.op {
+	case "":
+		raiseTime(since, start)
+		lowerTime(before, end)
+	case ">=":
+		raiseTime(since, start)
+	case ">":
+		raiseTime(since, end)
+	case "<=":
+		lowerTime(before, end)
+	case "<":
+		lowerTime(before, start)
+	}
+	return nil
+}
+
+// Raises the lower bound to t, unless it is later already.
+func raiseTime(since **time.Time, t time.Time) {
+	if *since == nil || (*since).Before(t) {
+		*since = &t
+	}
+}
+
+// Lowers the upper bound to t, unless it is earlier already.
+func lowerTime(before **time.Time, t time.Time) {
+	if *before == nil || (*before).After(t) {
+		*before = &t
+	}
+}
+
+// Returns the first time after the bound: the next day for a date, and
+// the next millisecond, the most precise time stored, for a time.
+func timeBoundEnd(raw string, t time.Time) time.Time {
+	if _, err := time.Parse(time.DateOnly, raw); err == nil {
+		return t.AddDate(0, 0, 1)
+	}
+	return t.Truncate(time.Millisecond).Add(time.Millisecond)
+}
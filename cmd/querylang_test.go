@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func intPtr(v int) *int { return &v }
+
+func datePtr(year int, month time.Month, day int) *time.Time {
+	t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return &t
+}
+
+func TestQueryLanguageNarrows(t *testing.T) {
+	tests := []struct {
+		name  string
+		start BookQuery
+		raw   string
+		want  BookQuery
+	}{
+		{
+			name: "the example of the doc comment",
+			raw:  `author:"Edgar Allan Poe" year:>1840 pages:<300 created:>=2024-01-01`,
+			want: BookQuery{Author: "Edgar Allan Poe", YearMin: intPtr(1841), PagesMax: intPtr(299), CreatedSince: datePtr(2024, 1, 1)},
+		},
+		{
+			name: "a lower and an upper bound",
+			raw:  "year:>=1840 year:<1850",
+			want: BookQuery{YearMin: intPtr(1840), YearMax: intPtr(1849)},
+		},
+		{
+			name: "a range within a bound",
+			raw:  "year:>=1850 year:1800..1900",
+			want: BookQuery{YearMin: intPtr(1850), YearMax: intPtr(1900)},
+		},
+		{
+			name: "a bound within a range",
+			raw:  "year:1800..1900 year:<=1850",
+			want: BookQuery{YearMin: intPtr(1800), YearMax: intPtr(1850)},
+		},
+		{
+			name: "the narrower of two lower bounds",
+			raw:  "pages:>100 pages:>=50",
+			want: BookQuery{PagesMin: intPtr(101)},
+		},
+		{
+			name:  "a term next to a parameter",
+			start: BookQuery{YearMin: intPtr(1900)},
+			raw:   "year:<1950",
+			want:  BookQuery{YearMin: intPtr(1900), YearMax: intPtr(1949)},
+		},
+		{
+			name:  "a term within a parameter",
+			start: BookQuery{YearMin: intPtr(1900), YearMax: intPtr(1950)},
+			raw:   "year:1800..1920",
+			want:  BookQuery{YearMin: intPtr(1900), YearMax: intPtr(1920)},
+		},
+		{
+			name: "dates",
+			raw:  "created:>=2024-01-01 created:<2024-03-01 created:>=2024-02-01",
+			want: BookQuery{CreatedSince: datePtr(2024, 2, 1), CreatedBefore: datePtr(2024, 3, 1)},
+		},
+		{
+			name:  "a date within a parameter",
+			start: BookQuery{UpdatedBefore: datePtr(2024, 1, 15)},
+			raw:   "updated:2024-01-01..2024-01-31",
+			want:  BookQuery{UpdatedSince: datePtr(2024, 1, 1), UpdatedBefore: datePtr(2024, 1, 15)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.start
+			if err := parseQueryLanguage(tt.raw, &q); err != nil {
+				t.Fatalf("parseQueryLanguage(%q): %v", tt.raw, err)
+			}
+			if !reflect.DeepEqual(q, tt.want) {
+				t.Errorf("parseQueryLanguage(%q) = %+v, want %+v", tt.raw, q, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryLanguageTerms(t *testing.T) {
+	updated := time.Date(2024, 1, 31, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		raw  string
+		want BookQuery
+	}{
+		{"", BookQuery{}},
+		{"name:Dune", BookQuery{Name: "Dune"}},
+		{`  name:Dune   author:Herbert  `, BookQuery{Name: "Dune", Author: "Herbert"}},
+		{`author:"Edgar Allan Poe"`, BookQuery{Author: "Edgar Allan Poe"}},
+		{`author:"Robert \"Bob\" Smith"`, BookQuery{Author: `Robert "Bob" Smith`}},
+		{`name:"a:b" genre:Horror`, BookQuery{Name: "a:b", Genre: "horror"}},
+		{"NAME:Dune Year:1965", BookQuery{Name: "Dune", YearMin: intPtr(1965), YearMax: intPtr(1965)}},
+		{"name:Dune name:Emma", BookQuery{Name: "Emma"}},
+		{"isbn:978-0-306-40615-7", BookQuery{ISBN: "9780306406157"}},
+		{"isbn:0306406152", BookQuery{ISBN: "9780306406157"}},
+		{"year:>1840", BookQuery{YearMin: intPtr(1841)}},
+		{"year:>=1840", BookQuery{YearMin: intPtr(1840)}},
+		{"year:<1850", BookQuery{YearMax: intPtr(1849)}},
+		{"year:<=1850", BookQuery{YearMax: intPtr(1850)}},
+		{"year:1840..1850", BookQuery{YearMin: intPtr(1840), YearMax: intPtr(1850)}},
+		{"pages:100..300", BookQuery{PagesMin: intPtr(100), PagesMax: intPtr(300)}},
+		{"created:2024-01-31", BookQuery{CreatedSince: datePtr(2024, 1, 31), CreatedBefore: datePtr(2024, 2, 1)}},
+		{"created:>2024-01-31", BookQuery{CreatedSince: datePtr(2024, 2, 1)}},
+		{"created:<2024-01-31", BookQuery{CreatedBefore: datePtr(2024, 1, 31)}},
+		{"created:<=2024-01-31", BookQuery{CreatedBefore: datePtr(2024, 2, 1)}},
+		{"created:2024-01-01..2024-01-31", BookQuery{CreatedSince: datePtr(2024, 1, 1), CreatedBefore: datePtr(2024, 2, 1)}},
+		{"updated:>=2024-01-31T13:30:00+01:00", BookQuery{UpdatedSince: &updated}},
+	}
+	for _, tt := range tests {
+		var q BookQuery
+		if err := parseQueryLanguage(tt.raw, &q); err != nil {
+			t.Errorf("parseQueryLanguage(%q): %v", tt.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(q, tt.want) {
+			t.Errorf("parseQueryLanguage(%q) = %+v, want %+v", tt.raw, q, tt.want)
+		}
+	}
+}
+
+func TestQueryLanguageErrors(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"title:Dune", `unknown field "title"`},
+		{"Dune", `"Dune" has no field`},
+		{"name:Dune Herbert", `"Herbert" has no field`},
+		{":Dune", "has no field"},
+		{"name:>Dune", "name cannot be compared with >"},
+		{"genre:<=horror", "genre cannot be compared with <="},
+		{"year:abc", "year takes a number"},
+		{"year:>1840..1850", "year takes a number"},
+		{"year:1840..", "year takes a number"},
+		{"pages:=300", "pages takes a number"},
+		{`author:"Edgar Allan Poe`, "the quote after author: is not closed"},
+		{"name:", "name: needs a value"},
+		{`name:""`, "name: needs a value"},
+		{"isbn:12345", "isbn must be an ISBN-10 or ISBN-13"},
+		{"isbn:9780306406158", "isbn must be an ISBN-10 or ISBN-13"},
+		{"created:2024-13-01", "created takes a date"},
+		{"updated:yesterday", "updated takes a date"},
+		{"created:>=2024-01-01..2024-02-01", "created takes a date"},
+	}
+	for _, tt := range tests {
+		err := parseQueryLanguage(tt.raw, &BookQuery{})
+		if err == nil {
+			t.Errorf("parseQueryLanguage(%q) succeeded, want an error with %q", tt.raw, tt.want)
+			continue
+		}
+		apiErr := toAPIError(err)
+		if apiErr.Code != http.StatusBadRequest || !strings.Contains(apiErr.Message, tt.want) {
+			t.Errorf("parseQueryLanguage(%q) = %d %q, want 400 with %q", tt.raw, apiErr.Code, apiErr.Message, tt.want)
+		}
+	}
+}
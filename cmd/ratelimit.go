@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// How many requests a client may send: Burst at once, refilled at Rate per
+// minute. This is a token bucket; every request takes a token.
+type quota struct {
+	Rate  int
+	Burst int
+}
+
+func (q quota) perSecond() float64 {
+	return float64(q.Rate) / 60
+}
+
+// Keeps the buckets of the clients. Take takes a token from the bucket of
+// key and reports whether there was one; if not, also how long until there
+// is.
+type rateLimitStore interface {
+	Take(ctx context.Context, key string, q quota) (bool, time.Duration, error)
+}
+
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+	// When the bucket will be full again if no more tokens are taken
+	full time.Time
+}
+
+// Keeps the buckets in memory, so every instance limits on its own.
+// Buckets that filled up again are dropped every now and then.
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	s := &memoryRateLimitStore{buckets: map[string]*tokenBucket{}}
+	go s.sweep()
+	return s
+}
+
+// Refills the bucket for the time passed since it was last used.
+func (b *tokenBucket) refill(now time.Time, q quota) {
+	b.tokens = math.Min(float64(q.Burst), b.tokens+now.Sub(b.at).Seconds()*q.perSecond())
+	b.at = now
+}
+
+func (s *memoryRateLimitStore) Take(ctx context.Context, key string, q quota) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(q.Burst), at: now}
+		s.buckets[key] = b
+	}
+	b.refill(now, q)
+	if b.tokens >= 1 {
+		b.tokens--
+		b.full = now.Add(time.Duration((float64(q.Burst) - b.tokens) / q.perSecond() * float64(time.Second)))
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / q.perSecond() * float64(time.Second)), nil
+}
+
+// A full bucket is the same as none, so those of clients that went quiet
+// are dropped.
+func (s *memoryRateLimitStore) sweep() {
+	for range time.Tick(time.Minute) {
+		s.mu.Lock()
+		now := time.Now()
+		for key, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Refills and takes from a bucket in one go, so the instances sharing the
+// Redis server do not race each other. The time comes from Redis, as the
+// clocks of the instances may differ. Buckets expire once they would be
+// full again.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(state[1]) or burst
+local at = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - at) / 1000 * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, wait}
+`)
+
+// Keeps the buckets in Redis, so the limits hold across all instances.
+type redisRateLimitStore struct {
+	client *redis.Client
+}
+
+func newRedisRateLimitStore(client *redis.Client) *redisRateLimitStore {
+	return &redisRateLimitStore{client: client}
+}
+
+func (s *redisRateLimitStore) Take(ctx context.Context, key string, q quota) (bool, time.Duration, error) {
+	res, err := takeTokenScript.Run(ctx, s.client, []string{"ratelimit:" + key}, q.perSecond(), q.Burst).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
+
+// Limits the requests to /api, see RateLimitConfig. Requests with a valid
+// API key count against the quota of the key, all others against the
+// quota of their IP address; an invalid key does not get a bucket of its
+// own. If the store fails, requests are let through rather than turning an
+// outage of Redis into one of the API.
+func (s *server) rateLimit(cfg RateLimitConfig, store rateLimitStore) echo.MiddlewareFunc {
+	perIP := quota{Rate: cfg.Rate, Burst: cfg.Burst}
+	perKey := quota{Rate: cfg.APIKeyRate, Burst: cfg.APIKeyBurst}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !strings.HasPrefix(c.Request().URL.Path, "/api/") {
+				return next(c)
+			}
+
+			key, q := "ip:"+c.RealIP(), perIP
+			if header := c.Request().Header.Get(headerAPIKey); header != "" {
+				if apiKey, err := s.authenticateAPIKey(c.Request().Context(), header); err == nil {
+					key, q = "key:"+apiKey.ID.Hex(), perKey
+				}
+			}
+
+			ctx, cancel := requestContext(c)
+			allowed, wait, err := store.Take(ctx, key, q)
+			cancel()
+			if err != nil {
+				log.Printf("Rate limit: failed to check %s: %v", key, err)
+				return next(c)
+			}
+			if !allowed {
+				seconds := int(math.Ceil(wait.Seconds()))
+				c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+				return echo.NewHTTPError(http.StatusTooManyRequests, "Too many requests, please slow down")
+			}
+			return next(c)
+		}
+	}
+}
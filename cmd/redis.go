@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Connects to the Redis server the instances share, if one is configured,
+// for the rate limits, the response cache and the sessions. Returns nil
+// without redis.url.
+func openRedis(ctx context.Context, cfg RedisConfig) (*redis.Client, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	opts, err := redis.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err = client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	return client, nil
+}
+
+// Returns the check of the connection to Redis for /readyz, or nil without
+// Redis.
+func pingRedis(client *redis.Client) func(context.Context) error {
+	if client == nil {
+		return nil
+	}
+	return func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
+	}
+}
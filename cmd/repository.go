@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Errors every BookRepository reports in the same way, so that handlers do
+// not need to know which database sits behind the repository.
+var (
+	ErrBookNotFound  = errors.New("book not found")
+	ErrDuplicateBook = errors.New("book already exists")
+	// The write was based on an older version of the book.
+	ErrVersionConflict = errors.New("the book was changed in the meantime")
+)
+
+// Returned when a book conflicts with one that is already stored, i.e. it
+// has the same ISBN. It matches ErrDuplicateBook with errors.Is.
+type DuplicateBookError struct {
+	ExistingID primitive.ObjectID
+}
+
+func (e *DuplicateBookError) Error() string {
+	return ErrDuplicateBook.Error()
+}
+
+func (e *DuplicateBookError) Is(target error) bool {
+	return target == ErrDuplicateBook
+}
+
+// Everything the handlers need to store and retrieve books. The handlers
+// only ever talk to this interface, which keeps them independent of the
+// database in use.
+type BookRepository interface {
+	// Returns the books matching the query and the total number of matches,
+	// ignoring the pagination window.
+	FindAll(ctx context.Context, q BookQuery) ([]BookStore, int64, error)
+	// Calls fn for every book FindAll would return, in the same order, and
+	// stops at the first error of fn. The books are read from the database
+	// while fn goes, so only a few of them are in memory at any time.
+	Each(ctx context.Context, q BookQuery, fn func(BookStore) error) error
+	// Books in the trash are not found, neither here nor by any of the
+	// methods changing a book; only FindAll with q.Trash lists them.
+	FindByID(ctx context.Context, id primitive.ObjectID) (BookStore, error)
+	// Counts the books matching the filter part of the query.
+	Count(ctx context.Context, q BookQuery) (int64, error)
+	Search(ctx context.Context, text string, limit int) ([]SearchHit, error)
+	// Searches like Search, but only among the books matching the filter,
+	// and counts the facets of all matches besides returning the best
+	// limit of them.
+	FacetedSearch(ctx context.Context, text string, f SearchFilter, limit int) (SearchResult, error)
+	// Returns up to limit books whose name or author starts with the
+	// prefix, ignoring case: those matching by name first, by name, then
+	// those matching by author, by author. This runs on every key stroke,
+	// so it only asks the database what an index can answer.
+	Suggest(ctx context.Context, prefix string, limit int) ([]BookStore, error)
+	// Returns up to limit other books similar to b, most similar first,
+	// scored as laid out in similar.go.
+	Similar(ctx context.Context, b BookStore, limit int) ([]SearchHit, error)
+	// Computes the figures of /api/stats.
+	Stats(ctx context.Context) (CatalogStats, error)
+	// Returns every author with the names of their books, both in
+	// alphabetical order.
+	GroupByAuthor(ctx context.Context) ([]AuthorBooks, error)
+	// Returns every decade with books and the names of those, in
+	// chronological order.
+	GroupByDecade(ctx context.Context) ([]DecadeBooks, error)
+
+	// Stores a new book at version 1 and returns it with its ID set. Storing a book
+	// with the ISBN of another one fails with a *DuplicateBookError; the
+	// same goes for Update and Patch.
+	Insert(ctx context.Context, b BookStore) (BookStore, error)
+	// Stores as many of the books as possible. The error is only set if the
+	// whole operation failed; problems with single books are reported in
+	// the result with the same index.
+	InsertMany(ctx context.Context, books []BookStore) ([]BulkResult, error)
+	// Replaces all fields of the book with the ID of b. If b.Version is set
+	// the book is only replaced while it still has that version, otherwise
+	// the result is ErrVersionConflict; Patch does the same with
+	// p.Version. Every change, including those of AddGenre, RemoveGenre and
+	// RenameAuthor, raises the version by one.
+	Update(ctx context.Context, b BookStore) (BookStore, error)
+	// Stores the book under its own ID, replacing the book with that ID if
+	// there is one, and reports whether the book was new. This is meant
+	// for restoring backups; another book with the same ISBN still makes
+	// it fail with a *DuplicateBookError. The version of b is kept.
+	Restore(ctx context.Context, b BookStore) (bool, error)
+	Patch(ctx context.Context, id primitive.ObjectID, p BookPatch) (BookStore, error)
+	// Moves the book to the trash, which keeps it, and its ISBN, until it is
+	// undeleted or purged.
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Takes the book back out of the trash and returns it. Books that are
+	// not in the trash are reported as ErrBookNotFound.
+	Undelete(ctx context.Context, id primitive.ObjectID) (BookStore, error)
+	// Removes the books that were moved to the trash before the given
+	// time for good and returns their IDs.
+	Purge(ctx context.Context, before time.Time) ([]primitive.ObjectID, error)
+	// Tag the book with a genre or remove it again. Both return the book as
+	// it looks afterwards, and do nothing if the book already has, or does
+	// not have, the genre.
+	AddGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error)
+	RemoveGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error)
+	// Copies the new name of an author into every book linked to it and
+	// returns how many books were changed.
+	RenameAuthor(ctx context.Context, authorID primitive.ObjectID, name string) (int64, error)
+	// Moves the books matching the filter part of the query to the trash
+	// and returns how many were moved.
+	DeleteMany(ctx context.Context, q BookQuery) (int64, error)
+}
+
+// Calls fn for every one of the books, for the implementations of
+// BookRepository.Each that read the books at once.
+func eachOf(books []BookStore, fn func(BookStore) error) error {
+	for _, b := range books {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Keeps the books in memory. Nothing survives a restart, which is exactly
+// what we want for demos, CI runs and tests that should not depend on a
+// running MongoDB.
+type memoryBookRepository struct {
+	mu    sync.RWMutex
+	books []BookStore // in insertion order, like a collection without sort
+}
+
+func newMemoryBookRepository() *memoryBookRepository {
+	return &memoryBookRepository{}
+}
+
+// Mirrors bookFilter of the Mongo repository.
+func matchesQuery(b BookStore, q BookQuery) bool {
+	if (b.DeletedAt != nil) != q.Trash {
+		return false
+	}
+	if q.Name != "" && !strings.Contains(strings.ToLower(b.BookName), strings.ToLower(q.Name)) {
+		return false
+	}
+	if q.Author != "" && !strings.Contains(strings.ToLower(b.BookAuthor), strings.ToLower(q.Author)) {
+		return false
+	}
+	if !q.AuthorID.IsZero() && b.AuthorID != q.AuthorID {
+		return false
+	}
+	if q.ISBN != "" && b.BookISBN != q.ISBN {
+		return false
+	}
+	if q.Genre != "" && !slices.Contains(b.Genres, q.Genre) {
+		return false
+	}
+	return inRange(b.BookYear, q.YearMin, q.YearMax) && inRange(b.BookPages, q.PagesMin, q.PagesMax) &&
+		inPeriod(b.CreatedAt, q.CreatedSince, q.CreatedBefore) && inPeriod(b.UpdatedAt, q.UpdatedSince, q.UpdatedBefore)
+}
+
+func inRange(v int, lo *int, hi *int) bool {
+	return (lo == nil || v >= *lo) && (hi == nil || v <= *hi)
+}
+
+func inPeriod(t time.Time, since *time.Time, before *time.Time) bool {
+	return (since == nil || !t.Before(*since)) && (before == nil || t.Before(*before))
+}
+
+func compareField(a BookStore, b BookStore, field string) int {
+	switch field {
+	case "name":
+		return cmp.Compare(a.BookName, b.BookName)
+	case "author":
+		return cmp.Compare(a.BookAuthor, b.BookAuthor)
+	case "isbn":
+		return cmp.Compare(a.BookISBN, b.BookISBN)
+	case "pages":
+		return cmp.Compare(a.BookPages, b.BookPages)
+	case "year":
+		return cmp.Compare(a.BookYear, b.BookYear)
+	case "created_at":
+		return a.CreatedAt.Compare(b.CreatedAt)
+	case "updated_at":
+		return a.UpdatedAt.Compare(b.UpdatedAt)
+	case "deleted_at":
+		return compareDeletedAt(a.DeletedAt, b.DeletedAt)
+	}
+	return 0
+}
+
+// Books that are not in the trash come first.
+func compareDeletedAt(a *time.Time, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	return a.Compare(*b)
+}
+
+// Sorts the books in place by the sort keys of the query.
+func sortBooks(books []BookStore, sort []SortField) {
+	if len(sort) == 0 {
+		return
+	}
+	slices.SortStableFunc(books, func(a, b BookStore) int {
+		for _, f := range sort {
+			c := compareField(a, b, f.Field)
+			if f.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+}
+
+func (r *memoryBookRepository) FindAll(ctx context.Context, q BookQuery) ([]BookStore, int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	results := []BookStore{}
+	for _, b := range r.books {
+		if matchesQuery(b, q) {
+			results = append(results, b)
+		}
+	}
+	sortBooks(results, q.Sort)
+
+	total := int64(len(results))
+	if q.Limit > 0 {
+		start := min(int(q.Skip()), len(results))
+		end := min(start+q.Limit, len(results))
+		results = results[start:end]
+	}
+	return results, total, nil
+}
+
+// The books are in memory anyway; fn gets them after the lock is released,
+// so it may take its time.
+func (r *memoryBookRepository) Each(ctx context.Context, q BookQuery, fn func(BookStore) error) error {
+	books, _, err := r.FindAll(ctx, q)
+	if err != nil {
+		return err
+	}
+	return eachOf(books, fn)
+}
+
+// Returns the position of the book with the given ID, or -1. The caller
+// must hold the lock.
+func (r *memoryBookRepository) indexOf(id primitive.ObjectID) int {
+	return slices.IndexFunc(r.books, func(b BookStore) bool { return b.ID == id })
+}
+
+// Like indexOf, but books in the trash count as missing.
+func (r *memoryBookRepository) indexOfLive(id primitive.ObjectID) int {
+	return slices.IndexFunc(r.books, func(b BookStore) bool { return b.ID == id && b.DeletedAt == nil })
+}
+
+func (r *memoryBookRepository) FindByID(ctx context.Context, id primitive.ObjectID) (BookStore, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i := r.indexOfLive(id)
+	if i < 0 {
+		return BookStore{}, ErrBookNotFound
+	}
+	return r.books[i], nil
+}
+
+func (r *memoryBookRepository) Count(ctx context.Context, q BookQuery) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var count int64
+	for _, b := range r.books {
+		if matchesQuery(b, q) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// A rough stand-in for Mongo's text search: every search term found in the
+// name, author or ISBN of a book adds one to its score.
+func (r *memoryBookRepository) Search(ctx context.Context, text string, limit int) ([]SearchHit, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	terms := strings.Fields(strings.ToLower(text))
+	hits := []SearchHit{}
+	for _, b := range r.books {
+		if b.DeletedAt != nil {
+			continue
+		}
+		haystack := strings.ToLower(b.BookName + " " + b.BookAuthor + " " + b.BookISBN)
+		score := 0
+		for _, term := range terms {
+			if strings.Contains(haystack, term) {
+				score++
+			}
+		}
+		if score > 0 {
+			hits = append(hits, SearchHit{BookStore: b, Score: float64(score)})
+		}
+	}
+	slices.SortStableFunc(hits, func(a, b SearchHit) int { return cmp.Compare(b.Score, a.Score) })
+
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+// Searches all books and leaves the rest to facetHits.
+func (r *memoryBookRepository) FacetedSearch(ctx context.Context, text string, f SearchFilter, limit int) (SearchResult, error) {
+	hits, err := r.Search(ctx, text, 0)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	return facetHits(hits, f, limit), nil
+}
+
+// Goes through all the books, which is fast enough for a catalog that fits
+// into memory.
+func (r *memoryBookRepository) Suggest(ctx context.Context, prefix string, limit int) ([]BookStore, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	prefix = strings.ToLower(prefix)
+	var byName, byAuthor []BookStore
+	for _, b := range r.books {
+		if b.DeletedAt != nil {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(b.BookName), prefix) {
+			byName = append(byName, b)
+		} else if strings.HasPrefix(strings.ToLower(b.BookAuthor), prefix) {
+			byAuthor = append(byAuthor, b)
+		}
+	}
+	slices.SortFunc(byName, func(a, b BookStore) int {
+		return cmp.Compare(strings.ToLower(a.BookName), strings.ToLower(b.BookName))
+	})
+	slices.SortFunc(byAuthor, func(a, b BookStore) int {
+		return cmp.Compare(strings.ToLower(a.BookAuthor), strings.ToLower(b.BookAuthor))
+	})
+	return mergeSuggestions(byName, byAuthor, limit), nil
+}
+
+// Scores every other book with similarity.
+func (r *memoryBookRepository) Similar(ctx context.Context, of BookStore, limit int) ([]SearchHit, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hits := []SearchHit{}
+	for _, b := range r.books {
+		if b.DeletedAt != nil || b.ID == of.ID {
+			continue
+		}
+		if score := similarity(of, b); score > 0 {
+			hits = append(hits, SearchHit{BookStore: b, Score: score})
+		}
+	}
+	slices.SortFunc(hits, func(a, b SearchHit) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(a.BookName, b.BookName))
+	})
+	return hits[:min(limit, len(hits))], nil
+}
+
+func (r *memoryBookRepository) Stats(ctx context.Context) (CatalogStats, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stats := CatalogStats{Authors: []AuthorCount{}, Decades: []DecadeCount{}}
+	var live []BookStore
+	var pages int64
+	authors, decades := map[string]int64{}, map[int]int64{}
+	for _, b := range r.books {
+		if b.DeletedAt != nil {
+			continue
+		}
+		live = append(live, b)
+		pages += int64(b.BookPages)
+		authors[b.BookAuthor]++
+		decades[decadeOf(b.BookYear)]++
+	}
+	stats.Books = int64(len(live))
+	if stats.Books > 0 {
+		stats.AveragePages = float64(pages) / float64(stats.Books)
+	}
+	for author, n := range authors {
+		stats.Authors = append(stats.Authors, AuthorCount{Author: author, Books: n})
+	}
+	slices.SortFunc(stats.Authors, func(a, b AuthorCount) int {
+		return cmp.Or(cmp.Compare(b.Books, a.Books), cmp.Compare(a.Author, b.Author))
+	})
+	for decade, n := range decades {
+		stats.Decades = append(stats.Decades, DecadeCount{Decade: decade, Books: n})
+	}
+	slices.SortFunc(stats.Decades, func(a, b DecadeCount) int { return cmp.Compare(a.Decade, b.Decade) })
+
+	sortBooks(live, newestFirst)
+	stats.Newest = slices.Clone(live[:min(statsBookCount, len(live))])
+	sortBooks(live, oldestFirst)
+	stats.Oldest = slices.Clone(live[:min(statsBookCount, len(live))])
+	return stats, nil
+}
+
+func (r *memoryBookRepository) GroupByAuthor(ctx context.Context) ([]AuthorBooks, error) {
+	books, _, err := r.FindAll(ctx, BookQuery{Sort: byAuthor})
+	if err != nil {
+		return nil, err
+	}
+	return groupByAuthor(books), nil
+}
+
+func (r *memoryBookRepository) GroupByDecade(ctx context.Context) ([]DecadeBooks, error) {
+	books, _, err := r.FindAll(ctx, BookQuery{Sort: byYear})
+	if err != nil {
+		return nil, err
+	}
+	return groupByDecade(books), nil
+}
+
+// Enforces the same unique ISBN rule as the index of the Mongo repository.
+// The book with the ID skip is ignored, so a book never conflicts with
+// itself. The caller must hold the lock.
+func (r *memoryBookRepository) checkDuplicate(b BookStore, skip primitive.ObjectID) error {
+	if b.BookISBN == "" {
+		return nil
+	}
+	for _, o := range r.books {
+		if o.ID != skip && o.BookISBN == b.BookISBN {
+			return &DuplicateBookError{ExistingID: o.ID}
+		}
+	}
+	return nil
+}
+
+func (r *memoryBookRepository) Insert(ctx context.Context, b BookStore) (BookStore, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.checkDuplicate(b, primitive.NilObjectID); err != nil {
+		return b, err
+	}
+	b.ID = primitive.NewObjectID()
+	b.Version = 1
+	b.CreatedAt = writeTime()
+	b.UpdatedAt = b.CreatedAt
+	r.books = append(r.books, b)
+	return b, nil
+}
+
+func (r *memoryBookRepository) InsertMany(ctx context.Context, books []BookStore) ([]BulkResult, error) {
+	results := make([]BulkResult, len(books))
+	for i, book := range books {
+		results[i].Index = i
+		created, err := r.Insert(ctx, book)
+		if err != nil {
+			results[i].Error = err.Error()
+			results[i].ExistingID = err.(*DuplicateBookError).ExistingID.Hex()
+			continue
+		}
+		results[i].ID = created.ID.Hex()
+	}
+	return results, nil
+}
+
+func (r *memoryBookRepository) Update(ctx context.Context, b BookStore) (BookStore, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.indexOfLive(b.ID)
+	if i < 0 {
+		return b, ErrBookNotFound
+	}
+	if b.Version != 0 && b.Version != r.books[i].Version {
+		return b, ErrVersionConflict
+	}
+	if err := r.checkDuplicate(b, b.ID); err != nil {
+		return b, err
+	}
+	b.Version = r.books[i].Version + 1
+	b.CreatedAt = r.books[i].CreatedAt
+	b.UpdatedAt = writeTime()
+	r.books[i] = b
+	return b, nil
+}
+
+func (r *memoryBookRepository) Restore(ctx context.Context, b BookStore) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.checkDuplicate(b, b.ID); err != nil {
+		return false, err
+	}
+	completeRestoredBook(&b)
+	if i := r.indexOf(b.ID); i >= 0 {
+		r.books[i] = b
+		return false, nil
+	}
+	r.books = append(r.books, b)
+	return true, nil
+}
+
+func (r *memoryBookRepository) Patch(ctx context.Context, id primitive.ObjectID, p BookPatch) (BookStore, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.indexOfLive(id)
+	if i < 0 {
+		return BookStore{}, ErrBookNotFound
+	}
+	if p.Version != nil && *p.Version != r.books[i].Version {
+		return BookStore{}, ErrVersionConflict
+	}
+	patched := r.books[i]
+	p.Apply(&patched)
+	if err := r.checkDuplicate(patched, id); err != nil {
+		return BookStore{}, err
+	}
+	patched.Version++
+	patched.UpdatedAt = writeTime()
+	r.books[i] = patched
+	return patched, nil
+}
+
+func (r *memoryBookRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.indexOfLive(id)
+	if i < 0 {
+		return ErrBookNotFound
+	}
+	r.trash(i, writeTime())
+	return nil
+}
+
+// Moves the book at position i to the trash. The caller must hold the
+// lock.
+func (r *memoryBookRepository) trash(i int, at time.Time) {
+	r.books[i].DeletedAt = &at
+	r.books[i].UpdatedAt = at
+	r.books[i].Version++
+}
+
+func (r *memoryBookRepository) Undelete(ctx context.Context, id primitive.ObjectID) (BookStore, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.indexOf(id)
+	if i < 0 || r.books[i].DeletedAt == nil {
+		return BookStore{}, ErrBookNotFound
+	}
+	r.books[i].DeletedAt = nil
+	r.books[i].UpdatedAt = writeTime()
+	r.books[i].Version++
+	return r.books[i], nil
+}
+
+func (r *memoryBookRepository) Purge(ctx context.Context, before time.Time) ([]primitive.ObjectID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var purged []primitive.ObjectID
+	r.books = slices.DeleteFunc(r.books, func(b BookStore) bool {
+		if b.DeletedAt == nil || !b.DeletedAt.Before(before) {
+			return false
+		}
+		purged = append(purged, b.ID)
+		return true
+	})
+	return purged, nil
+}
+
+// Replaces the genres of the book with the result of change, which gets a
+// copy it may modify.
+func (r *memoryBookRepository) changeGenres(id primitive.ObjectID, change func([]string) []string) (BookStore, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.indexOfLive(id)
+	if i < 0 {
+		return BookStore{}, ErrBookNotFound
+	}
+	genres := change(slices.Clone(r.books[i].Genres))
+	if !slices.Equal(genres, r.books[i].Genres) {
+		r.books[i].Genres = genres
+		r.books[i].Version++
+		r.books[i].UpdatedAt = writeTime()
+	}
+	return r.books[i], nil
+}
+
+func (r *memoryBookRepository) AddGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error) {
+	return r.changeGenres(id, func(genres []string) []string {
+		return normalizeGenres(append(genres, genre))
+	})
+}
+
+func (r *memoryBookRepository) RemoveGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error) {
+	return r.changeGenres(id, func(genres []string) []string {
+		return slices.DeleteFunc(genres, func(g string) bool { return g == genre })
+	})
+}
+
+func (r *memoryBookRepository) RenameAuthor(ctx context.Context, authorID primitive.ObjectID, name string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int64
+	now := writeTime()
+	for i := range r.books {
+		if r.books[i].AuthorID == authorID && r.books[i].BookAuthor != name {
+			r.books[i].BookAuthor = name
+			r.books[i].Version++
+			r.books[i].UpdatedAt = now
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *memoryBookRepository) DeleteMany(ctx context.Context, q BookQuery) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	q.Trash = false
+	var n int64
+	now := writeTime()
+	for i, b := range r.books {
+		if matchesQuery(b, q) {
+			r.trash(i, now)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,1152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Here we make sure the connection to the database is correct and initial
+// configurations exists. Otherwise, we create the proper database and collection
+// we will store the data.
+// To ensure correct management of the collection, we create a return a
+// reference to the collection to always be used. Make sure if you create other
+// files, that you pass the proper value to ensure communication with the
+// database
+// More on what bson means: https://www.mongodb.com/docs/drivers/go/current/fundamentals/bson/
+func prepareDatabase(ctx context.Context, client *mongo.Client, dbName string, collecName string, migrate bool) (*mongo.Collection, error) {
+	db := client.Database(dbName)
+
+	names, err := db.ListCollectionNames(ctx, bson.D{{}})
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(names, collecName) {
+		cmd := bson.D{{Key: "create", Value: collecName}}
+		var result bson.M
+		if err = db.RunCommand(ctx, cmd).Decode(&result); err != nil {
+			log.Fatal(err)
+			return nil, err
+		}
+	}
+
+	coll := db.Collection(collecName)
+
+	// The migrations come first, as some of them, like normalizing the
+	// ISBNs, are needed for the indexes below
+	if migrate {
+		if err = migrateMongo(ctx, db, coll); err != nil {
+			return nil, err
+		}
+	}
+
+	indexes := []mongo.IndexModel{
+		// Duplicates are detected by ISBN. Books without one are exempt,
+		// since plenty of older books never got an ISBN.
+		{
+			Keys: bson.D{{Key: "isbn", Value: 1}},
+			Options: options.Index().
+				SetName("books_isbn_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"isbn": bson.M{"$gt": ""}}),
+		},
+		// Lists the books of an author, see /api/authors/:id/books
+		{Keys: bson.D{{Key: "author_id", Value: 1}}, Options: options.Index().SetName("books_author_id")},
+		// Back sorting by author and year, and filtering by ?year_min= and
+		// ?year_max=
+		{Keys: bson.D{{Key: "author", Value: 1}}, Options: options.Index().SetName("books_author")},
+		{Keys: bson.D{{Key: "year", Value: 1}}, Options: options.Index().SetName("books_year")},
+		// Back /api/books/suggest, whose queries have to use the same
+		// collation
+		{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetName("books_name_suggest").SetCollation(suggestCollation)},
+		{Keys: bson.D{{Key: "author", Value: 1}}, Options: options.Index().SetName("books_author_suggest").SetCollation(suggestCollation)},
+		// A multikey index, which backs filtering by ?genre=
+		{Keys: bson.D{{Key: "genres", Value: 1}}, Options: options.Index().SetName("books_genres")},
+		// Back sorting and filtering by the timestamps, e.g. for the
+		// recently added books, and finding the books to purge from the
+		// trash
+		{Keys: bson.D{{Key: "created_at", Value: 1}}, Options: options.Index().SetName("books_created_at")},
+		{Keys: bson.D{{Key: "updated_at", Value: 1}}, Options: options.Index().SetName("books_updated_at")},
+		{Keys: bson.D{{Key: "deleted_at", Value: 1}}, Options: options.Index().SetName("books_deleted_at").SetSparse(true)},
+		// Backs /api/books/search
+		{
+			Keys: bson.D{
+				{Key: "name", Value: "text"},
+				{Key: "author", Value: "text"},
+				{Key: "isbn", Value: "text"},
+			},
+			Options: options.Index().SetName("books_text"),
+		},
+	}
+	if err = ensureIndexes(ctx, coll, indexes...); err != nil {
+		return nil, err
+	}
+	ensureSearchIndex(ctx, coll)
+
+	return coll, nil
+}
+
+// The Atlas Search index FuzzySearch uses.
+const fuzzySearchIndex = "books_fuzzy"
+
+// Starts building the Atlas Search index unless it exists; Atlas builds it
+// in the background. Servers outside of Atlas have no search indexes,
+// which is fine: the service searches with typos by itself then, see
+// fuzzy.go.
+func ensureSearchIndex(ctx context.Context, coll *mongo.Collection) {
+	cursor, err := coll.SearchIndexes().List(ctx, options.SearchIndexes().SetName(fuzzySearchIndex))
+	if err != nil {
+		return
+	}
+	var existing []bson.M
+	if err = cursor.All(ctx, &existing); err != nil || len(existing) > 0 {
+		return
+	}
+
+	model := mongo.SearchIndexModel{
+		Definition: bson.M{"mappings": bson.M{"dynamic": false, "fields": bson.M{
+			"name":   bson.M{"type": "string"},
+			"author": bson.M{"type": "string"},
+		}}},
+		Options: options.SearchIndexes().SetName(fuzzySearchIndex),
+	}
+	if _, err = coll.SearchIndexes().CreateOne(ctx, model); err != nil {
+		log.Printf("Failed to build the Atlas Search index %s of %s: %v", fuzzySearchIndex, coll.Name(), err)
+		return
+	}
+	log.Printf("Started building the Atlas Search index %s of %s", fuzzySearchIndex, coll.Name())
+}
+
+// Builds those of the indexes that do not exist yet, which makes it safe
+// to run on every start, and logs the ones it built. Indexes are told
+// apart by their names, so an index whose definition changes needs a new
+// name; the old one stays until somebody drops it.
+func ensureIndexes(ctx context.Context, coll *mongo.Collection, indexes ...mongo.IndexModel) error {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+	var missing []mongo.IndexModel
+	for _, index := range indexes {
+		exists := slices.ContainsFunc(specs, func(spec *mongo.IndexSpecification) bool {
+			return spec.Name == *index.Options.Name
+		})
+		if !exists {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	names, err := coll.Indexes().CreateMany(ctx, missing)
+	if err != nil {
+		return fmt.Errorf("failed to build the indexes of %s: %w", coll.Name(), err)
+	}
+	log.Printf("Built the indexes %s of %s in %v", strings.Join(names, ", "), coll.Name(), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Rewrites every ISBN that is not yet in its canonical form. ISBNs that
+// cannot be normalized are left as they are.
+func normalizeStoredISBNs(ctx context.Context, coll *mongo.Collection) error {
+	cursor, err := coll.Find(ctx, bson.M{"isbn": bson.M{"$regex": "[^0-9]"}})
+	if err != nil {
+		return err
+	}
+	var books []BookStore
+	if err = cursor.All(ctx, &books); err != nil {
+		return err
+	}
+	for _, b := range books {
+		canonical, err := isbn.Normalize(b.BookISBN)
+		if err != nil {
+			continue
+		}
+		_, err = coll.UpdateByID(ctx, b.ID, bson.M{"$set": bson.M{"isbn": canonical}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stores the books in a MongoDB collection.
+type mongoBookRepository struct {
+	coll mongoCollection
+}
+
+func newMongoBookRepository(coll *mongo.Collection) *mongoBookRepository {
+	return &mongoBookRepository{coll: withPolicy(coll)}
+}
+
+// Translates the filter part of a query into a MongoDB filter. The name
+// and the author are matched case-insensitively anywhere, so "shelley"
+// finds "Mary Shelley"; the numeric bounds are inclusive.
+func bookFilter(q BookQuery) bson.M {
+	filter := bson.M{"deleted_at": bson.M{"$exists": q.Trash}}
+	if q.Name != "" {
+		filter["name"] = primitive.Regex{Pattern: regexp.QuoteMeta(q.Name), Options: "i"}
+	}
+	if q.Author != "" {
+		filter["author"] = primitive.Regex{Pattern: regexp.QuoteMeta(q.Author), Options: "i"}
+	}
+	if !q.AuthorID.IsZero() {
+		filter["author_id"] = q.AuthorID
+	}
+	if q.ISBN != "" {
+		filter["isbn"] = q.ISBN
+	}
+	if q.Genre != "" {
+		filter["genres"] = q.Genre
+	}
+	if r := rangeFilter(q.YearMin, q.YearMax); r != nil {
+		filter["year"] = r
+	}
+	if r := rangeFilter(q.PagesMin, q.PagesMax); r != nil {
+		filter["pages"] = r
+	}
+	if r := periodFilter(q.CreatedSince, q.CreatedBefore); r != nil {
+		filter["created_at"] = r
+	}
+	if r := periodFilter(q.UpdatedSince, q.UpdatedBefore); r != nil {
+		filter["updated_at"] = r
+	}
+	return filter
+}
+
+func periodFilter(since *time.Time, before *time.Time) bson.M {
+	if since == nil && before == nil {
+		return nil
+	}
+	r := bson.M{}
+	if since != nil {
+		r["$gte"] = *since
+	}
+	if before != nil {
+		r["$lt"] = *before
+	}
+	return r
+}
+
+func rangeFilter(lo *int, hi *int) bson.M {
+	if lo == nil && hi == nil {
+		return nil
+	}
+	r := bson.M{}
+	if lo != nil {
+		r["$gte"] = *lo
+	}
+	if hi != nil {
+		r["$lte"] = *hi
+	}
+	return r
+}
+
+// Fetches the books selected by the query. Pagination is done with
+// skip+limit, which is plenty for catalogs of a few thousand books.
+func (r *mongoBookRepository) FindAll(ctx context.Context, q BookQuery) ([]BookStore, int64, error) {
+	filter := bookFilter(q)
+	total, err := r.coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	cursor, err := r.coll.Find(ctx, filter, findOptions(q))
+	if err != nil {
+		return nil, 0, err
+	}
+	results := []BookStore{}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, 0, err
+	}
+	return results, total, nil
+}
+
+// Reads the books off the cursor one by one; the driver fetches them from
+// the server in batches as the cursor goes.
+func (r *mongoBookRepository) Each(ctx context.Context, q BookQuery, fn func(BookStore) error) error {
+	cursor, err := r.coll.Find(ctx, bookFilter(q), findOptions(q).SetBatchSize(exportBatchSize))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var b BookStore
+		if err := cursor.Decode(&b); err != nil {
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// The sort order, the pagination window and the fields of the query.
+func findOptions(q BookQuery) *options.FindOptions {
+	opts := options.Find()
+	if q.Fields != nil {
+		opts.SetProjection(bookProjection(q.Fields))
+	}
+	if len(q.Sort) > 0 {
+		sort := bson.D{}
+		for _, f := range q.Sort {
+			dir := 1
+			if f.Desc {
+				dir = -1
+			}
+			sort = append(sort, bson.E{Key: f.Field, Value: dir})
+		}
+		// Ties are broken by _id so that pages do not overlap when many
+		// books share the same value.
+		opts.SetSort(append(sort, bson.E{Key: "_id", Value: 1}))
+	}
+	if q.Limit > 0 {
+		opts.SetSkip(q.Skip()).SetLimit(int64(q.Limit))
+	}
+	return opts
+}
+
+func (r *mongoBookRepository) FindByID(ctx context.Context, id primitive.ObjectID) (BookStore, error) {
+	var res BookStore
+	err := r.coll.FindOne(ctx, liveBook(id)).Decode(&res)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return res, ErrBookNotFound
+	}
+	return res, err
+}
+
+// Matches the book with the ID unless it is in the trash.
+func liveBook(id primitive.ObjectID) bson.M {
+	return bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}
+}
+
+func (r *mongoBookRepository) Count(ctx context.Context, q BookQuery) (int64, error) {
+	return r.coll.CountDocuments(ctx, bookFilter(q))
+}
+
+// Runs a $text search over name, author and ISBN and returns the best
+// matches first. Mongo takes care of stemming and stop words for us.
+func (r *mongoBookRepository) Search(ctx context.Context, text string, limit int) ([]SearchHit, error) {
+	score := bson.M{"score": bson.M{"$meta": "textScore"}}
+	opts := options.Find().SetProjection(score).SetSort(score)
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	filter := bson.M{"$text": bson.M{"$search": text}, "deleted_at": bson.M{"$exists": false}}
+	cursor, err := r.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	hits := []SearchHit{}
+	if err = cursor.All(ctx, &hits); err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+// Finds the hits and counts the facets in a single aggregation, with a
+// $facet for each of them.
+func (r *mongoBookRepository) FacetedSearch(ctx context.Context, text string, f SearchFilter, limit int) (SearchResult, error) {
+	match := bson.M{"$text": bson.M{"$search": text}, "deleted_at": bson.M{"$exists": false}}
+	if f.Author != "" {
+		match["author"] = f.Author
+	}
+	if f.Genre != "" {
+		match["genres"] = f.Genre
+	}
+	if f.Decade != nil {
+		match["year"] = bson.M{"$gte": *f.Decade, "$lt": *f.Decade + 10}
+	}
+	count := func(key interface{}) bson.A {
+		return bson.A{
+			bson.M{"$group": bson.M{"_id": key, "books": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.D{{Key: "books", Value: -1}, {Key: "_id", Value: 1}}},
+			bson.M{"$limit": maxFacetValues},
+		}
+	}
+	hits := bson.A{bson.M{"$sort": bson.M{"score": -1}}}
+	if limit > 0 {
+		hits = append(hits, bson.M{"$limit": limit})
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$set", Value: bson.M{"score": bson.M{"$meta": "textScore"}}}},
+		{{Key: "$facet", Value: bson.M{
+			"hits":    hits,
+			"authors": count("$author"),
+			"decades": count(decadeExpr),
+			"genres":  append(bson.A{bson.M{"$unwind": "$genres"}}, count("$genres")...),
+		}}},
+	}
+
+	cursor, err := r.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	var results []struct {
+		Hits         []SearchHit `bson:"hits"`
+		SearchFacets `bson:",inline"`
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return SearchResult{}, err
+	}
+	res := SearchResult{Hits: []SearchHit{}}
+	if len(results) > 0 {
+		res.Facets = results[0].SearchFacets
+		if results[0].Hits != nil {
+			res.Hits = results[0].Hits
+		}
+	}
+	return res, nil
+}
+
+// The codes of the errors servers without Atlas Search answer $search
+// with: an unknown pipeline stage, and $search outside of Atlas.
+var searchUnavailableCodes = []int{40324, 31082, 6047401}
+
+// Searches with Atlas Search, allowing up to two typos per term.
+func (r *mongoBookRepository) FuzzySearch(ctx context.Context, text string, limit int) ([]SearchHit, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$search", Value: bson.M{
+			"index": fuzzySearchIndex,
+			"text": bson.M{
+				"query": text,
+				"path":  bson.A{"name", "author"},
+				"fuzzy": bson.M{"maxEdits": 2},
+			},
+		}}},
+		{{Key: "$match", Value: bson.M{"deleted_at": bson.M{"$exists": false}}}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$set", Value: bson.M{"score": bson.M{"$meta": "searchScore"}}}})
+
+	cursor, err := r.coll.Aggregate(ctx, pipeline)
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && slices.ContainsFunc(searchUnavailableCodes, serverErr.HasErrorCode) {
+		return nil, fmt.Errorf("%w: %v", errFuzzySearchUnavailable, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	hits := []SearchHit{}
+	if err = cursor.All(ctx, &hits); err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+// Compares strings ignoring case, but not accents.
+var suggestCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// Reads the books off the indexes of name and author, which share their
+// collation with the queries, and never more than limit from each. U+FFFF
+// sorts after every other character in this collation, which ends the
+// range of the prefix.
+func (r *mongoBookRepository) Suggest(ctx context.Context, prefix string, limit int) ([]BookStore, error) {
+	find := func(field string) ([]BookStore, error) {
+		filter := bson.M{
+			field:        bson.M{"$gte": prefix, "$lt": prefix + "\uffff"},
+			"deleted_at": bson.M{"$exists": false},
+		}
+		opts := options.Find().
+			SetCollation(suggestCollation).
+			SetSort(bson.D{{Key: field, Value: 1}}).
+			SetLimit(int64(limit))
+		cursor, err := r.coll.Find(ctx, filter, opts)
+		if err != nil {
+			return nil, err
+		}
+		var books []BookStore
+		err = cursor.All(ctx, &books)
+		return books, err
+	}
+
+	byName, err := find("name")
+	if err != nil {
+		return nil, err
+	}
+	byAuthor, err := find("author")
+	if err != nil {
+		return nil, err
+	}
+	return mergeSuggestions(byName, byAuthor, limit), nil
+}
+
+// Scores the books in an aggregation: only those sharing the author, a
+// genre or the time with the book get past the $match, which are then
+// scored like similarity does.
+func (r *mongoBookRepository) Similar(ctx context.Context, of BookStore, limit int) ([]SearchHit, error) {
+	genres := append([]string{}, of.Genres...)
+	sameAuthor := bson.M{"$eq": bson.A{bson.M{"$toLower": "$author"}, strings.ToLower(of.BookAuthor)}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"_id":        bson.M{"$ne": of.ID},
+			"deleted_at": bson.M{"$exists": false},
+			"$or": bson.A{
+				bson.M{"$expr": sameAuthor},
+				bson.M{"genres": bson.M{"$in": genres}},
+				bson.M{"year": bson.M{"$gt": of.BookYear - similarYearSpan, "$lt": of.BookYear + similarYearSpan}},
+			},
+		}}},
+		{{Key: "$addFields", Value: bson.M{"score": bson.M{"$add": bson.A{
+			bson.M{"$cond": bson.A{sameAuthor, sameAuthorScore, 0}},
+			bson.M{"$multiply": bson.A{
+				bson.M{"$size": bson.M{"$setIntersection": bson.A{bson.M{"$ifNull": bson.A{"$genres", bson.A{}}}, genres}}},
+				sharedGenreScore,
+			}},
+			bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{1, bson.M{"$divide": bson.A{
+				bson.M{"$abs": bson.M{"$subtract": bson.A{"$year", of.BookYear}}},
+				similarYearSpan,
+			}}}}}},
+		}}}}},
+		{{Key: "$match", Value: bson.M{"score": bson.M{"$gt": 0}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "score", Value: -1}, {Key: "name", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := r.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	hits := []SearchHit{}
+	if err = cursor.All(ctx, &hits); err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+// The decade of a book, like decadeOf: $mod keeps the sign of the year,
+// so it is made positive before it is taken off.
+var decadeExpr = bson.M{"$subtract": bson.A{"$year", bson.M{"$mod": bson.A{bson.M{"$add": bson.A{bson.M{"$mod": bson.A{"$year", 10}}, 10}}, 10}}}}
+
+// Computes all the figures in a single aggregation, with a $facet for
+// each of them.
+func (r *mongoBookRepository) Stats(ctx context.Context) (CatalogStats, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"deleted_at": bson.M{"$exists": false}}}},
+		{{Key: "$facet", Value: bson.M{
+			"totals": bson.A{
+				bson.M{"$group": bson.M{"_id": nil, "books": bson.M{"$sum": 1}, "average_pages": bson.M{"$avg": "$pages"}}},
+			},
+			"authors": bson.A{
+				bson.M{"$group": bson.M{"_id": "$author", "books": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.D{{Key: "books", Value: -1}, {Key: "_id", Value: 1}}},
+			},
+			"decades": bson.A{
+				bson.M{"$group": bson.M{"_id": decadeExpr, "books": bson.M{"$sum": 1}}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			},
+			"newest": bson.A{
+				bson.M{"$sort": bson.D{{Key: "year", Value: -1}, {Key: "name", Value: 1}}},
+				bson.M{"$limit": statsBookCount},
+			},
+			"oldest": bson.A{
+				bson.M{"$sort": bson.D{{Key: "year", Value: 1}, {Key: "name", Value: 1}}},
+				bson.M{"$limit": statsBookCount},
+			},
+		}}},
+	}
+	cursor, err := r.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return CatalogStats{}, err
+	}
+	var results []struct {
+		Totals []struct {
+			Books        int64   `bson:"books"`
+			AveragePages float64 `bson:"average_pages"`
+		} `bson:"totals"`
+		Authors []AuthorCount `bson:"authors"`
+		Decades []DecadeCount `bson:"decades"`
+		Newest  []BookStore   `bson:"newest"`
+		Oldest  []BookStore   `bson:"oldest"`
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return CatalogStats{}, err
+	}
+
+	// $facet always returns a single document
+	res := results[0]
+	stats := CatalogStats{
+		Authors: append([]AuthorCount{}, res.Authors...),
+		Decades: append([]DecadeCount{}, res.Decades...),
+		Newest:  res.Newest,
+		Oldest:  res.Oldest,
+	}
+	// Without books, there is nothing to group
+	if len(res.Totals) > 0 {
+		stats.Books, stats.AveragePages = res.Totals[0].Books, res.Totals[0].AveragePages
+	}
+	return stats, nil
+}
+
+// The books are sorted before they are grouped, so $push collects the
+// names in order.
+func (r *mongoBookRepository) GroupByAuthor(ctx context.Context) ([]AuthorBooks, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"deleted_at": bson.M{"$exists": false}}}},
+		{{Key: "$project", Value: bookProjection([]string{"name", "author"})}},
+		{{Key: "$sort", Value: bson.D{{Key: "name", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    "$author",
+			"books":  bson.M{"$sum": 1},
+			"titles": bson.M{"$push": "$name"},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cursor, err := r.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	groups := []AuthorBooks{}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// Buckets the books by decade, sorted like in GroupByAuthor.
+func (r *mongoBookRepository) GroupByDecade(ctx context.Context) ([]DecadeBooks, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"deleted_at": bson.M{"$exists": false}}}},
+		{{Key: "$project", Value: bookProjection([]string{"name", "year"})}},
+		{{Key: "$sort", Value: bson.D{{Key: "year", Value: 1}, {Key: "name", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    decadeExpr,
+			"books":  bson.M{"$sum": 1},
+			"titles": bson.M{"$push": "$name"},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cursor, err := r.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	groups := []DecadeBooks{}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// Selects the fields of the books, and their ID.
+func bookProjection(fields []string) bson.D {
+	projection := bson.D{}
+	for _, f := range fields {
+		projection = append(projection, bson.E{Key: f, Value: 1})
+	}
+	return projection
+}
+
+// Error code of a write violating a unique index.
+const duplicateKeyCode = 11000
+
+// Turns the duplicate key error of the unique ISBN index into a
+// *DuplicateBookError pointing at the book that is already stored.
+func (r *mongoBookRepository) duplicateError(ctx context.Context, b BookStore) error {
+	var existing BookStore
+	err := r.coll.FindOne(ctx, bson.M{"isbn": b.BookISBN}).Decode(&existing)
+	if err != nil {
+		return err
+	}
+	return &DuplicateBookError{ExistingID: existing.ID}
+}
+
+func (r *mongoBookRepository) Insert(ctx context.Context, b BookStore) (BookStore, error) {
+	b.Version = 1
+	b.CreatedAt = writeTime()
+	b.UpdatedAt = b.CreatedAt
+	result, err := r.coll.InsertOne(ctx, b)
+	if mongo.IsDuplicateKeyError(err) {
+		return b, r.duplicateError(ctx, b)
+	}
+	if err != nil {
+		return b, err
+	}
+	b.ID = result.InsertedID.(primitive.ObjectID)
+	return b, nil
+}
+
+// Inserts the books in a single unordered InsertMany, so one bad entry
+// does not stop the rest from being stored.
+func (r *mongoBookRepository) InsertMany(ctx context.Context, books []BookStore) ([]BulkResult, error) {
+	results := make([]BulkResult, len(books))
+	var docs []interface{}
+	var docIndex []int // position in books for every entry of docs
+	now := writeTime()
+	for i, book := range books {
+		results[i].Index = i
+
+		// Assigning the IDs ourselves tells us which ID belongs to which
+		// book, even if some of the inserts fail.
+		book.ID = primitive.NewObjectID()
+		book.Version = 1
+		book.CreatedAt = now
+		book.UpdatedAt = now
+		results[i].ID = book.ID.Hex()
+		docs = append(docs, book)
+		docIndex = append(docIndex, i)
+	}
+	if len(docs) == 0 {
+		return results, nil
+	}
+
+	_, err := r.coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		for _, writeErr := range bulkErr.WriteErrors {
+			res := &results[docIndex[writeErr.Index]]
+			res.ID = ""
+			res.Error = writeErr.Message
+			if writeErr.Code == duplicateKeyCode {
+				err := r.duplicateError(ctx, books[docIndex[writeErr.Index]])
+				res.Error = err.Error()
+				var dupErr *DuplicateBookError
+				if errors.As(err, &dupErr) {
+					res.ExistingID = dupErr.ExistingID.Hex()
+				}
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Applies the update to the book with the given ID and returns the book as
+// it looks afterwards. The fields in unset are removed from the book. A
+// non-zero version restricts the update to the book at that version.
+func (r *mongoBookRepository) updateOne(ctx context.Context, id primitive.ObjectID, version int64, set bson.M, unset bson.M) (BookStore, error) {
+	var updated BookStore
+	filter := liveBook(id)
+	if version != 0 {
+		filter["version"] = version
+	}
+	set["updated_at"] = writeTime()
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	// MongoDB rejects empty operators
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After) // Return the updated document
+	err := r.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return updated, r.missingOrConflict(ctx, id)
+	}
+	if newISBN, ok := set["isbn"].(string); ok && mongo.IsDuplicateKeyError(err) {
+		return updated, r.duplicateError(ctx, BookStore{BookISBN: newISBN})
+	}
+	return updated, err
+}
+
+func (r *mongoBookRepository) Update(ctx context.Context, b BookStore) (BookStore, error) {
+	set := bson.M{"name": b.BookName,
+		"author": b.BookAuthor,
+		"year":   b.BookYear,
+		"isbn":   b.BookISBN,
+		"pages":  b.BookPages,
+	}
+	unset := bson.M{}
+	if b.AuthorID.IsZero() {
+		unset["author_id"] = ""
+	} else {
+		set["author_id"] = b.AuthorID
+	}
+	if len(b.Genres) == 0 {
+		unset["genres"] = ""
+	} else {
+		set["genres"] = b.Genres
+	}
+	return r.updateOne(ctx, b.ID, b.Version, set, unset)
+}
+
+// Tells why an update matched no book: either there is none with the ID,
+// or it has another version than expected.
+func (r *mongoBookRepository) missingOrConflict(ctx context.Context, id primitive.ObjectID) error {
+	_, err := r.FindByID(ctx, id)
+	if err == nil {
+		return ErrVersionConflict
+	}
+	return err
+}
+
+// Builds the $set document only from the fields that were sent.
+func (r *mongoBookRepository) Restore(ctx context.Context, b BookStore) (bool, error) {
+	completeRestoredBook(&b)
+	opts := options.Replace().SetUpsert(true)
+	result, err := r.coll.ReplaceOne(ctx, bson.M{"_id": b.ID}, b, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, r.duplicateError(ctx, b)
+	}
+	if err != nil {
+		return false, err
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+func (r *mongoBookRepository) Patch(ctx context.Context, id primitive.ObjectID, p BookPatch) (BookStore, error) {
+	set := bson.M{}
+	if p.BookName != nil {
+		set["name"] = *p.BookName
+	}
+	if p.BookAuthor != nil {
+		set["author"] = *p.BookAuthor
+	}
+	if p.BookISBN != nil {
+		set["isbn"] = *p.BookISBN
+	}
+	if p.BookPages != nil {
+		set["pages"] = *p.BookPages
+	}
+	if p.BookYear != nil {
+		set["year"] = *p.BookYear
+	}
+	unset := bson.M{}
+	if p.AuthorID != nil && p.AuthorID.IsZero() {
+		unset["author_id"] = ""
+	} else if p.AuthorID != nil {
+		set["author_id"] = *p.AuthorID
+	}
+	if p.Genres != nil && len(*p.Genres) == 0 {
+		unset["genres"] = ""
+	} else if p.Genres != nil {
+		set["genres"] = *p.Genres
+	}
+	var version int64
+	if p.Version != nil {
+		version = *p.Version
+	}
+	return r.updateOne(ctx, id, version, set, unset)
+}
+
+// Runs an update that only applies to some books, like adding a genre
+// the book does not have yet. If the filter rules the book out, the book
+// is returned unchanged.
+func (r *mongoBookRepository) updateIf(ctx context.Context, filter bson.M, update bson.M) (BookStore, error) {
+	var updated BookStore
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := r.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return r.FindByID(ctx, filter["_id"].(primitive.ObjectID))
+	}
+	return updated, err
+}
+
+// Keeps the genres sorted, like normalizeBook does.
+func (r *mongoBookRepository) AddGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error) {
+	return r.updateIf(ctx,
+		bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}, "genres": bson.M{"$ne": genre}},
+		bson.M{
+			"$push": bson.M{"genres": bson.M{"$each": bson.A{genre}, "$sort": 1}},
+			"$inc":  bson.M{"version": 1},
+			"$set":  bson.M{"updated_at": writeTime()},
+		})
+}
+
+func (r *mongoBookRepository) RemoveGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error) {
+	return r.updateIf(ctx,
+		bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}, "genres": genre},
+		bson.M{
+			"$pull": bson.M{"genres": genre},
+			"$inc":  bson.M{"version": 1},
+			"$set":  bson.M{"updated_at": writeTime()},
+		})
+}
+
+func (r *mongoBookRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.coll.UpdateOne(ctx, liveBook(id), trashUpdate(writeTime()))
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrBookNotFound
+	}
+	return nil
+}
+
+func (r *mongoBookRepository) RenameAuthor(ctx context.Context, authorID primitive.ObjectID, name string) (int64, error) {
+	res, err := r.coll.UpdateMany(ctx,
+		bson.M{"author_id": authorID, "author": bson.M{"$ne": name}},
+		bson.M{"$set": bson.M{"author": name, "updated_at": writeTime()}, "$inc": bson.M{"version": 1}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (r *mongoBookRepository) DeleteMany(ctx context.Context, q BookQuery) (int64, error) {
+	q.Trash = false
+	res, err := r.coll.UpdateMany(ctx, bookFilter(q), trashUpdate(writeTime()))
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// Moves the books an update applies to to the trash.
+func trashUpdate(at time.Time) bson.M {
+	return bson.M{
+		"$set": bson.M{"deleted_at": at, "updated_at": at},
+		"$inc": bson.M{"version": 1},
+	}
+}
+
+func (r *mongoBookRepository) Undelete(ctx context.Context, id primitive.ObjectID) (BookStore, error) {
+	var restored BookStore
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := r.coll.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "deleted_at": bson.M{"$exists": true}},
+		bson.M{
+			"$unset": bson.M{"deleted_at": ""},
+			"$set":   bson.M{"updated_at": writeTime()},
+			"$inc":   bson.M{"version": 1},
+		}, opts).Decode(&restored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return restored, ErrBookNotFound
+	}
+	return restored, err
+}
+
+// Looks up the IDs first, as DeleteMany does not report which documents
+// it removed. A book undeleted in between is still only removed if it is
+// in the trash.
+func (r *mongoBookRepository) Purge(ctx context.Context, before time.Time) ([]primitive.ObjectID, error) {
+	filter := bson.M{"deleted_at": bson.M{"$lt": before}}
+	cursor, err := r.coll.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err = cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	var ids []primitive.ObjectID
+	for _, d := range docs {
+		ids = append(ids, d.ID)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	filter["_id"] = bson.M{"$in": ids}
+	if _, err = r.coll.DeleteMany(ctx, filter); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Reports every change to the books through a change stream, including the
+// changes of other instances and those made directly in the database.
+// Change streams need a replica set; on a standalone server opening the
+// stream fails right away. Once open, the stream runs until ctx is done
+// and picks up where it left off after errors.
+func (r *mongoBookRepository) WatchChanges(ctx context.Context, publish func(BookEventType, BookStore)) error {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	stream, err := r.coll.Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			for stream.Next(ctx) {
+				if e, ok := decodeBookChange(stream); ok {
+					publish(e.Type, e.Book)
+				}
+			}
+			err := stream.Err()
+			token := stream.ResumeToken()
+			stream.Close(context.Background())
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("The change stream of the books ended, resuming: %v", err)
+
+			// StartAfter, unlike ResumeAfter, also continues after the
+			// collection was dropped
+			if token != nil {
+				opts.SetStartAfter(token)
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				if stream, err = r.coll.Watch(ctx, mongo.Pipeline{}, opts); err == nil {
+					break
+				}
+				log.Printf("Failed to resume the change stream of the books: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Turns the current change of the stream into an event, if it is one to
+// report.
+func decodeBookChange(stream *mongo.ChangeStream) (BookEvent, bool) {
+	var change struct {
+		OperationType string              `bson:"operationType"`
+		ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+		DocumentKey   struct {
+			ID primitive.ObjectID `bson:"_id"`
+		} `bson:"documentKey"`
+		FullDocument      *BookStore `bson:"fullDocument"`
+		UpdateDescription struct {
+			UpdatedFields bson.M   `bson:"updatedFields"`
+			RemovedFields []string `bson:"removedFields"`
+		} `bson:"updateDescription"`
+	}
+	if err := stream.Decode(&change); err != nil {
+		log.Printf("Skipping undecodable change to the books: %v", err)
+		return BookEvent{}, false
+	}
+	e := BookEvent{At: time.Unix(int64(change.ClusterTime.T), 0).UTC()}
+	switch change.OperationType {
+	case "insert":
+		e.Type, e.Book = BookCreated, *change.FullDocument
+	case "update", "replace":
+		// The book may have been deleted before it was looked up
+		if change.FullDocument == nil {
+			return BookEvent{}, false
+		}
+		switch _, trashed := change.UpdateDescription.UpdatedFields["deleted_at"]; {
+		case trashed:
+			e.Type, e.Book = BookDeleted, BookStore{ID: change.DocumentKey.ID}
+		case slices.Contains(change.UpdateDescription.RemovedFields, "deleted_at"):
+			e.Type, e.Book = BookCreated, *change.FullDocument
+		case change.FullDocument.DeletedAt == nil:
+			e.Type, e.Book = BookUpdated, *change.FullDocument
+		default:
+			return BookEvent{}, false
+		}
+	default:
+		// Deletions are not reported, as books are only removed for good
+		// when purged from the trash, long after moving there was
+		// reported
+		return BookEvent{}, false
+	}
+	return e, true
+}
+
+// The errors of change streams that cannot resume where they left off,
+// as the oplog moved on past the token: ChangeStreamHistoryLost and
+// ChangeStreamFatalError.
+var changesLostCodes = []int{286, 280}
+
+// Opens the change stream of the books after the token, or from now on
+// if it is nil. Like WatchChanges, it needs a replica set.
+func (r *mongoBookRepository) OpenChanges(ctx context.Context, token bson.Raw) (bookChangeCursor, error) {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if token != nil {
+		opts.SetStartAfter(token)
+	}
+	stream, err := r.coll.Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		return nil, changesError(err)
+	}
+	return &mongoChangeCursor{stream: stream}, nil
+}
+
+func changesError(err error) error {
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && slices.ContainsFunc(changesLostCodes, serverErr.HasErrorCode) {
+		return fmt.Errorf("%w: %v", errChangesLost, err)
+	}
+	return err
+}
+
+type mongoChangeCursor struct {
+	stream *mongo.ChangeStream
+}
+
+// Waits up to wait for changes, each poll waiting as long as the server
+// lets a getMore wait, and takes up to max of them.
+func (c *mongoChangeCursor) Next(ctx context.Context, wait time.Duration, max int) ([]BookEvent, bson.Raw, error) {
+	deadline := time.Now().Add(wait)
+	var events []BookEvent
+	seen := 0
+	for seen < max {
+		if !c.stream.TryNext(ctx) {
+			if err := c.stream.Err(); err != nil {
+				return nil, nil, changesError(err)
+			}
+			if seen > 0 || time.Now().After(deadline) {
+				break
+			}
+			continue
+		}
+		seen++
+		if e, ok := decodeBookChange(c.stream); ok {
+			events = append(events, e)
+		}
+	}
+	return events, c.stream.ResumeToken(), nil
+}
+
+func (c *mongoChangeCursor) Close(ctx context.Context) error {
+	return c.stream.Close(ctx)
+}
+
+// The sync worker's progress, kept next to the books: who holds the
+// worker, until when, and the token of the last change it synced.
+type mongoSyncState struct {
+	ID     string    `bson:"_id"`
+	Worker string    `bson:"worker"`
+	Until  time.Time `bson:"until"`
+	Token  bson.Raw  `bson:"token,omitempty"`
+}
+
+func (r *mongoBookRepository) syncState() *mongo.Collection {
+	return r.coll.Database().Collection("sync_state")
+}
+
+func (r *mongoBookRepository) LeaseSync(ctx context.Context, worker string, until time.Time) (bool, bson.Raw, error) {
+	var state mongoSyncState
+	err := r.syncState().FindOneAndUpdate(ctx,
+		bson.M{"_id": r.coll.Name(), "$or": bson.A{
+			bson.M{"worker": worker},
+			bson.M{"until": bson.M{"$lt": time.Now()}},
+		}},
+		bson.M{"$set": bson.M{"worker": worker, "until": until}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&state)
+	// Another worker holds it, so the upsert ran into the existing
+	// document
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	return true, state.Token, nil
+}
+
+func (r *mongoBookRepository) SaveSyncToken(ctx context.Context, worker string, token bson.Raw) error {
+	res, err := r.syncState().UpdateOne(ctx,
+		bson.M{"_id": r.coll.Name(), "worker": worker},
+		bson.M{"$set": bson.M{"token": token}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errSyncLeaseLost
+	}
+	return nil
+}
@@ -0,0 +1,1066 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Schema changes for the SQL backends, in the order they have to be applied.
+// Never edit a migration that has been released; append a new one instead.
+// IDs are the hex form of an ObjectID, so books keep the same kind of ID no
+// matter where they are stored.
+var sqlMigrations = []string{
+	`CREATE TABLE books (
+		id     TEXT PRIMARY KEY,
+		name   TEXT NOT NULL,
+		author TEXT NOT NULL,
+		isbn   TEXT NOT NULL DEFAULT '',
+		pages  INTEGER NOT NULL,
+		year   INTEGER NOT NULL
+	)`,
+	`CREATE INDEX books_author ON books (author)`,
+	`CREATE INDEX books_year ON books (year)`,
+	`CREATE UNIQUE INDEX books_isbn ON books (isbn) WHERE isbn <> ''`,
+	`CREATE TABLE users (
+		id            TEXT PRIMARY KEY,
+		username      TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		created_at    TIMESTAMP NOT NULL
+	)`,
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'reader'`,
+	`CREATE TABLE api_keys (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		prefix     TEXT NOT NULL,
+		hash       TEXT NOT NULL UNIQUE,
+		scopes     TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP
+	)`,
+	`ALTER TABLE users ADD COLUMN provider TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN external_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE UNIQUE INDEX users_identity ON users (provider, external_id) WHERE provider <> ''`,
+	`CREATE TABLE sessions (
+		hash       TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE authors (
+		id          TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		birth_year  INTEGER,
+		nationality TEXT NOT NULL DEFAULT '',
+		bio         TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX authors_name ON authors (name)`,
+	`ALTER TABLE books ADD COLUMN author_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX books_author_id ON books (author_id)`,
+	`CREATE TABLE genres (
+		name        TEXT PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT ''
+	)`,
+	`ALTER TABLE books ADD COLUMN genres TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE copies (
+		id        TEXT PRIMARY KEY,
+		book_id   TEXT NOT NULL,
+		condition TEXT NOT NULL,
+		location  TEXT NOT NULL DEFAULT '',
+		available BOOLEAN NOT NULL,
+		added_at  TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX copies_book_id ON copies (book_id)`,
+	`CREATE TABLE loans (
+		id          TEXT PRIMARY KEY,
+		copy_id     TEXT NOT NULL,
+		book_id     TEXT NOT NULL,
+		user_id     TEXT NOT NULL,
+		loaned_at   TIMESTAMP NOT NULL,
+		due_at      TIMESTAMP NOT NULL,
+		returned_at TIMESTAMP
+	)`,
+	`CREATE INDEX loans_user_id ON loans (user_id)`,
+	`CREATE INDEX loans_copy_id ON loans (copy_id)`,
+	`CREATE INDEX loans_due_at ON loans (due_at)`,
+	`CREATE TABLE reservations (
+		id         TEXT PRIMARY KEY,
+		book_id    TEXT NOT NULL,
+		user_id    TEXT NOT NULL,
+		status     TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		copy_id    TEXT NOT NULL DEFAULT '',
+		ready_at   TIMESTAMP
+	)`,
+	`CREATE INDEX reservations_book_id ON reservations (book_id, created_at)`,
+	`CREATE INDEX reservations_user_id ON reservations (user_id)`,
+	`CREATE TABLE webhooks (
+		id         TEXT PRIMARY KEY,
+		url        TEXT NOT NULL,
+		secret     TEXT NOT NULL,
+		events     TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE webhook_deliveries (
+		id            TEXT PRIMARY KEY,
+		webhook_id    TEXT NOT NULL,
+		delivery_id   TEXT NOT NULL,
+		event         TEXT NOT NULL,
+		book_id       TEXT NOT NULL,
+		attempt       INTEGER NOT NULL,
+		status_code   INTEGER NOT NULL DEFAULT 0,
+		error         TEXT NOT NULL DEFAULT '',
+		response      TEXT NOT NULL DEFAULT '',
+		duration_ms   INTEGER NOT NULL,
+		sent_at       TIMESTAMP NOT NULL,
+		next_retry_at TIMESTAMP
+	)`,
+	`CREATE INDEX webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, sent_at)`,
+	`CREATE INDEX webhook_deliveries_sent_at ON webhook_deliveries (sent_at)`,
+	`ALTER TABLE books ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+	// Filled in by backfillSQLTimestamps for books stored before
+	`ALTER TABLE books ADD COLUMN created_at TIMESTAMP`,
+	`ALTER TABLE books ADD COLUMN updated_at TIMESTAMP`,
+	`CREATE INDEX books_created_at ON books (created_at)`,
+	`CREATE INDEX books_updated_at ON books (updated_at)`,
+	`ALTER TABLE books ADD COLUMN deleted_at TIMESTAMP`,
+	`CREATE INDEX books_deleted_at ON books (deleted_at)`,
+	`CREATE TABLE audit_log (
+		id         TEXT PRIMARY KEY,
+		at         TIMESTAMP NOT NULL,
+		action     TEXT NOT NULL,
+		book_id    TEXT NOT NULL,
+		user_id    TEXT NOT NULL DEFAULT '',
+		username   TEXT NOT NULL DEFAULT '',
+		api_key_id TEXT NOT NULL DEFAULT '',
+		before_doc TEXT NOT NULL DEFAULT '',
+		after_doc  TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX audit_log_at ON audit_log (at)`,
+	`CREATE INDEX audit_log_book_id ON audit_log (book_id, at)`,
+	`CREATE INDEX audit_log_user_id ON audit_log (user_id, at)`,
+	`CREATE INDEX books_name_lower ON books (LOWER(name))`,
+	`CREATE INDEX books_author_lower ON books (LOWER(author))`,
+	`CREATE TABLE tenants (
+		slug       TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE shelves (
+		id          TEXT PRIMARY KEY,
+		user_id     TEXT NOT NULL,
+		name        TEXT NOT NULL,
+		book_ids    TEXT NOT NULL DEFAULT '',
+		share_token TEXT NOT NULL DEFAULT '',
+		created_at  TIMESTAMP NOT NULL,
+		updated_at  TIMESTAMP NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX shelves_user_id_name ON shelves (user_id, name)`,
+	`CREATE UNIQUE INDEX shelves_share_token ON shelves (share_token) WHERE share_token <> ''`,
+	`CREATE TABLE reading_progress (
+		user_id     TEXT NOT NULL,
+		book_id     TEXT NOT NULL,
+		page        INTEGER NOT NULL,
+		percent     DOUBLE PRECISION NOT NULL,
+		started_at  TIMESTAMP NOT NULL,
+		updated_at  TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP,
+		PRIMARY KEY (user_id, book_id)
+	)`,
+	`ALTER TABLE audit_log ADD COLUMN merged_into TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN email_opt_out BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN language TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN page_size INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN muted_emails TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN totp_step BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE login_failures (
+		id           TEXT PRIMARY KEY,
+		failures     INTEGER NOT NULL,
+		locked_until TIMESTAMP,
+		expires_at   TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE saved_searches (
+		id         TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		query      TEXT NOT NULL,
+		sort       TEXT NOT NULL DEFAULT '',
+		sort_order TEXT NOT NULL DEFAULT '',
+		notify     BOOLEAN NOT NULL DEFAULT FALSE,
+		checked_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX saved_searches_user_id_name ON saved_searches (user_id, name)`,
+}
+
+// Records the versions of the applied migrations.
+const createSchemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`
+
+// Applies every migration that has not been applied yet. The version of
+// each applied migration is recorded in schema_migrations, so running this
+// on every start is cheap.
+func migrateSQL(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, createSchemaMigrations)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(sqlMigrations); i++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, sqlMigrations[i]); err == nil {
+			_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d (%s)", i+1, sqlMigrationName(sqlMigrations[i]))
+	}
+	return nil
+}
+
+// Rewrites every ISBN that is not yet in its canonical form, the same as
+// normalizeStoredISBNs does for MongoDB. ISBNs that cannot be normalized,
+// or would then collide with another book, are left as they are.
+func normalizeSQLISBNs(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT id, isbn FROM books WHERE isbn <> ''")
+	if err != nil {
+		return err
+	}
+	stale := map[string]string{}
+	for rows.Next() {
+		var id, stored string
+		if err := rows.Scan(&id, &stored); err != nil {
+			rows.Close()
+			return err
+		}
+		if canonical, err := isbn.Normalize(stored); err == nil && canonical != stored {
+			stale[id] = canonical
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, canonical := range stale {
+		_, err := db.ExecContext(ctx, "UPDATE books SET isbn = $1 WHERE id = $2", canonical, id)
+		if err != nil && !isUniqueViolation(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stamps the books stored before they had timestamps with the time their
+// ID was made, like prepareDatabase does for MongoDB.
+func backfillSQLTimestamps(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM books WHERE created_at IS NULL")
+	if err != nil {
+		return err
+	}
+	var ids []primitive.ObjectID
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+			ids = append(ids, objID)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		created := id.Timestamp().UTC()
+		_, err := db.ExecContext(ctx, "UPDATE books SET created_at = $1, updated_at = $1 WHERE id = $2", created, id.Hex())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stores the books in a relational database through database/sql.
+type sqlBookRepository struct {
+	db *sql.DB
+}
+
+func newSQLBookRepository(db *sql.DB) *sqlBookRepository {
+	return &sqlBookRepository{db: db}
+}
+
+// The genres of a book are kept as a comma separated list, like the scopes
+// of an API key; genre names never contain commas.
+const bookColumns = "id, name, author, isbn, pages, year, author_id, genres, version, created_at, updated_at, deleted_at"
+
+// What the columns a query does not need are selected as instead, see
+// BookQuery.Fields. The ID and the timestamps are always selected, as not
+// every database scans a plain literal into a time.
+var sqlEmptyColumns = map[string]string{
+	"name": "''", "author": "''", "isbn": "''", "pages": "0", "year": "0",
+	"author_id": "''", "genres": "''", "version": "0",
+}
+
+// The columns of bookColumns for the fields of the query. The columns it
+// sorts by are kept as well, as ORDER BY would sort by a literal of the
+// same name otherwise.
+func sqlBookColumns(q BookQuery) string {
+	if q.Fields == nil {
+		return bookColumns
+	}
+	var columns []string
+	for _, column := range strings.Split(bookColumns, ", ") {
+		sorted := slices.ContainsFunc(q.Sort, func(f SortField) bool { return f.Field == column })
+		if empty, ok := sqlEmptyColumns[column]; ok && !sorted && !slices.Contains(q.Fields, column) {
+			column = empty + " AS " + column
+		}
+		columns = append(columns, column)
+	}
+	return strings.Join(columns, ", ")
+}
+
+func splitGenres(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// References that may be missing, like the author of a book, are stored as
+// an empty string instead of NULL.
+func optionalHex(id primitive.ObjectID) string {
+	if id.IsZero() {
+		return ""
+	}
+	return id.Hex()
+}
+
+func parseOptionalHex(s string) (primitive.ObjectID, error) {
+	if s == "" {
+		return primitive.NilObjectID, nil
+	}
+	return primitive.ObjectIDFromHex(s)
+}
+
+// Collects the arguments of a statement while it is being built. add
+// returns the placeholder to put into the SQL text.
+type sqlArgs []interface{}
+
+func (a *sqlArgs) add(v interface{}) string {
+	*a = append(*a, v)
+	return fmt.Sprintf("$%d", len(*a))
+}
+
+// Returns the placeholders for a list of IDs, e.g. for an IN condition.
+func idList(ids []primitive.ObjectID, args *sqlArgs) string {
+	var placeholders []string
+	for _, id := range ids {
+		placeholders = append(placeholders, args.add(id.Hex()))
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+// Escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Mirrors bookFilter of the Mongo repository.
+func sqlWhere(q BookQuery, args *sqlArgs) string {
+	conds := []string{"deleted_at IS NULL"}
+	if q.Trash {
+		conds[0] = "deleted_at IS NOT NULL"
+	}
+	if q.Name != "" {
+		pattern := "%" + escapeLike(strings.ToLower(q.Name)) + "%"
+		conds = append(conds, "LOWER(name) LIKE "+args.add(pattern)+` ESCAPE '\'`)
+	}
+	if q.Author != "" {
+		pattern := "%" + escapeLike(strings.ToLower(q.Author)) + "%"
+		conds = append(conds, "LOWER(author) LIKE "+args.add(pattern)+` ESCAPE '\'`)
+	}
+	if !q.AuthorID.IsZero() {
+		conds = append(conds, "author_id = "+args.add(q.AuthorID.Hex()))
+	}
+	if q.ISBN != "" {
+		conds = append(conds, "isbn = "+args.add(q.ISBN))
+	}
+	if q.Genre != "" {
+		conds = append(conds, "',' || genres || ',' LIKE "+args.add("%,"+escapeLike(q.Genre)+",%")+` ESCAPE '\'`)
+	}
+	if q.YearMin != nil {
+		conds = append(conds, "year >= "+args.add(*q.YearMin))
+	}
+	if q.YearMax != nil {
+		conds = append(conds, "year <= "+args.add(*q.YearMax))
+	}
+	if q.PagesMin != nil {
+		conds = append(conds, "pages >= "+args.add(*q.PagesMin))
+	}
+	if q.PagesMax != nil {
+		conds = append(conds, "pages <= "+args.add(*q.PagesMax))
+	}
+	if q.CreatedSince != nil {
+		conds = append(conds, "created_at >= "+args.add(q.CreatedSince.UTC()))
+	}
+	if q.CreatedBefore != nil {
+		conds = append(conds, "created_at < "+args.add(q.CreatedBefore.UTC()))
+	}
+	if q.UpdatedSince != nil {
+		conds = append(conds, "updated_at >= "+args.add(q.UpdatedSince.UTC()))
+	}
+	if q.UpdatedBefore != nil {
+		conds = append(conds, "updated_at < "+args.add(q.UpdatedBefore.UTC()))
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// The sort fields double as column names; parseSort makes sure only those
+// ever reach this point.
+func sqlOrderBy(sort []SortField) string {
+	if len(sort) == 0 {
+		return ""
+	}
+	var keys []string
+	for _, f := range sort {
+		if f.Desc {
+			keys = append(keys, f.Field+" DESC")
+		} else {
+			keys = append(keys, f.Field+" ASC")
+		}
+	}
+	return " ORDER BY " + strings.Join(keys, ", ") + ", id ASC"
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Reads the columns of bookColumns, followed by the extra destinations.
+func scanBook(row rowScanner, extra ...interface{}) (BookStore, error) {
+	var b BookStore
+	var id, authorID, genres string
+	var deletedAt sql.NullTime
+	dest := append([]interface{}{&id, &b.BookName, &b.BookAuthor, &b.BookISBN, &b.BookPages, &b.BookYear, &authorID, &genres,
+		&b.Version, &b.CreatedAt, &b.UpdatedAt, &deletedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return b, err
+	}
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return b, err
+	}
+	b.ID = objID
+	b.CreatedAt, b.UpdatedAt = b.CreatedAt.UTC(), b.UpdatedAt.UTC()
+	if deletedAt.Valid {
+		t := deletedAt.Time.UTC()
+		b.DeletedAt = &t
+	}
+	b.Genres = splitGenres(genres)
+	b.AuthorID, err = parseOptionalHex(authorID)
+	return b, err
+}
+
+func (r *sqlBookRepository) FindAll(ctx context.Context, q BookQuery) ([]BookStore, int64, error) {
+	total, err := r.Count(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	results, err := r.find(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	return results, total, nil
+}
+
+// Reads an unpaginated listing a batch at a time, and closes the rows
+// before fn gets the books of a batch: fn may take long, e.g. writing to a
+// slow client, and with SQLite an open query holds the only connection.
+func (r *sqlBookRepository) Each(ctx context.Context, q BookQuery, fn func(BookStore) error) error {
+	if q.Limit > 0 {
+		books, err := r.find(ctx, q)
+		if err != nil {
+			return err
+		}
+		return eachOf(books, fn)
+	}
+
+	q.Limit = exportBatchSize
+	if len(q.Sort) == 0 {
+		// Batches of an unsorted query could overlap
+		q.Sort = []SortField{{Field: "id"}}
+	}
+	for q.Page = 1; ; q.Page++ {
+		books, err := r.find(ctx, q)
+		if err != nil {
+			return err
+		}
+		if err := eachOf(books, fn); err != nil {
+			return err
+		}
+		if len(books) < q.Limit {
+			return nil
+		}
+	}
+}
+
+// Runs the query, without counting the matches.
+func (r *sqlBookRepository) find(ctx context.Context, q BookQuery) ([]BookStore, error) {
+	var args sqlArgs
+	query := "SELECT " + sqlBookColumns(q) + " FROM books" + sqlWhere(q, &args) + sqlOrderBy(q.Sort)
+	if q.Limit > 0 {
+		query += " LIMIT " + args.add(q.Limit) + " OFFSET " + args.add(q.Skip())
+	}
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []BookStore{}
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, b)
+	}
+	return results, rows.Err()
+}
+
+func (r *sqlBookRepository) FindByID(ctx context.Context, id primitive.ObjectID) (BookStore, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT "+bookColumns+" FROM books WHERE id = $1 AND deleted_at IS NULL", id.Hex())
+	b, err := scanBook(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return b, ErrBookNotFound
+	}
+	return b, err
+}
+
+func (r *sqlBookRepository) Count(ctx context.Context, q BookQuery) (int64, error) {
+	var args sqlArgs
+	var count int64
+	err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM books"+sqlWhere(q, &args), args...).Scan(&count)
+	return count, err
+}
+
+// Computes the figures with a query for each. The decade is rounded down
+// for the years BC as well, as % keeps the sign of the year.
+func (r *sqlBookRepository) Stats(ctx context.Context) (CatalogStats, error) {
+	stats := CatalogStats{Authors: []AuthorCount{}, Decades: []DecadeCount{}}
+	err := r.db.QueryRowContext(ctx,
+		"SELECT COUNT(*), CAST(COALESCE(AVG(pages), 0) AS DOUBLE PRECISION) FROM books WHERE deleted_at IS NULL",
+	).Scan(&stats.Books, &stats.AveragePages)
+	if err != nil {
+		return stats, err
+	}
+
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT author, COUNT(*) FROM books WHERE deleted_at IS NULL GROUP BY author ORDER BY COUNT(*) DESC, author")
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a AuthorCount
+		if err := rows.Scan(&a.Author, &a.Books); err != nil {
+			return stats, err
+		}
+		stats.Authors = append(stats.Authors, a)
+	}
+	if err = rows.Err(); err != nil {
+		return stats, err
+	}
+
+	rows, err = r.db.QueryContext(ctx,
+		"SELECT year - (year % 10 + 10) % 10 AS decade, COUNT(*) FROM books WHERE deleted_at IS NULL GROUP BY decade ORDER BY decade")
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DecadeCount
+		if err := rows.Scan(&d.Decade, &d.Books); err != nil {
+			return stats, err
+		}
+		stats.Decades = append(stats.Decades, d)
+	}
+	if err = rows.Err(); err != nil {
+		return stats, err
+	}
+
+	stats.Newest, _, err = r.FindAll(ctx, BookQuery{Sort: newestFirst, Limit: statsBookCount})
+	if err != nil {
+		return stats, err
+	}
+	stats.Oldest, _, err = r.FindAll(ctx, BookQuery{Sort: oldestFirst, Limit: statsBookCount})
+	return stats, err
+}
+
+// Collecting the names takes string_agg in PostgreSQL but group_concat in
+// SQLite, so the books are grouped as they come in, sorted by author.
+func (r *sqlBookRepository) GroupByAuthor(ctx context.Context) ([]AuthorBooks, error) {
+	books, err := r.find(ctx, BookQuery{Sort: byAuthor, Fields: []string{"name", "author"}})
+	if err != nil {
+		return nil, err
+	}
+	return groupByAuthor(books), nil
+}
+
+// Grouped as they come in, like GroupByAuthor.
+func (r *sqlBookRepository) GroupByDecade(ctx context.Context) ([]DecadeBooks, error) {
+	books, err := r.find(ctx, BookQuery{Sort: byYear, Fields: []string{"name", "year"}})
+	if err != nil {
+		return nil, err
+	}
+	return groupByDecade(books), nil
+}
+
+// Scores the books in the query, like similarity does: the genres of the
+// book are each looked for in the list of the other book.
+func (r *sqlBookRepository) Similar(ctx context.Context, of BookStore, limit int) ([]SearchHit, error) {
+	var args sqlArgs
+	terms := []string{
+		"CASE WHEN LOWER(author) = " + args.add(strings.ToLower(of.BookAuthor)) + fmt.Sprintf(" THEN %d ELSE 0 END", sameAuthorScore),
+		fmt.Sprintf("CASE WHEN ABS(year - %s) < %d THEN 1 - CAST(ABS(year - %s) AS DOUBLE PRECISION) / %d ELSE 0 END",
+			args.add(of.BookYear), similarYearSpan, args.add(of.BookYear), similarYearSpan),
+	}
+	for _, g := range of.Genres {
+		pattern := args.add("%," + escapeLike(g) + ",%")
+		terms = append(terms, "CASE WHEN ',' || genres || ',' LIKE "+pattern+` ESCAPE '\' `+fmt.Sprintf("THEN %d ELSE 0 END", sharedGenreScore))
+	}
+	scored := "SELECT " + bookColumns + ", " + strings.Join(terms, " + ") + " AS score FROM books" +
+		" WHERE deleted_at IS NULL AND id <> " + args.add(of.ID.Hex())
+	query := "SELECT " + bookColumns + ", score FROM (" + scored + ") AS scored" +
+		" WHERE score > 0 ORDER BY score DESC, name LIMIT " + args.add(limit)
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := []SearchHit{}
+	for rows.Next() {
+		var score float64
+		b, err := scanBook(rows, &score)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, SearchHit{BookStore: b, Score: score})
+	}
+	return hits, rows.Err()
+}
+
+// Searches all books and leaves the rest to facetHits.
+func (r *sqlBookRepository) FacetedSearch(ctx context.Context, text string, f SearchFilter, limit int) (SearchResult, error) {
+	hits, err := r.Search(ctx, text, 0)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	return facetHits(hits, f, limit), nil
+}
+
+// Reads the books off the indexes of LOWER(name) and LOWER(author). The
+// range of the prefix ends where the code points do, which is how SQLite
+// compares strings.
+func (r *sqlBookRepository) Suggest(ctx context.Context, prefix string, limit int) ([]BookStore, error) {
+	prefix = strings.ToLower(prefix)
+	find := func(column string) ([]BookStore, error) {
+		var args sqlArgs
+		expr := "LOWER(" + column + ")"
+		query := "SELECT " + bookColumns + " FROM books WHERE deleted_at IS NULL" +
+			" AND " + expr + " >= " + args.add(prefix) + " AND " + expr + " < " + args.add(prefixEnd(prefix)) +
+			" ORDER BY " + expr + " LIMIT " + args.add(limit)
+		rows, err := r.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var books []BookStore
+		for rows.Next() {
+			b, err := scanBook(rows)
+			if err != nil {
+				return nil, err
+			}
+			books = append(books, b)
+		}
+		return books, rows.Err()
+	}
+
+	byName, err := find("name")
+	if err != nil {
+		return nil, err
+	}
+	byAuthor, err := find("author")
+	if err != nil {
+		return nil, err
+	}
+	return mergeSuggestions(byName, byAuthor, limit), nil
+}
+
+// Scores books like the in-memory repository does: one point for every
+// search term found in the name, author or ISBN.
+func (r *sqlBookRepository) Search(ctx context.Context, text string, limit int) ([]SearchHit, error) {
+	terms := strings.Fields(strings.ToLower(text))
+	if len(terms) == 0 {
+		return []SearchHit{}, nil
+	}
+
+	var args sqlArgs
+	var parts []string
+	for _, term := range terms {
+		pattern := "%" + escapeLike(term) + "%"
+		parts = append(parts, "CASE WHEN LOWER(name || ' ' || author || ' ' || isbn) LIKE "+args.add(pattern)+` ESCAPE '\' THEN 1 ELSE 0 END`)
+	}
+	score := strings.Join(parts, " + ")
+	query := "SELECT " + bookColumns + ", score FROM (SELECT " + bookColumns + ", " + score + " AS score FROM books WHERE deleted_at IS NULL) scored" +
+		" WHERE score > 0 ORDER BY score DESC, id ASC"
+	if limit > 0 {
+		query += " LIMIT " + args.add(limit)
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := []SearchHit{}
+	for rows.Next() {
+		var hit SearchHit
+		b, err := scanBook(rows, &hit.Score)
+		if err != nil {
+			return nil, err
+		}
+		hit.BookStore = b
+		hits = append(hits, hit)
+	}
+	return hits, rows.Err()
+}
+
+// Reports whether the error is a violation of a unique index, for both
+// PostgreSQL (SQLSTATE 23505) and SQLite (SQLITE_CONSTRAINT_UNIQUE, or
+// SQLITE_CONSTRAINT_PRIMARYKEY for a duplicate primary key).
+func isUniqueViolation(err error) bool {
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) && pgErr.SQLState() == "23505" {
+		return true
+	}
+	var liteErr interface{ Code() int }
+	return errors.As(err, &liteErr) && (liteErr.Code() == 2067 || liteErr.Code() == 1555)
+}
+
+// Turns a unique violation of the ISBN index into a *DuplicateBookError
+// pointing at the book that is already stored.
+func (r *sqlBookRepository) duplicateError(ctx context.Context, isbn string) error {
+	var id string
+	err := r.db.QueryRowContext(ctx, "SELECT id FROM books WHERE isbn = $1", isbn).Scan(&id)
+	if err != nil {
+		return err
+	}
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	return &DuplicateBookError{ExistingID: objID}
+}
+
+func (r *sqlBookRepository) Insert(ctx context.Context, b BookStore) (BookStore, error) {
+	b.ID = primitive.NewObjectID()
+	b.Version = 1
+	b.CreatedAt = writeTime()
+	b.UpdatedAt = b.CreatedAt
+	err := r.insert(ctx, b)
+	return b, err
+}
+
+func (r *sqlBookRepository) insert(ctx context.Context, b BookStore) error {
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO books ("+bookColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)",
+		b.ID.Hex(), b.BookName, b.BookAuthor, b.BookISBN, b.BookPages, b.BookYear, optionalHex(b.AuthorID), strings.Join(b.Genres, ","),
+		b.Version, b.CreatedAt.UTC(), b.UpdatedAt.UTC(), utcOrNil(b.DeletedAt))
+	if isUniqueViolation(err) {
+		return r.duplicateError(ctx, b.BookISBN)
+	}
+	return err
+}
+
+// Tells why an update matched no row: either there is no book with the
+// ID, or it has another version than expected.
+func (r *sqlBookRepository) missingOrConflict(ctx context.Context, id primitive.ObjectID) error {
+	_, err := r.FindByID(ctx, id)
+	if err == nil {
+		return ErrVersionConflict
+	}
+	return err
+}
+
+// Every book is inserted on its own, so one failing row does not roll back
+// the others.
+func (r *sqlBookRepository) InsertMany(ctx context.Context, books []BookStore) ([]BulkResult, error) {
+	results := make([]BulkResult, len(books))
+	for i, book := range books {
+		results[i].Index = i
+		created, err := r.Insert(ctx, book)
+		var dupErr *DuplicateBookError
+		if errors.As(err, &dupErr) {
+			results[i].Error = err.Error()
+			results[i].ExistingID = dupErr.ExistingID.Hex()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		results[i].ID = created.ID.Hex()
+	}
+	return results, nil
+}
+
+func (r *sqlBookRepository) Update(ctx context.Context, b BookStore) (BookStore, error) {
+	b.UpdatedAt = writeTime()
+	args := sqlArgs{b.BookName, b.BookAuthor, b.BookISBN, b.BookPages, b.BookYear, optionalHex(b.AuthorID), strings.Join(b.Genres, ","), b.UpdatedAt}
+	query := "UPDATE books SET name = $1, author = $2, isbn = $3, pages = $4, year = $5, author_id = $6, genres = $7, updated_at = $8, version = version + 1" +
+		" WHERE id = " + args.add(b.ID.Hex()) + " AND deleted_at IS NULL"
+	if b.Version != 0 {
+		query += " AND version = " + args.add(b.Version)
+	}
+	err := r.db.QueryRowContext(ctx, query+" RETURNING version, created_at", args...).Scan(&b.Version, &b.CreatedAt)
+	b.CreatedAt = b.CreatedAt.UTC()
+	if isUniqueViolation(err) {
+		return b, r.duplicateError(ctx, b.BookISBN)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return b, r.missingOrConflict(ctx, b.ID)
+	}
+	return b, err
+}
+
+func (r *sqlBookRepository) Restore(ctx context.Context, b BookStore) (bool, error) {
+	completeRestoredBook(&b)
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE books SET name = $1, author = $2, isbn = $3, pages = $4, year = $5, author_id = $6, genres = $7,"+
+			" version = $8, created_at = $9, updated_at = $10, deleted_at = $11 WHERE id = $12",
+		b.BookName, b.BookAuthor, b.BookISBN, b.BookPages, b.BookYear, optionalHex(b.AuthorID), strings.Join(b.Genres, ","),
+		b.Version, b.CreatedAt.UTC(), b.UpdatedAt.UTC(), utcOrNil(b.DeletedAt), b.ID.Hex())
+	if isUniqueViolation(err) {
+		return false, r.duplicateError(ctx, b.BookISBN)
+	}
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return false, err
+	}
+	err = r.insert(ctx, b)
+	return err == nil, err
+}
+
+// Only the columns of the fields that were sent end up in the statement.
+func (r *sqlBookRepository) Patch(ctx context.Context, id primitive.ObjectID, p BookPatch) (BookStore, error) {
+	var args sqlArgs
+	var sets []string
+	if p.BookName != nil {
+		sets = append(sets, "name = "+args.add(*p.BookName))
+	}
+	if p.BookAuthor != nil {
+		sets = append(sets, "author = "+args.add(*p.BookAuthor))
+	}
+	if p.BookISBN != nil {
+		sets = append(sets, "isbn = "+args.add(*p.BookISBN))
+	}
+	if p.BookPages != nil {
+		sets = append(sets, "pages = "+args.add(*p.BookPages))
+	}
+	if p.BookYear != nil {
+		sets = append(sets, "year = "+args.add(*p.BookYear))
+	}
+	if p.AuthorID != nil {
+		sets = append(sets, "author_id = "+args.add(optionalHex(*p.AuthorID)))
+	}
+	if p.Genres != nil {
+		sets = append(sets, "genres = "+args.add(strings.Join(*p.Genres, ",")))
+	}
+	sets = append(sets, "updated_at = "+args.add(writeTime()), "version = version + 1")
+	query := "UPDATE books SET " + strings.Join(sets, ", ") + " WHERE id = " + args.add(id.Hex()) + " AND deleted_at IS NULL"
+	if p.Version != nil {
+		query += " AND version = " + args.add(*p.Version)
+	}
+	res, err := r.db.ExecContext(ctx, query, args...)
+	if isUniqueViolation(err) {
+		return BookStore{}, r.duplicateError(ctx, *p.BookISBN)
+	}
+	if err != nil {
+		return BookStore{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return BookStore{}, err
+	} else if n == 0 {
+		return BookStore{}, r.missingOrConflict(ctx, id)
+	}
+	return r.FindByID(ctx, id)
+}
+
+func (r *sqlBookRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE books SET deleted_at = $1, updated_at = $1, version = version + 1 WHERE id = $2 AND deleted_at IS NULL",
+		writeTime(), id.Hex())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrBookNotFound
+	}
+	return nil
+}
+
+// Reads the genres of the book, changes them and writes them back within
+// one transaction.
+func (r *sqlBookRepository) changeGenres(ctx context.Context, id primitive.ObjectID, change func([]string) []string) (BookStore, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return BookStore{}, err
+	}
+	defer tx.Rollback()
+
+	var genres string
+	err = tx.QueryRowContext(ctx, "SELECT genres FROM books WHERE id = $1 AND deleted_at IS NULL", id.Hex()).Scan(&genres)
+	if errors.Is(err, sql.ErrNoRows) {
+		return BookStore{}, ErrBookNotFound
+	}
+	if err != nil {
+		return BookStore{}, err
+	}
+	changed := strings.Join(change(splitGenres(genres)), ",")
+	if changed != genres {
+		_, err = tx.ExecContext(ctx, "UPDATE books SET genres = $1, updated_at = $2, version = version + 1 WHERE id = $3", changed, writeTime(), id.Hex())
+		if err != nil {
+			return BookStore{}, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return BookStore{}, err
+	}
+	return r.FindByID(ctx, id)
+}
+
+func (r *sqlBookRepository) AddGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error) {
+	return r.changeGenres(ctx, id, func(genres []string) []string {
+		return normalizeGenres(append(genres, genre))
+	})
+}
+
+func (r *sqlBookRepository) RemoveGenre(ctx context.Context, id primitive.ObjectID, genre string) (BookStore, error) {
+	return r.changeGenres(ctx, id, func(genres []string) []string {
+		return slices.DeleteFunc(genres, func(g string) bool { return g == genre })
+	})
+}
+
+func (r *sqlBookRepository) RenameAuthor(ctx context.Context, authorID primitive.ObjectID, name string) (int64, error) {
+	res, err := r.db.ExecContext(ctx, "UPDATE books SET author = $1, updated_at = $2, version = version + 1 WHERE author_id = $3 AND author <> $1",
+		name, writeTime(), authorID.Hex())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *sqlBookRepository) DeleteMany(ctx context.Context, q BookQuery) (int64, error) {
+	q.Trash = false
+	args := sqlArgs{writeTime()}
+	res, err := r.db.ExecContext(ctx, "UPDATE books SET deleted_at = $1, updated_at = $1, version = version + 1"+sqlWhere(q, &args), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *sqlBookRepository) Undelete(ctx context.Context, id primitive.ObjectID) (BookStore, error) {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE books SET deleted_at = NULL, updated_at = $1, version = version + 1 WHERE id = $2 AND deleted_at IS NOT NULL",
+		writeTime(), id.Hex())
+	if err != nil {
+		return BookStore{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return BookStore{}, err
+	} else if n == 0 {
+		return BookStore{}, ErrBookNotFound
+	}
+	return r.FindByID(ctx, id)
+}
+
+// Collects the IDs and deletes the books within one transaction, so the
+// IDs are exactly those of the removed books.
+func (r *sqlBookRepository) Purge(ctx context.Context, before time.Time) ([]primitive.ObjectID, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM books WHERE deleted_at < $1", before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	var ids []primitive.ObjectID
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+			ids = append(ids, objID)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var args sqlArgs
+	if _, err = tx.ExecContext(ctx, "DELETE FROM books WHERE id IN ("+idList(ids, &args)+")", args...); err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
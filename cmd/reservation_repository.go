@@ -0,0 +1,376 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrReservationNotFound  = errors.New("reservation not found")
+	ErrDuplicateReservation = errors.New("the user already has a hold on the book")
+	ErrReservationClosed    = errors.New("reservation is no longer active")
+)
+
+// Where a hold is in its life. Holds wait in line until a copy comes back,
+// are then ready with that copy set aside, and end once the copy is
+// checked out or the hold is cancelled.
+type ReservationStatus string
+
+const (
+	ReservationWaiting   ReservationStatus = "waiting"
+	ReservationReady     ReservationStatus = "ready"
+	ReservationFulfilled ReservationStatus = "fulfilled"
+	ReservationCancelled ReservationStatus = "cancelled"
+)
+
+var activeReservations = []ReservationStatus{ReservationWaiting, ReservationReady}
+
+// A user's hold on a book. CopyID and ReadyAt are set once a returned copy
+// is set aside for the user.
+type Reservation struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	BookID    primitive.ObjectID `json:"book_id" bson:"book_id"`
+	UserID    primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Status    ReservationStatus  `json:"status" bson:"status"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	CopyID    primitive.ObjectID `json:"copy_id,omitempty" bson:"copy_id,omitempty"`
+	ReadyAt   *time.Time         `json:"ready_at,omitempty" bson:"ready_at,omitempty"`
+}
+
+func (r Reservation) IsActive() bool {
+	return slices.Contains(activeReservations, r.Status)
+}
+
+// Selects reservations. Zero fields do not restrict the result.
+type ReservationQuery struct {
+	BookID   primitive.ObjectID
+	UserID   primitive.ObjectID
+	CopyID   primitive.ObjectID
+	Statuses []ReservationStatus
+}
+
+func (q ReservationQuery) matches(r Reservation) bool {
+	return (q.BookID.IsZero() || r.BookID == q.BookID) &&
+		(q.UserID.IsZero() || r.UserID == q.UserID) &&
+		(q.CopyID.IsZero() || r.CopyID == q.CopyID) &&
+		(len(q.Statuses) == 0 || slices.Contains(q.Statuses, r.Status))
+}
+
+// Stores the holds, next to the loans of the same backend.
+type ReservationRepository interface {
+	// Returns the reservations matching the query in the order they were
+	// placed, which is the order of the queue.
+	FindAll(ctx context.Context, q ReservationQuery) ([]Reservation, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (Reservation, error)
+	// Stores a new reservation and returns it with its ID set.
+	Insert(ctx context.Context, r Reservation) (Reservation, error)
+	// Replaces all fields of the reservation with the ID of r.
+	Update(ctx context.Context, r Reservation) (Reservation, error)
+	// Hands the reservations of the books over to the book to, when they
+	// are merged into it, and returns how many there were. Their places in
+	// the queue follow from when they were placed.
+	MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error)
+}
+
+// Keeps the reservations in memory, for the memory storage.
+type memoryReservationRepository struct {
+	mu           sync.RWMutex
+	reservations []Reservation
+}
+
+func newMemoryReservationRepository() *memoryReservationRepository {
+	return &memoryReservationRepository{}
+}
+
+func (r *memoryReservationRepository) FindAll(ctx context.Context, q ReservationQuery) ([]Reservation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	reservations := []Reservation{}
+	for _, res := range r.reservations {
+		if q.matches(res) {
+			reservations = append(reservations, res)
+		}
+	}
+	slices.SortStableFunc(reservations, func(a, b Reservation) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID.Hex(), b.ID.Hex()))
+	})
+	return reservations, nil
+}
+
+func (r *memoryReservationRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Reservation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	i := slices.IndexFunc(r.reservations, func(res Reservation) bool { return res.ID == id })
+	if i < 0 {
+		return Reservation{}, ErrReservationNotFound
+	}
+	return r.reservations[i], nil
+}
+
+func (r *memoryReservationRepository) Insert(ctx context.Context, res Reservation) (Reservation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res.ID = primitive.NewObjectID()
+	r.reservations = append(r.reservations, res)
+	return res, nil
+}
+
+func (r *memoryReservationRepository) Update(ctx context.Context, res Reservation) (Reservation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.reservations, func(o Reservation) bool { return o.ID == res.ID })
+	if i < 0 {
+		return res, ErrReservationNotFound
+	}
+	r.reservations[i] = res
+	return res, nil
+}
+
+func (r *memoryReservationRepository) MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for i := range r.reservations {
+		if slices.Contains(from, r.reservations[i].BookID) {
+			r.reservations[i].BookID = to
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Creates the indexes for walking the queue of a book and for looking up
+// the holds of a user.
+func prepareReservations(ctx context.Context, coll *mongo.Collection) error {
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "book_id", Value: 1}, {Key: "created_at", Value: 1}},
+			Options: options.Index().SetName("reservations_book_id"),
+		},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetName("reservations_user_id")},
+	}
+	return ensureIndexes(ctx, coll, indexes...)
+}
+
+// Stores the reservations in their own MongoDB collection.
+type mongoReservationRepository struct {
+	coll mongoCollection
+}
+
+func newMongoReservationRepository(coll *mongo.Collection) *mongoReservationRepository {
+	return &mongoReservationRepository{coll: withPolicy(coll)}
+}
+
+func reservationFilter(q ReservationQuery) bson.M {
+	filter := bson.M{}
+	if !q.BookID.IsZero() {
+		filter["book_id"] = q.BookID
+	}
+	if !q.UserID.IsZero() {
+		filter["user_id"] = q.UserID
+	}
+	if !q.CopyID.IsZero() {
+		filter["copy_id"] = q.CopyID
+	}
+	if len(q.Statuses) > 0 {
+		filter["status"] = bson.M{"$in": q.Statuses}
+	}
+	return filter
+}
+
+func (r *mongoReservationRepository) FindAll(ctx context.Context, q ReservationQuery) ([]Reservation, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := r.coll.Find(ctx, reservationFilter(q), opts)
+	if err != nil {
+		return nil, err
+	}
+	reservations := []Reservation{}
+	if err = cursor.All(ctx, &reservations); err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+func (r *mongoReservationRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Reservation, error) {
+	var res Reservation
+	err := r.coll.FindOne(ctx, bson.M{"_id": id}).Decode(&res)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return res, ErrReservationNotFound
+	}
+	return res, err
+}
+
+func (r *mongoReservationRepository) Insert(ctx context.Context, res Reservation) (Reservation, error) {
+	res.ID = primitive.NewObjectID()
+	_, err := r.coll.InsertOne(ctx, res)
+	return res, err
+}
+
+func (r *mongoReservationRepository) Update(ctx context.Context, res Reservation) (Reservation, error) {
+	result, err := r.coll.ReplaceOne(ctx, bson.M{"_id": res.ID}, res)
+	if err != nil {
+		return res, err
+	}
+	if result.MatchedCount == 0 {
+		return res, ErrReservationNotFound
+	}
+	return res, nil
+}
+
+func (r *mongoReservationRepository) MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error) {
+	if len(from) == 0 {
+		return 0, nil
+	}
+	res, err := r.coll.UpdateMany(ctx, bson.M{"book_id": bson.M{"$in": from}}, bson.M{"$set": bson.M{"book_id": to}})
+	if err != nil {
+		return 0, err
+	}
+	return res.MatchedCount, nil
+}
+
+// Stores the reservations in the reservations table, see sqlMigrations.
+type sqlReservationRepository struct {
+	db *sql.DB
+}
+
+func newSQLReservationRepository(db *sql.DB) *sqlReservationRepository {
+	return &sqlReservationRepository{db: db}
+}
+
+const reservationColumns = "id, book_id, user_id, status, created_at, copy_id, ready_at"
+
+func scanReservation(row rowScanner) (Reservation, error) {
+	var res Reservation
+	var id, bookID, userID, copyID string
+	var readyAt sql.NullTime
+	err := row.Scan(&id, &bookID, &userID, &res.Status, &res.CreatedAt, &copyID, &readyAt)
+	if err != nil {
+		return res, err
+	}
+	if res.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return res, err
+	}
+	if res.BookID, err = primitive.ObjectIDFromHex(bookID); err != nil {
+		return res, err
+	}
+	if res.UserID, err = primitive.ObjectIDFromHex(userID); err != nil {
+		return res, err
+	}
+	if res.CopyID, err = parseOptionalHex(copyID); err != nil {
+		return res, err
+	}
+	if readyAt.Valid {
+		res.ReadyAt = &readyAt.Time
+	}
+	return res, nil
+}
+
+// Mirrors reservationFilter of the Mongo repository.
+func reservationWhere(q ReservationQuery, args *sqlArgs) string {
+	var conds []string
+	if !q.BookID.IsZero() {
+		conds = append(conds, "book_id = "+args.add(q.BookID.Hex()))
+	}
+	if !q.UserID.IsZero() {
+		conds = append(conds, "user_id = "+args.add(q.UserID.Hex()))
+	}
+	if !q.CopyID.IsZero() {
+		conds = append(conds, "copy_id = "+args.add(q.CopyID.Hex()))
+	}
+	if len(q.Statuses) > 0 {
+		placeholders := make([]string, len(q.Statuses))
+		for i, status := range q.Statuses {
+			placeholders[i] = args.add(string(status))
+		}
+		conds = append(conds, "status IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+func (r *sqlReservationRepository) FindAll(ctx context.Context, q ReservationQuery) ([]Reservation, error) {
+	var args sqlArgs
+	query := "SELECT " + reservationColumns + " FROM reservations" + reservationWhere(q, &args) + " ORDER BY created_at, id"
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []Reservation{}
+	for rows.Next() {
+		res, err := scanReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, res)
+	}
+	return reservations, rows.Err()
+}
+
+func (r *sqlReservationRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Reservation, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT "+reservationColumns+" FROM reservations WHERE id = $1", id.Hex())
+	res, err := scanReservation(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return res, ErrReservationNotFound
+	}
+	return res, err
+}
+
+func (r *sqlReservationRepository) Insert(ctx context.Context, res Reservation) (Reservation, error) {
+	res.ID = primitive.NewObjectID()
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO reservations ("+reservationColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		res.ID.Hex(), res.BookID.Hex(), res.UserID.Hex(), res.Status, res.CreatedAt.UTC(),
+		optionalHex(res.CopyID), utcOrNil(res.ReadyAt))
+	return res, err
+}
+
+func (r *sqlReservationRepository) Update(ctx context.Context, res Reservation) (Reservation, error) {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE reservations SET status = $1, copy_id = $2, ready_at = $3 WHERE id = $4",
+		res.Status, optionalHex(res.CopyID), utcOrNil(res.ReadyAt), res.ID.Hex())
+	if err != nil {
+		return res, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return res, err
+	} else if n == 0 {
+		return res, ErrReservationNotFound
+	}
+	return res, nil
+}
+
+func (r *sqlReservationRepository) MoveBooks(ctx context.Context, from []primitive.ObjectID, to primitive.ObjectID) (int64, error) {
+	if len(from) == 0 {
+		return 0, nil
+	}
+	args := sqlArgs{to.Hex()}
+	res, err := r.db.ExecContext(ctx, "UPDATE reservations SET book_id = $1 WHERE book_id IN ("+idList(from, &args)+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Converts an optional time for storing it, so every stored time is in
+// UTC and compares correctly as text in SQLite.
+func utcOrNil(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A reservation as listed to its user. Position is the place in the queue
+// of the book, starting at 1, and only set while the hold is waiting. The
+// copy is left out until one is set aside.
+type reservationJSON struct {
+	Reservation
+	CopyID   *primitive.ObjectID `json:"copy_id,omitempty"`
+	Position int                 `json:"position,omitempty"`
+}
+
+// What can be sent to place a hold. Users place holds for themselves;
+// librarians may place them for others.
+type newReservation struct {
+	UserID primitive.ObjectID `json:"user_id"`
+}
+
+// Parses the :id path parameter of the reservation routes.
+func reservationID(c echo.Context) (primitive.ObjectID, error) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return objID, echo.NewHTTPError(http.StatusBadRequest, "Invalid ID format")
+	}
+	return objID, nil
+}
+
+// Decides whose holds a request is about. Without a requested user it is
+// the logged in one; acting for anybody else takes the loans:manage scope.
+// API keys belong to nobody and always have to name the user.
+func holdUser(c echo.Context, requested primitive.ObjectID) (primitive.ObjectID, error) {
+	user := currentUser(c)
+	if requested.IsZero() {
+		if user == nil {
+			return requested, &ValidationError{Fields: []FieldError{{Field: "user_id", Message: "is required for API keys"}}}
+		}
+		return user.ID, nil
+	}
+	if (user == nil || user.ID != requested) && !slices.Contains(currentScopes(c), ScopeLoansManage) {
+		return requested, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("This requires the %s scope", ScopeLoansManage))
+	}
+	return requested, nil
+}
+
+// Adds the queue positions to waiting holds.
+func (s *server) reservationsToJSON(ctx context.Context, reservations []Reservation) ([]reservationJSON, error) {
+	queues := map[primitive.ObjectID][]Reservation{}
+	result := make([]reservationJSON, len(reservations))
+	for i, r := range reservations {
+		result[i] = reservationJSON{Reservation: r}
+		if !r.CopyID.IsZero() {
+			result[i].CopyID = &r.CopyID
+		}
+		if r.Status != ReservationWaiting {
+			continue
+		}
+		queue, ok := queues[r.BookID]
+		if !ok {
+			var err error
+			queue, err = s.reservations.FindAll(ctx, ReservationQuery{
+				BookID:   r.BookID,
+				Statuses: []ReservationStatus{ReservationWaiting},
+			})
+			if err != nil {
+				return nil, err
+			}
+			queues[r.BookID] = queue
+		}
+		result[i].Position = slices.IndexFunc(queue, func(o Reservation) bool { return o.ID == r.ID }) + 1
+	}
+	return result, nil
+}
+
+// Hands a copy that came back or was given up to the first hold waiting
+// for its book. Without one, the copy goes back on the shelf.
+func (s *server) passOnCopy(ctx context.Context, bookID, copyID primitive.ObjectID) error {
+	queue, err := s.reservations.FindAll(ctx, ReservationQuery{
+		BookID:   bookID,
+		Statuses: []ReservationStatus{ReservationWaiting},
+	})
+	if err != nil {
+		return err
+	}
+	if len(queue) == 0 {
+		// The copy may have been removed while it was lent
+		if err := s.copies.Release(ctx, copyID); err != nil && !errors.Is(err, ErrCopyNotFound) {
+			return err
+		}
+		return nil
+	}
+	next := queue[0]
+	now := time.Now().UTC()
+	next.Status = ReservationReady
+	next.CopyID = copyID
+	next.ReadyAt = &now
+	if _, err = s.reservations.Update(ctx, next); err != nil {
+		return err
+	}
+	s.notifyHoldReady(next)
+	return nil
+}
+
+// Returns the hold the copy is set aside for, if any.
+func (s *server) copyHold(ctx context.Context, copyID primitive.ObjectID) (*Reservation, error) {
+	holds, err := s.reservations.FindAll(ctx, ReservationQuery{
+		CopyID:   copyID,
+		Statuses: []ReservationStatus{ReservationReady},
+	})
+	if err != nil || len(holds) == 0 {
+		return nil, err
+	}
+	return &holds[0], nil
+}
+
+// Closes the holds of the user on the book once they checked out a copy of
+// it. A copy that was set aside for them but that they did not take goes
+// to the next in line.
+func (s *server) closeHolds(ctx context.Context, cp Copy, userID primitive.ObjectID) error {
+	holds, err := s.reservations.FindAll(ctx, ReservationQuery{
+		BookID:   cp.BookID,
+		UserID:   userID,
+		Statuses: activeReservations,
+	})
+	if err != nil {
+		return err
+	}
+	for _, r := range holds {
+		setAside := r.CopyID
+		r.Status = ReservationFulfilled
+		if _, err := s.reservations.Update(ctx, r); err != nil {
+			return err
+		}
+		if !setAside.IsZero() && setAside != cp.ID {
+			if err := s.passOnCopy(ctx, r.BookID, setAside); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Lists the active holds of the logged in user, or of the user given as
+// ?user_id=.
+func (s *server) listReservations(c echo.Context) error {
+	var requested primitive.ObjectID
+	if v := c.QueryParam("user_id"); v != "" {
+		id, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "user_id must be a valid ID")
+		}
+		requested = id
+	}
+	userID, err := holdUser(c, requested)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	reservations, err := s.reservations.FindAll(ctx, ReservationQuery{UserID: userID, Statuses: activeReservations})
+	if err != nil {
+		return err
+	}
+	result, err := s.reservationsToJSON(ctx, reservations)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// Lists the queue of active holds on the book, first in line first.
+func (s *server) listBookReservations(c echo.Context) error {
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	if _, err := s.books.FindByID(ctx, id); err != nil {
+		return err
+	}
+	reservations, err := s.reservations.FindAll(ctx, ReservationQuery{BookID: id, Statuses: activeReservations})
+	if err != nil {
+		return err
+	}
+	result, err := s.reservationsToJSON(ctx, reservations)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// Places a hold on a book whose copies are all lent. Books with an
+// available copy should simply be checked out.
+func (s *server) placeHold(c echo.Context) error {
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	var req newReservation
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid reservation data").SetInternal(err)
+		}
+	}
+	userID, err := holdUser(c, req.UserID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	if _, err := s.books.FindByID(ctx, id); err != nil {
+		return err
+	}
+	counts, err := s.copies.Count(ctx, []primitive.ObjectID{id})
+	if err != nil {
+		return err
+	}
+	if counts[id].Total == 0 {
+		return echo.NewHTTPError(http.StatusConflict, "The library has no copies of the book")
+	}
+	if counts[id].Available > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "A copy is available and can be checked out")
+	}
+	existing, err := s.reservations.FindAll(ctx, ReservationQuery{BookID: id, UserID: userID, Statuses: activeReservations})
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return ErrDuplicateReservation
+	}
+
+	reservation, err := s.reservations.Insert(ctx, Reservation{
+		BookID:    id,
+		UserID:    userID,
+		Status:    ReservationWaiting,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	result, err := s.reservationsToJSON(ctx, []Reservation{reservation})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, result[0])
+}
+
+// Cancels a hold. Users can cancel their own holds, librarians anybody's.
+// A copy that was set aside for the hold goes to the next in line.
+func (s *server) cancelHold(c echo.Context) error {
+	id, err := reservationID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	reservation, err := s.reservations.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := holdUser(c, reservation.UserID); err != nil {
+		return err
+	}
+	if !reservation.IsActive() {
+		return ErrReservationClosed
+	}
+	setAside := reservation.CopyID
+	reservation.Status = ReservationCancelled
+	if _, err := s.reservations.Update(ctx, reservation); err != nil {
+		return err
+	}
+	if !setAside.IsZero() {
+		if err := s.passOnCopy(ctx, reservation.BookID, setAside); err != nil {
+			return err
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+)
+
+// What a user may do. Every role includes the rights of the ones before
+// it: readers can only read, librarians can also create and update books
+// and lend copies, and admins can additionally delete books and manage
+// users.
+type Role string
+
+const (
+	RoleReader    Role = "reader"
+	RoleLibrarian Role = "librarian"
+	RoleAdmin     Role = "admin"
+)
+
+// A single right, like changing books. Routes require scopes instead of
+// roles, so users, whose scopes follow from their role, and API keys,
+// which carry their scopes themselves, are checked the same way. Reading
+// the catalog is public and needs no scope.
+type Scope string
+
+const (
+	ScopeBooksWrite  Scope = "books:write"
+	ScopeBooksDelete Scope = "books:delete"
+	// Covers users as well as API keys
+	ScopeUsersManage Scope = "users:manage"
+	// Checking copies out and back in, and seeing who has them
+	ScopeLoansManage Scope = "loans:manage"
+	// Reading the audit log of the changes to the books
+	ScopeAuditRead Scope = "audit:read"
+)
+
+var allScopes = []Scope{ScopeBooksWrite, ScopeBooksDelete, ScopeUsersManage, ScopeLoansManage, ScopeAuditRead}
+
+var roleScopes = map[Role][]Scope{
+	RoleReader:    {},
+	RoleLibrarian: {ScopeBooksWrite, ScopeLoansManage},
+	RoleAdmin:     {ScopeBooksWrite, ScopeBooksDelete, ScopeUsersManage, ScopeLoansManage, ScopeAuditRead},
+}
+
+func (r Role) IsValid() bool {
+	_, ok := roleScopes[r]
+	return ok
+}
+
+// Returns the scopes granted by the role. Users stored before roles
+// existed have none and count as readers.
+func (r Role) Scopes() []Scope {
+	return roleScopes[r]
+}
+
+func checkRole(v *ValidationError, role Role) {
+	if !role.IsValid() {
+		v.add("role", fmt.Sprintf("must be one of %s, %s or %s", RoleReader, RoleLibrarian, RoleAdmin))
+	}
+}
+
+// Returns the scopes of whoever sent the request, be it a user or an API
+// key, or nil on public routes.
+func currentScopes(c echo.Context) []Scope {
+	if user := currentUser(c); user != nil {
+		return user.Role.Scopes()
+	}
+	if key := currentAPIKey(c); key != nil {
+		return key.Scopes
+	}
+	return nil
+}
+
+// Returns the first of the scopes the caller, a user or an API key, does
+// not have, and false if it has them all. Nobody can hand out more rights
+// than they have.
+func missingScope(c echo.Context, scopes []Scope) (Scope, bool) {
+	mine := currentScopes(c)
+	for _, scope := range scopes {
+		if !slices.Contains(mine, scope) {
+			return scope, true
+		}
+	}
+	return "", false
+}
+
+// Lets the request through only for users and API keys with the given
+// scope.
+func (s *server) requireScope(scope Scope) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return s.requireAuth(func(c echo.Context) error {
+			if !slices.Contains(currentScopes(c), scope) {
+				return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("This requires the %s scope", scope))
+			}
+			return next(c)
+		})
+	}
+}
+
+type scopesKey struct{}
+
+// Stores the scopes of an authenticated caller in the context, for APIs
+// that check scopes in their resolvers instead of per route, like GraphQL
+// and gRPC. Contexts of anonymous callers are left alone.
+func withScopes(ctx context.Context, scopes []Scope) context.Context {
+	return context.WithValue(ctx, scopesKey{}, append([]Scope{}, scopes...))
+}
+
+// Fails unless the context carries the scope, the counterpart of
+// requireScope for contexts prepared with withScopes.
+func checkScope(ctx context.Context, scope Scope) error {
+	scopes, ok := ctx.Value(scopesKey{}).([]Scope)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Authentication required")
+	}
+	if !slices.Contains(scopes, scope) {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("This requires the %s scope", scope))
+	}
+	return nil
+}
+
+// The counterpart of requireScope for the HTML pages, whose users are
+// known from their session rather than from a header.
+func requirePageScope(scope Scope) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if currentUser(c) == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Please log in first")
+			}
+			if !hasScope(c, scope) {
+				return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("This requires the %s scope", scope))
+			}
+			return next(c)
+		}
+	}
+}
+
+// Reports whether whoever sent the request has the scope.
+func hasScope(c echo.Context, scope Scope) bool {
+	return slices.Contains(currentScopes(c), scope)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrSavedSearchNotFound  = errors.New("saved search not found")
+	ErrDuplicateSavedSearch = errors.New("the user already has a saved search of that name")
+)
+
+// A search of the catalog a user keeps to run again, see searches.go.
+// Query holds the filters in the query language of ?q=, Sort and Order
+// are written like ?sort= and ?order=.
+type SavedSearch struct {
+	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Name   string             `json:"name" bson:"name"`
+	Query  string             `json:"query" bson:"query"`
+	Sort   string             `json:"sort,omitempty" bson:"sort,omitempty"`
+	Order  string             `json:"order,omitempty" bson:"order,omitempty"`
+	// Whether the owner is emailed about new books matching the search
+	Notify bool `json:"notify" bson:"notify"`
+	// The books created since are new to the owner
+	CheckedAt time.Time `json:"-" bson:"checked_at"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// Stores the saved searches, next to the books they search.
+type SavedSearchRepository interface {
+	// Returns the searches of the user in the order they were created.
+	FindByUser(ctx context.Context, userID primitive.ObjectID) ([]SavedSearch, error)
+	// Returns the searches of all users whose owners want to be told
+	// about new books.
+	FindNotifying(ctx context.Context) ([]SavedSearch, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (SavedSearch, error)
+	// Stores a new search and returns it with its ID set.
+	Insert(ctx context.Context, s SavedSearch) (SavedSearch, error)
+	// Replaces all fields of the search with the ID of s but its owner.
+	Update(ctx context.Context, s SavedSearch) (SavedSearch, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// Keeps the saved searches in memory, for the memory storage.
+type memorySavedSearchRepository struct {
+	mu       sync.RWMutex
+	searches []SavedSearch
+}
+
+func newMemorySavedSearchRepository() *memorySavedSearchRepository {
+	return &memorySavedSearchRepository{}
+}
+
+func (r *memorySavedSearchRepository) filter(match func(SavedSearch) bool) []SavedSearch {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	searches := []SavedSearch{}
+	for _, s := range r.searches {
+		if match(s) {
+			searches = append(searches, s)
+		}
+	}
+	slices.SortStableFunc(searches, func(a, b SavedSearch) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID.Hex(), b.ID.Hex()))
+	})
+	return searches
+}
+
+func (r *memorySavedSearchRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]SavedSearch, error) {
+	return r.filter(func(s SavedSearch) bool { return s.UserID == userID }), nil
+}
+
+func (r *memorySavedSearchRepository) FindNotifying(ctx context.Context) ([]SavedSearch, error) {
+	return r.filter(func(s SavedSearch) bool { return s.Notify }), nil
+}
+
+func (r *memorySavedSearchRepository) FindByID(ctx context.Context, id primitive.ObjectID) (SavedSearch, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	i := slices.IndexFunc(r.searches, func(s SavedSearch) bool { return s.ID == id })
+	if i < 0 {
+		return SavedSearch{}, ErrSavedSearchNotFound
+	}
+	return r.searches[i], nil
+}
+
+func (r *memorySavedSearchRepository) Insert(ctx context.Context, s SavedSearch) (SavedSearch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if slices.ContainsFunc(r.searches, func(o SavedSearch) bool { return o.UserID == s.UserID && o.Name == s.Name }) {
+		return s, ErrDuplicateSavedSearch
+	}
+	s.ID = primitive.NewObjectID()
+	r.searches = append(r.searches, s)
+	return s, nil
+}
+
+func (r *memorySavedSearchRepository) Update(ctx context.Context, s SavedSearch) (SavedSearch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.searches, func(o SavedSearch) bool { return o.ID == s.ID })
+	if i < 0 {
+		return s, ErrSavedSearchNotFound
+	}
+	s.UserID = r.searches[i].UserID
+	if slices.ContainsFunc(r.searches, func(o SavedSearch) bool { return o.ID != s.ID && o.UserID == s.UserID && o.Name == s.Name }) {
+		return s, ErrDuplicateSavedSearch
+	}
+	r.searches[i] = s
+	return s, nil
+}
+
+func (r *memorySavedSearchRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.searches, func(s SavedSearch) bool { return s.ID == id })
+	if i < 0 {
+		return ErrSavedSearchNotFound
+	}
+	r.searches = slices.Delete(r.searches, i, i+1)
+	return nil
+}
+
+// Creates the index for listing the searches of a user, which also keeps
+// their names unique, and the one for the searches to notify about.
+func prepareSavedSearches(ctx context.Context, coll *mongo.Collection) error {
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "name", Value: 1}},
+			Options: options.Index().SetName("saved_searches_user_id_name").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "notify", Value: 1}},
+			Options: options.Index().SetName("saved_searches_notify"),
+		},
+	}
+	return ensureIndexes(ctx, coll, indexes...)
+}
+
+// Stores the saved searches in their own MongoDB collection.
+type mongoSavedSearchRepository struct {
+	coll mongoCollection
+}
+
+func newMongoSavedSearchRepository(coll *mongo.Collection) *mongoSavedSearchRepository {
+	return &mongoSavedSearchRepository{coll: withPolicy(coll)}
+}
+
+func (r *mongoSavedSearchRepository) find(ctx context.Context, filter bson.M) ([]SavedSearch, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := r.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	searches := []SavedSearch{}
+	if err = cursor.All(ctx, &searches); err != nil {
+		return nil, err
+	}
+	return searches, nil
+}
+
+func (r *mongoSavedSearchRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]SavedSearch, error) {
+	return r.find(ctx, bson.M{"user_id": userID})
+}
+
+func (r *mongoSavedSearchRepository) FindNotifying(ctx context.Context) ([]SavedSearch, error) {
+	return r.find(ctx, bson.M{"notify": true})
+}
+
+func (r *mongoSavedSearchRepository) FindByID(ctx context.Context, id primitive.ObjectID) (SavedSearch, error) {
+	var s SavedSearch
+	err := r.coll.FindOne(ctx, bson.M{"_id": id}).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return s, ErrSavedSearchNotFound
+	}
+	return s, err
+}
+
+func (r *mongoSavedSearchRepository) Insert(ctx context.Context, s SavedSearch) (SavedSearch, error) {
+	s.ID = primitive.NewObjectID()
+	_, err := r.coll.InsertOne(ctx, s)
+	if mongo.IsDuplicateKeyError(err) {
+		return s, ErrDuplicateSavedSearch
+	}
+	return s, err
+}
+
+func (r *mongoSavedSearchRepository) Update(ctx context.Context, s SavedSearch) (SavedSearch, error) {
+	update := bson.M{"$set": bson.M{
+		"name":       s.Name,
+		"query":      s.Query,
+		"sort":       s.Sort,
+		"order":      s.Order,
+		"notify":     s.Notify,
+		"checked_at": s.CheckedAt,
+		"updated_at": s.UpdatedAt,
+	}}
+	var stored SavedSearch
+	err := r.coll.FindOneAndUpdate(ctx, bson.M{"_id": s.ID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return s, ErrSavedSearchNotFound
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return s, ErrDuplicateSavedSearch
+	}
+	return stored, err
+}
+
+func (r *mongoSavedSearchRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := r.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrSavedSearchNotFound
+	}
+	return nil
+}
+
+// Stores the saved searches in the saved_searches table, see
+// sqlMigrations. The order is in sort_order, as ORDER is taken.
+type sqlSavedSearchRepository struct {
+	db *sql.DB
+}
+
+func newSQLSavedSearchRepository(db *sql.DB) *sqlSavedSearchRepository {
+	return &sqlSavedSearchRepository{db: db}
+}
+
+const savedSearchColumns = "id, user_id, name, query, sort, sort_order, notify, checked_at, created_at, updated_at"
+
+func scanSavedSearch(row rowScanner) (SavedSearch, error) {
+	var s SavedSearch
+	var id, userID string
+	err := row.Scan(&id, &userID, &s.Name, &s.Query, &s.Sort, &s.Order, &s.Notify, &s.CheckedAt, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return s, err
+	}
+	if s.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return s, err
+	}
+	s.UserID, err = primitive.ObjectIDFromHex(userID)
+	return s, err
+}
+
+func (r *sqlSavedSearchRepository) find(ctx context.Context, where string, arg interface{}) ([]SavedSearch, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+savedSearchColumns+" FROM saved_searches WHERE "+where+" ORDER BY created_at, id", arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []SavedSearch{}
+	for rows.Next() {
+		s, err := scanSavedSearch(rows)
+		if err != nil {
+			return nil, err
+		}
+		searches = append(searches, s)
+	}
+	return searches, rows.Err()
+}
+
+func (r *sqlSavedSearchRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]SavedSearch, error) {
+	return r.find(ctx, "user_id = $1", userID.Hex())
+}
+
+func (r *sqlSavedSearchRepository) FindNotifying(ctx context.Context) ([]SavedSearch, error) {
+	return r.find(ctx, "notify = $1", true)
+}
+
+func (r *sqlSavedSearchRepository) FindByID(ctx context.Context, id primitive.ObjectID) (SavedSearch, error) {
+	s, err := scanSavedSearch(r.db.QueryRowContext(ctx, "SELECT "+savedSearchColumns+" FROM saved_searches WHERE id = $1", id.Hex()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, ErrSavedSearchNotFound
+	}
+	return s, err
+}
+
+func (r *sqlSavedSearchRepository) Insert(ctx context.Context, s SavedSearch) (SavedSearch, error) {
+	s.ID = primitive.NewObjectID()
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO saved_searches ("+savedSearchColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		s.ID.Hex(), s.UserID.Hex(), s.Name, s.Query, s.Sort, s.Order, s.Notify, s.CheckedAt.UTC(), s.CreatedAt.UTC(), s.UpdatedAt.UTC())
+	if isUniqueViolation(err) {
+		return s, ErrDuplicateSavedSearch
+	}
+	return s, err
+}
+
+func (r *sqlSavedSearchRepository) Update(ctx context.Context, s SavedSearch) (SavedSearch, error) {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE saved_searches SET name = $1, query = $2, sort = $3, sort_order = $4, notify = $5, checked_at = $6, updated_at = $7 WHERE id = $8",
+		s.Name, s.Query, s.Sort, s.Order, s.Notify, s.CheckedAt.UTC(), s.UpdatedAt.UTC(), s.ID.Hex())
+	if isUniqueViolation(err) {
+		return s, ErrDuplicateSavedSearch
+	}
+	if err != nil {
+		return s, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return s, err
+	} else if n == 0 {
+		return s, ErrSavedSearchNotFound
+	}
+	return r.FindByID(ctx, s.ID)
+}
+
+func (r *sqlSavedSearchRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM saved_searches WHERE id = $1", id.Hex())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrSavedSearchNotFound
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Users keep searches of the catalog to run again later: a name, the
+// filters in the query language of ?q=, see querylang.go, and the sort.
+// Only their owner sees them. Owners who turn notify on are emailed about
+// the books that match and were added since, by the search_alerts job;
+// the books added before notify was turned on are not new to them.
+
+const (
+	maxSavedSearchNameLength  = 100
+	maxSavedSearchQueryLength = 1000
+	// How many of the new books an alert lists
+	searchAlertBooks = 10
+)
+
+// What can be sent to create a saved search or, with any of the fields,
+// to change one.
+type savedSearchRequest struct {
+	Name   *string `json:"name"`
+	Query  *string `json:"query"`
+	Sort   *string `json:"sort"`
+	Order  *string `json:"order"`
+	Notify *bool   `json:"notify"`
+}
+
+// Returns the listing the search asks for, without pagination.
+func (ss SavedSearch) bookQuery() (BookQuery, error) {
+	var q BookQuery
+	if err := parseQueryLanguage(ss.Query, &q); err != nil {
+		return q, err
+	}
+	if err := parseSortOrder(ss.Sort, ss.Order, &q); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// Checks the search the way /api/books would check its parameters.
+func checkSavedSearch(ss SavedSearch) error {
+	v := &ValidationError{}
+	if ss.Name == "" {
+		v.add("name", "is required")
+	} else if len(ss.Name) > maxSavedSearchNameLength {
+		v.add("name", fmt.Sprintf("must be at most %d characters", maxSavedSearchNameLength))
+	}
+	if len(ss.Query) > maxSavedSearchQueryLength {
+		v.add("query", fmt.Sprintf("must be at most %d characters", maxSavedSearchQueryLength))
+	} else if err := parseQueryLanguage(ss.Query, &BookQuery{}); err != nil {
+		v.add("query", strings.TrimPrefix(toAPIError(err).Message, "q: "))
+	}
+	if err := parseSortOrder(ss.Sort, ss.Order, &BookQuery{}); err != nil {
+		message := toAPIError(err).Message
+		if strings.HasPrefix(message, "order") {
+			v.add("order", message)
+		} else {
+			v.add("sort", message)
+		}
+	}
+	return v.errOrNil()
+}
+
+// Applies the fields that were sent to the search. Turning notify on
+// starts the new books from now.
+func (req savedSearchRequest) apply(ss *SavedSearch, now time.Time) {
+	if req.Name != nil {
+		ss.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Query != nil {
+		ss.Query = strings.TrimSpace(*req.Query)
+	}
+	if req.Sort != nil {
+		ss.Sort = strings.TrimSpace(*req.Sort)
+	}
+	if req.Order != nil {
+		ss.Order = strings.TrimSpace(*req.Order)
+	}
+	if req.Notify != nil {
+		if *req.Notify && !ss.Notify {
+			ss.CheckedAt = now
+		}
+		ss.Notify = *req.Notify
+	}
+}
+
+// Loads the saved search named by the :id path parameter. The searches
+// of others are reported as missing, like shelves.
+func (s *server) ownSavedSearch(ctx context.Context, c echo.Context) (SavedSearch, error) {
+	user, err := requireUser(c)
+	if err != nil {
+		return SavedSearch{}, err
+	}
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return SavedSearch{}, echo.NewHTTPError(http.StatusBadRequest, "Invalid ID format")
+	}
+	ss, err := s.savedSearches.FindByID(ctx, id)
+	if err != nil {
+		return ss, err
+	}
+	if ss.UserID != user.ID {
+		return ss, ErrSavedSearchNotFound
+	}
+	return ss, nil
+}
+
+// The page of the books the search finds.
+func (s *server) savedSearchURL(ss SavedSearch) string {
+	params := url.Values{}
+	for name, value := range map[string]string{"q": ss.Query, "sort": ss.Sort, "order": ss.Order} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+	return strings.TrimSuffix(s.publicURL, "/") + "/books?" + params.Encode()
+}
+
+// Lists the saved searches of the logged in user.
+func (s *server) listSavedSearches(c echo.Context) error {
+	user, err := requireUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	searches, err := s.savedSearches.FindByUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, searches)
+}
+
+func (s *server) getSavedSearch(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	ss, err := s.ownSavedSearch(ctx, c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, ss)
+}
+
+func (s *server) createSavedSearch(c echo.Context) error {
+	user, err := requireUser(c)
+	if err != nil {
+		return err
+	}
+	var req savedSearchRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid search data").SetInternal(err)
+	}
+	now := writeTime()
+	ss := SavedSearch{UserID: user.ID, CheckedAt: now, CreatedAt: now, UpdatedAt: now}
+	req.apply(&ss, now)
+	if err := checkSavedSearch(ss); err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	ss, err = s.savedSearches.Insert(ctx, ss)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, ss)
+}
+
+// Renames a saved search, changes what it searches for, or turns its
+// emails on or off.
+func (s *server) patchSavedSearch(c echo.Context) error {
+	var req savedSearchRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid search data").SetInternal(err)
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	ss, err := s.ownSavedSearch(ctx, c)
+	if err != nil {
+		return err
+	}
+	now := writeTime()
+	req.apply(&ss, now)
+	if err := checkSavedSearch(ss); err != nil {
+		return err
+	}
+	ss.UpdatedAt = now
+	if ss, err = s.savedSearches.Update(ctx, ss); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, ss)
+}
+
+func (s *server) deleteSavedSearch(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	ss, err := s.ownSavedSearch(ctx, c)
+	if err != nil {
+		return err
+	}
+	if err := s.savedSearches.Delete(ctx, ss.ID); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Runs the saved search, answering like /api/books with its filters and
+// sort; ?page= and ?limit= page through the books.
+func (s *server) runSavedSearch(c echo.Context) error {
+	page, err := parsePagination(c, 0)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	ss, err := s.ownSavedSearch(ctx, c)
+	if err != nil {
+		return err
+	}
+	q, err := ss.bookQuery()
+	if err != nil {
+		return err
+	}
+	q.Page, q.Limit = page.Page, page.Limit
+	if q.Limit == 0 {
+		return s.streamBooks(c, q)
+	}
+	results, total, err := s.books.FindAll(ctx, q)
+	if err != nil {
+		return err
+	}
+	return s.booksJSON(ctx, c, q, results, total)
+}
+
+// Emails the owners of the saved searches with notify on about the books
+// that match and were added since the run before, see mail.go.
+func (s *server) searchAlertsJob() (string, error) {
+	if s.mailer == nil {
+		return "mail is off", nil
+	}
+	ctx, cancel := dbContext()
+	searches, err := s.savedSearches.FindNotifying(ctx)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+	now := writeTime()
+	matched, sent := 0, 0
+	for _, ss := range searches {
+		n, mailed, err := s.alertSavedSearch(ss, now)
+		if err != nil {
+			log.Printf("Failed to alert about saved search %s: %v", ss.ID.Hex(), err)
+			continue
+		}
+		if n > 0 {
+			matched++
+		}
+		if mailed {
+			sent++
+		}
+	}
+	return fmt.Sprintf("emailed %d of %d saved searches with new books", sent, matched), nil
+}
+
+// Emails the owner about the books added to the search since it was last
+// checked, up to now, and returns how many there were and whether the
+// email went out. The search is only checked off once that worked, so a
+// failed email is tried again on the next run.
+func (s *server) alertSavedSearch(ss SavedSearch, now time.Time) (int64, bool, error) {
+	q, err := ss.bookQuery()
+	if err != nil {
+		return 0, false, err
+	}
+	// Within the times the search itself may ask for
+	if q.CreatedSince == nil || q.CreatedSince.Before(ss.CheckedAt) {
+		q.CreatedSince = &ss.CheckedAt
+	}
+	if q.CreatedBefore == nil || q.CreatedBefore.After(now) {
+		q.CreatedBefore = &now
+	}
+	q.Page, q.Limit = 1, searchAlertBooks
+	q.Sort = []SortField{{Field: "created_at", Desc: true}}
+
+	ctx, cancel := notifyContext()
+	defer cancel()
+	books, total, err := s.books.FindAll(ctx, q)
+	if err != nil {
+		return 0, false, err
+	}
+	mailed := false
+	if total > 0 {
+		user, ok, err := s.mailRecipient(ctx, mailSearchAlert, ss.UserID)
+		if err != nil {
+			return total, false, err
+		}
+		if ok {
+			data := mailData{User: user, Search: ss, Books: books, Total: total, URL: s.savedSearchURL(ss)}
+			if err := s.sendMail(ctx, mailSearchAlert, data); err != nil {
+				return total, false, err
+			}
+			mailed = true
+		}
+	}
+	ss.CheckedAt = now
+	if _, err := s.savedSearches.Update(ctx, ss); err != nil {
+		return total, mailed, err
+	}
+	return total, mailed, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+)
+
+// The headers that keep browsers from doing what the pages never need:
+// running scripts or loading styles from anywhere else, framing the pages
+// into other sites, guessing content types and handing the URL of a page
+// to other origins. The policies come from SecurityHeadersConfig; the
+// default content security policy allows what the views load, htmx from
+// unpkg.com, the fonts from Google and the covers from Open Library, and
+// the inline script and styles of index.html.
+//
+// The API answers with JSON only and gets none of them.
+
+// Sets the headers on the responses of the pages. A header whose policy is
+// empty is left out.
+func (s *server) setSecurityHeaders(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		h := c.Response().Header()
+		h.Set(echo.HeaderXContentTypeOptions, "nosniff")
+		for name, value := range map[string]string{
+			echo.HeaderContentSecurityPolicy: s.securityHeaders.ContentSecurityPolicy,
+			echo.HeaderXFrameOptions:         s.securityHeaders.FrameOptions,
+			echo.HeaderReferrerPolicy:        s.securityHeaders.ReferrerPolicy,
+			"Permissions-Policy":             s.securityHeaders.PermissionsPolicy,
+		} {
+			if value != "" {
+				h.Set(name, value)
+			}
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The books a catalog starts with come from a file, seed/books.json by
+// default. They are stored on every start unless seed.enabled is off, as
+// it better is in production, and by `app seed`. Seeding is an upsert: a
+// seed book that is stored already, found by its ISBN or, without one, by
+// its name and author, is updated where it differs from the file, so
+// seeding twice changes nothing.
+
+// How seeding went, book by book of the file.
+type SeedReport struct {
+	Inserted  int
+	Updated   int
+	Unchanged int
+}
+
+func (r SeedReport) String() string {
+	return fmt.Sprintf("%d inserted, %d updated, %d unchanged", r.Inserted, r.Updated, r.Unchanged)
+}
+
+// Reads the seed books from a JSON array of books like POST
+// /api/books/bulk takes, or from a CSV file like POST /api/books/import
+// takes, told apart by the extension. IDs in the file are ignored.
+func readSeedFile(path string) ([]BookStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var books []BookStore
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if err := json.NewDecoder(f).Decode(&books); err != nil {
+			return nil, fmt.Errorf("%s is no JSON array of books: %w", path, err)
+		}
+	case ".csv":
+		imp, err := readImport(f, ',', "", 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, describeError(err))
+		}
+		for _, row := range imp.rows {
+			if row.Status == importFailed {
+				return nil, fmt.Errorf("%s, row %d: %s", path, row.Row, row.Error)
+			}
+		}
+		books = imp.books
+	default:
+		return nil, fmt.Errorf("%s must be a .json or .csv file", path)
+	}
+	for i := range books {
+		books[i].ID = primitive.NilObjectID
+	}
+	return books, nil
+}
+
+// Stores the books of the seed file, see the top of this file. A book the
+// file gets wrong stops the seeding, as it is a mistake in the file.
+func seedBooks(ctx context.Context, repo BookRepository, path string) (SeedReport, error) {
+	books, err := readSeedFile(path)
+	if err != nil {
+		return SeedReport{}, err
+	}
+	var report SeedReport
+	for i, b := range books {
+		normalizeBook(&b)
+		if err := validateBook(b); err != nil {
+			return report, fmt.Errorf("%s, book %d: %w", path, i+1, err)
+		}
+		existing, inserted, err := insertSeedBook(ctx, repo, b)
+		if err != nil {
+			return report, fmt.Errorf("%s, book %d: %w", path, i+1, err)
+		}
+		if inserted {
+			report.Inserted++
+			continue
+		}
+
+		p := seedPatch(existing, b)
+		if existing.ID.IsZero() || p.IsEmpty() {
+			report.Unchanged++
+			continue
+		}
+		if _, err := repo.Patch(ctx, existing.ID, p); err != nil {
+			return report, fmt.Errorf("%s, book %d: %w", path, i+1, err)
+		}
+		report.Updated++
+	}
+	return report, nil
+}
+
+// Inserts the seed book unless it is stored already, and returns the
+// stored one otherwise. Books with an ISBN are inserted right away, the
+// unique ISBN turns up the stored book; books without one are looked for
+// among the books of the author. A stored book that is in the trash is
+// returned without its ID, as it is left there.
+func insertSeedBook(ctx context.Context, repo BookRepository, b BookStore) (BookStore, bool, error) {
+	if b.BookISBN == "" {
+		books, _, err := repo.FindAll(ctx, BookQuery{Author: b.BookAuthor})
+		if err != nil {
+			return BookStore{}, false, err
+		}
+		i := slices.IndexFunc(books, func(other BookStore) bool {
+			return other.BookISBN == "" && other.BookName == b.BookName
+		})
+		if i >= 0 {
+			return books[i], false, nil
+		}
+	}
+
+	created, err := repo.Insert(ctx, b)
+	var dup *DuplicateBookError
+	if !errors.As(err, &dup) {
+		return created, err == nil, err
+	}
+	existing, err := repo.FindByID(ctx, dup.ExistingID)
+	if errors.Is(err, ErrBookNotFound) {
+		return BookStore{}, false, nil
+	}
+	return existing, false, err
+}
+
+// The changes that bring the stored book in line with the seed book. The
+// author of a book linked to an author is kept, as it follows that, and
+// so are the genres unless the file has some.
+func seedPatch(stored BookStore, seed BookStore) BookPatch {
+	var p BookPatch
+	if stored.BookName != seed.BookName {
+		p.BookName = &seed.BookName
+	}
+	if stored.BookAuthor != seed.BookAuthor && stored.AuthorID.IsZero() {
+		p.BookAuthor = &seed.BookAuthor
+	}
+	if stored.BookPages != seed.BookPages {
+		p.BookPages = &seed.BookPages
+	}
+	if stored.BookYear != seed.BookYear {
+		p.BookYear = &seed.BookYear
+	}
+	if len(seed.Genres) > 0 && !slices.Equal(stored.Genres, seed.Genres) {
+		p.Genres = &seed.Genres
+	}
+	return p
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// A login to the web UI. The cookie holds a random session ID; only its
+// hash is stored, so a leaked database does not leak live sessions.
+type Session struct {
+	Hash      string             `bson:"_id" json:"hash"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+}
+
+// Stores the sessions of the web UI, next to the users of the same
+// backend.
+type SessionRepository interface {
+	Insert(ctx context.Context, s Session) error
+	// Returns the session with the hash, unless it expired.
+	FindByHash(ctx context.Context, hash string) (Session, error)
+	Delete(ctx context.Context, hash string) error
+}
+
+// Keeps the sessions in memory, for the memory storage.
+type memorySessionRepository struct {
+	mu       sync.Mutex
+	sessions []Session
+}
+
+func newMemorySessionRepository() *memorySessionRepository {
+	return &memorySessionRepository{}
+}
+
+// Expired sessions are dropped whenever a new one starts, which keeps the
+// list from growing forever.
+func (r *memorySessionRepository) Insert(ctx context.Context, s Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.sessions = slices.DeleteFunc(r.sessions, func(o Session) bool { return o.ExpiresAt.Before(now) })
+	r.sessions = append(r.sessions, s)
+	return nil
+}
+
+func (r *memorySessionRepository) FindByHash(ctx context.Context, hash string) (Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.sessions, func(s Session) bool { return s.Hash == hash })
+	if i < 0 || r.sessions[i].ExpiresAt.Before(time.Now()) {
+		return Session{}, ErrSessionNotFound
+	}
+	return r.sessions[i], nil
+}
+
+func (r *memorySessionRepository) Delete(ctx context.Context, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions = slices.DeleteFunc(r.sessions, func(s Session) bool { return s.Hash == hash })
+	return nil
+}
+
+// Lets MongoDB remove expired sessions by itself.
+func prepareSessions(ctx context.Context, coll *mongo.Collection) error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetName("sessions_ttl").SetExpireAfterSeconds(0),
+	}
+	return ensureIndexes(ctx, coll, index)
+}
+
+// Stores the sessions in their own MongoDB collection, keyed by hash.
+type mongoSessionRepository struct {
+	coll mongoCollection
+}
+
+func newMongoSessionRepository(coll *mongo.Collection) *mongoSessionRepository {
+	return &mongoSessionRepository{coll: withPolicy(coll)}
+}
+
+func (r *mongoSessionRepository) Insert(ctx context.Context, s Session) error {
+	_, err := r.coll.InsertOne(ctx, s)
+	return err
+}
+
+// The TTL monitor only runs once a minute, so the expiry is checked here
+// as well.
+func (r *mongoSessionRepository) FindByHash(ctx context.Context, hash string) (Session, error) {
+	var s Session
+	err := r.coll.FindOne(ctx, bson.M{"_id": hash, "expires_at": bson.M{"$gt": time.Now()}}).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return s, ErrSessionNotFound
+	}
+	return s, err
+}
+
+func (r *mongoSessionRepository) Delete(ctx context.Context, hash string) error {
+	_, err := r.coll.DeleteOne(ctx, bson.M{"_id": hash})
+	return err
+}
+
+// Stores the sessions in the sessions table, see sqlMigrations.
+type sqlSessionRepository struct {
+	db *sql.DB
+}
+
+func newSQLSessionRepository(db *sql.DB) *sqlSessionRepository {
+	return &sqlSessionRepository{db: db}
+}
+
+// Like the memory repository, expired sessions are cleaned up whenever a
+// new one starts. Times are always compared in UTC, as SQLite compares
+// them as text.
+func (r *sqlSessionRepository) Insert(ctx context.Context, s Session) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < $1", time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx,
+		"INSERT INTO sessions (hash, user_id, created_at, expires_at) VALUES ($1, $2, $3, $4)",
+		s.Hash, s.UserID.Hex(), s.CreatedAt.UTC(), s.ExpiresAt.UTC())
+	return err
+}
+
+func (r *sqlSessionRepository) FindByHash(ctx context.Context, hash string) (Session, error) {
+	var s Session
+	var userID string
+	row := r.db.QueryRowContext(ctx,
+		"SELECT hash, user_id, created_at, expires_at FROM sessions WHERE hash = $1 AND expires_at > $2",
+		hash, time.Now().UTC())
+	err := row.Scan(&s.Hash, &userID, &s.CreatedAt, &s.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, ErrSessionNotFound
+	}
+	if err != nil {
+		return s, err
+	}
+	s.UserID, err = primitive.ObjectIDFromHex(userID)
+	return s, err
+}
+
+func (r *sqlSessionRepository) Delete(ctx context.Context, hash string) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM sessions WHERE hash = $1", hash)
+	return err
+}
+
+// Stores the sessions in Redis, shared by all instances, which spares the
+// database a lookup on every page. Redis expires them by itself.
+type redisSessionRepository struct {
+	client *redis.Client
+}
+
+func newRedisSessionRepository(client *redis.Client) *redisSessionRepository {
+	return &redisSessionRepository{client: client}
+}
+
+func (r *redisSessionRepository) Insert(ctx context.Context, s Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, "session:"+s.Hash, data, time.Until(s.ExpiresAt)).Err()
+}
+
+func (r *redisSessionRepository) FindByHash(ctx context.Context, hash string) (Session, error) {
+	var s Session
+	data, err := r.client.Get(ctx, "session:"+hash).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return s, ErrSessionNotFound
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+func (r *redisSessionRepository) Delete(ctx context.Context, hash string) error {
+	return r.client.Del(ctx, "session:"+hash).Err()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The cookie that keeps the user logged in on the HTML pages, and for how
+// long.
+const (
+	sessionCookie = "session"
+	sessionTTL    = 7 * 24 * time.Hour
+)
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Cookies are only marked secure when the server is served over HTTPS,
+// otherwise browsers would drop them during local development.
+func (s *server) secureCookies() bool {
+	return strings.HasPrefix(s.publicURL, "https://")
+}
+
+func (s *server) newCookie(name string, value string, maxAge time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   s.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Protects every state-changing request to the HTML pages. The token is
+// read from the X-CSRF-Token header, which htmx sends for us, or from the
+// _csrf field of plain forms. The API needs no such protection, as it
+// never authenticates through cookies.
+func (s *server) csrf() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		TokenLookup:    "header:X-CSRF-Token,form:_csrf",
+		ContextKey:     "csrf",
+		CookieName:     "_csrf",
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSecure:   s.secureCookies(),
+		CookieSameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Returns the CSRF token the HTML pages have to send back.
+func csrfToken(c echo.Context) string {
+	token, _ := c.Get("csrf").(string)
+	return token
+}
+
+// Logs the user into the web UI and sets the session cookie.
+func (s *server) startSession(c echo.Context, user User) error {
+	id, err := randomToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	session := Session{
+		Hash:      hashSecret(id),
+		UserID:    user.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(sessionTTL),
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	if err := s.sessions.Insert(ctx, session); err != nil {
+		return err
+	}
+	c.SetCookie(s.newCookie(sessionCookie, id, sessionTTL))
+	return nil
+}
+
+// Makes the user of a valid session cookie available to the HTML pages
+// through currentUser. Requests without a session simply stay anonymous;
+// the API does not look at the cookie at all and keeps requiring a token.
+func (s *server) loadSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cookie, err := c.Cookie(sessionCookie)
+		if err != nil || cookie.Value == "" {
+			return next(c)
+		}
+
+		ctx, cancel := requestContext(c)
+		defer cancel()
+		session, err := s.sessions.FindByHash(ctx, hashSecret(cookie.Value))
+		if errors.Is(err, ErrSessionNotFound) {
+			return next(c)
+		}
+		if err != nil {
+			return err
+		}
+		user, err := s.users.FindByID(ctx, session.UserID)
+		if errors.Is(err, ErrUserNotFound) {
+			return next(c)
+		}
+		if err != nil {
+			return err
+		}
+		c.Set("user", &user)
+		return next(c)
+	}
+}
+
+// Sends the browser to the given page. htmx requests get the HX-Redirect
+// header, as following a redirect would only swap the target element.
+func redirectPage(c echo.Context, url string) error {
+	if c.Request().Header.Get("HX-Request") == "true" {
+		c.Response().Header().Set("HX-Redirect", url)
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.Redirect(http.StatusSeeOther, url)
+}
+
+func (s *server) loginPage(c echo.Context) error {
+	return c.Render(http.StatusOK, "login-form", map[string]interface{}{
+		"CSRF": csrfToken(c),
+	})
+}
+
+// Logs users with a password into the web UI. Wrong credentials render
+// the form again with a 422, which the index page swaps in. Users with
+// two-factor authentication on get the form asking for the code next.
+func (s *server) loginForm(c echo.Context) error {
+	if challenge := c.FormValue("challenge"); challenge != "" {
+		return s.loginCodeForm(c, challenge)
+	}
+	username := normalizeUsername(c.FormValue("username"))
+	password := c.FormValue("password")
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	ip := c.RealIP()
+	if wait := s.lockout.wait(ctx, username, ip); wait > 0 {
+		return lockedOutForm(c, wait, username)
+	}
+	user, err := s.users.FindByUsername(ctx, username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		s.lockout.failed(ctx, username, ip)
+		return c.Render(http.StatusUnprocessableEntity, "login-form", map[string]interface{}{
+			"CSRF":     csrfToken(c),
+			"Username": username,
+			"Error":    ErrInvalidCredentials.Error(),
+		})
+	}
+
+	if user.TOTPEnabled {
+		challenge, err := s.issueLoginChallenge(user)
+		if err != nil {
+			return err
+		}
+		return c.Render(http.StatusOK, "login-form", map[string]interface{}{
+			"CSRF":      csrfToken(c),
+			"Challenge": challenge,
+		})
+	}
+	s.lockout.succeeded(ctx, user.Username)
+	if err := s.startSession(c, user); err != nil {
+		return err
+	}
+	return redirectPage(c, "/")
+}
+
+// The second step of the login form, taking the code of the user whose
+// password was right. A wrong code asks again, an expired challenge starts
+// over with the password.
+func (s *server) loginCodeForm(c echo.Context, challenge string) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	user, err := s.userFromChallenge(ctx, challenge)
+	if errors.Is(err, ErrUserNotFound) {
+		return c.Render(http.StatusUnprocessableEntity, "login-form", map[string]interface{}{
+			"CSRF":  csrfToken(c),
+			"Error": "The login took too long, please log in again",
+		})
+	}
+	if err != nil {
+		return err
+	}
+	ip := c.RealIP()
+	if wait := s.lockout.wait(ctx, user.Username, ip); wait > 0 {
+		return lockedOutForm(c, wait, "")
+	}
+
+	err = s.verifyLoginCode(ctx, &user, c.FormValue("code"))
+	if errors.Is(err, ErrCodeRequired) || errors.Is(err, ErrInvalidCode) {
+		if errors.Is(err, ErrInvalidCode) {
+			s.lockout.failed(ctx, user.Username, ip)
+		}
+		return c.Render(http.StatusUnprocessableEntity, "login-form", map[string]interface{}{
+			"CSRF":      csrfToken(c),
+			"Challenge": challenge,
+			"Error":     ErrInvalidCode.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	s.lockout.succeeded(ctx, user.Username)
+	if err := s.startSession(c, user); err != nil {
+		return err
+	}
+	return redirectPage(c, "/")
+}
+
+// Like lockedOut, rendering the login form again with a 422 for the index
+// page to swap in.
+func lockedOutForm(c echo.Context, wait time.Duration, username string) error {
+	setRetryAfter(c, wait)
+	return c.Render(http.StatusUnprocessableEntity, "login-form", map[string]interface{}{
+		"CSRF":     csrfToken(c),
+		"Username": username,
+		"Error":    lockedOutMessage,
+	})
+}
+
+// Ends the session on the server as well, so a copied cookie is useless
+// afterwards.
+func (s *server) logout(c echo.Context) error {
+	if cookie, err := c.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		ctx, cancel := requestContext(c)
+		defer cancel()
+		if err := s.sessions.Delete(ctx, hashSecret(cookie.Value)); err != nil {
+			return err
+		}
+	}
+	c.SetCookie(s.newCookie(sessionCookie, "", -1))
+	return redirectPage(c, "/")
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrShelfNotFound  = errors.New("shelf not found")
+	ErrDuplicateShelf = errors.New("the user already has a shelf of that name")
+)
+
+// A named reading list of a user, like "Want to read". The books are kept
+// in the order the user put them in. A shelf with a ShareToken can be
+// read by anybody knowing the token, see shelves.go.
+type Shelf struct {
+	ID         primitive.ObjectID   `json:"id" bson:"_id,omitempty"`
+	UserID     primitive.ObjectID   `json:"user_id" bson:"user_id"`
+	Name       string               `json:"name" bson:"name"`
+	BookIDs    []primitive.ObjectID `json:"book_ids" bson:"book_ids"`
+	ShareToken string               `json:"share_token,omitempty" bson:"share_token,omitempty"`
+	CreatedAt  time.Time            `json:"created_at" bson:"created_at"`
+	UpdatedAt  time.Time            `json:"updated_at" bson:"updated_at"`
+}
+
+// Stores the shelves, next to the books they list.
+type ShelfRepository interface {
+	// Returns the shelves of the user in the order they were created.
+	FindByUser(ctx context.Context, userID primitive.ObjectID) ([]Shelf, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (Shelf, error)
+	FindByShareToken(ctx context.Context, token string) (Shelf, error)
+	// Stores a new shelf and returns it with its ID set.
+	Insert(ctx context.Context, s Shelf) (Shelf, error)
+	// Replaces all fields of the shelf with the ID of s but its owner.
+	Update(ctx context.Context, s Shelf) (Shelf, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// Keeps the shelves in memory, for the memory storage.
+type memoryShelfRepository struct {
+	mu      sync.RWMutex
+	shelves []Shelf
+}
+
+func newMemoryShelfRepository() *memoryShelfRepository {
+	return &memoryShelfRepository{}
+}
+
+// Copies the books of the shelf, so callers never share them with the
+// stored shelf.
+func (s Shelf) clone() Shelf {
+	s.BookIDs = append([]primitive.ObjectID{}, s.BookIDs...)
+	return s
+}
+
+func (r *memoryShelfRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]Shelf, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	shelves := []Shelf{}
+	for _, s := range r.shelves {
+		if s.UserID == userID {
+			shelves = append(shelves, s.clone())
+		}
+	}
+	slices.SortStableFunc(shelves, func(a, b Shelf) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID.Hex(), b.ID.Hex()))
+	})
+	return shelves, nil
+}
+
+func (r *memoryShelfRepository) find(match func(Shelf) bool) (Shelf, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	i := slices.IndexFunc(r.shelves, match)
+	if i < 0 {
+		return Shelf{}, ErrShelfNotFound
+	}
+	return r.shelves[i].clone(), nil
+}
+
+func (r *memoryShelfRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Shelf, error) {
+	return r.find(func(s Shelf) bool { return s.ID == id })
+}
+
+func (r *memoryShelfRepository) FindByShareToken(ctx context.Context, token string) (Shelf, error) {
+	if token == "" {
+		return Shelf{}, ErrShelfNotFound
+	}
+	return r.find(func(s Shelf) bool { return s.ShareToken == token })
+}
+
+func (r *memoryShelfRepository) Insert(ctx context.Context, s Shelf) (Shelf, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if slices.ContainsFunc(r.shelves, func(o Shelf) bool { return o.UserID == s.UserID && o.Name == s.Name }) {
+		return s, ErrDuplicateShelf
+	}
+	s.ID = primitive.NewObjectID()
+	r.shelves = append(r.shelves, s.clone())
+	return s, nil
+}
+
+func (r *memoryShelfRepository) Update(ctx context.Context, s Shelf) (Shelf, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.shelves, func(o Shelf) bool { return o.ID == s.ID })
+	if i < 0 {
+		return s, ErrShelfNotFound
+	}
+	s.UserID = r.shelves[i].UserID
+	if slices.ContainsFunc(r.shelves, func(o Shelf) bool { return o.ID != s.ID && o.UserID == s.UserID && o.Name == s.Name }) {
+		return s, ErrDuplicateShelf
+	}
+	r.shelves[i] = s.clone()
+	return s, nil
+}
+
+func (r *memoryShelfRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.shelves, func(s Shelf) bool { return s.ID == id })
+	if i < 0 {
+		return ErrShelfNotFound
+	}
+	r.shelves = slices.Delete(r.shelves, i, i+1)
+	return nil
+}
+
+// Creates the indexes for listing the shelves of a user, which also keeps
+// their names unique, and for finding shared shelves by their token.
+func prepareShelves(ctx context.Context, coll *mongo.Collection) error {
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "name", Value: 1}},
+			Options: options.Index().SetName("shelves_user_id_name").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "share_token", Value: 1}},
+			Options: options.Index().SetName("shelves_share_token").SetUnique(true).SetSparse(true),
+		},
+	}
+	return ensureIndexes(ctx, coll, indexes...)
+}
+
+// Stores the shelves in their own MongoDB collection, with the books as
+// an array of IDs.
+type mongoShelfRepository struct {
+	coll mongoCollection
+}
+
+func newMongoShelfRepository(coll *mongo.Collection) *mongoShelfRepository {
+	return &mongoShelfRepository{coll: withPolicy(coll)}
+}
+
+func (r *mongoShelfRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]Shelf, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := r.coll.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	shelves := []Shelf{}
+	if err = cursor.All(ctx, &shelves); err != nil {
+		return nil, err
+	}
+	return shelves, nil
+}
+
+func (r *mongoShelfRepository) findOne(ctx context.Context, filter bson.M) (Shelf, error) {
+	var s Shelf
+	err := r.coll.FindOne(ctx, filter).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return s, ErrShelfNotFound
+	}
+	return s, err
+}
+
+func (r *mongoShelfRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Shelf, error) {
+	return r.findOne(ctx, bson.M{"_id": id})
+}
+
+func (r *mongoShelfRepository) FindByShareToken(ctx context.Context, token string) (Shelf, error) {
+	if token == "" {
+		return Shelf{}, ErrShelfNotFound
+	}
+	return r.findOne(ctx, bson.M{"share_token": token})
+}
+
+func (r *mongoShelfRepository) Insert(ctx context.Context, s Shelf) (Shelf, error) {
+	s.ID = primitive.NewObjectID()
+	_, err := r.coll.InsertOne(ctx, s)
+	if mongo.IsDuplicateKeyError(err) {
+		return s, ErrDuplicateShelf
+	}
+	return s, err
+}
+
+func (r *mongoShelfRepository) Update(ctx context.Context, s Shelf) (Shelf, error) {
+	set := bson.M{"name": s.Name, "book_ids": s.BookIDs, "updated_at": s.UpdatedAt}
+	update := bson.M{"$set": set}
+	if s.ShareToken == "" {
+		update["$unset"] = bson.M{"share_token": ""}
+	} else {
+		set["share_token"] = s.ShareToken
+	}
+	var stored Shelf
+	err := r.coll.FindOneAndUpdate(ctx, bson.M{"_id": s.ID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return s, ErrShelfNotFound
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return s, ErrDuplicateShelf
+	}
+	return stored, err
+}
+
+func (r *mongoShelfRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := r.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrShelfNotFound
+	}
+	return nil
+}
+
+// Stores the shelves in the shelves table, see sqlMigrations. The books
+// are a comma separated list of IDs in their order on the shelf.
+type sqlShelfRepository struct {
+	db *sql.DB
+}
+
+func newSQLShelfRepository(db *sql.DB) *sqlShelfRepository {
+	return &sqlShelfRepository{db: db}
+}
+
+const shelfColumns = "id, user_id, name, book_ids, share_token, created_at, updated_at"
+
+func joinIDs(ids []primitive.ObjectID) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = id.Hex()
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitIDs(s string) ([]primitive.ObjectID, error) {
+	ids := []primitive.ObjectID{}
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		id, err := primitive.ObjectIDFromHex(part)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func scanShelf(row rowScanner) (Shelf, error) {
+	var s Shelf
+	var id, userID, bookIDs string
+	err := row.Scan(&id, &userID, &s.Name, &bookIDs, &s.ShareToken, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return s, err
+	}
+	if s.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return s, err
+	}
+	if s.UserID, err = primitive.ObjectIDFromHex(userID); err != nil {
+		return s, err
+	}
+	s.BookIDs, err = splitIDs(bookIDs)
+	return s, err
+}
+
+func (r *sqlShelfRepository) FindByUser(ctx context.Context, userID primitive.ObjectID) ([]Shelf, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+shelfColumns+" FROM shelves WHERE user_id = $1 ORDER BY created_at, id", userID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shelves := []Shelf{}
+	for rows.Next() {
+		s, err := scanShelf(rows)
+		if err != nil {
+			return nil, err
+		}
+		shelves = append(shelves, s)
+	}
+	return shelves, rows.Err()
+}
+
+func (r *sqlShelfRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Shelf, error) {
+	s, err := scanShelf(r.db.QueryRowContext(ctx, "SELECT "+shelfColumns+" FROM shelves WHERE id = $1", id.Hex()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, ErrShelfNotFound
+	}
+	return s, err
+}
+
+func (r *sqlShelfRepository) FindByShareToken(ctx context.Context, token string) (Shelf, error) {
+	if token == "" {
+		return Shelf{}, ErrShelfNotFound
+	}
+	s, err := scanShelf(r.db.QueryRowContext(ctx, "SELECT "+shelfColumns+" FROM shelves WHERE share_token = $1", token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, ErrShelfNotFound
+	}
+	return s, err
+}
+
+func (r *sqlShelfRepository) Insert(ctx context.Context, s Shelf) (Shelf, error) {
+	s.ID = primitive.NewObjectID()
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO shelves ("+shelfColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		s.ID.Hex(), s.UserID.Hex(), s.Name, joinIDs(s.BookIDs), s.ShareToken, s.CreatedAt.UTC(), s.UpdatedAt.UTC())
+	if isUniqueViolation(err) {
+		return s, ErrDuplicateShelf
+	}
+	return s, err
+}
+
+func (r *sqlShelfRepository) Update(ctx context.Context, s Shelf) (Shelf, error) {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE shelves SET name = $1, book_ids = $2, share_token = $3, updated_at = $4 WHERE id = $5",
+		s.Name, joinIDs(s.BookIDs), s.ShareToken, s.UpdatedAt.UTC(), s.ID.Hex())
+	if isUniqueViolation(err) {
+		return s, ErrDuplicateShelf
+	}
+	if err != nil {
+		return s, err
+	}
+	return r.FindByID(ctx, s.ID)
+}
+
+func (r *sqlShelfRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM shelves WHERE id = $1", id.Hex())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrShelfNotFound
+	}
+	return nil
+}
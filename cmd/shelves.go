@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Users keep reading lists of their own, like "Want to read" or
+// "Favorites", as shelves of the catalog. Only their owner sees and
+// changes them, unless the owner shares one: a shared shelf gets a random
+// token, and anybody with the link /shelves/shared/<token> can read it.
+// Books that were deleted since they were put on a shelf are left out
+// when the shelf is shown.
+
+const (
+	maxShelfNameLength = 100
+	// Keeps a shelf showable on a single page
+	maxShelfBooks = 500
+)
+
+// A shelf as the API answers with it and the pages show it. Books are
+// only listed for a single shelf, in the order of the shelf; ShareURL is
+// set while it is shared.
+type shelfJSON struct {
+	Shelf
+	ShareURL string    `json:"share_url,omitempty"`
+	Books    []BookDTO `json:"books,omitempty"`
+	// Who the shelf belongs to, for the page of a shared shelf
+	Owner string `json:"-"`
+}
+
+// What can be sent to create a shelf or, with any of the fields, to
+// change one. Shared turns the share link on or off.
+type shelfRequest struct {
+	Name   *string `json:"name"`
+	Shared *bool   `json:"shared"`
+}
+
+// The books of a shelf in their new order, see reorderShelf.
+type shelfOrder struct {
+	BookIDs []primitive.ObjectID `json:"book_ids"`
+}
+
+func checkShelfName(v *ValidationError, name string) {
+	if name == "" {
+		v.add("name", "is required")
+	} else if len(name) > maxShelfNameLength {
+		v.add("name", fmt.Sprintf("must be at most %d characters", maxShelfNameLength))
+	}
+}
+
+// Loads the shelf named by the :id path parameter. The shelves of others
+// are reported as missing, so their IDs are not given away.
+func (s *server) ownShelf(ctx context.Context, c echo.Context) (Shelf, error) {
+	user, err := requireUser(c)
+	if err != nil {
+		return Shelf{}, err
+	}
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return Shelf{}, echo.NewHTTPError(http.StatusBadRequest, "Invalid ID format")
+	}
+	shelf, err := s.shelves.FindByID(ctx, id)
+	if err != nil {
+		return shelf, err
+	}
+	if shelf.UserID != user.ID {
+		return shelf, ErrShelfNotFound
+	}
+	return shelf, nil
+}
+
+// The public link of a shared shelf, empty if it is not shared.
+func (s *server) shelfShareURL(shelf Shelf) string {
+	if shelf.ShareToken == "" {
+		return ""
+	}
+	return strings.TrimSuffix(s.publicURL, "/") + "/shelves/shared/" + shelf.ShareToken
+}
+
+// Fetches the books of the shelf in its order, leaving out those that no
+// longer exist.
+func (s *server) shelfBooks(ctx context.Context, shelf Shelf) ([]BookStore, error) {
+	books := []BookStore{}
+	for _, id := range shelf.BookIDs {
+		book, err := s.books.FindByID(ctx, id)
+		if errors.Is(err, ErrBookNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	return books, nil
+}
+
+// Converts a single shelf with its books for the API.
+func (s *server) shelfToJSON(ctx context.Context, shelf Shelf) (shelfJSON, error) {
+	books, err := s.shelfBooks(ctx, shelf)
+	if err != nil {
+		return shelfJSON{}, err
+	}
+	result := shelfJSON{Shelf: shelf, ShareURL: s.shelfShareURL(shelf)}
+	if result.Books, err = s.bookDTOs(ctx, books); err != nil {
+		return shelfJSON{}, err
+	}
+	return result, nil
+}
+
+// Lists the shelves of the logged in user, without their books.
+func (s *server) listShelves(c echo.Context) error {
+	user, err := requireUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	shelves, err := s.shelves.FindByUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	result := make([]shelfJSON, len(shelves))
+	for i, shelf := range shelves {
+		result[i] = shelfJSON{Shelf: shelf, ShareURL: s.shelfShareURL(shelf)}
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func (s *server) getShelf(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	shelf, err := s.ownShelf(ctx, c)
+	if err != nil {
+		return err
+	}
+	result, err := s.shelfToJSON(ctx, shelf)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// Applies the share setting of the request to the shelf. Sharing a shelf
+// that is shared already keeps its link.
+func applyShared(shelf *Shelf, shared *bool) error {
+	if shared == nil {
+		return nil
+	}
+	if !*shared {
+		shelf.ShareToken = ""
+		return nil
+	}
+	if shelf.ShareToken != "" {
+		return nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	shelf.ShareToken = token
+	return nil
+}
+
+// Creates an empty shelf for the logged in user.
+func (s *server) createShelf(c echo.Context) error {
+	user, err := requireUser(c)
+	if err != nil {
+		return err
+	}
+	var req shelfRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid shelf data").SetInternal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	shelf := Shelf{UserID: user.ID, BookIDs: []primitive.ObjectID{}, CreatedAt: now, UpdatedAt: now}
+	if req.Name != nil {
+		shelf.Name = strings.TrimSpace(*req.Name)
+	}
+	v := &ValidationError{}
+	checkShelfName(v, shelf.Name)
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+	if err := applyShared(&shelf, req.Shared); err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	shelf, err = s.shelves.Insert(ctx, shelf)
+	if err != nil {
+		return err
+	}
+	result, err := s.shelfToJSON(ctx, shelf)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, result)
+}
+
+// Renames a shelf, or shares it or stops sharing it.
+func (s *server) patchShelf(c echo.Context) error {
+	var req shelfRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid shelf data").SetInternal(err)
+	}
+	v := &ValidationError{}
+	if req.Name != nil {
+		checkShelfName(v, strings.TrimSpace(*req.Name))
+	}
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	shelf, err := s.ownShelf(ctx, c)
+	if err != nil {
+		return err
+	}
+	if req.Name != nil {
+		shelf.Name = strings.TrimSpace(*req.Name)
+	}
+	if err := applyShared(&shelf, req.Shared); err != nil {
+		return err
+	}
+	return s.saveShelf(ctx, c, shelf)
+}
+
+// Stores the changed shelf and answers with it.
+func (s *server) saveShelf(ctx context.Context, c echo.Context, shelf Shelf) error {
+	shelf.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	shelf, err := s.shelves.Update(ctx, shelf)
+	if err != nil {
+		return err
+	}
+	result, err := s.shelfToJSON(ctx, shelf)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func (s *server) deleteShelf(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	shelf, err := s.ownShelf(ctx, c)
+	if err != nil {
+		return err
+	}
+	if err := s.shelves.Delete(ctx, shelf.ID); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Puts a book at the end of the shelf. A book that is already on the
+// shelf keeps its place.
+func (s *server) addShelfBook(c echo.Context) error {
+	id, err := primitive.ObjectIDFromHex(c.Param("book"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid book ID format")
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	shelf, err := s.ownShelf(ctx, c)
+	if err != nil {
+		return err
+	}
+	if _, err := s.books.FindByID(ctx, id); err != nil {
+		return err
+	}
+	if !slices.Contains(shelf.BookIDs, id) {
+		if len(shelf.BookIDs) >= maxShelfBooks {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("A shelf holds at most %d books", maxShelfBooks))
+		}
+		shelf.BookIDs = append(shelf.BookIDs, id)
+	}
+	return s.saveShelf(ctx, c, shelf)
+}
+
+// Takes a book off the shelf.
+func (s *server) removeShelfBook(c echo.Context) error {
+	id, err := primitive.ObjectIDFromHex(c.Param("book"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid book ID format")
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	shelf, err := s.ownShelf(ctx, c)
+	if err != nil {
+		return err
+	}
+	i := slices.Index(shelf.BookIDs, id)
+	if i < 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "The book is not on the shelf")
+	}
+	shelf.BookIDs = slices.Delete(shelf.BookIDs, i, i+1)
+	return s.saveShelf(ctx, c, shelf)
+}
+
+// Puts the books of the shelf into a new order. The request lists every
+// book of the shelf exactly once.
+func (s *server) reorderShelf(c echo.Context) error {
+	var req shelfOrder
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid shelf order").SetInternal(err)
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	shelf, err := s.ownShelf(ctx, c)
+	if err != nil {
+		return err
+	}
+	sorted := slices.Clone(req.BookIDs)
+	slices.SortFunc(sorted, func(a, b primitive.ObjectID) int { return strings.Compare(a.Hex(), b.Hex()) })
+	current := slices.Clone(shelf.BookIDs)
+	slices.SortFunc(current, func(a, b primitive.ObjectID) int { return strings.Compare(a.Hex(), b.Hex()) })
+	if !slices.Equal(sorted, current) {
+		return &ValidationError{Fields: []FieldError{{Field: "book_ids", Message: "must list every book of the shelf exactly once"}}}
+	}
+	shelf.BookIDs = req.BookIDs
+	return s.saveShelf(ctx, c, shelf)
+}
+
+// Shows the shelves of the logged in user, with their books and share
+// links.
+func (s *server) shelvesPage(c echo.Context) error {
+	user := currentUser(c)
+	if user == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Please log in first")
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	shelves, err := s.shelves.FindByUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	views := make([]shelfJSON, len(shelves))
+	for i, shelf := range shelves {
+		if views[i], err = s.shelfToJSON(ctx, shelf); err != nil {
+			return err
+		}
+	}
+	return c.Render(http.StatusOK, "shelf-list", views)
+}
+
+// Shows a shared shelf to anybody with its link, as a page of its own.
+func (s *server) sharedShelfPage(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	shelf, err := s.shelves.FindByShareToken(ctx, c.Param("token"))
+	if err != nil {
+		return err
+	}
+	view, err := s.shelfToJSON(ctx, shelf)
+	if err != nil {
+		return err
+	}
+	if owner, err := s.users.FindByID(ctx, shelf.UserID); err == nil {
+		view.Owner = owner.Name()
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	return c.Render(http.StatusOK, "shared-shelf", view)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc"
+)
+
+// Blocks until the process is asked to stop, then stops the servers from
+// accepting new requests and waits up to timeout for the ones in flight.
+// Whatever still runs by then is cut off. A second signal skips the wait.
+// redirect and grpcServer are nil if they are turned off.
+// WebSocket connections are not waited for, and the Server-Sent Events
+// streams are ended by closing stopping; the browsers reconnect to another
+// instance.
+func waitForShutdown(e *echo.Echo, redirect *http.Server, grpcServer *grpc.Server, stopping chan struct{}, timeout time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	// From here on signals are handled as usual again, i.e. kill the process
+	stop()
+	log.Printf("Shutting down, waiting up to %s for the requests in flight", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	close(stopping)
+
+	// GracefulStop knows no deadline, so it gets cut short once ours passes
+	grpcStopped := make(chan struct{})
+	go func() {
+		if grpcServer != nil {
+			grpcServer.GracefulStop()
+		}
+		close(grpcStopped)
+	}()
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+	if err := e.Shutdown(ctx); err != nil {
+		log.Printf("Failed to drain the HTTP connections: %v", err)
+		e.Close()
+	}
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+		log.Printf("Failed to drain the gRPC connections in time")
+		grpcServer.Stop()
+	}
+}
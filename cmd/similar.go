@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Books are similar to a book by what they share with it: its author, its
+// genres and, less so, its time. Every repository scores them alike, see
+// BookRepository.Similar:
+//
+//   - the same author, ignoring case, scores sameAuthorScore
+//   - every genre in common scores sharedGenreScore
+//   - the year scores up to 1, falling linearly to 0 at similarYearSpan
+//     years apart
+//
+// Books scoring 0 are not similar at all.
+const (
+	sameAuthorScore  = 3
+	sharedGenreScore = 2
+	similarYearSpan  = 20
+)
+
+// How many similar books /api/books/:id/similar answers with, unless
+// ?limit= asks for fewer or more, and how many it answers with at most.
+const (
+	defaultSimilarBooks = 5
+	maxSimilarBooks     = 20
+)
+
+// Scores how similar b is to the book of, as laid out above.
+func similarity(of, b BookStore) float64 {
+	score := 0.0
+	if strings.EqualFold(of.BookAuthor, b.BookAuthor) {
+		score += sameAuthorScore
+	}
+	for _, g := range b.Genres {
+		if slices.Contains(of.Genres, g) {
+			score += sharedGenreScore
+		}
+	}
+	years := math.Abs(float64(of.BookYear - b.BookYear))
+	return score + max(0, 1-years/similarYearSpan)
+}
+
+// Recommends books like the given one, most similar first, for a "You may
+// also like" section. Every book comes with its score.
+func (s *server) similarBooks(c echo.Context) error {
+	id, err := bookID(c)
+	if err != nil {
+		return err
+	}
+	q, err := parsePagination(c, defaultSimilarBooks)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	book, err := s.books.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	hits, err := s.books.Similar(ctx, book, min(q.Limit, maxSimilarBooks))
+	if err != nil {
+		return err
+	}
+	books := make([]BookStore, len(hits))
+	for i, h := range hits {
+		books[i] = h.BookStore
+	}
+	ret, err := s.bookDTOs(ctx, books)
+	if err != nil {
+		return err
+	}
+	for i, h := range hits {
+		ret[i].Score = &h.Score
+	}
+	return jsonWithETag(c, ret)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The sitemap (sitemaps.org) at /sitemap.xml tells search engines about
+// the public pages of the catalog: the index page and the page of every
+// book, with the day it last changed. A sitemap may list 50,000 URLs, so a
+// larger catalog gets a sitemap index instead, which points to the pages
+// /sitemap.xml?page=1, 2 and so on. /robots.txt names the sitemap.
+
+const (
+	mimeXML   = "application/xml; charset=utf-8"
+	sitemapNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+	// How many books a sitemap lists, one URL short of the limit for the
+	// index page
+	sitemapBooks = 50000 - 1
+)
+
+// An entry of a sitemap or of a sitemap index.
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	NS       string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+// Serves the sitemap, the sitemap index, or with ?page= a page of it.
+func (s *server) sitemap(c echo.Context) error {
+	page := 0
+	if raw := c.QueryParam("page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "page must be a positive integer")
+		}
+		page = n
+	}
+
+	ctx, cancel := requestContext(c)
+	_, total, err := s.books.FindAll(ctx, BookQuery{Page: 1, Limit: 1, Fields: []string{"updated_at"}})
+	cancel()
+	if err != nil {
+		return err
+	}
+	pages := max(int((total+sitemapBooks-1)/sitemapBooks), 1)
+	if page > pages {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("the sitemap has no page %d", page))
+	}
+	base := strings.TrimSuffix(s.publicURL, "/")
+	if page == 0 && pages > 1 {
+		index := sitemapIndex{NS: sitemapNS}
+		for i := 1; i <= pages; i++ {
+			index.Sitemaps = append(index.Sitemaps, sitemapURL{Loc: fmt.Sprintf("%s/sitemap.xml?page=%d", base, i)})
+		}
+		body, err := xml.MarshalIndent(index, "", "  ")
+		if err != nil {
+			return err
+		}
+		return c.Blob(http.StatusOK, mimeXML, append([]byte(xml.Header), body...))
+	}
+
+	// The books are written as they are read, like an export
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, mimeXML)
+	res.WriteHeader(http.StatusOK)
+	if _, err := res.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(res)
+	enc.Indent("", "  ")
+	urlset := xml.StartElement{Name: xml.Name{Local: "urlset"}, Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: sitemapNS}}}
+	urlElement := xml.StartElement{Name: xml.Name{Local: "url"}}
+	if err := enc.EncodeToken(urlset); err != nil {
+		return err
+	}
+	if page <= 1 {
+		if err := enc.EncodeElement(sitemapURL{Loc: base + "/"}, urlElement); err != nil {
+			return err
+		}
+	}
+	q := BookQuery{Sort: []SortField{{Field: "created_at"}}, Fields: []string{"updated_at"}}
+	if pages > 1 {
+		q.Page, q.Limit = page, sitemapBooks
+	}
+	err = s.books.Each(c.Request().Context(), q, func(b BookStore) error {
+		loc := base + "/books/" + b.ID.Hex()
+		return enc.EncodeElement(sitemapURL{Loc: loc, LastMod: b.UpdatedAt.UTC().Format(time.DateOnly)}, urlElement)
+	})
+	if err != nil {
+		return err
+	}
+	if err := enc.EncodeToken(urlset.End()); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+// Lets every crawler in and points it to the sitemap.
+func (s *server) robots(c echo.Context) error {
+	return c.String(http.StatusOK, "User-agent: *\nAllow: /\n\nSitemap: "+strings.TrimSuffix(s.publicURL, "/")+"/sitemap.xml\n")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Queries that take longer than database.slow_query are counted by their
+// command, like select or find, for /metrics and the admin dashboard. The
+// counts cover this instance since it started. For MongoDB the command
+// monitor reports them, see metrics.go; for the SQL databases the
+// connections are wrapped to time the queries.
+
+// How long a query may take before it counts as slow. Zero counts none.
+var slowQueryThreshold = 250 * time.Millisecond
+
+var slowQueries = &slowQueryCounter{counts: map[string]int64{}}
+
+type slowQueryCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// How many slow queries there were of a command.
+type SlowQueryCount struct {
+	Command string `json:"command"`
+	Count   int64  `json:"count"`
+}
+
+func countQuery(command string, d time.Duration) {
+	if slowQueryThreshold <= 0 || d < slowQueryThreshold {
+		return
+	}
+	dbSlowQueries.WithLabelValues(command).Inc()
+	slowQueries.mu.Lock()
+	slowQueries.counts[command]++
+	slowQueries.mu.Unlock()
+}
+
+// Change streams and tailing cursors wait for new data in getMore, so
+// those are slow on purpose and not counted.
+func countSlowMongoCommand(command string, d time.Duration) {
+	if command != "getMore" {
+		countQuery(command, d)
+	}
+}
+
+// Returns the counts, the most frequent command first.
+func (c *slowQueryCounter) list() []SlowQueryCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make([]SlowQueryCount, 0, len(c.counts))
+	for command, n := range c.counts {
+		counts = append(counts, SlowQueryCount{Command: command, Count: n})
+	}
+	slices.SortFunc(counts, func(a, b SlowQueryCount) int {
+		if a.Count != b.Count {
+			return int(b.Count - a.Count)
+		}
+		return strings.Compare(a.Command, b.Command)
+	})
+	return counts
+}
+
+// The command of a SQL query, its first keyword, in lower case.
+func sqlCommand(query string) string {
+	query = strings.TrimLeft(query, " \t\r\n(")
+	if i := strings.IndexAny(query, " \t\r\n("); i >= 0 {
+		query = query[:i]
+	}
+	return strings.ToLower(query)
+}
+
+// Opens the database like sql.Open, with the queries timed.
+func openTimedSQL(driverName, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+	return sql.OpenDB(timedConnector{driver: d, dsn: dsn}), nil
+}
+
+type timedConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (t timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var conn driver.Conn
+	var err error
+	if dc, ok := t.driver.(driver.DriverContext); ok {
+		var connector driver.Connector
+		if connector, err = dc.OpenConnector(t.dsn); err == nil {
+			conn, err = connector.Connect(ctx)
+		}
+	} else {
+		conn, err = t.driver.Open(t.dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{Conn: conn}, nil
+}
+
+func (t timedConnector) Driver() driver.Driver {
+	return t.driver
+}
+
+// A connection timing the queries sent through it, and otherwise passing
+// on what the driver's connection can do. Queries a driver can only run as
+// prepared statements are not timed, which neither pgx nor SQLite needs.
+type timedConn struct {
+	driver.Conn
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	countQuery(sqlCommand(query), time.Since(start))
+	return rows, err
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	res, err := e.ExecContext(ctx, query, args)
+	countQuery(sqlCommand(query), time.Since(start))
+	return res, err
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *timedConn) CheckNamedValue(v *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
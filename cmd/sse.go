@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How often an idle event stream gets a comment, so proxies do not close
+// it for inactivity.
+const sseKeepAlive = 30 * time.Second
+
+// Streams the changes to the catalog as Server-Sent Events until the client
+// disconnects or the server shuts down. The event name is the type of the change and the data holds
+// the book after it, of deleted books only the ID. Clients that fall
+// behind are disconnected; EventSource reconnects by itself, but changes in
+// between are lost, so they should reload what they show.
+func (s *server) streamBookEvents(c echo.Context) error {
+	events, unsubscribe := s.events.Subscribe()
+	defer unsubscribe()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	// Keeps nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-s.stopping:
+			return nil
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(bookEventJSON(e))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How many of the newest and of the oldest books the statistics list.
+const statsBookCount = 5
+
+// Figures about the books in the catalog; books in the trash do not count.
+type CatalogStats struct {
+	Books        int64
+	AveragePages float64
+	// By number of books, most first
+	Authors []AuthorCount
+	// In chronological order; decades without books are left out
+	Decades []DecadeCount
+	// By publication year, at most statsBookCount of each
+	Newest []BookStore
+	Oldest []BookStore
+}
+
+type AuthorCount struct {
+	Author string `json:"author" bson:"_id"`
+	Books  int64  `json:"books" bson:"books"`
+}
+
+// Decade is the first year of the decade, e.g. 1920 for 1920 to 1929.
+type DecadeCount struct {
+	Decade int   `json:"decade" bson:"_id"`
+	Books  int64 `json:"books" bson:"books"`
+}
+
+// An author and the names of their books, for the authors page.
+type AuthorBooks struct {
+	Author string   `json:"author" bson:"_id"`
+	Books  int64    `json:"books" bson:"books"`
+	Titles []string `json:"titles" bson:"titles"`
+}
+
+var byAuthor = []SortField{{Field: "author"}, {Field: "name"}}
+
+// Groups books sorted by byAuthor, for the repositories that cannot group
+// by themselves.
+func groupByAuthor(books []BookStore) []AuthorBooks {
+	groups := []AuthorBooks{}
+	for _, b := range books {
+		if n := len(groups); n == 0 || groups[n-1].Author != b.BookAuthor {
+			groups = append(groups, AuthorBooks{Author: b.BookAuthor})
+		}
+		g := &groups[len(groups)-1]
+		g.Books++
+		g.Titles = append(g.Titles, b.BookName)
+	}
+	return groups
+}
+
+// A decade and the names of the books published in it, for the years page.
+type DecadeBooks struct {
+	Decade int      `json:"decade" bson:"_id"`
+	Books  int64    `json:"books" bson:"books"`
+	Titles []string `json:"titles" bson:"titles"`
+}
+
+var byYear = []SortField{{Field: "year"}, {Field: "name"}}
+
+// Groups books sorted by byYear, like groupByAuthor.
+func groupByDecade(books []BookStore) []DecadeBooks {
+	groups := []DecadeBooks{}
+	for _, b := range books {
+		decade := decadeOf(b.BookYear)
+		if n := len(groups); n == 0 || groups[n-1].Decade != decade {
+			groups = append(groups, DecadeBooks{Decade: decade})
+		}
+		g := &groups[len(groups)-1]
+		g.Books++
+		g.Titles = append(g.Titles, b.BookName)
+	}
+	return groups
+}
+
+// Returns the first year of the decade the year falls into, rounding down
+// for the years BC as well.
+func decadeOf(year int) int {
+	return year - (year%10+10)%10
+}
+
+// The newest books by year, and among those of a year by name.
+var newestFirst = []SortField{{Field: "year", Desc: true}, {Field: "name"}}
+
+var oldestFirst = byYear
+
+// The statistics as /api/stats answers with them and the statistics page
+// shows them.
+type statsDTO struct {
+	Books        int64         `json:"books"`
+	AveragePages float64       `json:"average_pages"`
+	Authors      []AuthorCount `json:"authors"`
+	Decades      []DecadeCount `json:"decades"`
+	Newest       []BookDTO     `json:"newest"`
+	Oldest       []BookDTO     `json:"oldest"`
+}
+
+func newStatsDTO(stats CatalogStats) statsDTO {
+	dto := statsDTO{
+		Books:        stats.Books,
+		AveragePages: stats.AveragePages,
+		Authors:      stats.Authors,
+		Decades:      stats.Decades,
+		Newest:       []BookDTO{},
+		Oldest:       []BookDTO{},
+	}
+	for _, b := range stats.Newest {
+		dto.Newest = append(dto.Newest, newBookDTO(b))
+	}
+	for _, b := range stats.Oldest {
+		dto.Oldest = append(dto.Oldest, newBookDTO(b))
+	}
+	return dto
+}
+
+// The statistics as the stats job computed them last, see jobs.go.
+type statsSnapshot struct {
+	mu    sync.RWMutex
+	stats *CatalogStats
+}
+
+func (sn *statsSnapshot) set(stats CatalogStats) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.stats = &stats
+}
+
+func (sn *statsSnapshot) get() (CatalogStats, bool) {
+	sn.mu.RLock()
+	defer sn.mu.RUnlock()
+	if sn.stats == nil {
+		return CatalogStats{}, false
+	}
+	return *sn.stats, true
+}
+
+// Returns the statistics of the stats job if it ran, or computes them.
+func (s *server) catalogStats(ctx context.Context) (CatalogStats, error) {
+	if stats, ok := s.stats.get(); ok {
+		return stats, nil
+	}
+	return s.books.Stats(ctx)
+}
+
+func (s *server) getStats(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	stats, err := s.catalogStats(ctx)
+	if err != nil {
+		return err
+	}
+	return jsonWithETag(c, newStatsDTO(stats))
+}
+
+func (s *server) statsPage(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	stats, err := s.catalogStats(ctx)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "stats", newStatsDTO(stats))
+}
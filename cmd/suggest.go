@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How many suggestions /api/books/suggest answers with, unless ?limit=
+// asks for fewer or more, and how many it answers with at most. They are
+// fetched on every key stroke, so there are never many.
+const (
+	defaultSuggestions = 8
+	maxSuggestions     = 20
+)
+
+// Puts the books matching by name before those matching by author, both
+// in the order they came in, and keeps the first limit of them. A book
+// matching by both only shows up once.
+func mergeSuggestions(byName []BookStore, byAuthor []BookStore, limit int) []BookStore {
+	books := []BookStore{}
+	for _, b := range slices.Concat(byName, byAuthor) {
+		if len(books) == limit {
+			break
+		}
+		if !slices.ContainsFunc(books, func(other BookStore) bool { return other.ID == b.ID }) {
+			books = append(books, b)
+		}
+	}
+	return books
+}
+
+// Returns the smallest string greater than every string starting with the
+// prefix, comparing code point by code point, for a range query over an
+// index.
+func prefixEnd(prefix string) string {
+	last, size := utf8.DecodeLastRuneInString(prefix)
+	return prefix[:len(prefix)-size] + string(last+1)
+}
+
+// Answers while the user is still typing, with the books whose name or
+// author starts with what was typed so far. Only the fields needed to
+// show a suggestion are returned.
+func (s *server) suggestBooks(c echo.Context) error {
+	prefix := strings.ToLower(strings.TrimSpace(c.QueryParam("q")))
+	if prefix == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "q must not be empty")
+	}
+	q, err := parsePagination(c, defaultSuggestions)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	books, err := s.books.Suggest(ctx, prefix, min(q.Limit, maxSuggestions))
+	if err != nil {
+		return err
+	}
+
+	ret := []map[string]interface{}{}
+	for _, b := range books {
+		match := "name"
+		if !strings.HasPrefix(strings.ToLower(b.BookName), prefix) {
+			match = "author"
+		}
+		ret = append(ret, map[string]interface{}{
+			"id":     b.ID.Hex(),
+			"name":   b.BookName,
+			"author": b.BookAuthor,
+			"year":   b.BookYear,
+			"match":  match,
+		})
+	}
+	return jsonWithETag(c, ret)
+}
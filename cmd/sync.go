@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The systems outside the server that follow the changes to the books, the
+// search index, the webhooks and the response cache in Redis, are usually
+// kept up to date by every instance from its own subscription to the book
+// events. Changes made while no instance ran are missed that way, and with
+// change streams every instance delivers every webhook.
+//
+// With sync enabled, a single worker among the instances reads the change
+// stream of the books instead and hands the changes to those systems. Its
+// resume token is stored in the database once they took the changes, so
+// that after a restart, or when another instance takes over, it picks up
+// where it left off. A change may be handed over twice that way, but none
+// is lost. If the database no longer has the changes since the token, the
+// systems are brought up to date as a whole, and so they are on the very
+// first start.
+
+// Implemented by repositories whose changes can be read again from where a
+// reader left off, like MongoDB with the resume tokens of its change
+// streams.
+type bookChangeLog interface {
+	// Opens the changes after the token, or from now on if it is nil.
+	OpenChanges(ctx context.Context, token bson.Raw) (bookChangeCursor, error)
+	// Takes the sync of the books for the worker, or extends it, until the
+	// given time, unless another worker holds it. Returns the token the
+	// sync got to.
+	LeaseSync(ctx context.Context, worker string, until time.Time) (bool, bson.Raw, error)
+	// Records the token the sync got to, if the worker still holds it.
+	SaveSyncToken(ctx context.Context, worker string, token bson.Raw) error
+}
+
+type bookChangeCursor interface {
+	// Waits up to wait for changes and returns up to max of them, with the
+	// token after them.
+	Next(ctx context.Context, wait time.Duration, max int) ([]BookEvent, bson.Raw, error)
+	Close(ctx context.Context) error
+}
+
+var (
+	errChangesLost   = errors.New("the changes since the token are no longer available")
+	errSyncLeaseLost = errors.New("another instance took over the sync")
+)
+
+// How many changes are handed over at once.
+const syncBatchSize = 100
+
+// A system kept up to date by the worker.
+type syncSink struct {
+	name string
+	// Takes the changes, in order. Failures are retried until it does.
+	apply func(ctx context.Context, events []BookEvent) error
+	// Brings the system up to date as a whole, after changes were missed.
+	reset func(ctx context.Context) error
+}
+
+type syncWorker struct {
+	changes bookChangeLog
+	names   []string
+	sinks   []syncSink
+	lease   time.Duration
+	// Tells the instances apart, and the branches in the log
+	id      string
+	library string
+}
+
+// Returns the worker syncing the given branch of the library, or the main
+// library if it is empty, or nil if sync is disabled. It needs change
+// streams, so watched, the books as returned by watchBooks, tells whether
+// they are available.
+func newSyncWorker(cfg SyncConfig, books, watched BookRepository, library string) *syncWorker {
+	if !cfg.Enabled {
+		return nil
+	}
+	changes, ok := books.(bookChangeLog)
+	if _, fallback := watched.(*watchedBookRepository); !ok || fallback {
+		log.Printf("Sync needs change streams, the systems outside follow the changes made by this instance instead")
+		return nil
+	}
+	id, err := randomToken()
+	if err != nil {
+		log.Printf("Sync is disabled, failed to name the worker: %v", err)
+		return nil
+	}
+	return &syncWorker{changes: changes, names: cfg.Sinks, lease: cfg.Lease, id: id, library: library}
+}
+
+// Reports whether the worker keeps the named system up to date, rather
+// than the book events.
+func (w *syncWorker) takes(sink string) bool {
+	return w != nil && slices.Contains(w.names, sink)
+}
+
+func (w *syncWorker) add(sink syncSink) {
+	w.sinks = append(w.sinks, sink)
+}
+
+// Syncs for as long as the server runs, whenever this instance holds the
+// sync.
+func (w *syncWorker) start() {
+	if w == nil || len(w.sinks) == 0 {
+		return
+	}
+	go func() {
+		for {
+			if err := w.sync(); err != nil {
+				w.logf("Sync stopped, retrying: %v", err)
+			}
+			time.Sleep(w.lease / 3)
+		}
+	}()
+}
+
+func (w *syncWorker) logf(format string, args ...interface{}) {
+	if w.library != "" {
+		format = "[" + w.library + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// Takes the sync or extends it.
+func (w *syncWorker) renew() (bool, bson.Raw, error) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	return w.changes.LeaseSync(ctx, w.id, time.Now().Add(w.lease))
+}
+
+// Hands the changes over until the sync is lost or fails. Returns nil
+// right away if another instance holds it.
+func (w *syncWorker) sync() error {
+	ctx := context.Background()
+	held, token, err := w.renew()
+	if err != nil || !held {
+		return err
+	}
+	renewed := time.Now()
+
+	cursor, err := w.changes.OpenChanges(ctx, token)
+	if errors.Is(err, errChangesLost) {
+		w.logf("Sync missed changes, bringing %s up to date: %v", w.names, err)
+		token = nil
+		cursor, err = w.changes.OpenChanges(ctx, nil)
+	}
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+	// The stream is open before the reset, so that nothing changed
+	// meanwhile is missed
+	if token == nil {
+		for _, sink := range w.sinks {
+			if err := w.retry(sink, "bring %s up to date", func() error { return sink.reset(ctx) }); err != nil {
+				return err
+			}
+		}
+	}
+	w.logf("Syncing %s from the change stream", w.names)
+
+	for {
+		if time.Since(renewed) >= w.lease/3 {
+			held, _, err := w.renew()
+			if err != nil {
+				return err
+			}
+			if !held {
+				return errSyncLeaseLost
+			}
+			renewed = time.Now()
+		}
+		events, next, err := cursor.Next(ctx, w.lease/3, syncBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(events) > 0 {
+			for _, sink := range w.sinks {
+				if err := w.retry(sink, "update %s", func() error { return sink.apply(ctx, events) }); err != nil {
+					return err
+				}
+			}
+		}
+		if next != nil && !bytes.Equal(next, token) {
+			saveCtx, cancel := dbContext()
+			err := w.changes.SaveSyncToken(saveCtx, w.id, next)
+			cancel()
+			if err != nil {
+				return err
+			}
+			token = next
+		}
+	}
+}
+
+// Calls f until it succeeds, waiting longer after every failure, for as
+// long as this instance holds the sync.
+func (w *syncWorker) retry(sink syncSink, what string, f func() error) error {
+	for delay := time.Second; ; delay = min(2*delay, time.Minute) {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		w.logf("Sync failed to "+what+", retrying in %v: %v", sink.name, delay, err)
+		time.Sleep(delay)
+		held, _, err := w.renew()
+		if err != nil {
+			return err
+		}
+		if !held {
+			return errSyncLeaseLost
+		}
+	}
+}
+
+// Keeps the Elasticsearch index up to date, and builds it anew when
+// changes were missed.
+func searchSync(x *elasticsearchIndex, books BookRepository) syncSink {
+	return syncSink{
+		name: "search",
+		apply: func(ctx context.Context, events []BookEvent) error {
+			return x.apply(events)
+		},
+		reset: func(ctx context.Context) error {
+			index, count, err := x.Reindex(ctx, books)
+			if err == nil {
+				log.Printf("Indexed %d books in %s", count, index)
+			}
+			return err
+		},
+	}
+}
+
+// Delivers the changes to the webhooks. Those missed cannot be delivered
+// after the fact.
+func webhookSync(d *webhookDispatcher) syncSink {
+	return syncSink{
+		name: "webhooks",
+		apply: func(ctx context.Context, events []BookEvent) error {
+			for _, e := range events {
+				d.dispatch(e)
+			}
+			return nil
+		},
+		reset: func(ctx context.Context) error {
+			return nil
+		},
+	}
+}
+
+// Clears the response cache shared in Redis.
+func cacheSync(cache responseCache) syncSink {
+	clearCache := func(context.Context) error {
+		ctx, cancel := dbContext()
+		defer cancel()
+		return cache.Clear(ctx)
+	}
+	return syncSink{
+		name:  "cache",
+		apply: func(ctx context.Context, _ []BookEvent) error { return clearCache(ctx) },
+		reset: clearCache,
+	}
+}
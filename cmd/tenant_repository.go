@@ -0,0 +1,238 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrTenantNotFound  = errors.New("library not found")
+	ErrDuplicateTenant = errors.New("library already exists")
+)
+
+// A library branch with a catalog of its own, see tenants.go. Requests
+// name it by its slug.
+type Tenant struct {
+	Slug      string    `json:"slug" bson:"_id"`
+	Name      string    `json:"name" bson:"name"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Stores the library branches, in the database of the main library.
+type TenantRepository interface {
+	// Returns all branches, ordered by slug.
+	FindAll(ctx context.Context) ([]Tenant, error)
+	FindBySlug(ctx context.Context, slug string) (Tenant, error)
+	// Stores a new branch. A slug that is already taken fails with
+	// ErrDuplicateTenant.
+	Insert(ctx context.Context, t Tenant) (Tenant, error)
+	// Renames the branch; the slug stays.
+	Update(ctx context.Context, t Tenant) (Tenant, error)
+	Delete(ctx context.Context, slug string) error
+}
+
+// Keeps the branches in memory, for the memory storage.
+type memoryTenantRepository struct {
+	mu      sync.RWMutex
+	tenants map[string]Tenant
+}
+
+func newMemoryTenantRepository() *memoryTenantRepository {
+	return &memoryTenantRepository{tenants: map[string]Tenant{}}
+}
+
+func (r *memoryTenantRepository) FindAll(ctx context.Context) ([]Tenant, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tenants := []Tenant{}
+	for _, t := range r.tenants {
+		tenants = append(tenants, t)
+	}
+	slices.SortFunc(tenants, func(a, b Tenant) int { return cmp.Compare(a.Slug, b.Slug) })
+	return tenants, nil
+}
+
+func (r *memoryTenantRepository) FindBySlug(ctx context.Context, slug string) (Tenant, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.tenants[slug]
+	if !ok {
+		return Tenant{}, ErrTenantNotFound
+	}
+	return t, nil
+}
+
+func (r *memoryTenantRepository) Insert(ctx context.Context, t Tenant) (Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.tenants[t.Slug]; ok {
+		return t, ErrDuplicateTenant
+	}
+	r.tenants[t.Slug] = t
+	return t, nil
+}
+
+func (r *memoryTenantRepository) Update(ctx context.Context, t Tenant) (Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.tenants[t.Slug]
+	if !ok {
+		return t, ErrTenantNotFound
+	}
+	stored.Name = t.Name
+	r.tenants[t.Slug] = stored
+	return stored, nil
+}
+
+func (r *memoryTenantRepository) Delete(ctx context.Context, slug string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.tenants[slug]; !ok {
+		return ErrTenantNotFound
+	}
+	delete(r.tenants, slug)
+	return nil
+}
+
+// Stores the branches in their own MongoDB collection, keyed by slug.
+type mongoTenantRepository struct {
+	coll mongoCollection
+}
+
+func newMongoTenantRepository(coll *mongo.Collection) *mongoTenantRepository {
+	return &mongoTenantRepository{coll: withPolicy(coll)}
+}
+
+func (r *mongoTenantRepository) FindAll(ctx context.Context) ([]Tenant, error) {
+	cursor, err := r.coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	tenants := []Tenant{}
+	if err = cursor.All(ctx, &tenants); err != nil {
+		return nil, err
+	}
+	return tenants, nil
+}
+
+func (r *mongoTenantRepository) FindBySlug(ctx context.Context, slug string) (Tenant, error) {
+	var t Tenant
+	err := r.coll.FindOne(ctx, bson.M{"_id": slug}).Decode(&t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return t, ErrTenantNotFound
+	}
+	return t, err
+}
+
+func (r *mongoTenantRepository) Insert(ctx context.Context, t Tenant) (Tenant, error) {
+	_, err := r.coll.InsertOne(ctx, t)
+	if mongo.IsDuplicateKeyError(err) {
+		return t, ErrDuplicateTenant
+	}
+	return t, err
+}
+
+func (r *mongoTenantRepository) Update(ctx context.Context, t Tenant) (Tenant, error) {
+	var stored Tenant
+	err := r.coll.FindOneAndUpdate(ctx, bson.M{"_id": t.Slug}, bson.M{"$set": bson.M{"name": t.Name}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return t, ErrTenantNotFound
+	}
+	return stored, err
+}
+
+func (r *mongoTenantRepository) Delete(ctx context.Context, slug string) error {
+	res, err := r.coll.DeleteOne(ctx, bson.M{"_id": slug})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrTenantNotFound
+	}
+	return nil
+}
+
+// Stores the branches in the tenants table, see sqlMigrations.
+type sqlTenantRepository struct {
+	db *sql.DB
+}
+
+func newSQLTenantRepository(db *sql.DB) *sqlTenantRepository {
+	return &sqlTenantRepository{db: db}
+}
+
+func (r *sqlTenantRepository) FindAll(ctx context.Context) ([]Tenant, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT slug, name, created_at FROM tenants ORDER BY slug")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := []Tenant{}
+	for rows.Next() {
+		var t Tenant
+		if err := rows.Scan(&t.Slug, &t.Name, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+func (r *sqlTenantRepository) FindBySlug(ctx context.Context, slug string) (Tenant, error) {
+	var t Tenant
+	err := r.db.QueryRowContext(ctx, "SELECT slug, name, created_at FROM tenants WHERE slug = $1", slug).
+		Scan(&t.Slug, &t.Name, &t.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, ErrTenantNotFound
+	}
+	return t, err
+}
+
+func (r *sqlTenantRepository) Insert(ctx context.Context, t Tenant) (Tenant, error) {
+	_, err := r.db.ExecContext(ctx, "INSERT INTO tenants (slug, name, created_at) VALUES ($1, $2, $3)", t.Slug, t.Name, t.CreatedAt)
+	if isUniqueViolation(err) {
+		return t, ErrDuplicateTenant
+	}
+	return t, err
+}
+
+func (r *sqlTenantRepository) Update(ctx context.Context, t Tenant) (Tenant, error) {
+	res, err := r.db.ExecContext(ctx, "UPDATE tenants SET name = $1 WHERE slug = $2", t.Name, t.Slug)
+	if err != nil {
+		return t, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return t, err
+	}
+	if n == 0 {
+		return t, ErrTenantNotFound
+	}
+	return r.FindBySlug(ctx, t.Slug)
+}
+
+func (r *sqlTenantRepository) Delete(ctx context.Context, slug string) error {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM tenants WHERE slug = $1", slug)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTenantNotFound
+	}
+	return nil
+}
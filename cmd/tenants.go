@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// Several library branches can be served from one deployment, each with a
+// catalog of its own: its books, authors, genres, copies, loans,
+// reservations, shelves, reading progress, webhooks and audit log. The
+// users, with their sessions and API keys, are shared, so a librarian logs
+// in once for all branches.
+//
+// Requests name their branch as configured by tenancy.resolve; those that
+// do not go to the main library, the one there was before branches. The
+// catalog of a branch lives in a database of its own next to the main
+// one, see repositories.openTenant, so no query needs to know about
+// branches at all. Branches are created and deleted by the admins under
+// /api/admin/tenants.
+//
+// The web pages link to absolute paths, so they only work with branches
+// named by subdomain; the other ways suit the API. gRPC always serves the
+// main library.
+
+// The longest slug a branch may have, which keeps the database names
+// derived from it within the limits.
+const maxTenantSlugLength = 32
+
+// Slugs are lower case words joined by hyphens, like genre names, so they
+// fit into subdomains, paths and database names alike.
+func validTenantSlug(slug string) bool {
+	return genrePattern.MatchString(slug) && len(slug) <= maxTenantSlugLength
+}
+
+const maxTenantNameLength = 100
+
+// Where the requests naming a branch are sent to. Every branch gets a
+// server of its own, a copy of the main one with the catalog swapped, see
+// serveCatalog. Its catalog is opened on its first request, or when it is
+// created, and stays open until shutdown.
+//
+// Other instances only learn of a deleted branch on their next start.
+type tenantRouter struct {
+	main   *server
+	cfg    Config
+	repos  *repositories
+	rdb    *redis.Client
+	limits rateLimitStore
+
+	mu       sync.Mutex
+	catalogs map[string]*tenantCatalog
+}
+
+type tenantCatalog struct {
+	e     *echo.Echo
+	close func()
+	// Unset once the branch is deleted; created again, it is served by
+	// the catalog that is still open
+	active bool
+}
+
+func newTenantRouter(main *server, cfg Config, repos *repositories, rdb *redis.Client, limits rateLimitStore) *tenantRouter {
+	return &tenantRouter{
+		main:     main,
+		cfg:      cfg,
+		repos:    repos,
+		rdb:      rdb,
+		limits:   limits,
+		catalogs: map[string]*tenantCatalog{},
+	}
+}
+
+// Tells which branch the request names, and the path it asks for within
+// the branch if that differs from the path of the request. An empty slug
+// stands for the main library.
+func (t *tenantRouter) resolve(req *http.Request) (string, string) {
+	switch t.cfg.Tenancy.Resolve {
+	case "header":
+		return strings.ToLower(req.Header.Get(t.cfg.Tenancy.Header)), ""
+	case "path":
+		rest, ok := strings.CutPrefix(req.URL.Path, "/libraries/")
+		if !ok {
+			return "", ""
+		}
+		slug, path, _ := strings.Cut(rest, "/")
+		return slug, "/" + path
+	}
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	u, err := url.Parse(t.cfg.PublicURL)
+	if err != nil {
+		return "", ""
+	}
+	slug, _ := strings.CutSuffix(host, "."+strings.ToLower(u.Hostname()))
+	if slug == host {
+		return "", ""
+	}
+	return slug, ""
+}
+
+// Hands the requests naming a branch to the server of the branch. Runs
+// before routing, see echo's Pre, so the main library never sees them.
+func (t *tenantRouter) dispatch(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		slug, path := t.resolve(req)
+		if slug == "" {
+			return next(c)
+		}
+		if !validTenantSlug(slug) {
+			return ErrTenantNotFound
+		}
+		ctx, cancel := requestContext(c)
+		defer cancel()
+		e, err := t.open(ctx, slug)
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			req.URL.Path, req.URL.RawPath = path, ""
+		}
+		e.ServeHTTP(c.Response(), req)
+		return nil
+	}
+}
+
+// Returns the server of the branch, opening its catalog unless it is open
+// already.
+func (t *tenantRouter) open(ctx context.Context, slug string) (*echo.Echo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	catalog, ok := t.catalogs[slug]
+	if ok && catalog.active {
+		return catalog.e, nil
+	}
+	if _, err := t.repos.tenants.FindBySlug(ctx, slug); err != nil {
+		return nil, err
+	}
+	if ok {
+		catalog.active = true
+		return catalog.e, nil
+	}
+
+	// Creating the database of a new branch takes longer than a request
+	// may talk to the database
+	openCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+	repos, closeStorage, err := t.repos.openTenant(openCtx, slug)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the catalog of %s: %w", slug, err)
+	}
+	if !t.cfg.Database.Migrate {
+		if err := checkMigrations(openCtx, repos); err != nil {
+			closeStorage()
+			return nil, fmt.Errorf("failed to open the catalog of %s: %w", slug, err)
+		}
+	}
+
+	s := *t.main
+	s.tenants = nil
+	s.serveCatalog(t.cfg, repos, t.rdb, slug)
+	t.catalogs[slug] = &tenantCatalog{e: s.newEcho(t.cfg, t.limits), close: closeStorage, active: true}
+	log.Printf("Opened the catalog of the library %s", slug)
+	return t.catalogs[slug].e, nil
+}
+
+// Stops serving a deleted branch.
+func (t *tenantRouter) forget(slug string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if catalog, ok := t.catalogs[slug]; ok {
+		catalog.active = false
+	}
+}
+
+// Releases the catalogs of all branches, on shutdown.
+func (t *tenantRouter) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, catalog := range t.catalogs {
+		catalog.close()
+	}
+}
+
+// What an admin sends to create a branch or, without the slug, to rename
+// one.
+type tenantRequest struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+func checkTenantName(v *ValidationError, name string) {
+	if name == "" {
+		v.add("name", "is required")
+	} else if len(name) > maxTenantNameLength {
+		v.add("name", fmt.Sprintf("must be at most %d characters", maxTenantNameLength))
+	}
+}
+
+func (s *server) listTenants(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	tenants, err := s.tenants.repos.tenants.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tenants)
+}
+
+func (s *server) getTenant(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	tenant, err := s.tenants.repos.tenants.FindBySlug(ctx, c.Param("slug"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tenant)
+}
+
+// Registers a branch and opens its catalog, which creates its database.
+// The catalog starts out empty.
+func (s *server) createTenant(c echo.Context) error {
+	var req tenantRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid library data").SetInternal(err)
+	}
+	tenant := Tenant{
+		Slug:      strings.TrimSpace(req.Slug),
+		Name:      strings.TrimSpace(req.Name),
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	v := &ValidationError{}
+	if tenant.Slug == "" {
+		v.add("slug", "is required")
+	} else if !validTenantSlug(tenant.Slug) {
+		v.add("slug", fmt.Sprintf("must be lower case words joined by hyphens, at most %d characters", maxTenantSlugLength))
+	}
+	checkTenantName(v, tenant.Name)
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	tenant, err := s.tenants.repos.tenants.Insert(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	if _, err := s.tenants.open(ctx, tenant.Slug); err != nil {
+		if err := s.tenants.repos.tenants.Delete(ctx, tenant.Slug); err != nil && !errors.Is(err, ErrTenantNotFound) {
+			log.Printf("Failed to remove the library %s again: %v", tenant.Slug, err)
+		}
+		return err
+	}
+	return c.JSON(http.StatusCreated, tenant)
+}
+
+// Renames a branch.
+func (s *server) patchTenant(c echo.Context) error {
+	var req tenantRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid library data").SetInternal(err)
+	}
+	v := &ValidationError{}
+	checkTenantName(v, strings.TrimSpace(req.Name))
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	tenant, err := s.tenants.repos.tenants.Update(ctx, Tenant{Slug: c.Param("slug"), Name: strings.TrimSpace(req.Name)})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tenant)
+}
+
+// Stops serving a branch. Its database is kept, so creating a branch of
+// the same slug brings the catalog back; dropping it is up to the
+// operators.
+func (s *server) deleteTenant(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	slug := c.Param("slug")
+	if err := s.tenants.repos.tenants.Delete(ctx, slug); err != nil {
+		return err
+	}
+	s.tenants.forget(slug)
+	return c.NoContent(http.StatusNoContent)
+}
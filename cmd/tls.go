@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Serves e on the configured address: over HTTPS with the given
+// certificate, over HTTPS with certificates from Let's Encrypt, or over
+// plain HTTP if TLS is not configured, e.g. behind a proxy that terminates
+// it.
+func serve(e *echo.Echo, cfg Config) error {
+	switch {
+	case cfg.TLS.CertFile != "":
+		return e.StartTLS(cfg.Listen, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	case len(cfg.TLS.Domains) > 0:
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(cfg.TLS.Domains...)
+		e.AutoTLSManager.Cache = autocert.DirCache(cfg.TLS.CacheDir)
+		e.AutoTLSManager.Email = cfg.TLS.Email
+		return e.StartAutoTLS(cfg.Listen)
+	}
+	return e.Start(cfg.Listen)
+}
+
+// Tells browsers to stick to HTTPS for tls.hsts_max_age. Subdomains are
+// left out, as they may well be served by someone else. The header is only
+// sent over HTTPS, where browsers take it into account.
+func hsts(cfg TLSConfig) echo.MiddlewareFunc {
+	return middleware.SecureWithConfig(middleware.SecureConfig{
+		HSTSMaxAge:            int(cfg.HSTSMaxAge.Seconds()),
+		HSTSExcludeSubdomains: true,
+	})
+}
+
+// Starts a plain HTTP server on tls.redirect_listen that sends every
+// request on to the same URL over HTTPS. It also answers the HTTP
+// challenges of Let's Encrypt, which needs port 80 for them. Returns nil if
+// no such server is configured.
+func startRedirect(e *echo.Echo, cfg Config) *http.Server {
+	if cfg.TLS.RedirectListen == "" {
+		return nil
+	}
+	// Browsers leave out the default port, anything else has to be added
+	port := ""
+	if _, p, err := net.SplitHostPort(cfg.Listen); err == nil && p != "443" {
+		port = ":" + p
+	}
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			// A bare IPv6 address
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+port+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	if len(cfg.TLS.Domains) > 0 {
+		handler = e.AutoTLSManager.HTTPHandler(handler)
+	}
+
+	srv := &http.Server{Addr: cfg.TLS.RedirectListen, Handler: handler}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("HTTPS redirect: %v", err)
+		}
+	}()
+	return srv
+}
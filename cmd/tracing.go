@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/CAPS-Cloud/exercises/cmd"
+
+// Sets up tracing with OpenTelemetry. The spans are exported over OTLP/HTTP
+// as soon as OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set; the exporter, the sampler and
+// the service name (bookstore unless OTEL_SERVICE_NAME says otherwise) are
+// configured through the standard OTEL_* variables. Without an endpoint no
+// spans are recorded, but trace context is still passed on. The returned
+// function flushes the spans not exported yet.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName("bookstore")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Opens a span for every request, continuing the trace of the caller if
+// the request carries a traceparent header. Handlers pass the span on to
+// the database through requestContext.
+func traceRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	tracer := otel.Tracer(tracerName)
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := tracer.Start(ctx, req.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(req.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(req.URL.Path),
+				semconv.ClientAddress(c.RealIP()),
+				semconv.UserAgentOriginal(req.UserAgent()),
+			))
+		defer span.End()
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+
+		// Like in instrumentRequests, errors only become responses further
+		// out
+		status := c.Response().Status
+		if err != nil {
+			status = toAPIError(err).Code
+			span.RecordError(err)
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
+
+// Wraps a command monitor so every command the MongoDB client sends gets a
+// span within the trace of the context it was sent with. The commands
+// themselves are left out of the spans, as they may hold personal data.
+func traceMongoCommands(next *event.CommandMonitor) *event.CommandMonitor {
+	tracer := otel.Tracer(tracerName)
+	var spans sync.Map // request ID -> trace.Span
+	end := func(requestID int64, failure string) {
+		s, ok := spans.LoadAndDelete(requestID)
+		if !ok {
+			return
+		}
+		span := s.(trace.Span)
+		if failure != "" {
+			span.SetStatus(codes.Error, failure)
+		}
+		span.End()
+	}
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			attrs := []attribute.KeyValue{
+				semconv.DBSystemMongoDB,
+				semconv.DBOperationName(e.CommandName),
+				semconv.DBNamespace(e.DatabaseName),
+			}
+			name := e.CommandName
+			if coll, ok := e.Command.Lookup(e.CommandName).StringValueOK(); ok {
+				attrs = append(attrs, semconv.DBCollectionName(coll))
+				name += " " + coll
+			}
+			_, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+			spans.Store(e.RequestID, span)
+			if next.Started != nil {
+				next.Started(ctx, e)
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			end(e.RequestID, "")
+			if next.Succeeded != nil {
+				next.Succeeded(ctx, e)
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			end(e.RequestID, e.Failure)
+			if next.Failed != nil {
+				next.Failed(ctx, e)
+			}
+		},
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// How long deleted books stay in the trash unless TRASH_DAYS says
+// otherwise.
+const defaultTrashDays = 30
+
+// Takes from library.trash_days how long deleted books can still be
+// restored.
+func loadTrashRetention(cfg LibraryConfig) time.Duration {
+	return time.Duration(cfg.TrashDays) * 24 * time.Hour
+}
+
+// Lists the deleted books, the most recently deleted first unless ?sort=
+// says otherwise. Takes the same filters as /api/books.
+func (s *server) listTrash(c echo.Context) error {
+	q, err := parseBookQuery(c, 0)
+	if err != nil {
+		return err
+	}
+	q.Trash = true
+	if len(q.Sort) == 0 {
+		q.Sort = []SortField{{Field: "deleted_at", Desc: true}}
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	results, total, err := s.books.FindAll(ctx, q)
+	if err != nil {
+		return err
+	}
+	books, err := s.bookDTOs(ctx, results)
+	if err != nil {
+		return err
+	}
+	setPaginationHeaders(c, newBookPage(c, q, books, total))
+	return c.JSON(http.StatusOK, books)
+}
+
+// Takes a book back out of the trash.
+func (s *server) undeleteBook(c echo.Context) error {
+	objID, err := bookID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := writeContext(c)
+	defer cancel()
+	book, err := s.books.Undelete(ctx, objID)
+	if err != nil {
+		return err
+	}
+	books, err := s.bookDTOs(ctx, []BookStore{book})
+	if err != nil {
+		return err
+	}
+	return taggedJSON(c, books[0])
+}
+
+// Removes the books that were deleted before the given time, together
+// with their copies, and returns how many. The purge_trash job does so
+// regularly, see jobs.go. Every instance does, which is harmless, as a
+// book can only be purged once.
+func (s *server) purgeTrashBefore(before time.Time) (int, error) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	ids, err := s.books.Purge(ctx, before)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	log.Printf("Purged %d books from the trash", len(ids))
+	return len(ids), s.copies.DeleteByBooks(ctx, ids)
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/qr"
+	"github.com/CAPS-Cloud/exercises/internal/totp"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Users who log in with a password can turn on two-factor authentication
+// under /api/me/2fa. After scanning the QR code into an authenticator app
+// and confirming the first code, logging in takes a code from the app as
+// well, or one of the recovery codes for when the app is gone. Every
+// recovery code works once. Users of a login provider, see oauth.go, use
+// the second factor of their provider instead. An admin can turn it off for
+// users who lost both their app and their recovery codes.
+//
+// The secrets the apps share with the server are encrypted in the
+// database with auth.totp_key, if it is set, and bound to the account, so
+// that a copy of the database alone does not give away the codes.
+// Secrets stored before the key was set stay readable in the clear.
+
+// How many recovery codes users get at once.
+const recoveryCodeCount = 10
+
+// How long the login form waits for the code after the password was right.
+const loginChallengeTTL = 5 * time.Minute
+
+// Marks the TOTP secrets stored encrypted.
+const sealedTOTPPrefix = "sealed:"
+
+var (
+	ErrCodeRequired = errors.New("a one-time code is required")
+	ErrInvalidCode  = errors.New("invalid one-time code")
+)
+
+// Returns the cipher the TOTP secrets are encrypted with, from
+// auth.totp_key, or nil without one.
+func loadTOTPKey(key string) cipher.AEAD {
+	if key == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return aead
+}
+
+// Encrypts the secret of the user for the database. The ID of the user
+// goes into the authentication, so the secret cannot be moved to another
+// account.
+func (s *server) sealTOTPSecret(u User, secret string) (string, error) {
+	if s.totpKey == nil {
+		return secret, nil
+	}
+	nonce := make([]byte, s.totpKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.totpKey.Seal(nonce, nonce, []byte(secret), u.ID[:])
+	return sealedTOTPPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Returns the secret of the user in the clear.
+func (s *server) openTOTPSecret(u User) (string, error) {
+	raw, sealed := strings.CutPrefix(u.TOTPSecret, sealedTOTPPrefix)
+	if !sealed {
+		return u.TOTPSecret, nil
+	}
+	if s.totpKey == nil {
+		return "", errors.New("the TOTP secret of the user is encrypted, but auth.totp_key is not set")
+	}
+	b, err := base64.RawStdEncoding.DecodeString(raw)
+	n := s.totpKey.NonceSize()
+	if err != nil || len(b) < n {
+		return "", errors.New("the TOTP secret of the user is damaged")
+	}
+	secret, err := s.totpKey.Open(nil, b[:n], b[n:], u.ID[:])
+	if err != nil {
+		return "", errors.New("the TOTP secret of the user does not decrypt with auth.totp_key")
+	}
+	return string(secret), nil
+}
+
+// What users send to confirm, turn off and renew their second factor.
+type totpRequest struct {
+	Code string `json:"code"`
+}
+
+// What users scan into their authenticator app. The QR code is a PNG in a
+// data URL, ready to be shown in an img tag.
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URL    string `json:"otpauth_url"`
+	QRCode string `json:"qr_code"`
+}
+
+type recoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// The name the authenticator apps list the account under: the host of the
+// server, as the label of otpauth URLs cannot hold a port.
+func (s *server) totpIssuer() string {
+	if u, err := url.Parse(s.publicURL); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return "bookstore"
+}
+
+// Starts the enrollment with a new secret. It only takes effect once the
+// first code is confirmed, until then starting over replaces it.
+func (s *server) enrollTOTP(c echo.Context) error {
+	me, err := requireUser(c)
+	if err != nil {
+		return err
+	}
+	if me.Provider != "" {
+		return echo.NewHTTPError(http.StatusConflict, "Accounts of a login provider use the second factor of the provider")
+	}
+	if me.TOTPEnabled {
+		return echo.NewHTTPError(http.StatusConflict, "Two-factor authentication is already on")
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	user, err := s.users.FindByID(ctx, me.ID)
+	if err != nil {
+		return err
+	}
+	if user.TOTPSecret, err = s.sealTOTPSecret(user, secret); err != nil {
+		return err
+	}
+	if _, err := s.users.Update(ctx, user); err != nil {
+		return err
+	}
+
+	otpauth := totp.URL(s.totpIssuer(), user.Username, secret)
+	code, err := qr.Encode([]byte(otpauth), qr.Medium)
+	if err != nil {
+		return err
+	}
+	var img bytes.Buffer
+	if err := png.Encode(&img, code.Image(4)); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, totpEnrollment{
+		Secret: secret,
+		URL:    otpauth,
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(img.Bytes()),
+	})
+}
+
+// Turns two-factor authentication on once the user proved with a code
+// that the app has the secret, and hands out the recovery codes.
+func (s *server) confirmTOTP(c echo.Context) error {
+	req, err := bindTOTPRequest(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	user, err := s.meForTOTP(ctx, c)
+	if err != nil {
+		return err
+	}
+	if user.TOTPEnabled {
+		return echo.NewHTTPError(http.StatusConflict, "Two-factor authentication is already on")
+	}
+	if user.TOTPSecret == "" {
+		return echo.NewHTTPError(http.StatusConflict, "Two-factor authentication has to be set up with POST /api/v1/me/2fa first")
+	}
+	secret, err := s.openTOTPSecret(user)
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(secret, req.Code, time.Now())
+	if !ok {
+		return invalidCode()
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	user.TOTPEnabled = true
+	user.TOTPStep = step
+	user.RecoveryCodes = hashes
+	if _, err := s.users.Update(ctx, user); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, recoveryCodes{Codes: codes})
+}
+
+// Turns two-factor authentication off, with a code or a recovery code.
+func (s *server) disableTOTP(c echo.Context) error {
+	req, err := bindTOTPRequest(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	user, err := s.meForTOTP(ctx, c)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return echo.NewHTTPError(http.StatusConflict, "Two-factor authentication is not on")
+	}
+	if ok, err := s.useSecondFactor(ctx, &user, req.Code); err != nil {
+		return err
+	} else if !ok {
+		return invalidCode()
+	}
+	turnOffTOTP(&user)
+	if _, err := s.users.Update(ctx, user); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Replaces the recovery codes with new ones, for users who used up or lost
+// theirs.
+func (s *server) renewRecoveryCodes(c echo.Context) error {
+	req, err := bindTOTPRequest(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	user, err := s.meForTOTP(ctx, c)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return echo.NewHTTPError(http.StatusConflict, "Two-factor authentication is not on")
+	}
+	if ok, err := s.useSecondFactor(ctx, &user, req.Code); err != nil {
+		return err
+	} else if !ok {
+		return invalidCode()
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	user.RecoveryCodes = hashes
+	if _, err := s.users.Update(ctx, user); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, recoveryCodes{Codes: codes})
+}
+
+func bindTOTPRequest(c echo.Context) (totpRequest, error) {
+	var req totpRequest
+	if err := c.Bind(&req); err != nil {
+		return req, echo.NewHTTPError(http.StatusBadRequest, "Invalid code").SetInternal(err)
+	}
+	return req, nil
+}
+
+// Looks up the logged in user afresh, as their second factor may have
+// changed since the request started.
+func (s *server) meForTOTP(ctx context.Context, c echo.Context) (User, error) {
+	me, err := requireUser(c)
+	if err != nil {
+		return User{}, err
+	}
+	return s.users.FindByID(ctx, me.ID)
+}
+
+// Wrong codes of logged in users are a mistake in the request rather than
+// a failed login, so they do not answer with 401.
+func invalidCode() error {
+	v := &ValidationError{}
+	v.add("code", "is not a current code of the authenticator app or an unused recovery code")
+	return v.errOrNil()
+}
+
+func turnOffTOTP(u *User) {
+	u.TOTPEnabled = false
+	u.TOTPSecret = ""
+	u.TOTPStep = 0
+	u.RecoveryCodes = nil
+}
+
+// Checks a code of the authenticator app or a recovery code. Codes of the
+// app are only taken once, and used recovery codes are struck off, which
+// useSecondFactor stores.
+func (s *server) checkSecondFactor(u *User, code string) (bool, error) {
+	secret, err := s.openTOTPSecret(*u)
+	if err != nil {
+		return false, err
+	}
+	if step, ok := totp.Validate(secret, code, time.Now()); ok {
+		if step <= u.TOTPStep {
+			return false, nil
+		}
+		u.TOTPStep = step
+		return true, nil
+	}
+	hash := hashSecret(normalizeRecoveryCode(code))
+	if i := slices.Index(u.RecoveryCodes, hash); i >= 0 {
+		u.RecoveryCodes = slices.Delete(slices.Clone(u.RecoveryCodes), i, i+1)
+		return true, nil
+	}
+	return false, nil
+}
+
+// Checks the second factor of a user whose password was right. Returns
+// ErrCodeRequired if there was no code, so that clients know to ask for
+// one.
+func (s *server) verifyLoginCode(ctx context.Context, u *User, code string) error {
+	if !u.TOTPEnabled {
+		return nil
+	}
+	if strings.TrimSpace(code) == "" {
+		return ErrCodeRequired
+	}
+	if ok, err := s.useSecondFactor(ctx, u, code); err != nil {
+		return err
+	} else if !ok {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// Checks the code and stores that it was used, unless the user used a
+// code meanwhile, in another request. The same code thus only gets
+// through once, even if sent twice at the same time.
+func (s *server) useSecondFactor(ctx context.Context, u *User, code string) (bool, error) {
+	prev := *u
+	if ok, err := s.checkSecondFactor(u, code); err != nil || !ok {
+		return false, err
+	}
+	return s.users.UseSecondFactor(ctx, prev, *u)
+}
+
+// Returns the recovery codes to show to the user, like
+// 7XQD-KB2M-PA4T-WNZC, and their hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := base32.StdEncoding.EncodeToString(b)
+		codes[i] = raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		hashes[i] = hashSecret(raw)
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// The login form of the HTML pages asks for the code in a second step. In
+// between it carries this token, which says whose password was right. It is
+// signed with a key of its own, so that it can never pass as an access
+// token.
+type loginChallengeClaims struct {
+	jwt.RegisteredClaims
+}
+
+func (s *server) challengeKey() []byte {
+	mac := hmac.New(sha256.New, s.jwtSecret)
+	mac.Write([]byte("login challenge"))
+	return mac.Sum(nil)
+}
+
+func (s *server) issueLoginChallenge(u User) (string, error) {
+	now := time.Now()
+	claims := loginChallengeClaims{jwt.RegisteredClaims{
+		Subject:   u.ID.Hex(),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(loginChallengeTTL)),
+	}}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.challengeKey())
+}
+
+// Looks up the user whose password was right. An invalid or expired
+// challenge fails with ErrUserNotFound.
+func (s *server) userFromChallenge(ctx context.Context, challenge string) (User, error) {
+	claims := &loginChallengeClaims{}
+	_, err := jwt.ParseWithClaims(challenge, claims, func(t *jwt.Token) (interface{}, error) {
+		return s.challengeKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return User{}, ErrUserNotFound
+	}
+	id, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return User{}, ErrUserNotFound
+	}
+	return s.users.FindByID(ctx, id)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/totp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTOTPSecretSealing(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	s := &server{totpKey: loadTOTPKey("a key")}
+	alice := User{ID: primitive.NewObjectID()}
+
+	sealed, err := s.sealTOTPSecret(alice, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, sealedTOTPPrefix) || strings.Contains(sealed, secret) {
+		t.Fatalf("sealed secret %q", sealed)
+	}
+	again, _ := s.sealTOTPSecret(alice, secret)
+	if again == sealed {
+		t.Error("the same secret sealed twice gives the same text")
+	}
+	alice.TOTPSecret = sealed
+	if got, err := s.openTOTPSecret(alice); err != nil || got != secret {
+		t.Errorf("openTOTPSecret = %q, %v, want %q", got, err, secret)
+	}
+
+	// Another account, another key, no key or a damaged text
+	bob := User{ID: primitive.NewObjectID(), TOTPSecret: sealed}
+	if _, err := s.openTOTPSecret(bob); err == nil {
+		t.Error("the secret of one user opened for another")
+	}
+	other := &server{totpKey: loadTOTPKey("another key")}
+	if _, err := other.openTOTPSecret(alice); err == nil {
+		t.Error("the secret opened with another key")
+	}
+	if _, err := (&server{}).openTOTPSecret(alice); err == nil {
+		t.Error("the secret opened without a key")
+	}
+	damaged := alice
+	damaged.TOTPSecret = sealedTOTPPrefix + "AAAA"
+	if _, err := s.openTOTPSecret(damaged); err == nil {
+		t.Error("a damaged secret opened")
+	}
+}
+
+func TestTOTPSecretInTheClear(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	u := User{ID: primitive.NewObjectID()}
+	plain := &server{}
+	stored, err := plain.sealTOTPSecret(u, secret)
+	if err != nil || stored != secret {
+		t.Fatalf("sealTOTPSecret without a key = %q, %v, want the secret", stored, err)
+	}
+	// Stored before the key was set
+	u.TOTPSecret = secret
+	for _, s := range []*server{plain, {totpKey: loadTOTPKey("a key")}} {
+		if got, err := s.openTOTPSecret(u); err != nil || got != secret {
+			t.Errorf("openTOTPSecret = %q, %v, want %q", got, err, secret)
+		}
+	}
+}
+
+func TestUseSecondFactorOnce(t *testing.T) {
+	ctx := context.Background()
+	users := newMemoryUserRepository()
+	s := &server{users: users}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const recovery = "7XQD-KB2M-PA4T-WNZC"
+	u, err := users.Insert(ctx, User{
+		Username:      "alice",
+		TOTPEnabled:   true,
+		TOTPSecret:    secret,
+		RecoveryCodes: []string{hashSecret(normalizeRecoveryCode(recovery)), hashSecret("OTHER")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, code := range []string{code, recovery} {
+		// Two requests that both read the user before either stored it
+		u, err = users.FindByID(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first, second := u, u
+		if ok, err := s.useSecondFactor(ctx, &first, code); err != nil || !ok {
+			t.Fatalf("first use of %s = %v, %v, want true", code, ok, err)
+		}
+		if ok, err := s.useSecondFactor(ctx, &second, code); err != nil || ok {
+			t.Errorf("second use of %s = %v, %v, want false", code, ok, err)
+		}
+		// And a request after that
+		third, err := users.FindByID(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.useSecondFactor(ctx, &third, code); err != nil || ok {
+			t.Errorf("third use of %s = %v, %v, want false", code, ok, err)
+		}
+	}
+	stored, _ := users.FindByID(ctx, u.ID)
+	if len(stored.RecoveryCodes) != 1 || stored.TOTPStep == 0 {
+		t.Errorf("stored %d recovery codes and step %d, want 1 and the step of the code", len(stored.RecoveryCodes), stored.TOTPStep)
+	}
+}
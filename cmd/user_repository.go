@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrDuplicateUser = errors.New("username is already taken")
+)
+
+// An account that can log in. Usernames are stored in lower case, so
+// "Alice" and "alice" are the same user. The password is only ever kept as
+// a bcrypt hash and never leaves the server. Users provisioned through an
+// OAuth2 provider have no password; Provider and ExternalID identify them
+// at their provider instead. The library emails users with an address
+// about their loans and holds, see mail.go, unless they opted out. The
+// second factor is described in twofactor.go.
+type User struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Username     string             `json:"username" bson:"username"`
+	PasswordHash string             `json:"-" bson:"password_hash"`
+	Role         Role               `json:"role" bson:"role"`
+	Provider     string             `json:"provider,omitempty" bson:"provider,omitempty"`
+	ExternalID   string             `json:"-" bson:"external_id,omitempty"`
+	Email        string             `json:"email,omitempty" bson:"email,omitempty"`
+	EmailOptOut  bool               `json:"email_opt_out" bson:"email_opt_out,omitempty"`
+	// The preferences the users set themselves, see me.go
+	DisplayName string `json:"display_name,omitempty" bson:"display_name,omitempty"`
+	Language    string `json:"language,omitempty" bson:"language,omitempty"`
+	PageSize    int    `json:"page_size,omitempty" bson:"page_size,omitempty"`
+	// The kinds of emails the user does not want, see mail.go
+	MutedEmails []string `json:"muted_emails,omitempty" bson:"muted_emails,omitempty"`
+	// The secret of the authenticator app, which is set while enrolling
+	// already, the step of the last code used and the hashes of the
+	// recovery codes left
+	TOTPEnabled   bool      `json:"totp_enabled" bson:"totp_enabled,omitempty"`
+	TOTPSecret    string    `json:"-" bson:"totp_secret,omitempty"`
+	TOTPStep      int64     `json:"-" bson:"totp_step,omitempty"`
+	RecoveryCodes []string  `json:"-" bson:"recovery_codes,omitempty"`
+	CreatedAt     time.Time `json:"created_at" bson:"created_at"`
+}
+
+// The name to address the user by: the display name, if they chose one.
+func (u User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
+}
+
+// Stores the accounts, next to the books of the same backend.
+type UserRepository interface {
+	// Returns all users, oldest first.
+	FindAll(ctx context.Context) ([]User, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (User, error)
+	FindByUsername(ctx context.Context, username string) (User, error)
+	// Finds the user provisioned for the account with the given ID at an
+	// OAuth2 provider.
+	FindByIdentity(ctx context.Context, provider string, externalID string) (User, error)
+	// Stores a new user and returns it with its ID set. A taken username
+	// fails with ErrDuplicateUser.
+	Insert(ctx context.Context, u User) (User, error)
+	// Replaces all fields of the user with the ID of u.
+	Update(ctx context.Context, u User) (User, error)
+	// Stores the step of the last code and the recovery codes left of u,
+	// if those stored are still the ones of prev, and reports whether
+	// they were.
+	UseSecondFactor(ctx context.Context, prev, u User) (bool, error)
+	// Stores the preferences of u, see me.go, and leaves the other fields
+	// as they are. Returns the user as stored.
+	SetPreferences(ctx context.Context, u User) (User, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// Keeps the users in memory, for the memory storage.
+type memoryUserRepository struct {
+	mu    sync.RWMutex
+	users []User
+}
+
+func newMemoryUserRepository() *memoryUserRepository {
+	return &memoryUserRepository{}
+}
+
+func (r *memoryUserRepository) find(match func(User) bool) (User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, u := range r.users {
+		if match(u) {
+			return u, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+func (r *memoryUserRepository) FindAll(ctx context.Context) ([]User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]User{}, r.users...), nil
+}
+
+func (r *memoryUserRepository) FindByID(ctx context.Context, id primitive.ObjectID) (User, error) {
+	return r.find(func(u User) bool { return u.ID == id })
+}
+
+func (r *memoryUserRepository) FindByUsername(ctx context.Context, username string) (User, error) {
+	return r.find(func(u User) bool { return u.Username == username })
+}
+
+func (r *memoryUserRepository) FindByIdentity(ctx context.Context, provider string, externalID string) (User, error) {
+	return r.find(func(u User) bool { return u.Provider == provider && u.ExternalID == externalID })
+}
+
+func (r *memoryUserRepository) Insert(ctx context.Context, u User) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, o := range r.users {
+		if o.Username == u.Username {
+			return u, ErrDuplicateUser
+		}
+	}
+	u.ID = primitive.NewObjectID()
+	r.users = append(r.users, u)
+	return u, nil
+}
+
+func (r *memoryUserRepository) Update(ctx context.Context, u User) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.users, func(o User) bool { return o.ID == u.ID })
+	if i < 0 {
+		return u, ErrUserNotFound
+	}
+	if slices.ContainsFunc(r.users, func(o User) bool { return o.ID != u.ID && o.Username == u.Username }) {
+		return u, ErrDuplicateUser
+	}
+	r.users[i] = u
+	return u, nil
+}
+
+func (r *memoryUserRepository) UseSecondFactor(ctx context.Context, prev, u User) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.users, func(o User) bool { return o.ID == u.ID })
+	if i < 0 {
+		return false, ErrUserNotFound
+	}
+	stored := &r.users[i]
+	if stored.TOTPStep != prev.TOTPStep || !slices.Equal(stored.RecoveryCodes, prev.RecoveryCodes) {
+		return false, nil
+	}
+	stored.TOTPStep, stored.RecoveryCodes = u.TOTPStep, u.RecoveryCodes
+	return true, nil
+}
+
+func (r *memoryUserRepository) SetPreferences(ctx context.Context, u User) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.users, func(o User) bool { return o.ID == u.ID })
+	if i < 0 {
+		return u, ErrUserNotFound
+	}
+	stored := &r.users[i]
+	stored.Email, stored.EmailOptOut = u.Email, u.EmailOptOut
+	stored.DisplayName, stored.Language, stored.PageSize = u.DisplayName, u.Language, u.PageSize
+	stored.MutedEmails = slices.Clone(u.MutedEmails)
+	return *stored, nil
+}
+
+func (r *memoryUserRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.users, func(o User) bool { return o.ID == id })
+	if i < 0 {
+		return ErrUserNotFound
+	}
+	r.users = slices.Delete(r.users, i, i+1)
+	return nil
+}
+
+// Creates the unique indexes on the username, which is what keeps two
+// accounts from sharing a name, and on the identity at an OAuth2 provider.
+func prepareUsers(ctx context.Context, coll *mongo.Collection) error {
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetName("users_username_unique").SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "provider", Value: 1}, {Key: "external_id", Value: 1}},
+			Options: options.Index().
+				SetName("users_identity_unique").
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"provider": bson.M{"$exists": true}}),
+		},
+	}
+	return ensureIndexes(ctx, coll, indexes...)
+}
+
+// Stores the users in their own MongoDB collection.
+type mongoUserRepository struct {
+	coll mongoCollection
+}
+
+func newMongoUserRepository(coll *mongo.Collection) *mongoUserRepository {
+	return &mongoUserRepository{coll: withPolicy(coll)}
+}
+
+func (r *mongoUserRepository) findOne(ctx context.Context, filter bson.M) (User, error) {
+	var u User
+	err := r.coll.FindOne(ctx, filter).Decode(&u)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return u, ErrUserNotFound
+	}
+	return u, err
+}
+
+func (r *mongoUserRepository) FindAll(ctx context.Context) ([]User, error) {
+	cursor, err := r.coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (r *mongoUserRepository) FindByID(ctx context.Context, id primitive.ObjectID) (User, error) {
+	return r.findOne(ctx, bson.M{"_id": id})
+}
+
+func (r *mongoUserRepository) FindByUsername(ctx context.Context, username string) (User, error) {
+	return r.findOne(ctx, bson.M{"username": username})
+}
+
+func (r *mongoUserRepository) FindByIdentity(ctx context.Context, provider string, externalID string) (User, error) {
+	return r.findOne(ctx, bson.M{"provider": provider, "external_id": externalID})
+}
+
+func (r *mongoUserRepository) Insert(ctx context.Context, u User) (User, error) {
+	u.ID = primitive.NewObjectID()
+	_, err := r.coll.InsertOne(ctx, u)
+	if mongo.IsDuplicateKeyError(err) {
+		return u, ErrDuplicateUser
+	}
+	return u, err
+}
+
+func (r *mongoUserRepository) Update(ctx context.Context, u User) (User, error) {
+	res, err := r.coll.ReplaceOne(ctx, bson.M{"_id": u.ID}, u)
+	if mongo.IsDuplicateKeyError(err) {
+		return u, ErrDuplicateUser
+	}
+	if err != nil {
+		return u, err
+	}
+	if res.MatchedCount == 0 {
+		return u, ErrUserNotFound
+	}
+	return u, nil
+}
+
+// The zero values of the fields are left out of the documents, so they
+// are matched as missing and unset.
+func (r *mongoUserRepository) UseSecondFactor(ctx context.Context, prev, u User) (bool, error) {
+	filter := bson.M{"_id": u.ID, "totp_step": nil, "recovery_codes": nil}
+	if prev.TOTPStep != 0 {
+		filter["totp_step"] = prev.TOTPStep
+	}
+	if len(prev.RecoveryCodes) > 0 {
+		filter["recovery_codes"] = prev.RecoveryCodes
+	}
+	set, unset := bson.M{}, bson.M{}
+	if u.TOTPStep != 0 {
+		set["totp_step"] = u.TOTPStep
+	} else {
+		unset["totp_step"] = ""
+	}
+	if len(u.RecoveryCodes) > 0 {
+		set["recovery_codes"] = u.RecoveryCodes
+	} else {
+		unset["recovery_codes"] = ""
+	}
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	res, err := r.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// Like in UseSecondFactor, the zero values are unset.
+func (r *mongoUserRepository) SetPreferences(ctx context.Context, u User) (User, error) {
+	set, unset := bson.M{}, bson.M{}
+	store := func(name string, value interface{}, zero bool) {
+		if zero {
+			unset[name] = ""
+		} else {
+			set[name] = value
+		}
+	}
+	store("email", u.Email, u.Email == "")
+	store("email_opt_out", u.EmailOptOut, !u.EmailOptOut)
+	store("display_name", u.DisplayName, u.DisplayName == "")
+	store("language", u.Language, u.Language == "")
+	store("page_size", u.PageSize, u.PageSize == 0)
+	store("muted_emails", u.MutedEmails, len(u.MutedEmails) == 0)
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	var stored User
+	err := r.coll.FindOneAndUpdate(ctx, bson.M{"_id": u.ID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return u, ErrUserNotFound
+	}
+	return stored, err
+}
+
+func (r *mongoUserRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Stores the users in the users table, see sqlMigrations.
+type sqlUserRepository struct {
+	db *sql.DB
+}
+
+func newSQLUserRepository(db *sql.DB) *sqlUserRepository {
+	return &sqlUserRepository{db: db}
+}
+
+const userColumns = "id, username, password_hash, role, provider, external_id, email, email_opt_out, display_name, language, page_size, muted_emails, " +
+	"totp_enabled, totp_secret, totp_step, recovery_codes, created_at"
+
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	var id, muted, recovery string
+	err := row.Scan(&id, &u.Username, &u.PasswordHash, &u.Role, &u.Provider, &u.ExternalID, &u.Email, &u.EmailOptOut,
+		&u.DisplayName, &u.Language, &u.PageSize, &muted,
+		&u.TOTPEnabled, &u.TOTPSecret, &u.TOTPStep, &recovery, &u.CreatedAt)
+	if err != nil {
+		return u, err
+	}
+	if muted != "" {
+		u.MutedEmails = strings.Split(muted, ",")
+	}
+	if recovery != "" {
+		u.RecoveryCodes = strings.Split(recovery, ",")
+	}
+	objID, err := primitive.ObjectIDFromHex(id)
+	u.ID = objID
+	return u, err
+}
+
+func (r *sqlUserRepository) FindAll(ctx context.Context) ([]User, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+userColumns+" FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// The condition may use $1 and following for the arguments.
+func (r *sqlUserRepository) findOne(ctx context.Context, where string, args ...interface{}) (User, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE "+where, args...)
+	u, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, ErrUserNotFound
+	}
+	return u, err
+}
+
+func (r *sqlUserRepository) FindByID(ctx context.Context, id primitive.ObjectID) (User, error) {
+	return r.findOne(ctx, "id = $1", id.Hex())
+}
+
+func (r *sqlUserRepository) FindByUsername(ctx context.Context, username string) (User, error) {
+	return r.findOne(ctx, "username = $1", username)
+}
+
+func (r *sqlUserRepository) FindByIdentity(ctx context.Context, provider string, externalID string) (User, error) {
+	return r.findOne(ctx, "provider = $1 AND external_id = $2", provider, externalID)
+}
+
+func (r *sqlUserRepository) Insert(ctx context.Context, u User) (User, error) {
+	u.ID = primitive.NewObjectID()
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO users ("+userColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)",
+		u.ID.Hex(), u.Username, u.PasswordHash, u.Role, u.Provider, u.ExternalID, u.Email, u.EmailOptOut,
+		u.DisplayName, u.Language, u.PageSize, strings.Join(u.MutedEmails, ","),
+		u.TOTPEnabled, u.TOTPSecret, u.TOTPStep, strings.Join(u.RecoveryCodes, ","), u.CreatedAt)
+	if isUniqueViolation(err) {
+		return u, ErrDuplicateUser
+	}
+	return u, err
+}
+
+func (r *sqlUserRepository) Update(ctx context.Context, u User) (User, error) {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE users SET username = $1, password_hash = $2, role = $3, email = $4, email_opt_out = $5, "+
+			"display_name = $6, language = $7, page_size = $8, muted_emails = $9, "+
+			"totp_enabled = $10, totp_secret = $11, totp_step = $12, recovery_codes = $13 WHERE id = $14",
+		u.Username, u.PasswordHash, u.Role, u.Email, u.EmailOptOut,
+		u.DisplayName, u.Language, u.PageSize, strings.Join(u.MutedEmails, ","),
+		u.TOTPEnabled, u.TOTPSecret, u.TOTPStep, strings.Join(u.RecoveryCodes, ","), u.ID.Hex())
+	if isUniqueViolation(err) {
+		return u, ErrDuplicateUser
+	}
+	if err != nil {
+		return u, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return u, err
+	} else if n == 0 {
+		return u, ErrUserNotFound
+	}
+	return u, nil
+}
+
+func (r *sqlUserRepository) UseSecondFactor(ctx context.Context, prev, u User) (bool, error) {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE users SET totp_step = $1, recovery_codes = $2 WHERE id = $3 AND totp_step = $4 AND recovery_codes = $5",
+		u.TOTPStep, strings.Join(u.RecoveryCodes, ","), u.ID.Hex(), prev.TOTPStep, strings.Join(prev.RecoveryCodes, ","))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (r *sqlUserRepository) SetPreferences(ctx context.Context, u User) (User, error) {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE users SET email = $1, email_opt_out = $2, display_name = $3, language = $4, page_size = $5, muted_emails = $6 WHERE id = $7",
+		u.Email, u.EmailOptOut, u.DisplayName, u.Language, u.PageSize, strings.Join(u.MutedEmails, ","), u.ID.Hex())
+	if err != nil {
+		return u, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return u, err
+	} else if n == 0 {
+		return u, ErrUserNotFound
+	}
+	return r.FindByID(ctx, u.ID)
+}
+
+func (r *sqlUserRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM users WHERE id = $1", id.Hex())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
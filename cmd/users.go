@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// What an admin sends to create an account. Without a role the user
+// becomes a reader, just like after registering.
+type newUser struct {
+	credentials
+	Role Role `json:"role"`
+}
+
+// The changes an admin can make to an account. Fields that are not sent
+// stay as they are. Two-factor authentication can only be turned off, for
+// users who lost their authenticator app and recovery codes; they turn it
+// on themselves.
+type userPatch struct {
+	Role        *Role   `json:"role"`
+	Password    *string `json:"password"`
+	Email       *string `json:"email"`
+	EmailOptOut *bool   `json:"email_opt_out"`
+	TOTPEnabled *bool   `json:"totp_enabled"`
+}
+
+// Parses the :id path parameter of the user routes.
+func userID(c echo.Context) (primitive.ObjectID, error) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return objID, echo.NewHTTPError(http.StatusBadRequest, "Invalid ID format")
+	}
+	return objID, nil
+}
+
+// Refuses roles with scopes the caller, a user or an API key, does not
+// have, see missingScope.
+func checkRoleGrant(c echo.Context, v *ValidationError, role Role) {
+	if scope, missing := missingScope(c, role.Scopes()); missing {
+		v.add("role", fmt.Sprintf("you do not have the %s scope of the %s role yourself", scope, role))
+	}
+}
+
+// Refuses to change or delete accounts with scopes the caller does not
+// have: setting the password of an admin would make the caller one.
+func checkAccountRights(c echo.Context, user User) error {
+	if _, missing := missingScope(c, user.Role.Scopes()); missing {
+		return echo.NewHTTPError(http.StatusForbidden, "You cannot change an account with rights you do not have")
+	}
+	return nil
+}
+
+func (s *server) listUsers(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	users, err := s.users.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, users)
+}
+
+func (s *server) getUser(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	user, err := s.users.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+func (s *server) createUser(c echo.Context) error {
+	var req newUser
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user data").SetInternal(err)
+	}
+	req.Username = normalizeUsername(req.Username)
+	if req.Role == "" {
+		req.Role = RoleReader
+	}
+
+	v := &ValidationError{}
+	checkUsername(v, req.Username)
+	checkPassword(v, req.Password)
+	checkRole(v, req.Role)
+	checkRoleGrant(c, v, req.Role)
+	req.Email = strings.TrimSpace(req.Email)
+	checkEmail(v, req.Email)
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	user, err := s.users.Insert(ctx, User{
+		Username:     req.Username,
+		PasswordHash: hash,
+		Role:         req.Role,
+		Email:        req.Email,
+		CreatedAt:    time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, user)
+}
+
+func (s *server) patchUser(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	var p userPatch
+	if err := c.Bind(&p); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid user data").SetInternal(err)
+	}
+
+	v := &ValidationError{}
+	if p.Role != nil {
+		checkRole(v, *p.Role)
+		checkRoleGrant(c, v, *p.Role)
+	}
+	if p.Password != nil {
+		checkPassword(v, *p.Password)
+	}
+	if p.Email != nil {
+		*p.Email = strings.TrimSpace(*p.Email)
+		checkEmail(v, *p.Email)
+	}
+	if p.TOTPEnabled != nil && *p.TOTPEnabled {
+		v.add("totp_enabled", "can only be turned off, users turn it on under /api/v1/me/2fa")
+	}
+	if err := v.errOrNil(); err != nil {
+		return err
+	}
+	// An admin demoting themselves could leave nobody to manage the users.
+	// API keys act on nobody's behalf, so there is no "self" for them.
+	me := currentUser(c)
+	if me != nil && id == me.ID && p.Role != nil && *p.Role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusConflict, "You cannot take away your own admin role")
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	user, err := s.users.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkAccountRights(c, user); err != nil {
+		return err
+	}
+	if p.Role != nil {
+		user.Role = *p.Role
+	}
+	if p.Password != nil {
+		if user.PasswordHash, err = hashPassword(*p.Password); err != nil {
+			return err
+		}
+	}
+	if p.Email != nil {
+		user.Email = *p.Email
+	}
+	if p.EmailOptOut != nil {
+		user.EmailOptOut = *p.EmailOptOut
+	}
+	if p.TOTPEnabled != nil {
+		turnOffTOTP(&user)
+	}
+	if user, err = s.users.Update(ctx, user); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+func (s *server) deleteUser(c echo.Context) error {
+	id, err := userID(c)
+	if err != nil {
+		return err
+	}
+	if me := currentUser(c); me != nil && id == me.ID {
+		return echo.NewHTTPError(http.StatusConflict, "You cannot delete your own account")
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	user, err := s.users.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkAccountRights(c, user); err != nil {
+		return err
+	}
+	if err := s.users.Delete(ctx, id); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal/isbn"
+)
+
+// Bounds for the publication year. Anything outside is almost certainly a
+// typo, like a page count entered into the year field.
+const minBookYear = -3000
+
+func maxBookYear() int {
+	return time.Now().Year() + 1
+}
+
+// Describes what is wrong with a single field of a request. Field uses the
+// JSON name, so clients can map it straight back to their form inputs.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Collects every problem found in a request instead of stopping at the
+// first one, so the user can fix them all in one go.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var parts []string
+	for _, f := range e.Fields {
+		parts = append(parts, f.Field+": "+f.Message)
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (e *ValidationError) add(field string, message string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+}
+
+// Returns nil if no problem was found. Returning the *ValidationError
+// directly would produce a non-nil error interface holding a nil pointer.
+func (e *ValidationError) errOrNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+func checkName(v *ValidationError, name string) {
+	if strings.TrimSpace(name) == "" {
+		v.add("name", "is required")
+	}
+}
+
+func checkAuthor(v *ValidationError, author string) {
+	if strings.TrimSpace(author) == "" {
+		v.add("author", "is required")
+	}
+}
+
+func checkPages(v *ValidationError, pages int) {
+	if pages <= 0 {
+		v.add("pages", "must be greater than 0")
+	}
+}
+
+func checkVersion(v *ValidationError, version int64) {
+	if version <= 0 {
+		v.add("version", "must be greater than 0")
+	}
+}
+
+func checkYear(v *ValidationError, year int) {
+	if year == 0 {
+		v.add("year", "is required")
+	} else if year < minBookYear || year > maxBookYear() {
+		v.add("year", fmt.Sprintf("must be between %d and %d", minBookYear, maxBookYear()))
+	}
+}
+
+// An ISBN is optional, but if one is given it has to be a valid ISBN-10
+// or ISBN-13, check digit included.
+func checkISBN(v *ValidationError, s string) {
+	if s == "" {
+		return
+	}
+	if err := isbn.Validate(s); err != nil {
+		v.add("isbn", err.Error())
+	}
+}
+
+// Genre names are lower case words joined by hyphens, e.g.
+// "science-fiction".
+var genrePattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+const maxGenreLength = 32
+
+func validGenre(g string) bool {
+	return genrePattern.MatchString(g) && len(g) <= maxGenreLength
+}
+
+// Checks the form of the genres once they are normalized. Whether they are
+// part of the vocabulary is up to the handlers, which can reach it.
+func checkGenres(v *ValidationError, genres []string) {
+	for _, g := range genres {
+		if g = normalizeGenre(g); !validGenre(g) {
+			v.add("genres", fmt.Sprintf("%q is not a valid genre name", g))
+		}
+	}
+}
+
+// Checks every field of a book.
+func validateBook(b BookStore) error {
+	v := &ValidationError{}
+	checkName(v, b.BookName)
+	checkAuthor(v, b.BookAuthor)
+	checkISBN(v, b.BookISBN)
+	checkPages(v, b.BookPages)
+	checkYear(v, b.BookYear)
+	checkGenres(v, b.Genres)
+	// Zero means the book was sent without the version it is based on
+	if b.Version != 0 {
+		checkVersion(v, b.Version)
+	}
+	return v.errOrNil()
+}
+
+// The same rules as validateBook, restricted to the fields that are sent.
+func validatePatch(p BookPatch) error {
+	v := &ValidationError{}
+	if p.BookName != nil {
+		checkName(v, *p.BookName)
+	}
+	if p.BookAuthor != nil {
+		checkAuthor(v, *p.BookAuthor)
+	}
+	if p.BookISBN != nil {
+		checkISBN(v, *p.BookISBN)
+	}
+	if p.BookPages != nil {
+		checkPages(v, *p.BookPages)
+	}
+	if p.BookYear != nil {
+		checkYear(v, *p.BookYear)
+	}
+	if p.Genres != nil {
+		checkGenres(v, *p.Genres)
+	}
+	if p.Version != nil {
+		checkVersion(v, *p.Version)
+	}
+	return v.errOrNil()
+}
+
+// Brings the ISBN of a validated book into its canonical form, so the same
+// book is always stored with the same ISBN. The same goes for the genres.
+func normalizeBook(b *BookStore) {
+	if b.BookISBN != "" {
+		b.BookISBN, _ = isbn.Normalize(b.BookISBN)
+	}
+	b.Genres = normalizeGenres(b.Genres)
+}
+
+func normalizePatch(p *BookPatch) {
+	if p.BookISBN != nil && *p.BookISBN != "" {
+		canonical, _ := isbn.Normalize(*p.BookISBN)
+		p.BookISBN = &canonical
+	}
+	if p.Genres != nil {
+		genres := normalizeGenres(*p.Genres)
+		p.Genres = &genres
+	}
+}
+
+func normalizeGenre(g string) string {
+	return strings.ToLower(strings.TrimSpace(g))
+}
+
+// Returns the genres in lower case, sorted and without duplicates.
+func normalizeGenres(genres []string) []string {
+	if len(genres) == 0 {
+		return nil
+	}
+	normalized := make([]string, 0, len(genres))
+	for _, g := range genres {
+		normalized = append(normalized, normalizeGenre(g))
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized)
+}
+
+// Checks every field of an author. Unlike books, authors cannot come from
+// next year.
+func validateAuthor(a Author) error {
+	v := &ValidationError{}
+	checkName(v, a.Name)
+	if a.BirthYear != nil && (*a.BirthYear < minBookYear || *a.BirthYear > time.Now().Year()) {
+		v.add("birth_year", fmt.Sprintf("must be between %d and %d", minBookYear, time.Now().Year()))
+	}
+	return v.errOrNil()
+}
+
+func normalizeAuthor(a *Author) {
+	a.Name = strings.TrimSpace(a.Name)
+	a.Nationality = strings.TrimSpace(a.Nationality)
+	a.Bio = strings.TrimSpace(a.Bio)
+}
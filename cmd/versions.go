@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The REST API is versioned by path: /api/v1 is the current version. The
+// routes under /api itself are those from before the versioning, served
+// as they were for the clients still using them, but deprecated: their
+// responses carry the Deprecation and Sunset headers (RFC 9745 and RFC
+// 8594) and link the same route of the version replacing them.
+//
+// A breaking change goes into a new version: a registerAPIv2 with the
+// routes as they are then, listed below next to v1, which stays as it is
+// until its own sunset.
+
+// A version of the API and where it is mounted.
+type apiVersion struct {
+	// e.g. /api/v1
+	prefix string
+	routes func(s *server, api *echo.Group)
+	// When the version was deprecated and when it goes away; zero while
+	// it is current
+	deprecated time.Time
+	sunset     time.Time
+	// The prefix of the version replacing a deprecated one
+	successor string
+}
+
+// The versions of the API, the newest first. A function rather than a
+// variable, as the routes lead back to the server setup listing them.
+func apiVersions() []apiVersion {
+	return []apiVersion{
+		{prefix: "/api/v1", routes: (*server).registerAPIv1},
+		{
+			prefix:     "/api",
+			routes:     (*server).registerAPIv1,
+			deprecated: time.Date(2026, time.October, 17, 0, 0, 0, 0, time.UTC),
+			sunset:     time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC),
+			successor:  "/api/v1",
+		},
+	}
+}
+
+// Registers the routes of the version under its prefix.
+func (v apiVersion) mount(s *server, e *echo.Echo) {
+	var middleware []echo.MiddlewareFunc
+	if !v.deprecated.IsZero() {
+		middleware = append(middleware, v.announceDeprecation)
+	}
+	v.routes(s, e.Group(v.prefix, middleware...))
+}
+
+// Tells the clients of a deprecated version that it is, when it goes away
+// and where the route moved to.
+func (v apiVersion) announceDeprecation(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		h := c.Response().Header()
+		h.Set("Deprecation", "@"+strconv.FormatInt(v.deprecated.Unix(), 10))
+		h.Set("Sunset", v.sunset.Format(http.TimeFormat))
+		successor := v.successor + strings.TrimPrefix(c.Request().URL.Path, v.prefix)
+		h.Add("Link", `<`+successor+`>; rel="successor-version"`)
+		return next(c)
+	}
+}
+
+// Returns the route within the API, e.g. /books/:id for /api/v1/books/:id,
+// or false if the route is not one of the API.
+func apiRoute(path string) (string, bool) {
+	for _, v := range apiVersions() {
+		if route, ok := strings.CutPrefix(path, v.prefix+"/"); ok {
+			return "/" + route, true
+		}
+	}
+	return "", false
+}
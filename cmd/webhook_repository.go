@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// An URL that gets a signed POST for every change to the catalog, see
+// webhooks.go. The secret has to be stored as is, since the signatures are
+// computed from it; it is only shown once, when the webhook is created.
+type Webhook struct {
+	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	URL    string             `json:"url" bson:"url"`
+	Secret string             `json:"-" bson:"secret"`
+	// The types of changes to send; all of them if empty
+	Events    []BookEventType    `json:"events" bson:"events"`
+	CreatedBy primitive.ObjectID `json:"created_by" bson:"created_by"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// Reports whether the webhook wants events of the given type.
+func (w Webhook) wants(t BookEventType) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, t)
+}
+
+// A single attempt to deliver an event to a webhook. Retries of the same
+// event share the DeliveryID, which receivers can use to skip duplicates.
+type WebhookDelivery struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	WebhookID  primitive.ObjectID `json:"webhook_id" bson:"webhook_id"`
+	DeliveryID string             `json:"delivery_id" bson:"delivery_id"`
+	Event      BookEventType      `json:"event" bson:"event"`
+	BookID     primitive.ObjectID `json:"book_id" bson:"book_id"`
+	Attempt    int                `json:"attempt" bson:"attempt"`
+	// Zero if no response arrived at all, see Error
+	StatusCode int    `json:"status_code,omitempty" bson:"status_code,omitempty"`
+	Error      string `json:"error,omitempty" bson:"error,omitempty"`
+	// The start of the response body
+	Response    string     `json:"response,omitempty" bson:"response,omitempty"`
+	DurationMS  int64      `json:"duration_ms" bson:"duration_ms"`
+	SentAt      time.Time  `json:"sent_at" bson:"sent_at"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty" bson:"next_retry_at,omitempty"`
+}
+
+// How long delivery attempts are kept for debugging.
+const webhookLogRetention = 7 * 24 * time.Hour
+
+// Stores the webhooks and the log of their deliveries.
+type WebhookRepository interface {
+	// Returns all webhooks, oldest first.
+	FindAll(ctx context.Context) ([]Webhook, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (Webhook, error)
+	Insert(ctx context.Context, w Webhook) (Webhook, error)
+	// Deletes the webhook together with its deliveries.
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Logs a delivery attempt. Attempts older than webhookLogRetention
+	// are dropped along the way.
+	AddDelivery(ctx context.Context, d WebhookDelivery) error
+	// Returns the latest delivery attempts of the webhook, newest first.
+	FindDeliveries(ctx context.Context, webhookID primitive.ObjectID, limit int) ([]WebhookDelivery, error)
+}
+
+// Keeps the webhooks in memory, for the memory storage.
+type memoryWebhookRepository struct {
+	mu         sync.RWMutex
+	hooks      []Webhook
+	deliveries []WebhookDelivery
+}
+
+func newMemoryWebhookRepository() *memoryWebhookRepository {
+	return &memoryWebhookRepository{}
+}
+
+func (r *memoryWebhookRepository) FindAll(ctx context.Context) ([]Webhook, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Webhook{}, r.hooks...), nil
+}
+
+func (r *memoryWebhookRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Webhook, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	i := slices.IndexFunc(r.hooks, func(w Webhook) bool { return w.ID == id })
+	if i < 0 {
+		return Webhook{}, ErrWebhookNotFound
+	}
+	return r.hooks[i], nil
+}
+
+func (r *memoryWebhookRepository) Insert(ctx context.Context, w Webhook) (Webhook, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w.ID = primitive.NewObjectID()
+	r.hooks = append(r.hooks, w)
+	return w, nil
+}
+
+func (r *memoryWebhookRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.hooks, func(w Webhook) bool { return w.ID == id })
+	if i < 0 {
+		return ErrWebhookNotFound
+	}
+	r.hooks = slices.Delete(r.hooks, i, i+1)
+	r.deliveries = slices.DeleteFunc(r.deliveries, func(d WebhookDelivery) bool { return d.WebhookID == id })
+	return nil
+}
+
+func (r *memoryWebhookRepository) AddDelivery(ctx context.Context, d WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cutoff := time.Now().Add(-webhookLogRetention)
+	r.deliveries = slices.DeleteFunc(r.deliveries, func(d WebhookDelivery) bool { return d.SentAt.Before(cutoff) })
+	d.ID = primitive.NewObjectID()
+	r.deliveries = append(r.deliveries, d)
+	return nil
+}
+
+func (r *memoryWebhookRepository) FindDeliveries(ctx context.Context, webhookID primitive.ObjectID, limit int) ([]WebhookDelivery, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	deliveries := []WebhookDelivery{}
+	for i := len(r.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if r.deliveries[i].WebhookID == webhookID {
+			deliveries = append(deliveries, r.deliveries[i])
+		}
+	}
+	return deliveries, nil
+}
+
+// Creates the index for listing the deliveries of a webhook, and lets
+// MongoDB drop old deliveries by itself.
+func prepareWebhooks(ctx context.Context, deliveries *mongo.Collection) error {
+	return ensureIndexes(ctx, deliveries, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "webhook_id", Value: 1}, {Key: "sent_at", Value: -1}},
+			Options: options.Index().SetName("webhook_deliveries_webhook_id"),
+		},
+		{
+			Keys:    bson.D{{Key: "sent_at", Value: 1}},
+			Options: options.Index().SetName("webhook_deliveries_ttl").SetExpireAfterSeconds(int32(webhookLogRetention.Seconds())),
+		},
+	}...)
+}
+
+// Stores the webhooks and their deliveries in two MongoDB collections.
+type mongoWebhookRepository struct {
+	hooks      mongoCollection
+	deliveries mongoCollection
+}
+
+func newMongoWebhookRepository(hooks, deliveries *mongo.Collection) *mongoWebhookRepository {
+	return &mongoWebhookRepository{hooks: withPolicy(hooks), deliveries: withPolicy(deliveries)}
+}
+
+func (r *mongoWebhookRepository) FindAll(ctx context.Context) ([]Webhook, error) {
+	cursor, err := r.hooks.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	hooks := []Webhook{}
+	if err = cursor.All(ctx, &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func (r *mongoWebhookRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Webhook, error) {
+	var w Webhook
+	err := r.hooks.FindOne(ctx, bson.M{"_id": id}).Decode(&w)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return w, ErrWebhookNotFound
+	}
+	return w, err
+}
+
+func (r *mongoWebhookRepository) Insert(ctx context.Context, w Webhook) (Webhook, error) {
+	w.ID = primitive.NewObjectID()
+	_, err := r.hooks.InsertOne(ctx, w)
+	return w, err
+}
+
+func (r *mongoWebhookRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	res, err := r.hooks.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrWebhookNotFound
+	}
+	_, err = r.deliveries.DeleteMany(ctx, bson.M{"webhook_id": id})
+	return err
+}
+
+// Old deliveries are dropped by the TTL index, see prepareWebhooks.
+func (r *mongoWebhookRepository) AddDelivery(ctx context.Context, d WebhookDelivery) error {
+	d.ID = primitive.NewObjectID()
+	_, err := r.deliveries.InsertOne(ctx, d)
+	return err
+}
+
+func (r *mongoWebhookRepository) FindDeliveries(ctx context.Context, webhookID primitive.ObjectID, limit int) ([]WebhookDelivery, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "sent_at", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := r.deliveries.Find(ctx, bson.M{"webhook_id": webhookID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []WebhookDelivery{}
+	if err = cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Stores the webhooks in the webhooks and webhook_deliveries tables, see
+// sqlMigrations. The event types are kept as a comma separated list.
+type sqlWebhookRepository struct {
+	db *sql.DB
+}
+
+func newSQLWebhookRepository(db *sql.DB) *sqlWebhookRepository {
+	return &sqlWebhookRepository{db: db}
+}
+
+const (
+	webhookColumns  = "id, url, secret, events, created_by, created_at"
+	deliveryColumns = "id, webhook_id, delivery_id, event, book_id, attempt, status_code, error, response, duration_ms, sent_at, next_retry_at"
+)
+
+func joinEventTypes(types []BookEventType) string {
+	var parts []string
+	for _, t := range types {
+		parts = append(parts, string(t))
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitEventTypes(s string) []BookEventType {
+	types := []BookEventType{}
+	for _, part := range strings.Split(s, ",") {
+		if part != "" {
+			types = append(types, BookEventType(part))
+		}
+	}
+	return types
+}
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var w Webhook
+	var id, events, createdBy string
+	err := row.Scan(&id, &w.URL, &w.Secret, &events, &createdBy, &w.CreatedAt)
+	if err != nil {
+		return w, err
+	}
+	if w.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return w, err
+	}
+	if w.CreatedBy, err = primitive.ObjectIDFromHex(createdBy); err != nil {
+		return w, err
+	}
+	w.Events = splitEventTypes(events)
+	return w, nil
+}
+
+func scanDelivery(row rowScanner) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var id, webhookID, bookID string
+	var nextRetryAt sql.NullTime
+	err := row.Scan(&id, &webhookID, &d.DeliveryID, &d.Event, &bookID, &d.Attempt,
+		&d.StatusCode, &d.Error, &d.Response, &d.DurationMS, &d.SentAt, &nextRetryAt)
+	if err != nil {
+		return d, err
+	}
+	if d.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return d, err
+	}
+	if d.WebhookID, err = primitive.ObjectIDFromHex(webhookID); err != nil {
+		return d, err
+	}
+	if d.BookID, err = primitive.ObjectIDFromHex(bookID); err != nil {
+		return d, err
+	}
+	if nextRetryAt.Valid {
+		d.NextRetryAt = &nextRetryAt.Time
+	}
+	return d, nil
+}
+
+func (r *sqlWebhookRepository) FindAll(ctx context.Context) ([]Webhook, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+webhookColumns+" FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks, rows.Err()
+}
+
+func (r *sqlWebhookRepository) FindByID(ctx context.Context, id primitive.ObjectID) (Webhook, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT "+webhookColumns+" FROM webhooks WHERE id = $1", id.Hex())
+	w, err := scanWebhook(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return w, ErrWebhookNotFound
+	}
+	return w, err
+}
+
+func (r *sqlWebhookRepository) Insert(ctx context.Context, w Webhook) (Webhook, error) {
+	w.ID = primitive.NewObjectID()
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO webhooks ("+webhookColumns+") VALUES ($1, $2, $3, $4, $5, $6)",
+		w.ID.Hex(), w.URL, w.Secret, joinEventTypes(w.Events), w.CreatedBy.Hex(), w.CreatedAt)
+	return w, err
+}
+
+func (r *sqlWebhookRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id = $1", id.Hex())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrWebhookNotFound
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE webhook_id = $1", id.Hex()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *sqlWebhookRepository) AddDelivery(ctx context.Context, d WebhookDelivery) error {
+	d.ID = primitive.NewObjectID()
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO webhook_deliveries ("+deliveryColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)",
+		d.ID.Hex(), d.WebhookID.Hex(), d.DeliveryID, d.Event, d.BookID.Hex(), d.Attempt,
+		d.StatusCode, d.Error, d.Response, d.DurationMS, d.SentAt, d.NextRetryAt)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE sent_at < $1", time.Now().Add(-webhookLogRetention).UTC())
+	return err
+}
+
+func (r *sqlWebhookRepository) FindDeliveries(ctx context.Context, webhookID primitive.ObjectID, limit int) ([]WebhookDelivery, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY sent_at DESC, id DESC LIMIT $2",
+		webhookID.Hex(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
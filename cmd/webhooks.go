@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Delivery of the webhooks. A failed delivery is retried after
+// webhookBackoff, and after twice as long on every further failure, until
+// webhookAttempts attempts were made. Pending retries only live in memory
+// and are lost on a restart.
+const (
+	webhookAttempts = 6
+	webhookBackoff  = 5 * time.Second
+	webhookTimeout  = 10 * time.Second
+	webhookWorkers  = 4
+	// Deliveries beyond this many waiting ones are dropped
+	webhookQueueSize = 1000
+	// How much of the response body is logged
+	webhookResponseLimit = 1024
+	// Largest number of delivery attempts a single request lists
+	maxDeliveryLimit = 100
+)
+
+// Secrets generated for webhooks start with this.
+const webhookSecretPrefix = "whsec_"
+
+// Shortest secret an admin may choose.
+const minWebhookSecretLength = 16
+
+// The headers of every delivery. The signature is the hex encoded
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed with the secret
+// of the webhook, e.g. "sha256=5d41...". Receivers should reject old
+// timestamps to keep deliveries from being replayed.
+const (
+	headerWebhookID        = "X-Webhook-ID"
+	headerWebhookEvent     = "X-Webhook-Event"
+	headerWebhookTimestamp = "X-Webhook-Timestamp"
+	headerWebhookSignature = "X-Webhook-Signature"
+)
+
+// What an admin sends to register a webhook. Without a secret one is made
+// up.
+type newWebhook struct {
+	URL    string          `json:"url"`
+	Secret string          `json:"secret"`
+	Events []BookEventType `json:"events"`
+}
+
+var webhookEventTypes = []BookEventType{BookCreated, BookUpdated, BookDeleted}
+
+func validateWebhook(req newWebhook) error {
+	v := &ValidationError{}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add("url", "must be an absolute http or https URL")
+	}
+	if req.Secret != "" && len(req.Secret) < minWebhookSecretLength {
+		v.add("secret", fmt.Sprintf("must be at least %d characters", minWebhookSecretLength))
+	}
+	for _, t := range req.Events {
+		if !slices.Contains(webhookEventTypes, t) {
+			v.add("events", fmt.Sprintf("unknown event %q, expected created, updated or deleted", t))
+		}
+	}
+	return v.errOrNil()
+}
+
+func generateWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Parses the :id path parameter of the webhook routes.
+func webhookID(c echo.Context) (primitive.ObjectID, error) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return objID, echo.NewHTTPError(http.StatusBadRequest, "Invalid ID format")
+	}
+	return objID, nil
+}
+
+func (s *server) listWebhooks(c echo.Context) error {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	hooks, err := s.webhooks.FindAll(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, hooks)
+}
+
+func (s *server) getWebhook(c echo.Context) error {
+	id, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	hook, err := s.webhooks.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, hook)
+}
+
+func (s *server) createWebhook(c echo.Context) error {
+	var req newWebhook
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid webhook data").SetInternal(err)
+	}
+	req.URL = strings.TrimSpace(req.URL)
+	if err := validateWebhook(req); err != nil {
+		return err
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		var err error
+		if secret, err = generateWebhookSecret(); err != nil {
+			return err
+		}
+	}
+	events := slices.Clone(req.Events)
+	slices.Sort(events)
+	hook := Webhook{
+		URL:       req.URL,
+		Secret:    secret,
+		Events:    slices.Compact(events),
+		CreatedAt: time.Now().UTC(),
+	}
+	if hook.Events == nil {
+		hook.Events = []BookEventType{}
+	}
+	if user := currentUser(c); user != nil {
+		hook.CreatedBy = user.ID
+	} else if key := currentAPIKey(c); key != nil {
+		hook.CreatedBy = key.CreatedBy
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	hook, err := s.webhooks.Insert(ctx, hook)
+	if err != nil {
+		return err
+	}
+
+	// The only time the secret is ever sent
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"secret":  secret,
+		"webhook": hook,
+	})
+}
+
+func (s *server) deleteWebhook(c echo.Context) error {
+	id, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	if err := s.webhooks.Delete(ctx, id); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Lists the latest delivery attempts of a webhook, ?limit= of them.
+func (s *server) listWebhookDeliveries(c echo.Context) error {
+	id, err := webhookID(c)
+	if err != nil {
+		return err
+	}
+	limit := 20
+	if raw := c.QueryParam("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer")
+		}
+		limit = min(limit, maxDeliveryLimit)
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	// Unknown webhooks are a 404 rather than an empty log
+	if _, err := s.webhooks.FindByID(ctx, id); err != nil {
+		return err
+	}
+	deliveries, err := s.webhooks.FindDeliveries(ctx, id, limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+// An event on its way to a single webhook.
+type webhookJob struct {
+	hook       Webhook
+	deliveryID string
+	event      BookEvent
+	body       []byte
+	attempt    int
+}
+
+// Sends the changes to the catalog to the registered webhooks. Every
+// instance delivers the events it learns about, so with MongoDB change
+// streams, where each instance sees all changes, WEBHOOKS=off should be
+// set on all instances but one.
+type webhookDispatcher struct {
+	hooks  WebhookRepository
+	client *http.Client
+	queue  chan webhookJob
+}
+
+func newWebhookDispatcher(hooks WebhookRepository) *webhookDispatcher {
+	return &webhookDispatcher{
+		hooks:  hooks,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan webhookJob, webhookQueueSize),
+	}
+}
+
+// Starts the workers delivering what is dispatched.
+func (d *webhookDispatcher) start() {
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for job := range d.queue {
+				d.deliver(job)
+			}
+		}()
+	}
+}
+
+// Delivers the changes to the catalog for as long as the server runs.
+func (d *webhookDispatcher) run(events *bookEvents) {
+	d.start()
+	for {
+		ch, unsubscribe := events.Subscribe()
+		for e := range ch {
+			d.dispatch(e)
+		}
+		unsubscribe()
+		log.Println("Webhooks: fell behind the changes to the catalog, some were not delivered")
+	}
+}
+
+// Queues the event for every webhook that wants it.
+func (d *webhookDispatcher) dispatch(e BookEvent) {
+	ctx, cancel := dbContext()
+	hooks, err := d.hooks.FindAll(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("Webhooks: failed to load the webhooks: %v", err)
+		return
+	}
+	for _, hook := range hooks {
+		if !hook.wants(e.Type) {
+			continue
+		}
+		deliveryID := primitive.NewObjectID().Hex()
+		payload := bookEventJSON(e)
+		payload["id"] = deliveryID
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Webhooks: failed to encode a book event: %v", err)
+			return
+		}
+		d.enqueue(webhookJob{hook: hook, deliveryID: deliveryID, event: e, body: body, attempt: 1})
+	}
+}
+
+func (d *webhookDispatcher) enqueue(job webhookJob) {
+	select {
+	case d.queue <- job:
+	default:
+		log.Printf("Webhooks: queue is full, dropping delivery %s to %s", job.deliveryID, job.hook.URL)
+	}
+}
+
+// Makes a single attempt and logs it, scheduling the next one if it failed.
+func (d *webhookDispatcher) deliver(job webhookJob) {
+	if job.attempt > 1 {
+		// The webhook may have been deleted in the meantime
+		ctx, cancel := dbContext()
+		_, err := d.hooks.FindByID(ctx, job.hook.ID)
+		cancel()
+		if errors.Is(err, ErrWebhookNotFound) {
+			return
+		}
+	}
+
+	start := time.Now()
+	status, response, err := d.send(job)
+	rec := WebhookDelivery{
+		WebhookID:  job.hook.ID,
+		DeliveryID: job.deliveryID,
+		Event:      job.event.Type,
+		BookID:     job.event.Book.ID,
+		Attempt:    job.attempt,
+		StatusCode: status,
+		Response:   response,
+		DurationMS: time.Since(start).Milliseconds(),
+		SentAt:     start.UTC(),
+	}
+	if err == nil && (status < 200 || status > 299) {
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+		if job.attempt < webhookAttempts {
+			delay := webhookBackoff << (job.attempt - 1)
+			next := start.Add(delay).UTC()
+			rec.NextRetryAt = &next
+			job.attempt++
+			time.AfterFunc(delay, func() { d.enqueue(job) })
+		}
+	}
+
+	ctx, cancel := dbContext()
+	defer cancel()
+	if err := d.hooks.AddDelivery(ctx, rec); err != nil {
+		log.Printf("Webhooks: failed to log delivery %s: %v", job.deliveryID, err)
+	}
+}
+
+func (d *webhookDispatcher) send(job webhookJob) (int, string, error) {
+	req, err := http.NewRequest(http.MethodPost, job.hook.URL, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, "", err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(headerWebhookID, job.deliveryID)
+	req.Header.Set(headerWebhookEvent, string(job.event.Type))
+	req.Header.Set(headerWebhookTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(headerWebhookSignature, signWebhook(job.hook.Secret, timestamp, job.body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, webhookResponseLimit))
+	// Reading the rest lets the connection be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<20))
+	return res.StatusCode, strings.ToValidUTF8(string(body), ""), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// Timing of the WebSocket connections. The server pings every client
+// and gives up on those that did not answer within wsPongWait.
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	// Browsers only answer pings; anything larger they send is an error
+	wsMaxMessageSize = 512
+	// How many messages a client may fall behind before it is dropped
+	wsSendBuffer = 64
+)
+
+// The default origin check only lets pages of this very host connect, so
+// other sites cannot listen in through their visitors' browsers.
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// Sent instead of the changes a client missed because the hub itself fell
+// behind, telling it to reload what it shows.
+var wsReload = []byte(`{"type":"reload"}`)
+
+// Keeps track of the connected browsers and broadcasts the changes to the
+// catalog to them. Every message is encoded once and queued for each
+// client; clients whose queue is full are disconnected instead of slowing
+// down the others.
+type wsHub struct {
+	mu      sync.Mutex
+	clients map[*wsClient]struct{}
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{clients: map[*wsClient]struct{}{}}
+}
+
+type wsClient struct {
+	conn *websocket.Conn
+	send chan []byte
+}
+
+func (h *wsHub) add(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = struct{}{}
+}
+
+// Unregisters the client and closes its queue, which ends its write loop.
+func (h *wsHub) remove(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(c)
+}
+
+func (h *wsHub) drop(c *wsClient) {
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+func (h *wsHub) broadcast(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		select {
+		case c.send <- msg:
+		default:
+			h.drop(c)
+		}
+	}
+}
+
+// Forwards the changes to the catalog to the clients for as long as the
+// server runs.
+func (h *wsHub) run(events *bookEvents) {
+	for {
+		ch, unsubscribe := events.Subscribe()
+		for e := range ch {
+			msg, err := json.Marshal(bookEventJSON(e))
+			if err != nil {
+				log.Printf("Failed to encode a book event: %v", err)
+				continue
+			}
+			h.broadcast(msg)
+		}
+		// The subscription was dropped for being too slow
+		unsubscribe()
+		h.broadcast(wsReload)
+	}
+}
+
+// Upgrades the request to a WebSocket connection that receives every
+// change to the catalog as JSON, in the format of /api/books/events.
+func (s *server) serveWS(c echo.Context) error {
+	conn, err := wsUpgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// The upgrader already answered the request
+		return nil
+	}
+	client := &wsClient{conn: conn, send: make(chan []byte, wsSendBuffer)}
+	s.ws.add(client)
+	go client.writeLoop()
+	client.readLoop()
+	s.ws.remove(client)
+	return nil
+}
+
+// Reads until the connection fails, which is how a closed connection or a
+// missing pong is noticed. The messages themselves are ignored.
+func (c *wsClient) readLoop() {
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// Writes the queued messages and the pings. Once the hub closed the queue
+// the connection is closed too.
+func (c *wsClient) writeLoop() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ping.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
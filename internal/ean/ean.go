@@ -0,0 +1,182 @@
+// Package ean encodes EAN-13 barcodes, as specified in ISO/IEC 15420, the
+// kind printed on the back of books, where they carry the ISBN-13.
+//
+// The barcodes are rendered with the digits written under the bars, in a
+// small built-in font, so that people can read them too. The add-on codes
+// of two and five digits, which some books carry for their price, are out
+// of scope.
+package ean
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+var (
+	ErrLength   = errors.New("ean: an EAN-13 consists of 13 digits")
+	ErrChecksum = errors.New("ean: the check digit is wrong")
+)
+
+// The width of a code in modules: the start, middle and end guards and
+// twelve digits of seven modules each. The first digit has no bars of its
+// own; it decides how the next six are written.
+const Width = 3 + 6*7 + 5 + 6*7 + 3
+
+// The light modules scanners need left and right of the bars.
+const (
+	quietLeft  = 11
+	quietRight = 7
+)
+
+// How the digits are written, from the left; 1 is a dark module. The
+// left half uses the L or G patterns, the right half the R ones.
+var (
+	patternsL = [10]string{"0001101", "0011001", "0010011", "0111101", "0100011", "0110001", "0101111", "0111011", "0110111", "0001011"}
+	patternsG = [10]string{"0100111", "0110011", "0011011", "0100001", "0011101", "0111001", "0000101", "0010001", "0001001", "0010111"}
+	patternsR = [10]string{"1110010", "1100110", "1101100", "1000010", "1011100", "1001110", "1010000", "1000100", "1001000", "1110100"}
+	// Which of the digits of the left half use the G patterns, by the
+	// first digit
+	parities = [10]string{"LLLLLL", "LLGLGG", "LLGGLG", "LLGGGL", "LGLLGG", "LGGLLG", "LGGGLL", "LGLGLG", "LGLGGL", "LGGLGL"}
+)
+
+// An EAN-13 barcode, as a row of dark and light modules.
+type Code struct {
+	digits  string
+	modules [Width]bool
+}
+
+// Encodes the 13 digits, the last of which has to be their check digit.
+func Encode(digits string) (*Code, error) {
+	if len(digits) != 13 {
+		return nil, ErrLength
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return nil, ErrLength
+		}
+	}
+	if CheckDigit(digits[:12]) != digits[12] {
+		return nil, ErrChecksum
+	}
+
+	c := &Code{digits: digits}
+	bits := "101"
+	for i, p := range parities[digits[0]-'0'] {
+		d := digits[i+1] - '0'
+		if p == 'G' {
+			bits += patternsG[d]
+		} else {
+			bits += patternsL[d]
+		}
+	}
+	bits += "01010"
+	for _, r := range digits[7:] {
+		bits += patternsR[r-'0']
+	}
+	bits += "101"
+	for i := range c.modules {
+		c.modules[i] = bits[i] == '1'
+	}
+	return c, nil
+}
+
+// Returns the check digit of the first 12 digits of a code: their sum,
+// with every second one counted three times, taken up to the next ten.
+func CheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// The digits the code carries.
+func (c *Code) Digits() string {
+	return c.digits
+}
+
+// Reports whether module x, counted from the start guard, is dark. Those
+// outside the code are light.
+func (c *Code) Dark(x int) bool {
+	return x >= 0 && x < Width && c.modules[x]
+}
+
+// Reports whether module x belongs to one of the guards, whose bars reach
+// down between the digits.
+func isGuard(x int) bool {
+	return x < 3 || (x >= 45 && x < 50) || x >= Width-3
+}
+
+// The digits of the font, five pixels wide and seven high.
+var font = [10][7]string{
+	{"01110", "10001", "10011", "10101", "11001", "10001", "01110"},
+	{"00100", "01100", "00100", "00100", "00100", "00100", "01110"},
+	{"01110", "10001", "00001", "00010", "00100", "01000", "11111"},
+	{"11111", "00010", "00100", "00010", "00001", "10001", "01110"},
+	{"00010", "00110", "01010", "10010", "11111", "00010", "00010"},
+	{"11111", "10000", "11110", "00001", "00001", "10001", "01110"},
+	{"00110", "01000", "10000", "11110", "10001", "10001", "01110"},
+	{"11111", "00001", "00010", "00100", "01000", "01000", "01000"},
+	{"01110", "10001", "10001", "01110", "10001", "10001", "01110"},
+	{"01110", "10001", "10001", "01111", "00001", "00010", "01100"},
+}
+
+// Renders the code in black and white, with each module scale pixels wide
+// and the quiet zones beside it. The digits go under the bars, the first
+// one into the left quiet zone, at one pixel of the font per module.
+func (c *Code) Image(scale int) image.Image {
+	const (
+		barHeight = 60
+		// How far the guards reach below the other bars
+		guardExtra = 5
+		textTop    = barHeight + 1
+		height     = textTop + 7 + 2
+	)
+	width := quietLeft + Width + quietRight
+	img := image.NewPaletted(image.Rect(0, 0, width*scale, height*scale), color.Palette{color.White, color.Black})
+	fill := func(x, y int) {
+		for py := y * scale; py < (y+1)*scale; py++ {
+			for px := x * scale; px < (x+1)*scale; px++ {
+				img.SetColorIndex(px, py, 1)
+			}
+		}
+	}
+
+	for x := 0; x < Width; x++ {
+		if !c.modules[x] {
+			continue
+		}
+		bottom := barHeight
+		if isGuard(x) {
+			bottom += guardExtra
+		}
+		for y := 0; y < bottom; y++ {
+			fill(quietLeft+x, y)
+		}
+	}
+
+	// Each digit is centered in the seven modules of its bars
+	for i := 0; i < len(c.digits); i++ {
+		left := quietLeft - 7
+		switch {
+		case i >= 7:
+			left = quietLeft + 3 + 6*7 + 5 + (i-7)*7
+		case i >= 1:
+			left = quietLeft + 3 + (i-1)*7
+		}
+		glyph := font[c.digits[i]-'0']
+		for gy, row := range glyph {
+			for gx := range row {
+				if row[gx] == '1' {
+					fill(left+1+gx, textTop+gy)
+				}
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,150 @@
+package ean
+
+import (
+	"errors"
+	"image"
+	"strings"
+	"testing"
+)
+
+func TestCheckDigit(t *testing.T) {
+	tests := map[string]byte{
+		"978030640615": '7',
+		"978014143981": '5',
+		"400638133393": '1',
+		"590123412345": '7',
+		"000000000000": '0',
+		"978000000000": '2',
+	}
+	for digits, want := range tests {
+		if got := CheckDigit(digits); got != want {
+			t.Errorf("CheckDigit(%s) = %c, want %c", digits, got, want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	// 9 writes the left half as LGGLGL
+	want := strings.Join([]string{
+		"101",
+		"0111011", "0001001", "0100111", "0111101", "0100111", "0101111",
+		"01010",
+		"1011100", "1110010", "1010000", "1100110", "1001110", "1000100",
+		"101",
+	}, "")
+	c, err := Encode("9780306406157")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got strings.Builder
+	for x := 0; x < Width; x++ {
+		if c.Dark(x) {
+			got.WriteByte('1')
+		} else {
+			got.WriteByte('0')
+		}
+	}
+	if got.String() != want {
+		t.Errorf("modules\n%s, want\n%s", got.String(), want)
+	}
+	if c.Dark(-1) || c.Dark(Width) {
+		t.Error("modules outside the code are dark")
+	}
+	if c.Digits() != "9780306406157" {
+		t.Errorf("Digits() = %s", c.Digits())
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := map[string]error{
+		"":               ErrLength,
+		"978030640615":   ErrLength,
+		"97803064061577": ErrLength,
+		"978030640615X":  ErrLength,
+		"978-030640615":  ErrLength,
+		"9780306406158":  ErrChecksum,
+	}
+	for digits, want := range tests {
+		if _, err := Encode(digits); !errors.Is(err, want) {
+			t.Errorf("Encode(%q) = %v, want %v", digits, err, want)
+		}
+	}
+}
+
+// Reads the digits back from the modules, by the patterns of each half
+// and the parity the first digit leaves in the left one.
+func TestDecode(t *testing.T) {
+	for _, digits := range []string{"9780306406157", "4006381333931", "0123456789012", "5901234123457"} {
+		c, err := Encode(digits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pattern := func(x int) string {
+			var b strings.Builder
+			for i := x; i < x+7; i++ {
+				if c.Dark(i) {
+					b.WriteByte('1')
+				} else {
+					b.WriteByte('0')
+				}
+			}
+			return b.String()
+		}
+		var decoded, parity strings.Builder
+		for i := 0; i < 6; i++ {
+			p := pattern(3 + 7*i)
+			for d := 0; d < 10; d++ {
+				switch p {
+				case patternsL[d]:
+					decoded.WriteByte(byte('0' + d))
+					parity.WriteByte('L')
+				case patternsG[d]:
+					decoded.WriteByte(byte('0' + d))
+					parity.WriteByte('G')
+				}
+			}
+		}
+		for i := 0; i < 6; i++ {
+			p := pattern(50 + 7*i)
+			for d := 0; d < 10; d++ {
+				if p == patternsR[d] {
+					decoded.WriteByte(byte('0' + d))
+				}
+			}
+		}
+		first := -1
+		for d, p := range parities {
+			if p == parity.String() {
+				first = d
+			}
+		}
+		if got := string(rune('0'+first)) + decoded.String(); got != digits {
+			t.Errorf("decoded %s, want %s", got, digits)
+		}
+	}
+}
+
+func TestImage(t *testing.T) {
+	c, err := Encode("9780306406157")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const scale = 3
+	img := c.Image(scale)
+	width := (quietLeft + Width + quietRight) * scale
+	if b := img.Bounds(); b.Dx() != width {
+		t.Fatalf("image %v, want %d pixels wide", b, width)
+	}
+	// Along the top, the bars are the modules, scale pixels each
+	for px := 0; px < width; px++ {
+		x := px/scale - quietLeft
+		if dark := isDark(img, px, 0); dark != c.Dark(x) {
+			t.Fatalf("pixel %d of the top row is dark %v, module %d is %v", px, dark, x, c.Dark(x))
+		}
+	}
+}
+
+func isDark(img image.Image, x, y int) bool {
+	r, _, _, _ := img.At(x, y).RGBA()
+	return r < 0x8000
+}
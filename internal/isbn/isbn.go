@@ -0,0 +1,132 @@
+// Package isbn validates International Standard Book Numbers and converts
+// them between their 10 and 13 digit forms.
+//
+// The canonical form used throughout the application is the ISBN-13
+// without any separators, e.g. 9783649646099. Where the hyphens go depends
+// on the registration group and publisher ranges, which are maintained by
+// the International ISBN Agency, so we do not try to reproduce them.
+package isbn
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrLength    = errors.New("an ISBN must have 10 or 13 digits")
+	ErrCharacter = errors.New("an ISBN may only contain digits, hyphens and spaces, and an X as last character of an ISBN-10")
+	ErrChecksum  = errors.New("the check digit of the ISBN is wrong")
+	ErrPrefix    = errors.New("only ISBN-13 starting with 978 have an ISBN-10 counterpart")
+)
+
+// Removes hyphens and spaces and upper-cases a trailing x.
+func Clean(s string) string {
+	s = strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(s))
+	return strings.ToUpper(s)
+}
+
+// Checks length, characters and check digit of an ISBN-10 or ISBN-13.
+// Separators are ignored.
+func Validate(s string) error {
+	s = Clean(s)
+	switch len(s) {
+	case 10:
+		if !isDigits(s[:9]) || !(isDigits(s[9:]) || s[9] == 'X') {
+			return ErrCharacter
+		}
+		if checkDigit10(s[:9]) != s[9] {
+			return ErrChecksum
+		}
+	case 13:
+		if !isDigits(s) {
+			return ErrCharacter
+		}
+		if checkDigit13(s[:12]) != s[12] {
+			return ErrChecksum
+		}
+	default:
+		if !isDigits(strings.TrimSuffix(s, "X")) {
+			return ErrCharacter
+		}
+		return ErrLength
+	}
+	return nil
+}
+
+// Reports whether s is a valid ISBN-10 or ISBN-13.
+func IsValid(s string) bool {
+	return Validate(s) == nil
+}
+
+// Returns the ISBN-13 of a valid ISBN-10 or ISBN-13. ISBN-10 get the 978
+// prefix and a recomputed check digit.
+func ToISBN13(s string) (string, error) {
+	if err := Validate(s); err != nil {
+		return "", err
+	}
+	s = Clean(s)
+	if len(s) == 13 {
+		return s, nil
+	}
+	body := "978" + s[:9]
+	return body + string(checkDigit13(body)), nil
+}
+
+// Returns the ISBN-10 of a valid ISBN. This only works for ISBN-13 with
+// the 978 prefix, as the 979 range never had 10 digit numbers.
+func ToISBN10(s string) (string, error) {
+	if err := Validate(s); err != nil {
+		return "", err
+	}
+	s = Clean(s)
+	if len(s) == 10 {
+		return s, nil
+	}
+	if !strings.HasPrefix(s, "978") {
+		return "", ErrPrefix
+	}
+	body := s[3:12]
+	return body + string(checkDigit10(body)), nil
+}
+
+// Returns the canonical form of an ISBN, see the package documentation.
+func Normalize(s string) (string, error) {
+	return ToISBN13(s)
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Check digit of an ISBN-10: the weighted sum with weights 10 down to 1
+// has to be divisible by 11, where X stands for 10.
+func checkDigit10(body string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(body[i]-'0') * (10 - i)
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return byte('0' + check)
+}
+
+// Check digit of an ISBN-13, same as for an EAN-13: the digits are
+// weighted alternately with 1 and 3 and the sum has to be divisible by 10.
+func checkDigit13(body string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(body[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
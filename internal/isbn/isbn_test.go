@@ -0,0 +1,90 @@
+package isbn
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want error
+	}{
+		{"9780306406157", nil},
+		{"978-0-306-40615-7", nil},
+		{"978 0 306 40615 7", nil},
+		{" 9780306406157 ", nil},
+		{"9791090636071", nil},
+		{"0306406152", nil},
+		{"0-306-40615-2", nil},
+		// X stands for a check digit of 10
+		{"080442957X", nil},
+		{"0-8044-2957-x", nil},
+		{"043942089X", nil},
+
+		{"9780306406158", ErrChecksum},
+		{"978-0-306-40615-0", ErrChecksum},
+		{"0306406153", ErrChecksum},
+		{"0804429570", ErrChecksum},
+		{"0306406150X", ErrLength},
+		{"", ErrLength},
+		{"978030640615", ErrLength},
+		{"97803064061577", ErrLength},
+		{"030640615", ErrLength},
+		{"X", ErrLength},
+		{"08044295X7", ErrCharacter},
+		{"978030640615X", ErrCharacter},
+		{"97803064O6157", ErrCharacter},
+		{"978.0.306.40615.7", ErrCharacter},
+		{"ISBN 9780306406157", ErrCharacter},
+	}
+	for _, tt := range tests {
+		if err := Validate(tt.isbn); !errors.Is(err, tt.want) {
+			t.Errorf("Validate(%q) = %v, want %v", tt.isbn, err, tt.want)
+		}
+		if IsValid(tt.isbn) != (tt.want == nil) {
+			t.Errorf("IsValid(%q) = %v", tt.isbn, !(tt.want == nil))
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		in, isbn13, isbn10 string
+	}{
+		{"9780306406157", "9780306406157", "0306406152"},
+		{"0-306-40615-2", "9780306406157", "0306406152"},
+		{"080442957x", "9780804429573", "080442957X"},
+		{"978-0-439-42089-1", "9780439420891", "043942089X"},
+		{"9780141439815", "9780141439815", "0141439815"},
+	}
+	for _, tt := range tests {
+		if got, err := ToISBN13(tt.in); err != nil || got != tt.isbn13 {
+			t.Errorf("ToISBN13(%q) = %q, %v, want %q", tt.in, got, err, tt.isbn13)
+		}
+		if got, err := Normalize(tt.in); err != nil || got != tt.isbn13 {
+			t.Errorf("Normalize(%q) = %q, %v, want %q", tt.in, got, err, tt.isbn13)
+		}
+		if got, err := ToISBN10(tt.in); err != nil || got != tt.isbn10 {
+			t.Errorf("ToISBN10(%q) = %q, %v, want %q", tt.in, got, err, tt.isbn10)
+		}
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	if _, err := ToISBN10("979-10-90636-07-1"); !errors.Is(err, ErrPrefix) {
+		t.Errorf("ToISBN10 of a 979 ISBN = %v, want ErrPrefix", err)
+	}
+	if _, err := ToISBN13("0306406153"); !errors.Is(err, ErrChecksum) {
+		t.Errorf("ToISBN13 of a wrong ISBN-10 = %v, want ErrChecksum", err)
+	}
+	if _, err := ToISBN10("9780306406158"); !errors.Is(err, ErrChecksum) {
+		t.Errorf("ToISBN10 of a wrong ISBN-13 = %v, want ErrChecksum", err)
+	}
+}
+
+func TestClean(t *testing.T) {
+	if got := Clean(" 0-8044 2957-x "); got != "080442957X" {
+		t.Errorf("Clean = %q", got)
+	}
+}
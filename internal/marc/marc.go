@@ -0,0 +1,161 @@
+// Package marc writes MARC 21 bibliographic records, both in the binary
+// ISO 2709 transmission format and as MARCXML.
+//
+// Only writing is supported, and only what is needed to hand records to
+// other catalogs: the package does not know what the tags mean and does
+// not check a record against the MARC 21 format beyond its structure. See
+// https://www.loc.gov/marc/bibliographic/ for the format itself.
+package marc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidTag     = errors.New("a MARC tag consists of three digits")
+	ErrRecordTooLong  = errors.New("the record exceeds 99999 bytes")
+	ErrFieldTooLong   = errors.New("a field exceeds 9999 bytes")
+	ErrInvalidLeader  = errors.New("the leader has to be 24 characters long")
+	ErrInvalidSubcode = errors.New("a subfield code is a single lowercase letter or digit")
+)
+
+// The separators of ISO 2709.
+const (
+	subfieldDelimiter = 0x1F
+	fieldTerminator   = 0x1E
+	recordTerminator  = 0x1D
+)
+
+// Leader of a minimal-level record of a printed monograph in Unicode. The
+// record length and the base address of the data are left blank, the
+// writers fill them in.
+const MonographLeader = "     nam a22     7  4500"
+
+// A subfield of a data field, e.g. $a.
+type Subfield struct {
+	Code  byte
+	Value string
+}
+
+// A variable field. Control fields (tags 001 to 009) only have a Value,
+// data fields have indicators and subfields instead.
+type Field struct {
+	Tag       string
+	Value     string
+	Ind1      byte
+	Ind2      byte
+	Subfields []Subfield
+}
+
+// Reports whether the field is a control field.
+func (f Field) IsControl() bool {
+	return strings.HasPrefix(f.Tag, "00")
+}
+
+// A bibliographic record. Fields are written in the order they have here,
+// which should be ascending by tag.
+type Record struct {
+	Leader string
+	Fields []Field
+}
+
+// Returns a control field.
+func ControlField(tag, value string) Field {
+	return Field{Tag: tag, Value: value}
+}
+
+// Returns a data field. Blank indicators can be given as 0 or ' '.
+func DataField(tag string, ind1, ind2 byte, subfields ...Subfield) Field {
+	return Field{Tag: tag, Ind1: ind1, Ind2: ind2, Subfields: subfields}
+}
+
+// Returns a subfield.
+func Sub(code byte, value string) Subfield {
+	return Subfield{Code: code, Value: value}
+}
+
+func (r Record) validate() error {
+	if len(r.Leader) != 24 {
+		return ErrInvalidLeader
+	}
+	for _, f := range r.Fields {
+		if len(f.Tag) != 3 || strings.Trim(f.Tag, "0123456789") != "" {
+			return fmt.Errorf("%w: %q", ErrInvalidTag, f.Tag)
+		}
+		for _, s := range f.Subfields {
+			if !(s.Code >= 'a' && s.Code <= 'z' || s.Code >= '0' && s.Code <= '9') {
+				return fmt.Errorf("%w: field %s", ErrInvalidSubcode, f.Tag)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the data of a field in ISO 2709, including its terminator.
+func (f Field) encode() []byte {
+	var b bytes.Buffer
+	if f.IsControl() {
+		b.WriteString(clean(f.Value))
+	} else {
+		b.WriteByte(indicator(f.Ind1))
+		b.WriteByte(indicator(f.Ind2))
+		for _, s := range f.Subfields {
+			b.WriteByte(subfieldDelimiter)
+			b.WriteByte(s.Code)
+			b.WriteString(clean(s.Value))
+		}
+	}
+	b.WriteByte(fieldTerminator)
+	return b.Bytes()
+}
+
+// Encodes the record in the ISO 2709 transmission format. Records can be
+// concatenated to form a file of many records.
+func (r Record) MarshalBinary() ([]byte, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	var directory, data bytes.Buffer
+	for _, f := range r.Fields {
+		encoded := f.encode()
+		if len(encoded) > 9999 {
+			return nil, fmt.Errorf("%w: field %s", ErrFieldTooLong, f.Tag)
+		}
+		fmt.Fprintf(&directory, "%s%04d%05d", f.Tag, len(encoded), data.Len())
+		data.Write(encoded)
+	}
+	directory.WriteByte(fieldTerminator)
+
+	base := 24 + directory.Len()
+	length := base + data.Len() + 1
+	if length > 99999 {
+		return nil, ErrRecordTooLong
+	}
+	out := make([]byte, 0, length)
+	out = fmt.Appendf(out, "%05d%s%05d%s", length, r.Leader[5:12], base, r.Leader[17:])
+	out = append(out, directory.Bytes()...)
+	out = append(out, data.Bytes()...)
+	return append(out, recordTerminator), nil
+}
+
+// Blank indicators are written as spaces.
+func indicator(b byte) byte {
+	if b == 0 {
+		return ' '
+	}
+	return b
+}
+
+// Drops the separators of ISO 2709 from a value, as they would break the
+// structure of the record.
+func clean(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == subfieldDelimiter || r == fieldTerminator || r == recordTerminator {
+			return -1
+		}
+		return r
+	}, s)
+}
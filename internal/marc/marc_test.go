@@ -0,0 +1,109 @@
+package marc
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func dune() Record {
+	return Record{
+		Leader: MonographLeader,
+		Fields: []Field{
+			ControlField("001", "123"),
+			DataField("020", ' ', 0, Sub('a', "9780306406157")),
+			DataField("245", '1', '0', Sub('a', "Dune"), Sub('c', "Frank Herbert")),
+		},
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	// The leader with the record length and the base address of the data,
+	// the directory of tag, length and start of each field, and the fields
+	want := "00108nam a22000617  4500" +
+		"001000400000" + "020001800004" + "245002400022" + "\x1e" +
+		"123\x1e" +
+		"  \x1fa9780306406157\x1e" +
+		"10\x1faDune\x1fcFrank Herbert\x1e" +
+		"\x1d"
+	got, err := dune().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("MarshalBinary =\n%q, want\n%q", got, want)
+	}
+}
+
+func TestMarshalBinaryCleansValues(t *testing.T) {
+	r := Record{Leader: MonographLeader, Fields: []Field{
+		DataField("245", '0', '0', Sub('a', "Du\x1fne\x1e\x1d")),
+	}}
+	got, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(got, []byte("00\x1faDune\x1e\x1d")) {
+		t.Errorf("MarshalBinary = %q, want the separators dropped from the value", got)
+	}
+}
+
+func TestMarshalBinaryErrors(t *testing.T) {
+	tests := []struct {
+		record Record
+		want   error
+	}{
+		{Record{Leader: "short"}, ErrInvalidLeader},
+		{Record{Leader: MonographLeader, Fields: []Field{ControlField("1", "x")}}, ErrInvalidTag},
+		{Record{Leader: MonographLeader, Fields: []Field{ControlField("0a1", "x")}}, ErrInvalidTag},
+		{Record{Leader: MonographLeader, Fields: []Field{DataField("245", 0, 0, Sub('A', "x"))}}, ErrInvalidSubcode},
+		{Record{Leader: MonographLeader, Fields: []Field{DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9996)))}}, ErrFieldTooLong},
+		{Record{Leader: MonographLeader, Fields: []Field{
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+			DataField("500", 0, 0, Sub('a', strings.Repeat("x", 9000))),
+		}}, ErrRecordTooLong},
+	}
+	for _, tt := range tests {
+		if _, err := tt.record.MarshalBinary(); !errors.Is(err, tt.want) {
+			t.Errorf("MarshalBinary = %v, want %v", err, tt.want)
+		}
+	}
+}
+
+func TestXMLWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewXMLWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := dune()
+	r.Fields = append(r.Fields, DataField("500", 0, 0, Sub('a', "Sand & <spice>\x1f")))
+	if err := w.Write(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<collection xmlns="http://www.loc.gov/MARC21/slim">` +
+		`<record><leader>00139nam a22000737  4500</leader>` +
+		`<controlfield tag="001">123</controlfield>` +
+		`<datafield tag="020" ind1=" " ind2=" "><subfield code="a">9780306406157</subfield></datafield>` +
+		`<datafield tag="245" ind1="1" ind2="0"><subfield code="a">Dune</subfield><subfield code="c">Frank Herbert</subfield></datafield>` +
+		`<datafield tag="500" ind1=" " ind2=" "><subfield code="a">Sand &amp; &lt;spice&gt;</subfield></datafield>` +
+		`</record></collection>`
+	if buf.String() != want {
+		t.Errorf("MARCXML =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
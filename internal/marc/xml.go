@@ -0,0 +1,103 @@
+package marc
+
+import (
+	"bufio"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// Namespace of MARCXML, see https://www.loc.gov/standards/marcxml/.
+const Namespace = "http://www.loc.gov/MARC21/slim"
+
+type xmlSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlDataField struct {
+	Tag       string        `xml:"tag,attr"`
+	Ind1      string        `xml:"ind1,attr"`
+	Ind2      string        `xml:"ind2,attr"`
+	Subfields []xmlSubfield `xml:"subfield"`
+}
+
+type xmlRecord struct {
+	XMLName       xml.Name          `xml:"record"`
+	Leader        string            `xml:"leader"`
+	ControlFields []xmlControlField `xml:"controlfield"`
+	DataFields    []xmlDataField    `xml:"datafield"`
+}
+
+// Writes records as a MARCXML collection, one record at a time. Close has
+// to be called to finish the document.
+type XMLWriter struct {
+	w   *bufio.Writer
+	enc *xml.Encoder
+}
+
+// Starts a collection.
+func NewXMLWriter(w io.Writer) (*XMLWriter, error) {
+	buf := bufio.NewWriter(w)
+	if _, err := buf.WriteString(xml.Header + `<collection xmlns="` + Namespace + `">`); err != nil {
+		return nil, err
+	}
+	return &XMLWriter{w: buf, enc: xml.NewEncoder(buf)}, nil
+}
+
+// Appends a record to the collection. Its leader carries the same lengths
+// as in the binary format.
+func (x *XMLWriter) Write(r Record) error {
+	binary, err := r.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	out := xmlRecord{Leader: string(binary[:24])}
+	for _, f := range r.Fields {
+		if f.IsControl() {
+			out.ControlFields = append(out.ControlFields, xmlControlField{Tag: f.Tag, Value: xmlText(f.Value)})
+			continue
+		}
+		field := xmlDataField{Tag: f.Tag, Ind1: string(indicator(f.Ind1)), Ind2: string(indicator(f.Ind2))}
+		for _, s := range f.Subfields {
+			field.Subfields = append(field.Subfields, xmlSubfield{Code: string(s.Code), Value: xmlText(s.Value)})
+		}
+		out.DataFields = append(out.DataFields, field)
+	}
+	return x.enc.Encode(out)
+}
+
+// Writes buffered records to the underlying writer.
+func (x *XMLWriter) Flush() error {
+	if err := x.enc.Flush(); err != nil {
+		return err
+	}
+	return x.w.Flush()
+}
+
+// Finishes the collection. It does not close the underlying writer.
+func (x *XMLWriter) Close() error {
+	if err := x.enc.Flush(); err != nil {
+		return err
+	}
+	if _, err := x.w.WriteString(`</collection>`); err != nil {
+		return err
+	}
+	return x.w.Flush()
+}
+
+// Drops the characters XML does not allow at all, which includes the
+// separators of ISO 2709.
+func xmlText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == 0xFFFE || r == 0xFFFF {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,317 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// The data of HELLO WORLD as a 1-M code, from the worked example that
+	// goes around with the standard
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomonRemainder(data, reedSolomonDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("error correction = %v, want %v", got, want)
+	}
+}
+
+func TestFormatBits(t *testing.T) {
+	// Table C.1 of ISO/IEC 18004, after the mask
+	tests := []struct {
+		level Level
+		mask  int
+		want  string
+	}{
+		{Low, 0, "111011111000100"},
+		{Low, 4, "110011000101111"},
+		{Low, 7, "110100101110110"},
+		{Medium, 0, "101010000010010"},
+		{Medium, 4, "100010111111001"},
+		{Medium, 7, "100101010100000"},
+		{Quartile, 0, "011010101011111"},
+		{Quartile, 6, "010111011011010"},
+		{Quartile, 7, "010101111101101"},
+		{High, 0, "001011010001001"},
+		{High, 6, "000110100001100"},
+		{High, 7, "000100000111011"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprintf("%015b", formatBits(tt.level, tt.mask)); got != tt.want {
+			t.Errorf("formatBits(%d, %d) = %s, want %s", tt.level, tt.mask, got, tt.want)
+		}
+	}
+}
+
+func TestAlignmentPositions(t *testing.T) {
+	tests := map[int][]int{
+		1:  nil,
+		2:  {6, 18},
+		6:  {6, 34},
+		7:  {6, 22, 38},
+		14: {6, 26, 46, 66},
+		32: {6, 34, 60, 86, 112, 138},
+		36: {6, 24, 50, 76, 102, 128, 154},
+		40: {6, 30, 58, 86, 114, 142, 170},
+	}
+	for version, want := range tests {
+		if got := alignmentPositions(version); !slices.Equal(got, want) {
+			t.Errorf("alignmentPositions(%d) = %v, want %v", version, got, want)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	tests := []struct {
+		version int
+		level   Level
+		// The data codewords and the bytes of data they hold
+		codewords, bytes int
+	}{
+		{1, Low, 19, 17},
+		{1, Medium, 16, 14},
+		{1, Quartile, 13, 11},
+		{1, High, 9, 7},
+		{7, Medium, 124, 122},
+		{10, Low, 274, 271},
+		{40, Low, 2956, 2953},
+		{40, High, 1276, 1273},
+	}
+	for _, tt := range tests {
+		if got := dataCodewords(tt.version, tt.level); got != tt.codewords {
+			t.Errorf("dataCodewords(%d, %d) = %d, want %d", tt.version, tt.level, got, tt.codewords)
+		}
+		c, err := Encode(make([]byte, tt.bytes), tt.level)
+		if err != nil {
+			t.Errorf("%d bytes at level %d: %v", tt.bytes, tt.level, err)
+		} else if c.Size() != 4*tt.version+17 {
+			t.Errorf("%d bytes at level %d made a code of %d modules, want version %d", tt.bytes, tt.level, c.Size(), tt.version)
+		}
+		if tt.version < 40 {
+			if c, err := Encode(make([]byte, tt.bytes+1), tt.level); err != nil || c.Size() != 4*tt.version+21 {
+				t.Errorf("%d bytes at level %d do not make the next version", tt.bytes+1, tt.level)
+			}
+		}
+	}
+	if _, err := Encode(make([]byte, 2954), Low); !errors.Is(err, ErrTooLong) {
+		t.Errorf("Encode of 2954 bytes = %v, want ErrTooLong", err)
+	}
+	if _, err := Encode(nil, High+1); err == nil {
+		t.Error("Encode with an unknown level succeeded")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	long := strings.Repeat("0123456789abcdef", 200)
+	tests := []struct {
+		data  string
+		level Level
+	}{
+		{"", Low},
+		{"HELLO WORLD", Medium},
+		{"https://books.example.org/books/65f1c0a2e4b0a1b2c3d4e5f6", Medium},
+		{"otpauth://totp/books.example.org:alice?algorithm=SHA1&digits=6&issuer=books.example.org&period=30&secret=JBSWY3DPEHPK3PXP", Medium},
+		{"\x00\xff binary \x80", Quartile},
+		// With the version information
+		{long[:150], High},
+		// With a 16 bit length, and blocks of two lengths
+		{long[:300], Low},
+		{long[:1000], Quartile},
+		{long[:2953], Low},
+	}
+	for _, tt := range tests {
+		c, err := Encode([]byte(tt.data), tt.level)
+		if err != nil {
+			t.Fatalf("Encode of %d bytes: %v", len(tt.data), err)
+		}
+		got, level := decode(t, c)
+		if level != tt.level {
+			t.Errorf("%d bytes: level %d, want %d", len(tt.data), level, tt.level)
+		}
+		if string(got) != tt.data {
+			t.Errorf("%d bytes: decoded %q, want %q", len(tt.data), got, tt.data)
+		}
+	}
+}
+
+// The masks of the standard, by the row and column of a module.
+var masks = [8]func(y, x int) bool{
+	func(y, x int) bool { return (y+x)%2 == 0 },
+	func(y, x int) bool { return y%2 == 0 },
+	func(y, x int) bool { return x%3 == 0 },
+	func(y, x int) bool { return (y+x)%3 == 0 },
+	func(y, x int) bool { return (y/2+x/3)%2 == 0 },
+	func(y, x int) bool { return (y*x)%2+(y*x)%3 == 0 },
+	func(y, x int) bool { return ((y*x)%2+(y*x)%3)%2 == 0 },
+	func(y, x int) bool { return ((y*x)%3+(y+x)%2)%2 == 0 },
+}
+
+// Reads the code back the way a scanner would once it found the modules:
+// the format information, the codewords under the mask, the blocks with
+// their error correction, and the byte mode segment in them.
+func decode(t *testing.T, c *Code) ([]byte, Level) {
+	t.Helper()
+	if (c.Size()-17)%4 != 0 {
+		t.Fatalf("a code of %d modules", c.Size())
+	}
+	version := (c.Size() - 17) / 4
+	dark := func(x, y int) int {
+		if c.Dark(x, y) {
+			return 1
+		}
+		return 0
+	}
+
+	// Both copies of the format information
+	var format, copy2 int
+	for i := 0; i < 15; i++ {
+		x, y := 8, i
+		switch {
+		case i == 6:
+			y = 7
+		case i == 7:
+			y = 8
+		case i == 8:
+			x, y = 7, 8
+		case i > 8:
+			x, y = 14-i, 8
+		}
+		format |= dark(x, y) << i
+		if i < 8 {
+			copy2 |= dark(c.Size()-1-i, 8) << i
+		} else {
+			copy2 |= dark(8, c.Size()-15+i) << i
+		}
+	}
+	if format != copy2 {
+		t.Fatalf("the copies of the format information differ: %015b and %015b", format, copy2)
+	}
+	level, mask := Level(-1), -1
+	for l := Low; l <= High; l++ {
+		for m := 0; m < 8; m++ {
+			if formatBits(l, m) == format {
+				level, mask = l, m
+			}
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("invalid format information %015b", format)
+	}
+
+	// The function patterns have to be where the standard puts them
+	f := newCode(version)
+	f.drawFunctionPatterns(version, level)
+	f.drawFormatBits(level, mask)
+	for y := 0; y < c.Size(); y++ {
+		for x := 0; x < c.Size(); x++ {
+			if f.function[y][x] && c.Dark(x, y) != f.modules[y][x] {
+				t.Fatalf("function module (%d, %d) is %v", x, y, c.Dark(x, y))
+			}
+		}
+	}
+	if version >= 7 {
+		// Table D.1 has the version information of all versions; that of
+		// version 7 for one
+		info := 0
+		for i := 0; i < 18; i++ {
+			info |= dark(c.Size()-11+i%3, i/3) << i
+		}
+		if version == 7 && info != 0b000111110010010100 {
+			t.Errorf("version information %018b", info)
+		}
+		if info>>12 != version {
+			t.Errorf("version information of version %d", info>>12)
+		}
+	}
+
+	// The codewords, up and down the columns in pairs from the right
+	var bits []int
+	for right := c.Size() - 1; right > 0; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for i := 0; i < c.Size(); i++ {
+			y := i
+			if (c.Size()-1-right)/2%2 == 0 {
+				y = c.Size() - 1 - i
+			}
+			for _, x := range []int{right, right - 1} {
+				if f.function[y][x] {
+					continue
+				}
+				bit := dark(x, y)
+				if masks[mask](y, x) {
+					bit ^= 1
+				}
+				bits = append(bits, bit)
+			}
+		}
+	}
+	raw := make([]byte, len(bits)/8)
+	for i := range raw {
+		for _, bit := range bits[8*i : 8*i+8] {
+			raw[i] = raw[i]<<1 | byte(bit)
+		}
+	}
+
+	// Undoes the interleaving and checks the error correction of each block
+	numBlocks, eccLen := eccBlocks[level][version], eccPerBlock[level][version]
+	numLong := len(raw) % numBlocks
+	shortData := len(raw)/numBlocks - eccLen
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i <= shortData; i++ {
+		for j := range blocks {
+			if i < shortData || j >= numBlocks-numLong {
+				blocks[j] = append(blocks[j], raw[k])
+				k++
+			}
+		}
+	}
+	if len(raw)-k != eccLen*numBlocks {
+		t.Fatalf("%d codewords left for the error correction, want %d", len(raw)-k, eccLen*numBlocks)
+	}
+	var data []byte
+	for j, block := range blocks {
+		ecc := make([]byte, eccLen)
+		for i := range ecc {
+			ecc[i] = raw[k+j+i*numBlocks]
+		}
+		if want := reedSolomonRemainder(block, reedSolomonDivisor(eccLen)); !bytes.Equal(ecc, want) {
+			t.Errorf("block %d has the error correction %v, want %v", j, ecc, want)
+		}
+		data = append(data, block...)
+	}
+
+	// The segment, the terminator and the padding
+	read := func(pos, n int) int {
+		v := 0
+		for i := pos; i < pos+n; i++ {
+			v = v<<1 | int(data[i/8]>>(7-i%8)&1)
+		}
+		return v
+	}
+	if mode := read(0, 4); mode != 0b0100 {
+		t.Fatalf("mode %04b, want byte mode", mode)
+	}
+	n := read(4, countBits(version))
+	pos := 4 + countBits(version)
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = byte(read(pos, 8))
+		pos += 8
+	}
+	if end := min(pos+4, 8*len(data)); read(pos, end-pos) != 0 {
+		t.Error("no terminator after the data")
+	}
+	for i, pad := (pos+7)/8, byte(0xEC); i < len(data); i, pad = i+1, pad^0xEC^0x11 {
+		if data[i] != pad {
+			t.Errorf("padding codeword %d is %#x, want %#x", i, data[i], pad)
+			break
+		}
+	}
+	return out, level
+}
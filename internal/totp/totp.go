@@ -0,0 +1,104 @@
+// Package totp generates and checks the time-based one-time passwords of
+// RFC 6238, the six digit codes authenticator apps show.
+//
+// Only the parameters every app supports are implemented: HMAC-SHA1, six
+// digits and a new code every 30 seconds. Secrets are passed around in
+// base32, the way the apps take them.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	// How long a code is valid, in seconds
+	Period = 30
+)
+
+// How many steps a code may be off, for clocks that are not quite right
+// and users that take a moment to type.
+const skew = 1
+
+var ErrSecret = errors.New("the secret is not valid base32")
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Returns a new random secret of 160 bits, as RFC 4226 recommends.
+func NewSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// The number of the period t falls into, counted from the Unix epoch.
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Returns the code of the given step.
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", ErrSecret
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0F
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7FFFFFFF
+	return fmt.Sprintf("%0*d", Digits, value%1000000), nil
+}
+
+// Checks the code against the step of t and the ones right before and
+// after it. Returns the step it matched, so that callers can refuse codes
+// that were already used.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != Digits {
+		return 0, false
+	}
+	now := Step(t)
+	for step := now - skew; step <= now+skew; step++ {
+		want, err := Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(want), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the otpauth URL that authenticator apps scan from a QR code. The
+// issuer is what the apps list the account under.
+func URL(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(Digits))
+	q.Set("period", fmt.Sprint(Period))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
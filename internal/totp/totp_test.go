@@ -0,0 +1,136 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The key of the SHA-1 test vectors of RFC 4226 and RFC 6238.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeRFC4226(t *testing.T) {
+	// Appendix D of RFC 4226, by counter
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		got, err := Code(rfcSecret, int64(counter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != code {
+			t.Errorf("Code(counter %d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	// The SHA-1 rows of Appendix B of RFC 6238, whose eight digit codes end
+	// in the six digit ones
+	tests := []struct {
+		unix int64
+		step int64
+		want string
+	}{
+		{59, 0x1, "94287082"},
+		{1111111109, 0x23523EC, "07081804"},
+		{1111111111, 0x23523ED, "14050471"},
+		{1234567890, 0x273EF07, "89005924"},
+		{2000000000, 0x3F940AA, "69279037"},
+		{20000000000, 0x27BC86AA, "65353130"},
+	}
+	for _, tt := range tests {
+		at := time.Unix(tt.unix, 0)
+		if step := Step(at); step != tt.step {
+			t.Errorf("Step(%d) = %#x, want %#x", tt.unix, step, tt.step)
+		}
+		got, err := Code(rfcSecret, Step(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.want[len(tt.want)-Digits:]; got != want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, want)
+		}
+		if step, ok := Validate(rfcSecret, got, at); !ok || step != tt.step {
+			t.Errorf("Validate(%s at %d) = %#x, %v, want %#x, true", got, tt.unix, step, ok, tt.step)
+		}
+	}
+}
+
+func TestCodeSecretForms(t *testing.T) {
+	want, _ := Code(rfcSecret, 1)
+	for _, secret := range []string{strings.ToLower(rfcSecret), rfcSecret + "===="} {
+		if got, err := Code(secret, 1); err != nil || got != want {
+			t.Errorf("Code(%q) = %q, %v, want %q", secret, got, err, want)
+		}
+	}
+	if _, err := Code("not base32!", 1); err != ErrSecret {
+		t.Errorf("Code of an invalid secret = %v, want ErrSecret", err)
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	// The middle of step 0x23523ED
+	now := time.Unix(1111111111+4, 0)
+	step := Step(now)
+	for offset := int64(-3); offset <= 3; offset++ {
+		code, err := Code(rfcSecret, step+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := Validate(rfcSecret, code, now)
+		wantOK := offset >= -skew && offset <= skew
+		if ok != wantOK {
+			t.Errorf("code of step %+d: valid %v, want %v", offset, ok, wantOK)
+		} else if ok && got != step+offset {
+			t.Errorf("code of step %+d matched step %+d", offset, got-step)
+		}
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, _ := Code(rfcSecret, Step(now))
+	tests := []struct {
+		code string
+		ok   bool
+	}{
+		{code, true},
+		{code[:3] + " " + code[3:], true},
+		{code[:5], false},
+		{code + "0", false},
+		{"", false},
+		{"abcdef", false},
+	}
+	for _, tt := range tests {
+		if _, ok := Validate(rfcSecret, tt.code, now); ok != tt.ok {
+			t.Errorf("Validate(%q) = %v, want %v", tt.code, ok, tt.ok)
+		}
+	}
+	if _, ok := Validate("not base32!", code, now); ok {
+		t.Error("a code was valid for an invalid secret")
+	}
+}
+
+func TestURL(t *testing.T) {
+	got := URL("books.example.org", "alice", "JBSWY3DPEHPK3PXP")
+	want := "otpauth://totp/books.example.org:alice?algorithm=SHA1&digits=6&issuer=books.example.org&period=30&secret=JBSWY3DPEHPK3PXP"
+	if got != want {
+		t.Errorf("URL = %s, want %s", got, want)
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewSecret()
+	if a == b {
+		t.Error("two secrets are the same")
+	}
+	key, err := encoding.DecodeString(a)
+	if err != nil || len(key) != 20 {
+		t.Errorf("secret %q decodes to %d bytes, %v, want 20", a, len(key), err)
+	}
+}
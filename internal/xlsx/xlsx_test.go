@@ -0,0 +1,130 @@
+package xlsx
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestColumn(t *testing.T) {
+	tests := map[int]string{0: "A", 1: "B", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA", 16383: "XFD"}
+	for i, want := range tests {
+		if got := column(i); got != want {
+			t.Errorf("column(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
+
+// The parts of a sheet that are read back.
+type sheet struct {
+	Rows []struct {
+		Ref   string `xml:"r,attr"`
+		Cells []struct {
+			Ref    string `xml:"r,attr"`
+			Type   string `xml:"t,attr"`
+			Value  string `xml:"v"`
+			Inline string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+type workbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, `Books & "more"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]interface{}{
+		{"Name", "Pages", "Year"},
+		{"Dune", 412, int64(1965)},
+		{"<Sand> & \"spice\"\n  2nd line\x00", -1, 3.5},
+	}
+	for _, row := range rows {
+		if err := w.WriteRow(row...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteRow("late"); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteRow after Close = %v, want ErrClosed", err)
+	}
+	if err := w.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Close after Close = %v, want ErrClosed", err)
+	}
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := map[string][]byte{}
+	var names []string
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[f.Name], err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, f.Name)
+	}
+	wantNames := []string{"[Content_Types].xml", "_rels/.rels", "xl/_rels/workbook.xml.rels", "xl/workbook.xml", "xl/worksheets/sheet1.xml"}
+	if !slices.Equal(names, wantNames) {
+		t.Errorf("parts %v, want %v", names, wantNames)
+	}
+	for name, content := range parts {
+		if err := xml.Unmarshal(content, new(struct{})); err != nil {
+			t.Errorf("%s is not well-formed: %v", name, err)
+		}
+	}
+
+	var wb workbook
+	if err := xml.Unmarshal(parts["xl/workbook.xml"], &wb); err != nil {
+		t.Fatal(err)
+	}
+	if len(wb.Sheets) != 1 || wb.Sheets[0].Name != `Books & "more"` {
+		t.Errorf("sheets %+v", wb.Sheets)
+	}
+
+	var s sheet
+	if err := xml.Unmarshal(parts["xl/worksheets/sheet1.xml"], &s); err != nil {
+		t.Fatal(err)
+	}
+	type cell struct{ ref, typ, value string }
+	want := [][]cell{
+		{{"A1", "inlineStr", "Name"}, {"B1", "inlineStr", "Pages"}, {"C1", "inlineStr", "Year"}},
+		{{"A2", "inlineStr", "Dune"}, {"B2", "", "412"}, {"C2", "", "1965"}},
+		// Control characters are dropped, floats are text
+		{{"A3", "inlineStr", "<Sand> & \"spice\"\n  2nd line"}, {"B3", "", "-1"}, {"C3", "inlineStr", "3.5"}},
+	}
+	if len(s.Rows) != len(want) {
+		t.Fatalf("%d rows, want %d", len(s.Rows), len(want))
+	}
+	for i, row := range s.Rows {
+		var got []cell
+		for _, c := range row.Cells {
+			value := c.Value
+			if c.Type == "inlineStr" {
+				value = c.Inline
+			}
+			got = append(got, cell{c.Ref, c.Type, value})
+		}
+		if !slices.Equal(got, want[i]) {
+			t.Errorf("row %s = %q, want %q", row.Ref, got, want[i])
+		}
+	}
+}